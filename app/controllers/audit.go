@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ParseAuditQuery reads the filters and paging parameters of an audit log listing
+func ParseAuditQuery(r *http.Request) (query models.AuditQuery, err error) {
+	values := r.URL.Query()
+
+	query.Actor = values.Get("actor")
+	query.Target = values.Get("target")
+	query.Action = values.Get("action")
+	query.RequestID = values.Get("request_id")
+	query.Cursor = values.Get("cursor")
+
+	query.Limit = utilities.DefaultPageLimit
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > utilities.MaxPageLimit {
+			return query, invalidListParam("limit", fmt.Sprintf("limit must be a number between 1 and %d", utilities.MaxPageLimit))
+		}
+	}
+
+	if since := values.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, invalidListParam("since", "since must be an RFC 3339 timestamp")
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return query, invalidListParam("until", "until must be an RFC 3339 timestamp")
+		}
+	}
+
+	return query, nil
+}
+
+var AuditIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "Only admins can view the audit log") {
+		return
+	}
+
+	query, err := ParseAuditQuery(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	page, err := models.ListAuditEvents(r.Context(), query)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	SetLinkHeader(w, r, page.NextCursor)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"message":     "Retrieved audit events",
+		"events":      page.Events,
+		"next_cursor": page.NextCursor,
+	})
+})
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"net/http"
+)
+
+// DocsShow renders openapi.json as a page without loading anything other than the document,
+// so the documentation works offline and behind strict content security policies
+var DocsShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+})
+
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>API documentation</title>
+<style>
+body { font-family: sans-serif; max-width: 960px; margin: 0 auto; padding: 1em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: .2em; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: .5em 0; }
+summary { padding: .5em; cursor: pointer; }
+.body { padding: 0 1em 1em; }
+.method { display: inline-block; width: 5em; font-weight: bold; font-family: monospace; }
+.get { color: #1a7f37; } .post { color: #0969da; } .put { color: #9a6700; } .patch { color: #8250df; } .delete { color: #cf222e; }
+.path { font-family: monospace; }
+.deprecated { text-decoration: line-through; }
+pre { background: #f6f8fa; padding: .5em; overflow: auto; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: .2em .6em .2em 0; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1 id="title">API documentation</h1>
+<p id="description"></p>
+<div id="operations">Loading openapi.json&hellip;</div>
+<script>
+function el(tag, attrs, children) {
+  var node = document.createElement(tag);
+  for (var name in attrs || {}) node.setAttribute(name, attrs[name]);
+  (children || []).forEach(function (child) {
+    node.appendChild(typeof child === "string" ? document.createTextNode(child) : child);
+  });
+  return node;
+}
+
+function resolve(doc, schema) {
+  var seen = 0;
+  while (schema && schema.$ref && seen++ < 32) {
+    schema = doc.components.schemas[schema.$ref.split("/").pop()];
+  }
+  return schema;
+}
+
+function expand(doc, schema, depth) {
+  if (!schema || depth > 4) return schema;
+  if (schema.$ref) {
+    var name = schema.$ref.split("/").pop();
+    if (depth > 2) return {$ref: name};
+    return expand(doc, resolve(doc, schema), depth + 1);
+  }
+  var copy = {};
+  for (var key in schema) {
+    var value = schema[key];
+    if (key === "properties") {
+      copy[key] = {};
+      for (var property in value) copy[key][property] = expand(doc, value[property], depth + 1);
+    } else if (key === "items") {
+      copy[key] = expand(doc, value, depth + 1);
+    } else if (key === "oneOf" || key === "anyOf" || key === "allOf") {
+      copy[key] = value.map(function (s) { return expand(doc, s, depth + 1); });
+    } else {
+      copy[key] = value;
+    }
+  }
+  return copy;
+}
+
+function content(doc, media) {
+  var nodes = [];
+  for (var type in media || {}) {
+    nodes.push(el("div", {}, [el("code", {}, [type])]));
+    nodes.push(el("pre", {}, [JSON.stringify(expand(doc, media[type].schema, 0), null, 2)]));
+  }
+  return nodes;
+}
+
+function operation(doc, path, method, op) {
+  var body = el("div", {"class": "body"});
+  if (op.description) body.appendChild(el("p", {}, [op.description]));
+  if (op.security) body.appendChild(el("p", {}, [el("em", {}, ["Requires a bearer token."])]));
+
+  if (op.parameters && op.parameters.length) {
+    var rows = op.parameters.map(function (p) {
+      return el("tr", {}, [
+        el("td", {}, [el("code", {}, [p.name + (p.required ? " *" : "")])]),
+        el("td", {}, [p.in]),
+        el("td", {}, [JSON.stringify(p.schema)]),
+        el("td", {}, [p.description || ""])
+      ]);
+    });
+    body.appendChild(el("h4", {}, ["Parameters"]));
+    body.appendChild(el("table", {}, [el("tr", {}, [el("th", {}, ["Name"]), el("th", {}, ["In"]), el("th", {}, ["Schema"]), el("th", {}, ["Description"])])].concat(rows)));
+  }
+
+  if (op.requestBody) {
+    body.appendChild(el("h4", {}, ["Request body"]));
+    content(doc, op.requestBody.content).forEach(function (n) { body.appendChild(n); });
+  }
+
+  body.appendChild(el("h4", {}, ["Responses"]));
+  Object.keys(op.responses).sort().forEach(function (status) {
+    var response = op.responses[status];
+    var details = el("details", {}, [el("summary", {}, [status + " " + response.description])]);
+    var inner = el("div", {"class": "body"});
+    for (var header in response.headers || {}) {
+      inner.appendChild(el("div", {}, ["Header ", el("code", {}, [header]), ": " + (response.headers[header].description || "")]));
+    }
+    content(doc, response.content).forEach(function (n) { inner.appendChild(n); });
+    details.appendChild(inner);
+    body.appendChild(details);
+  });
+
+  var title = el("span", {"class": op.deprecated ? "path deprecated" : "path"}, [path]);
+  return el("details", {id: op.operationId}, [
+    el("summary", {}, [el("span", {"class": "method " + method}, [method.toUpperCase()]), title, " — " + (op.summary || "")]),
+    body
+  ]);
+}
+
+function render(doc) {
+  document.title = doc.info.title + " " + doc.info.version;
+  document.getElementById("title").textContent = doc.info.title + " " + doc.info.version;
+  document.getElementById("description").textContent = doc.info.description || "";
+
+  var tags = {};
+  Object.keys(doc.paths).sort().forEach(function (path) {
+    ["get", "post", "put", "patch", "delete"].forEach(function (method) {
+      var op = doc.paths[path][method];
+      if (!op) return;
+      var tag = (op.tags || ["Other"])[0];
+      (tags[tag] = tags[tag] || []).push(operation(doc, path, method, op));
+    });
+  });
+
+  var root = document.getElementById("operations");
+  root.textContent = "";
+  Object.keys(tags).sort().forEach(function (tag) {
+    root.appendChild(el("h2", {}, [tag]));
+    tags[tag].forEach(function (n) { root.appendChild(n); });
+  });
+}
+
+var url = location.pathname.replace(/[^\/]*$/, "") + "openapi.json";
+fetch(url).then(function (response) {
+  if (!response.ok) throw new Error(response.status + " " + response.statusText);
+  return response.json();
+}).then(render).catch(function (err) {
+  document.getElementById("operations").textContent = "Failed to load " + url + ": " + err.message;
+});
+</script>
+</body>
+</html>
+`
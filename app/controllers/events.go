@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/events"
+	"github.com/omar-ozgur/gram/health"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LastEventIdHeader is sent by reconnecting EventSource clients with the id of the last event they received
+const LastEventIdHeader = "Last-Event-ID"
+
+const (
+	eventsPollInterval = time.Second
+	eventsKeepAlive    = 15 * time.Second
+	eventsRetry        = 2 * time.Second
+	eventsBatchSize    = 100
+
+	// eventsGapWait is how long a stream waits for a missing event id before skipping it. Ids are assigned when an
+	// event is inserted but can be read only once its transaction commits, so a later event may be read first.
+	// The ids of rolled back transactions never appear.
+	eventsGapWait = 5 * time.Second
+)
+
+// ParseEventTypes reads the comma-separated types parameter. An empty result matches every type.
+func ParseEventTypes(r *http.Request) (map[string]bool, error) {
+	types := map[string]bool{}
+	for _, name := range strings.Split(r.URL.Query().Get("types"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !events.IsValid(name) {
+			return nil, invalidListParam("types", fmt.Sprintf("types must be a list of %s", strings.Join(events.All, ", ")))
+		}
+		types[name] = true
+	}
+	return types, nil
+}
+
+// ParseLastEventId reads the id a stream resumes after: the Last-Event-ID header of a reconnecting client, or the
+// last_event_id parameter for a client's first connection. ok is false if neither is set.
+func ParseLastEventId(r *http.Request) (id int64, ok bool, err error) {
+	value := r.Header.Get(LastEventIdHeader)
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err = strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, invalidListParam("last_event_id", "The last event id must be a non-negative number")
+	}
+	return id, true, nil
+}
+
+var EventsStream = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "Only admins can stream events") {
+		return
+	}
+
+	types, err := ParseEventTypes(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+	lastId, resume, err := ParseLastEventId(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utilities.WriteProblem(w, r, utilities.NewInternalError("The response cannot be streamed", nil))
+		return
+	}
+
+	// New streams start with the next event
+	if !resume {
+		lastId, err = models.LastEventId(r.Context())
+		if err != nil {
+			utilities.WriteProblem(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry/time.Millisecond)
+	flusher.Flush()
+
+	streamEvents(r, w, flusher, lastId, types)
+})
+
+// streamEvents writes events after lastId until the client disconnects. The stream ends before the server's write
+// timeout would cut it off, and when the server shuts down; clients reconnect with the Last-Event-ID header and
+// carry on where they left off.
+func streamEvents(r *http.Request, w io.Writer, flusher http.Flusher, lastId int64, types map[string]bool) {
+	ctx := r.Context()
+
+	var deadline <-chan time.Time
+	if timeout := utilities.CurrentConfig().Server.WriteTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout - timeout/10)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+
+	lastWrite := time.Now()
+	var gapAfter int64
+	var gapSince time.Time
+	for {
+		list, err := models.ListEvents(ctx, lastId, eventsBatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				utilities.Log(ctx).Error("Failed to read events", zap.Error(err))
+			}
+			return
+		}
+
+		for _, event := range list {
+			// Wait for a missing event to be committed, unless the gap is old enough that it never will be
+			if event.Id != lastId+1 && time.Since(event.Time) < eventsGapWait {
+				if gapAfter != lastId {
+					gapAfter, gapSince = lastId, time.Now()
+				}
+				if time.Since(gapSince) < eventsGapWait {
+					break
+				}
+			}
+
+			lastId = event.Id
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				utilities.Log(ctx).Error("Failed to encode event", zap.Int64("event_id", event.Id), zap.Error(err))
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+			lastWrite = time.Now()
+		}
+
+		// An id without data moves the client's Last-Event-ID past events that were filtered out
+		if time.Since(lastWrite) >= eventsKeepAlive {
+			fmt.Fprintf(w, ": keep-alive\nid: %d\n\n", lastId)
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+		if health.ShuttingDown() {
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// loginStateCookie binds a federated login to the browser that started it, so that a callback
+// URL cannot be used to log someone else in
+const loginStateCookie = "gram_login_state"
+
+var FederationStart = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+
+	authURL, state, err := models.StartFederatedLogin(r.Context(), providerName, r.URL.Query().Get("return_to"))
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   secureCallback(r, providerName),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+})
+
+var FederationCallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+	query := r.URL.Query()
+
+	http.SetCookie(w, &http.Cookie{Name: loginStateCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureCallback(r, providerName), SameSite: http.SameSiteLaxMode})
+	cookie, err := r.Cookie(loginStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidLoginState, "The login was not started in this browser. Start the login again"))
+		return
+	}
+
+	login, err := models.FinishFederatedLogin(r.Context(), providerName, query.Get("state"), query.Get("code"), query.Get("error"))
+
+	// Browser logins are sent back to the client with the result in the fragment, which is not sent to servers
+	if login.ReturnTo != "" {
+		fragment := url.Values{}
+		switch {
+		case err != nil:
+			e := utilities.AsError(err)
+			fragment.Set("error", e.Code)
+			if e.Kind != utilities.ErrorInternal {
+				fragment.Set("error_description", e.Message)
+			}
+		case login.LinkToken != "":
+			fragment.Set("link_token", login.LinkToken)
+			fragment.Set("provider", login.Provider)
+		default:
+			fragment.Set("token", login.Token)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, login.ReturnTo+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if login.LinkToken != "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     "success",
+			"message":    "Log in another way and link this account with the link token",
+			"link_token": login.LinkToken,
+			"provider":   login.Provider,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Logged in",
+		"token":   login.Token,
+	})
+})
+
+// secureCallback reports whether the login state cookie should only be sent over https
+func secureCallback(r *http.Request, providerName string) bool {
+	provider := utilities.CurrentConfig().Policy().Federation.Providers[providerName]
+	return r.TLS != nil || strings.HasPrefix(provider.RedirectURL, "https:")
+}
+
+var IdentitiesIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	current_user_id, _ := GetCurrentUserId(r)
+
+	identities, err := models.ListIdentities(r.Context(), current_user_id)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "success",
+		"message":    "Retrieved identities",
+		"identities": identities,
+	})
+})
+
+var IdentitiesCreate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		LinkToken string `json:"link_token"`
+	}
+	err := readJSON(r, &body)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	current_user_id, _ := GetCurrentUserId(r)
+
+	identity, err := models.LinkIdentity(r.Context(), current_user_id, body.LinkToken)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":   "success",
+		"message":  "Identity linked",
+		"identity": identity,
+	})
+})
+
+var IdentitiesDelete = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	current_user_id, _ := GetCurrentUserId(r)
+
+	err := models.UnlinkIdentity(r.Context(), current_user_id, mux.Vars(r)["provider"])
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Identity unlinked",
+	})
+})
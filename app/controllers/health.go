@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"github.com/omar-ozgur/gram/health"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HealthzShow reports that the process is alive. It keeps passing during shutdown, so the process is not
+// restarted while it drains requests.
+var HealthzShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Alive",
+	})
+})
+
+// ReadyzShow reports whether the server can handle requests. Failed checks are only named, since the probe is public.
+var ReadyzShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	results, ready := health.Ready(r.Context())
+	if !ready {
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorUnavailable, utilities.CodeNotReady, "Failed checks: "+strings.Join(health.Failed(results), ", ")))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Ready",
+	})
+})
+
+// StatusShow reports the result of each readiness check and the build of the running server to admins
+var StatusShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "Only admins can view the server status") {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	results, ready := health.Ready(r.Context())
+	message := "Ready"
+	if !ready {
+		message = "Not ready"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "success",
+		"message":        message,
+		"ready":          ready,
+		"shutting_down":  health.ShuttingDown(),
+		"service":        utilities.CurrentConfig().Server.Service,
+		"components":     results,
+		"build":          health.Build(),
+		"started_at":     health.StartedAt().UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(health.Uptime().Seconds()),
+	})
+})
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func invalidListParam(field string, message string) error {
+	return utilities.NewValidationError("The listing parameters are invalid", utilities.FieldError{
+		Field:   field,
+		Code:    utilities.FieldInvalid,
+		Message: message,
+	})
+}
+
+// ParseUserListParams reads the limit, cursor, sort and filter query parameters of a user listing
+func ParseUserListParams(r *http.Request) (params models.UserListParams, err error) {
+	query := r.URL.Query()
+
+	params.Limit = utilities.DefaultPageLimit
+	if limit := query.Get("limit"); limit != "" {
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit < 1 || params.Limit > utilities.MaxPageLimit {
+			return params, invalidListParam("limit", fmt.Sprintf("limit must be a number between 1 and %d", utilities.MaxPageLimit))
+		}
+	}
+
+	params.Cursor = query.Get("cursor")
+
+	params.Sort = "id"
+	if sort := query.Get("sort"); sort != "" {
+		params.Descending = strings.HasPrefix(sort, "-")
+		params.Sort = strings.TrimPrefix(sort, "-")
+	}
+
+	if after := query.Get("created_after"); after != "" {
+		params.CreatedAfter, err = time.Parse(time.RFC3339, after)
+		if err != nil {
+			return params, invalidListParam("created_after", "created_after must be an RFC 3339 timestamp")
+		}
+	}
+	if before := query.Get("created_before"); before != "" {
+		params.CreatedBefore, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			return params, invalidListParam("created_before", "created_before must be an RFC 3339 timestamp")
+		}
+	}
+
+	params.IncludeTotal = query.Get("include_total") == "true"
+
+	return params, nil
+}
+
+// SetLinkHeader adds RFC 8288 links to the first and next pages of a listing
+func SetLinkHeader(w http.ResponseWriter, r *http.Request, nextCursor string) {
+	pageURL := func(cursor string) string {
+		u := url.URL{Path: r.URL.Path}
+		query := r.URL.Query()
+		query.Del("include_total")
+		query.Del("cursor")
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(""))}
+	if nextCursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(nextCursor)))
+	}
+	w.Header().Add("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/omar-ozgur/gram/utilities"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// ParsePatch reads a JSON merge patch or JSON patch body, depending on its content type
+func ParsePatch(r *http.Request) (func(document interface{}) (interface{}, error), error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, "The request body could not be read")
+	}
+
+	switch mediaType {
+	case utilities.MergePatchType:
+		var patch interface{}
+		err = json.Unmarshal(b, &patch)
+		if err != nil {
+			return nil, utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, "The merge patch must be valid JSON: "+err.Error())
+		}
+		return func(document interface{}) (interface{}, error) {
+			return utilities.MergePatch(document, patch), nil
+		}, nil
+	case utilities.JSONPatchType:
+		var operations []utilities.PatchOperation
+		err = json.Unmarshal(b, &operations)
+		if err != nil {
+			return nil, utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, "The JSON patch must be an array of operations: "+err.Error())
+		}
+		return func(document interface{}) (interface{}, error) {
+			return utilities.JSONPatch(document, operations)
+		}, nil
+	}
+
+	return nil, utilities.NewError(utilities.ErrorUnsupportedMediaType, utilities.CodeUnsupportedMedia,
+		"Patches must be sent as "+utilities.MergePatchType+" or "+utilities.JSONPatchType)
+}
@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/scim"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SCIMPrefix is the path under which the SCIM endpoints are served
+const SCIMPrefix = "/scim/v2"
+
+// scimBase returns the absolute URL of the SCIM endpoints, for meta.location
+func scimBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + SCIMPrefix
+}
+
+// writeSCIMError writes an error in the SCIM format, translating domain errors to the closest scimType
+func writeSCIMError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(*scim.Error); ok {
+		scim.WriteError(w, e)
+		return
+	}
+
+	e := utilities.AsError(err)
+	if e.Kind == utilities.ErrorInternal {
+		utilities.Log(r.Context()).Error("Request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(e))
+		scim.WriteError(w, scim.NewError(http.StatusInternalServerError, "", "An unexpected error occurred"))
+		return
+	}
+
+	detail := e.Message
+	if len(e.Fields) > 0 {
+		messages := make([]string, len(e.Fields))
+		for i, field := range e.Fields {
+			messages[i] = field.Message
+		}
+		detail += ": " + strings.Join(messages, "; ")
+	}
+
+	scimType := ""
+	switch {
+	case e.Code == utilities.CodeInvalidSearch:
+		scimType = scim.ErrInvalidFilter
+	case e.Code == utilities.CodeInvalidRequest:
+		scimType = scim.ErrInvalidSyntax
+	case e.Kind == utilities.ErrorValidation:
+		scimType = scim.ErrInvalidValue
+	case e.Kind == utilities.ErrorConflict:
+		scimType = scim.ErrUniqueness
+	}
+	scim.WriteError(w, scim.NewError(e.Status(), scimType, detail))
+}
+
+// readSCIMBody reads a request body, which identity providers send as application/scim+json or application/json
+func readSCIMBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, scim.BadRequest(scim.ErrInvalidSyntax, "The request body could not be read")
+	}
+	return body, nil
+}
+
+func decodeSCIMResource(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return scim.BadRequest(scim.ErrInvalidSyntax, "The request body must be valid JSON: "+err.Error())
+	}
+	return nil
+}
+
+// scimBool is a boolean that some identity providers send as the string "True" or "False"
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case bool:
+		*b = scimBool(value)
+		return nil
+	case string:
+		parsed, err := strconv.ParseBool(strings.ToLower(value))
+		if err == nil {
+			*b = scimBool(parsed)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a boolean", string(data))
+}
+
+// scimMultiValue is a value of a multi-valued attribute such as emails
+type scimMultiValue struct {
+	Value   string   `json:"value"`
+	Type    string   `json:"type"`
+	Primary scimBool `json:"primary"`
+}
+
+// primaryValue returns the primary value, or the first value if none is primary. Gram stores one value of each.
+func primaryValue(values []scimMultiValue) string {
+	for _, value := range values {
+		if value.Primary {
+			return value.Value
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// scimID parses the id of a resource, which SCIM represents as a string
+func scimID(value string, resourceType string) (int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 1 {
+		return 0, scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("'%s' is not the id of a %s", value, resourceType))
+	}
+	return id, nil
+}
+
+// parseSCIMList reads the filter, startIndex and count parameters of a list request.
+// attributes maps SCIM attributes to the search fields they are filtered by.
+func parseSCIMList(r *http.Request, schema string, attributes map[string]string) (filter *models.UserFilter, startIndex, count int, err error) {
+	startIndex, count, err = scim.ParseIndex(r, utilities.DefaultPageLimit, utilities.MaxPageLimit)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if text := r.URL.Query().Get("filter"); text != "" {
+		parsed, err := scim.ParseFilter(text)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		filter, err = translateSCIMFilter(parsed, schema, attributes)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return filter, startIndex, count, nil
+}
+
+var scimFilterOps = map[string]string{"eq": "eq", "ne": "ne", "co": "contains", "sw": "prefix", "ew": "suffix"}
+
+var scimRangeBounds = map[string]string{"gt": "gt", "ge": "gte", "lt": "lt", "le": "lte"}
+
+// translateSCIMFilter converts a SCIM filter to a search filter. Chains of the same logical operator are flattened,
+// so that long chains are not rejected for being nested too deeply.
+func translateSCIMFilter(filter *scim.Filter, schema string, attributes map[string]string) (*models.UserFilter, error) {
+	switch filter.Op {
+	case "and", "or":
+		var operands []models.UserFilter
+		for _, operand := range []*scim.Filter{filter.Left, filter.Right} {
+			translated, err := translateSCIMFilter(operand, schema, attributes)
+			if err != nil {
+				return nil, err
+			}
+			if filter.Op == "and" && translated.And != nil {
+				operands = append(operands, translated.And...)
+			} else if filter.Op == "or" && translated.Or != nil {
+				operands = append(operands, translated.Or...)
+			} else {
+				operands = append(operands, *translated)
+			}
+		}
+		if filter.Op == "and" {
+			return &models.UserFilter{And: operands}, nil
+		}
+		return &models.UserFilter{Or: operands}, nil
+	case "not":
+		operand, err := translateSCIMFilter(filter.Left, schema, attributes)
+		if err != nil {
+			return nil, err
+		}
+		return &models.UserFilter{Not: operand}, nil
+	}
+
+	field, ok := attributes[scim.AttributeName(filter.Attr, schema)]
+	if !ok {
+		return nil, scim.BadRequest(scim.ErrInvalidFilter, fmt.Sprintf("Filtering by '%s' is not supported", filter.Attr))
+	}
+	if filter.Op == "pr" {
+		return &models.UserFilter{Field: field, Op: "present"}, nil
+	}
+
+	value := filter.Value
+	if value == nil {
+		return nil, scim.BadRequest(scim.ErrInvalidFilter, fmt.Sprintf("'%s' cannot be compared with null", filter.Attr))
+	}
+
+	// Ids are strings in SCIM but numbers in Gram
+	if text, ok := value.(string); ok && field == "id" {
+		id, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, scim.BadRequest(scim.ErrInvalidFilter, fmt.Sprintf("'%s' is not a valid id", text))
+		}
+		value = id
+	}
+	raw, _ := json.Marshal(value)
+
+	if bound, ok := scimRangeBounds[filter.Op]; ok {
+		raw, _ = json.Marshal(map[string]json.RawMessage{bound: raw})
+		return &models.UserFilter{Field: field, Op: "range", Value: raw}, nil
+	}
+	return &models.UserFilter{Field: field, Op: scimFilterOps[filter.Op], Value: raw}, nil
+}
+
+// matchSCIMFilter evaluates a value filter of a patch path, such as type eq "work", against one value of a
+// multi-valued attribute. Values are keyed by lower-case sub-attribute, and strings compare case-insensitively.
+func matchSCIMFilter(filter *scim.Filter, value map[string]interface{}) bool {
+	switch filter.Op {
+	case "and":
+		return matchSCIMFilter(filter.Left, value) && matchSCIMFilter(filter.Right, value)
+	case "or":
+		return matchSCIMFilter(filter.Left, value) || matchSCIMFilter(filter.Right, value)
+	case "not":
+		return !matchSCIMFilter(filter.Left, value)
+	}
+
+	actual, ok := value[strings.ToLower(filter.Attr)]
+	if filter.Op == "pr" {
+		return ok && actual != nil && actual != ""
+	}
+	if !ok {
+		return false
+	}
+
+	if expected, ok := filter.Value.(bool); ok {
+		matches := actual == expected
+		return (filter.Op == "eq" && matches) || (filter.Op == "ne" && !matches)
+	}
+
+	left, right := strings.ToLower(fmt.Sprintf("%v", actual)), strings.ToLower(fmt.Sprintf("%v", filter.Value))
+	switch filter.Op {
+	case "eq":
+		return left == right
+	case "ne":
+		return left != right
+	case "co":
+		return strings.Contains(left, right)
+	case "sw":
+		return strings.HasPrefix(left, right)
+	case "ew":
+		return strings.HasSuffix(left, right)
+	case "gt":
+		return left > right
+	case "ge":
+		return left >= right
+	case "lt":
+		return left < right
+	case "le":
+		return left <= right
+	}
+	return false
+}
+
+// projectSCIMResource applies the attributes and excludedAttributes parameters to a resource.
+// Only top-level attributes are selected; id, schemas and meta are always returned.
+func projectSCIMResource(r *http.Request, schema string, resource map[string]interface{}) map[string]interface{} {
+	split := func(parameter string) map[string]bool {
+		names := make(map[string]bool)
+		for _, name := range strings.Split(r.URL.Query().Get(parameter), ",") {
+			name = scim.AttributeName(strings.TrimSpace(name), schema)
+			if dot := strings.Index(name, "."); dot >= 0 {
+				name = name[:dot]
+			}
+			if name != "" {
+				names[name] = true
+			}
+		}
+		return names
+	}
+	included, excluded := split("attributes"), split("excludedAttributes")
+
+	for name := range resource {
+		key := strings.ToLower(name)
+		if key == "id" || key == "schemas" || key == "meta" {
+			continue
+		}
+		if (len(included) > 0 && !included[key]) || excluded[key] {
+			delete(resource, name)
+		}
+	}
+	return resource
+}
+
+// excludesSCIMAttribute reports whether a request leaves out an attribute, so that it need not be loaded
+func excludesSCIMAttribute(r *http.Request, schema, attribute string) bool {
+	return len(projectSCIMResource(r, schema, map[string]interface{}{attribute: true})) == 0
+}
+
+// setSCIMLocation sets the Location and ETag headers of a created or retrieved resource
+func setSCIMLocation(w http.ResponseWriter, meta scim.Meta) {
+	w.Header().Set("Location", meta.Location)
+	if meta.Version != "" {
+		w.Header().Set("ETag", meta.Version)
+	}
+}
+
+var SCIMServiceProviderConfigShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	scim.WriteJSON(w, http.StatusOK, scim.ServiceProviderConfig(scimBase(r), utilities.MaxPageLimit))
+})
+
+// writeSCIMDefinitions writes a schema or resource type by id, or lists them all
+func writeSCIMDefinitions(w http.ResponseWriter, r *http.Request, definitions []interface{}, kind string) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		scim.WriteJSON(w, http.StatusOK, scim.NewListResponse(definitions, len(definitions), 1))
+		return
+	}
+	for _, definition := range definitions {
+		if definition.(map[string]interface{})["id"] == id {
+			scim.WriteJSON(w, http.StatusOK, definition)
+			return
+		}
+	}
+	scim.WriteError(w, scim.NewError(http.StatusNotFound, "", fmt.Sprintf("%s %s was not found", kind, id)))
+}
+
+var SCIMResourceTypesIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	writeSCIMDefinitions(w, r, scim.ResourceTypes(scimBase(r)), "Resource type")
+})
+
+var SCIMSchemasIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	writeSCIMDefinitions(w, r, scim.Schemas(scimBase(r)), "Schema")
+})
@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/scim"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// scimGroupAttributes maps the SCIM attributes of groups to the search fields they are filtered by
+var scimGroupAttributes = map[string]string{
+	"id":                "id",
+	"displayname":       "display_name",
+	"externalid":        "external_id",
+	"meta.created":      "created_at",
+	"meta.lastmodified": "updated_at",
+}
+
+// scimMemberInput is a member as an identity provider sends it
+type scimMemberInput struct {
+	Value string `json:"value"`
+}
+
+// scimGroupInput is a group as an identity provider sends it. Read-only attributes are ignored.
+type scimGroupInput struct {
+	DisplayName string            `json:"displayName"`
+	ExternalId  string            `json:"externalId"`
+	Members     []scimMemberInput `json:"members"`
+}
+
+func scimGroupMembers(inputs []scimMemberInput) ([]models.GroupMember, error) {
+	members := make([]models.GroupMember, len(inputs))
+	for i, input := range inputs {
+		id, err := scimID(input.Value, "user")
+		if err != nil {
+			return nil, err
+		}
+		members[i] = models.GroupMember{UserId: id}
+	}
+	return members, nil
+}
+
+// apply replaces a group's name, external id and members
+func (input scimGroupInput) apply(group *models.Group) error {
+	if input.DisplayName == "" {
+		return scim.BadRequest(scim.ErrInvalidValue, "displayName is required")
+	}
+	members, err := scimGroupMembers(input.Members)
+	if err != nil {
+		return err
+	}
+	group.DisplayName, group.ExternalId, group.Members = input.DisplayName, input.ExternalId, members
+	return nil
+}
+
+// scimGroupResource represents a group in the SCIM format
+func scimGroupResource(r *http.Request, group models.Group) map[string]interface{} {
+	base := scimBase(r)
+	id := strconv.FormatInt(group.Id, 10)
+
+	members := []interface{}{}
+	for _, member := range group.Members {
+		userId := strconv.Itoa(member.UserId)
+		members = append(members, map[string]interface{}{"value": userId, "$ref": base + "/Users/" + userId, "display": member.Name, "type": "User"})
+	}
+
+	resource := map[string]interface{}{
+		"schemas":     []string{scim.GroupSchema},
+		"id":          id,
+		"displayName": group.DisplayName,
+		"members":     members,
+		"meta": scim.Meta{
+			ResourceType: "Group",
+			Created:      &group.CreatedAt,
+			LastModified: &group.UpdatedAt,
+			Location:     base + "/Groups/" + id,
+			Version:      group.ETag(),
+		},
+	}
+	if group.ExternalId != "" {
+		resource["externalId"] = group.ExternalId
+	}
+	return projectSCIMResource(r, scim.GroupSchema, resource)
+}
+
+// writeSCIMGroup writes a group with its Location and ETag
+func writeSCIMGroup(w http.ResponseWriter, r *http.Request, status int, group models.Group) {
+	resource := scimGroupResource(r, group)
+	setSCIMLocation(w, resource["meta"].(scim.Meta))
+	scim.WriteJSON(w, status, resource)
+}
+
+var SCIMGroupsIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	filter, startIndex, count, err := parseSCIMList(r, scim.GroupSchema, scimGroupAttributes)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	page, err := models.ListGroups(r.Context(), models.GroupQuery{
+		Filter:         filter,
+		Offset:         startIndex - 1,
+		Limit:          count,
+		ExcludeMembers: excludesSCIMAttribute(r, scim.GroupSchema, "members"),
+	})
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	resources := make([]interface{}, len(page.Groups))
+	for i, group := range page.Groups {
+		resources[i] = scimGroupResource(r, group)
+	}
+	scim.WriteJSON(w, http.StatusOK, scim.NewListResponse(resources, page.Total, startIndex))
+})
+
+var SCIMGroupsCreate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	var input scimGroupInput
+	if err := decodeSCIMResource(body, &input); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	var group models.Group
+	if err := input.apply(&group); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	created, err := models.CreateGroup(r.Context(), group)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	writeSCIMGroup(w, r, http.StatusCreated, created)
+})
+
+var SCIMGroupsShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	group, err := models.GetGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	writeSCIMGroup(w, r, http.StatusOK, group)
+})
+
+// updateSCIMGroup saves the changes that update makes to the group in the request's path
+func updateSCIMGroup(w http.ResponseWriter, r *http.Request, update func(group *models.Group) error) {
+	updated, err := models.UpdateGroup(r.Context(), mux.Vars(r)["id"], func(current models.Group) (models.Group, error) {
+		err := update(&current)
+		return current, err
+	}, r.Header.Get("If-Match"))
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	// Identity providers that patch members do not need them back, and large groups are expensive to return
+	if r.Method == http.MethodPatch && len(r.URL.Query()["attributes"]) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeSCIMGroup(w, r, http.StatusOK, updated)
+}
+
+var SCIMGroupsUpdate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	var input scimGroupInput
+	if err := decodeSCIMResource(body, &input); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	updateSCIMGroup(w, r, input.apply)
+})
+
+var SCIMGroupsPatch = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	request, err := scim.ParsePatchRequest(body)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	updateSCIMGroup(w, r, func(group *models.Group) error {
+		for _, operation := range request.Operations {
+			if err := patchSCIMGroup(group, operation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+})
+
+var SCIMGroupsDelete = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if err := models.DeleteGroup(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// patchSCIMGroup applies a patch operation to a group. An operation without a path applies each attribute of its value.
+func patchSCIMGroup(group *models.Group, operation scim.PatchOperation) error {
+	if operation.Path != "" {
+		path, err := scim.ParsePath(operation.Path, scim.GroupSchema)
+		if err != nil {
+			return err
+		}
+		return patchSCIMGroupPath(group, operation.Op, path, operation.Value)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &values); err != nil {
+		return scim.BadRequest(scim.ErrInvalidSyntax, "The value of an operation without a path must be an object")
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path, err := scim.ParsePath(name, scim.GroupSchema)
+		if err != nil {
+			return err
+		}
+		if err := patchSCIMGroupPath(group, operation.Op, path, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func patchSCIMGroupPath(group *models.Group, op string, path scim.Path, raw json.RawMessage) error {
+	if path.Attr != "members" && (path.Filter != nil || path.Sub != "") {
+		return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("%s has no sub-attributes or values to filter", path.Attr))
+	}
+
+	switch path.Attr {
+	case "displayname":
+		if op == "remove" {
+			return scim.BadRequest(scim.ErrInvalidValue, "displayName is required")
+		}
+		if json.Unmarshal(raw, &group.DisplayName) != nil {
+			return scim.BadRequest(scim.ErrInvalidValue, "The value of displayName must be a string")
+		}
+	case "externalid":
+		group.ExternalId = ""
+		if op != "remove" && json.Unmarshal(raw, &group.ExternalId) != nil {
+			return scim.BadRequest(scim.ErrInvalidValue, "The value of externalId must be a string")
+		}
+	case "members":
+		return patchSCIMMembers(group, op, path, raw)
+	case "id", "meta", "schemas":
+		return nil
+	default:
+		return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("Groups have no attribute '%s'", path.Attr))
+	}
+	return nil
+}
+
+// patchSCIMMembers adds, replaces or removes members. Members can be removed by a filter such as
+// members[value eq "42"], or by listing them in the value, as some identity providers do.
+func patchSCIMMembers(group *models.Group, op string, path scim.Path, raw json.RawMessage) error {
+	if path.Sub != "" {
+		return scim.BadRequest(scim.ErrInvalidPath, "Members can only be changed as a whole")
+	}
+
+	var inputs []scimMemberInput
+	if len(raw) > 0 && string(raw) != "null" {
+		if json.Unmarshal(raw, &inputs) != nil {
+			var input scimMemberInput
+			if json.Unmarshal(raw, &input) != nil {
+				return scim.BadRequest(scim.ErrInvalidValue, "The value of members must be an array of members")
+			}
+			inputs = []scimMemberInput{input}
+		}
+	}
+	listed, err := scimGroupMembers(inputs)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case "add":
+		if path.Filter != nil {
+			return scim.BadRequest(scim.ErrInvalidPath, "Members cannot be added with a filter")
+		}
+		group.Members = append(group.Members, listed...)
+	case "replace":
+		if path.Filter != nil {
+			return scim.BadRequest(scim.ErrInvalidPath, "Members cannot be replaced with a filter")
+		}
+		group.Members = listed
+	case "remove":
+		removed := make(map[int]bool)
+		for _, member := range listed {
+			removed[member.UserId] = true
+		}
+		var kept []models.GroupMember
+		for _, member := range group.Members {
+			value := map[string]interface{}{"value": strconv.Itoa(member.UserId), "display": member.Name, "type": "User"}
+			matched := removed[member.UserId] || (path.Filter != nil && matchSCIMFilter(path.Filter, value))
+			if path.Filter == nil && len(listed) == 0 {
+
+				// Removing members without a filter or value removes every member
+				matched = true
+			}
+			if !matched {
+				kept = append(kept, member)
+			}
+		}
+		group.Members = kept
+	}
+	return nil
+}
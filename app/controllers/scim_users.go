@@ -0,0 +1,469 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/identifiers"
+	"github.com/omar-ozgur/gram/scim"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// scimUserNameField returns the user field that userName is stored as, which the service configures
+func scimUserNameField() string {
+	if utilities.CurrentConfig().Policy().SCIM.UserName == identifiers.Username {
+		return "username"
+	}
+	return "email"
+}
+
+// scimUserAttributes maps the SCIM attributes of users to the search fields they are filtered by
+func scimUserAttributes() map[string]string {
+	return map[string]string{
+		"id":                 "id",
+		"username":           scimUserNameField(),
+		"externalid":         "external_id",
+		"name.givenname":     "first_name",
+		"name.familyname":    "last_name",
+		"emails":             "email",
+		"emails.value":       "email",
+		"phonenumbers":       "phone",
+		"phonenumbers.value": "phone",
+		"active":             "active",
+		"meta.created":       "time_created",
+		"meta.lastmodified":  "updated_at",
+	}
+}
+
+// scimUserInput is a user as an identity provider sends it. Read-only attributes are ignored.
+type scimUserInput struct {
+	UserName   string `json:"userName"`
+	ExternalId string `json:"externalId"`
+	Name       struct {
+		GivenName  string `json:"givenName"`
+		FamilyName string `json:"familyName"`
+	} `json:"name"`
+	Emails       []scimMultiValue `json:"emails"`
+	PhoneNumbers []scimMultiValue `json:"phoneNumbers"`
+	Active       *scimBool        `json:"active"`
+	Password     string           `json:"password"`
+}
+
+// apply replaces the provisioned fields of a user. Users stay active unless active is given.
+func (input scimUserInput) apply(user *models.User) error {
+	if input.UserName == "" {
+		return scim.BadRequest(scim.ErrInvalidValue, "userName is required")
+	}
+
+	user.First_name, user.Last_name = input.Name.GivenName, input.Name.FamilyName
+	user.Email, user.Phone = primaryValue(input.Emails), primaryValue(input.PhoneNumbers)
+	if scimUserNameField() == "username" {
+		user.Username = input.UserName
+	} else {
+		user.Email = input.UserName
+	}
+	user.External_id = input.ExternalId
+	if input.Active != nil {
+		user.Active = bool(*input.Active)
+	}
+	if input.Password != "" {
+		user.Password = []byte(input.Password)
+	}
+	return nil
+}
+
+// scimUserResource represents a user in the SCIM format
+func scimUserResource(r *http.Request, user models.User, groups []models.GroupRef) map[string]interface{} {
+	base := scimBase(r)
+	id := strconv.Itoa(user.Id)
+
+	userName := user.Email
+	if scimUserNameField() == "username" {
+		userName = user.Username
+	}
+
+	resource := map[string]interface{}{
+		"schemas":  []string{scim.UserSchema},
+		"id":       id,
+		"userName": userName,
+		"name": map[string]interface{}{
+			"givenName":  user.First_name,
+			"familyName": user.Last_name,
+			"formatted":  user.First_name + " " + user.Last_name,
+		},
+		"displayName": user.First_name + " " + user.Last_name,
+		"active":      user.Active,
+		"meta": scim.Meta{
+			ResourceType: "User",
+			Created:      &user.Time_created,
+			LastModified: &user.Updated_at,
+			Location:     base + "/Users/" + id,
+			Version:      user.ETag(),
+		},
+	}
+	if user.External_id != "" {
+		resource["externalId"] = user.External_id
+	}
+	if user.Email != "" {
+		resource["emails"] = []interface{}{map[string]interface{}{"value": user.Email, "type": "work", "primary": true}}
+	}
+	if user.Phone != "" {
+		resource["phoneNumbers"] = []interface{}{map[string]interface{}{"value": user.Phone, "type": "work", "primary": true}}
+	}
+
+	memberships := []interface{}{}
+	for _, group := range groups {
+		groupId := strconv.FormatInt(group.Id, 10)
+		memberships = append(memberships, map[string]interface{}{"value": groupId, "$ref": base + "/Groups/" + groupId, "display": group.DisplayName})
+	}
+	resource["groups"] = memberships
+
+	return projectSCIMResource(r, scim.UserSchema, resource)
+}
+
+// scimUserId returns the id in the request's path, treating ids that are not numbers as missing users
+func scimUserId(r *http.Request) (string, error) {
+	id := mux.Vars(r)["id"]
+	if _, err := strconv.Atoi(id); err != nil {
+		return "", utilities.NewError(utilities.ErrorNotFound, utilities.CodeUserNotFound, fmt.Sprintf("User %s was not found", id))
+	}
+	return id, nil
+}
+
+// writeSCIMUser writes a user with the groups they belong to
+func writeSCIMUser(w http.ResponseWriter, r *http.Request, status int, user models.User) {
+	groups, err := models.GetUserGroups(r.Context(), []int{user.Id})
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	resource := scimUserResource(r, user, groups[user.Id])
+	setSCIMLocation(w, resource["meta"].(scim.Meta))
+	scim.WriteJSON(w, status, resource)
+}
+
+var SCIMUsersIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	filter, startIndex, count, err := parseSCIMList(r, scim.UserSchema, scimUserAttributes())
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	page, err := models.GetUsers(r.Context(), models.UserListParams{
+		Limit:        count,
+		Offset:       startIndex - 1,
+		Sort:         "id",
+		IncludeTotal: true,
+		Filter:       filter,
+		Visibility:   models.VisibilityAdmin,
+	})
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	groups := map[int][]models.GroupRef{}
+	if !excludesSCIMAttribute(r, scim.UserSchema, "groups") && len(page.Users) > 0 {
+		ids := make([]int, len(page.Users))
+		for i, user := range page.Users {
+			ids[i] = user.Id
+		}
+		groups, err = models.GetUserGroups(r.Context(), ids)
+		if err != nil {
+			writeSCIMError(w, r, err)
+			return
+		}
+	}
+
+	resources := make([]interface{}, len(page.Users))
+	for i, user := range page.Users {
+		resources[i] = scimUserResource(r, user, groups[user.Id])
+	}
+	scim.WriteJSON(w, http.StatusOK, scim.NewListResponse(resources, *page.Total, startIndex))
+})
+
+var SCIMUsersCreate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	var input scimUserInput
+	if err := decodeSCIMResource(body, &input); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	user := models.User{Active: true}
+	if err := input.apply(&user); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	created, err := models.ProvisionUser(r.Context(), user)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	writeSCIMUser(w, r, http.StatusCreated, created)
+})
+
+var SCIMUsersShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	id, err := scimUserId(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	user, err := models.GetUser(r.Context(), id)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	writeSCIMUser(w, r, http.StatusOK, user)
+})
+
+// updateSCIMUser saves the changes that update makes to the user in the request's path
+func updateSCIMUser(w http.ResponseWriter, r *http.Request, update func(user *models.User) error) {
+	id, err := scimUserId(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	updated, err := models.UpdateProvisionedUser(r.Context(), id, func(current models.User) (models.User, error) {
+		current.Password = nil
+		err := update(&current)
+		return current, err
+	}, r.Header.Get("If-Match"))
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	writeSCIMUser(w, r, http.StatusOK, updated)
+}
+
+var SCIMUsersUpdate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	var input scimUserInput
+	if err := decodeSCIMResource(body, &input); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	updateSCIMUser(w, r, input.apply)
+})
+
+var SCIMUsersPatch = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := readSCIMBody(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	request, err := scim.ParsePatchRequest(body)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+
+	updateSCIMUser(w, r, func(user *models.User) error {
+		for _, operation := range request.Operations {
+			if err := patchSCIMUser(user, operation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+})
+
+var SCIMUsersDelete = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	id, err := scimUserId(r)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	if err := models.DeleteUser(r.Context(), id); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// patchSCIMUser applies a patch operation to a user. An operation without a path applies each attribute of its value.
+func patchSCIMUser(user *models.User, operation scim.PatchOperation) error {
+	if operation.Path != "" {
+		path, err := scim.ParsePath(operation.Path, scim.UserSchema)
+		if err != nil {
+			return err
+		}
+		return patchSCIMUserPath(user, operation.Op, path, operation.Value)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &values); err != nil {
+		return scim.BadRequest(scim.ErrInvalidSyntax, "The value of an operation without a path must be an object")
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path, err := scim.ParsePath(name, scim.UserSchema)
+		if err != nil {
+			return err
+		}
+		if err := patchSCIMUserPath(user, operation.Op, path, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func patchSCIMUserPath(user *models.User, op string, path scim.Path, raw json.RawMessage) error {
+	remove := op == "remove"
+	invalid := func(expected string) error {
+		return scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("The value of %s must be %s", path.Attr, expected))
+	}
+	text := func() (string, error) {
+		var value string
+		if !remove && json.Unmarshal(raw, &value) != nil {
+			return "", invalid("a string")
+		}
+		return value, nil
+	}
+	if path.Filter != nil && path.Attr != "emails" && path.Attr != "phonenumbers" {
+		return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("%s is not a multi-valued attribute", path.Attr))
+	}
+
+	switch path.Attr {
+	case "username":
+		if remove {
+			return scim.BadRequest(scim.ErrInvalidValue, "userName is required")
+		}
+		value, err := text()
+		if err != nil {
+			return err
+		}
+		if scimUserNameField() == "username" {
+			user.Username = value
+		} else {
+			user.Email = value
+		}
+	case "name":
+		switch path.Sub {
+		case "givenname":
+			value, err := text()
+			user.First_name = value
+			return err
+		case "familyname":
+			value, err := text()
+			user.Last_name = value
+			return err
+		case "formatted":
+			return nil
+		case "":
+			if remove {
+				user.First_name, user.Last_name = "", ""
+				return nil
+			}
+			var name struct {
+				GivenName  *string `json:"givenName"`
+				FamilyName *string `json:"familyName"`
+			}
+			if json.Unmarshal(raw, &name) != nil {
+				return invalid("an object")
+			}
+			if name.GivenName != nil {
+				user.First_name = *name.GivenName
+			}
+			if name.FamilyName != nil {
+				user.Last_name = *name.FamilyName
+			}
+		default:
+			return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("name has no sub-attribute '%s'", path.Sub))
+		}
+	case "emails", "phonenumbers":
+		field := &user.Email
+		if path.Attr == "phonenumbers" {
+			field = &user.Phone
+		}
+		return patchSCIMMultiValue(field, op, path, raw)
+	case "active":
+		var value scimBool
+		if remove || json.Unmarshal(raw, &value) != nil {
+			return invalid("a boolean")
+		}
+		user.Active = bool(value)
+	case "externalid":
+		value, err := text()
+		if err != nil {
+			return err
+		}
+		user.External_id = value
+	case "password":
+		if remove {
+			return scim.BadRequest(scim.ErrMutability, "password cannot be removed")
+		}
+		value, err := text()
+		if err != nil {
+			return err
+		}
+		user.Password = []byte(value)
+	case "displayname", "groups", "id", "meta", "schemas":
+
+		// Read-only attributes are ignored, as they are when users are created or replaced
+		return nil
+	default:
+		return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("Users have no attribute '%s'", path.Attr))
+	}
+	return nil
+}
+
+// patchSCIMMultiValue patches emails or phoneNumbers, of which Gram stores a single value as the primary work value
+func patchSCIMMultiValue(field *string, op string, path scim.Path, raw json.RawMessage) error {
+	if path.Filter != nil {
+		current := map[string]interface{}{"value": *field, "type": "work", "primary": true}
+		if *field == "" || !matchSCIMFilter(path.Filter, current) {
+			if op == "remove" {
+				return nil
+			}
+			return scim.BadRequest(scim.ErrNoTarget, fmt.Sprintf("No value of %s matches the filter", path.Attr))
+		}
+	}
+
+	switch {
+	case op == "remove":
+		if path.Sub == "" || path.Sub == "value" {
+			*field = ""
+		}
+	case path.Sub == "value":
+		if json.Unmarshal(raw, field) != nil {
+			return scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("The value of %s.value must be a string", path.Attr))
+		}
+	case path.Sub == "type" || path.Sub == "primary":
+
+		// Values are always primary work values
+		return nil
+	case path.Sub != "":
+		return scim.BadRequest(scim.ErrInvalidPath, fmt.Sprintf("%s has no sub-attribute '%s'", path.Attr, path.Sub))
+	default:
+		var values []scimMultiValue
+		if json.Unmarshal(raw, &values) != nil {
+			var value scimMultiValue
+			if json.Unmarshal(raw, &value) != nil {
+				return scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("The value of %s must be an array of values", path.Attr))
+			}
+			values = []scimMultiValue{value}
+		}
+		*field = primaryValue(values)
+	}
+	return nil
+}
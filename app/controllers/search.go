@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"sort"
+	"strings"
+)
+
+// ParseUserFilter reads a search body, either {"filter": {...}} or a flat object of fields that must all be equal
+func ParseUserFilter(body []byte) (*models.UserFilter, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, invalidSearchBody("The search body must be a JSON object")
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	if raw, ok := fields["filter"]; ok {
+		if len(fields) > 1 {
+			return nil, invalidSearchBody("The search body cannot contain other keys alongside 'filter'")
+		}
+		var filter models.UserFilter
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&filter)
+		if err != nil {
+			return nil, invalidSearchBody("Invalid filter: " + err.Error())
+		}
+		return &filter, nil
+	}
+
+	// Older clients send fields to match exactly, such as {"Email": "..."}
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	filter := models.UserFilter{}
+	for _, key := range keys {
+		filter.And = append(filter.And, models.UserFilter{Field: strings.ToLower(key), Op: "eq", Value: fields[key]})
+	}
+	return &filter, nil
+}
+
+func invalidSearchBody(message string) error {
+	return utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, message)
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/omar-ozgur/gram/utilities"
+	"testing"
+)
+
+func TestParseUserFilter(t *testing.T) {
+	filter, err := ParseUserFilter([]byte(`{"filter": {"field": "id", "op": "eq", "value": 1}}`))
+	if err != nil || filter == nil || filter.Field != "id" || filter.Op != "eq" {
+		t.Errorf("got %+v, %v", filter, err)
+	}
+
+	// Flat objects match every field exactly, in a stable order
+	filter, err = ParseUserFilter([]byte(`{"Last_name": "Doe", "First_name": "Jane"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(filter)
+	if want := `{"and":[{"field":"first_name","op":"eq","value":"Jane"},{"field":"last_name","op":"eq","value":"Doe"}]}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, body := range []string{"", " ", "{}"} {
+		if filter, err := ParseUserFilter([]byte(body)); filter != nil || err != nil {
+			t.Errorf("%q: got %+v, %v, want no filter", body, filter, err)
+		}
+	}
+
+	for _, body := range []string{
+		`[]`,
+		`"email"`,
+		`{"filter": {"field": "id", "op": "eq", "value": 1}, "email": "x"}`,
+		`{"filter": {"field": "id", "op": "eq", "value": 1, "sql": "1=1"}}`,
+		`{"filter": []}`,
+	} {
+		_, err := ParseUserFilter([]byte(body))
+		if err == nil || utilities.AsError(err).Code != utilities.CodeInvalidRequest {
+			t.Errorf("%s: got %v, want invalid_request", body, err)
+		}
+	}
+}
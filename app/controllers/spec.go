@@ -0,0 +1,796 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/events"
+	"github.com/omar-ozgur/gram/openapi"
+	"github.com/omar-ozgur/gram/scim"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+)
+
+// Operations describe every route in the OpenAPI document, keyed by method and path
+var Operations = map[string]openapi.Operation{
+	"POST /signup": {
+		OperationID: "createUser",
+		Summary:     "Sign up",
+		Description: "Creates a user. Which identifiers are required depends on the service's login_identifiers and required_identifiers.",
+		Tags:        []string{"Users"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON("application/json", openapi.Ref("UserInput"))},
+		Responses: map[string]openapi.Response{
+			"201": {Description: "The created user", Headers: etagHeader, Content: openapi.JSON("application/json", openapi.Ref("UserResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeInvalidRequest, utilities.CodeValidationFailed},
+			http.StatusForbidden:  {utilities.CodeSignupDisabled},
+			http.StatusConflict:   {utilities.CodeUserConflict},
+		},
+	},
+	"POST /login": {
+		OperationID: "login",
+		Summary:     "Log in",
+		Description: "Returns a signed JWT for the user identified by the first of Email, Username or Phone that is given. Services that authenticate against an LDAP directory create users the first time they log in.",
+		Tags:        []string{"Users"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON("application/json", openapi.Ref("Credentials"))},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A token for the user", Content: openapi.JSON("application/json", openapi.Ref("TokenResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest:         {utilities.CodeInvalidRequest, utilities.CodeValidationFailed},
+			http.StatusUnauthorized:       {utilities.CodeInvalidCredentials},
+			http.StatusForbidden:          {utilities.CodeForbidden},
+			http.StatusServiceUnavailable: {utilities.CodeDirectoryUnavailable},
+		},
+	},
+	"GET /profile": {
+		OperationID: "getProfile",
+		Summary:     "Get the current user",
+		Tags:        []string{"Users"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The user the token was issued to", Headers: etagHeader, Content: openapi.JSON("application/json", openapi.Ref("UserResponse"))},
+		},
+		Errors: map[int][]string{http.StatusNotFound: {utilities.CodeUserNotFound}},
+	},
+	"GET /users": {
+		OperationID: "listUsers",
+		Summary:     "List users",
+		Description: "Returns users one page at a time. The Link header contains the first and next page URLs.",
+		Tags:        []string{"Users"},
+		Parameters:  listParameters,
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A page of users", Headers: linkHeader, Content: openapi.JSON("application/json", openapi.Ref("UserPage"))},
+		},
+		Errors: map[int][]string{http.StatusBadRequest: {utilities.CodeValidationFailed, utilities.CodeInvalidSearch}},
+	},
+	"POST /users/search": {
+		OperationID: "searchUsers",
+		Summary:     "Search users",
+		Description: "Returns the users matching a filter, one page at a time. Only admins can search by fields that are hidden from the public.",
+		Tags:        []string{"Users"},
+		Parameters:  listParameters,
+		RequestBody: &openapi.RequestBody{Content: openapi.JSON("application/json", openapi.Ref("SearchRequest"))},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A page of matching users", Headers: linkHeader, Content: openapi.JSON("application/json", openapi.Ref("UserPage"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeInvalidRequest, utilities.CodeValidationFailed, utilities.CodeInvalidSearch},
+			http.StatusForbidden:  {utilities.CodeForbidden},
+		},
+	},
+	"GET /users/{id}": {
+		OperationID: "getUser",
+		Summary:     "Get a user",
+		Description: "Fields are hidden depending on whether the requester is the user, an admin or anyone else.",
+		Tags:        []string{"Users"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The user", Headers: etagHeader, Content: openapi.JSON("application/json", openapi.Ref("UserResponse"))},
+		},
+		Errors: map[int][]string{http.StatusNotFound: {utilities.CodeUserNotFound}},
+	},
+	"PUT /users/{id}": {
+		OperationID: "updateUser",
+		Summary:     "Update a user",
+		Description: "Changes the fields that are given and not empty.",
+		Tags:        []string{"Users"},
+		Parameters:  []openapi.Parameter{ifMatchParameter},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON("application/json", openapi.Ref("UserInput"))},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The updated user", Headers: etagHeader, Content: openapi.JSON("application/json", openapi.Ref("UserResponse"))},
+		},
+		Errors: updateErrors,
+	},
+	"PATCH /users/{id}": {
+		OperationID: "patchUser",
+		Summary:     "Patch a user",
+		Description: "Applies an RFC 7396 merge patch or an RFC 6902 JSON patch to the user's patch document.",
+		Tags:        []string{"Users"},
+		Parameters:  []openapi.Parameter{ifMatchParameter},
+		RequestBody: &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+			utilities.MergePatchType: {Schema: openapi.Ref("UserPatchDocument")},
+			utilities.JSONPatchType:  {Schema: openapi.Schema{"type": "array", "items": openapi.Ref("PatchOperation")}},
+		}},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The updated user", Headers: etagHeader, Content: openapi.JSON("application/json", openapi.Ref("UserResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest:           {utilities.CodeInvalidRequest, utilities.CodeValidationFailed},
+			http.StatusForbidden:            {utilities.CodeForbidden},
+			http.StatusNotFound:             {utilities.CodeUserNotFound},
+			http.StatusConflict:             {utilities.CodeUserConflict, utilities.CodePatchFailed},
+			http.StatusPreconditionFailed:   {utilities.CodePreconditionFailed},
+			http.StatusUnsupportedMediaType: {utilities.CodeUnsupportedMedia},
+		},
+	},
+	"DELETE /users/{id}": {
+		OperationID: "deleteUser",
+		Summary:     "Delete a user",
+		Tags:        []string{"Users"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The user was deleted", Content: openapi.JSON("application/json", openapi.Ref("StatusResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusForbidden: {utilities.CodeForbidden},
+			http.StatusNotFound:  {utilities.CodeUserNotFound},
+		},
+	},
+	"GET /auth/{provider}": {
+		OperationID: "startFederatedLogin",
+		Summary:     "Log in with an identity provider",
+		Description: "Redirects the browser to the provider, with a state, a PKCE code challenge and, for OpenID Connect providers, a nonce. The state is also set in a cookie, which the callback checks.",
+		Tags:        []string{"Federation"},
+		Parameters: []openapi.Parameter{
+			{Name: "return_to", In: "query", Description: "One of the service's return URLs, to send the browser back to with the result of the login", Schema: openapi.Schema{"type": "string", "format": "uri"}},
+		},
+		Responses: map[string]openapi.Response{
+			"302": {Description: "A redirect to the provider", Headers: locationHeader},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest:         {utilities.CodeValidationFailed},
+			http.StatusNotFound:           {utilities.CodeProviderNotFound},
+			http.StatusServiceUnavailable: {utilities.CodeProviderUnavailable},
+		},
+	},
+	"GET /auth/{provider}/callback": {
+		OperationID: "finishFederatedLogin",
+		Summary:     "Finish a login with an identity provider",
+		Description: "The provider's redirect URL. Identities are linked to users the first time they log in: to the user with the same email if the provider verified it, or to a new user if signups are allowed. Otherwise a link token is returned, which a logged in user can link with POST /identities. Logins started with return_to are redirected there with token, link_token and provider, or error and error_description, in the URL fragment; other logins get the result as JSON.",
+		Tags:        []string{"Federation"},
+		Parameters: []openapi.Parameter{
+			{Name: "state", In: "query", Schema: openapi.Schema{"type": "string"}},
+			{Name: "code", In: "query", Schema: openapi.Schema{"type": "string"}},
+			{Name: "error", In: "query", Description: "Set by the provider when the login failed or was cancelled", Schema: openapi.Schema{"type": "string"}},
+		},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A token for the user, or a link token if the identity is not linked", Content: openapi.JSON("application/json", openapi.Ref("FederatedLoginResponse"))},
+			"302": {Description: "A redirect to the login's return_to, with the result in the fragment", Headers: locationHeader},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest:         {utilities.CodeInvalidLoginState},
+			http.StatusUnauthorized:       {utilities.CodeFederationFailed},
+			http.StatusForbidden:          {utilities.CodeForbidden},
+			http.StatusNotFound:           {utilities.CodeProviderNotFound},
+			http.StatusConflict:           {utilities.CodeIdentityConflict},
+			http.StatusServiceUnavailable: {utilities.CodeProviderUnavailable},
+		},
+	},
+	"GET /identities": {
+		OperationID: "listIdentities",
+		Summary:     "List the current user's identities",
+		Description: "Returns the identity provider accounts linked to the user the token was issued to.",
+		Tags:        []string{"Federation"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The user's identities", Content: openapi.JSON("application/json", openapi.Ref("IdentityList"))},
+		},
+	},
+	"POST /identities": {
+		OperationID: "linkIdentity",
+		Summary:     "Link an identity to the current user",
+		Description: "Links the identity provider account of a link token, returned by a login that could not be linked automatically, to the user the token was issued to. Link tokens can only be used once, within 10 minutes.",
+		Tags:        []string{"Federation"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON("application/json", openapi.Schema{
+			"type":       "object",
+			"required":   []string{"link_token"},
+			"properties": map[string]interface{}{"link_token": openapi.Schema{"type": "string"}},
+		})},
+		Responses: map[string]openapi.Response{
+			"201": {Description: "The identity was linked", Content: openapi.JSON("application/json", openapi.Ref("IdentityResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeInvalidRequest, utilities.CodeInvalidLinkToken},
+			http.StatusNotFound:   {utilities.CodeUserNotFound, utilities.CodeProviderNotFound},
+			http.StatusConflict:   {utilities.CodeIdentityConflict},
+		},
+	},
+	"DELETE /identities/{provider}": {
+		OperationID: "unlinkIdentity",
+		Summary:     "Unlink an identity from the current user",
+		Tags:        []string{"Federation"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The identity was unlinked", Content: openapi.JSON("application/json", openapi.Ref("StatusResponse"))},
+		},
+		Errors: map[int][]string{http.StatusNotFound: {utilities.CodeIdentityNotFound}},
+	},
+	"GET /openapi.json": {
+		OperationID: "getOpenAPI",
+		Summary:     "Get this OpenAPI document",
+		Tags:        []string{"Documentation"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The OpenAPI 3.1 document", Content: openapi.JSON("application/json", openapi.Schema{"type": "object"})},
+		},
+	},
+	"GET /metrics": {
+		OperationID: "getMetrics",
+		Summary:     "Get Prometheus metrics",
+		Description: "Only served here when server.admin_address is not set.",
+		Tags:        []string{"Operations"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "Metrics in the Prometheus text format", Content: openapi.JSON("text/plain", openapi.Schema{"type": "string"})},
+		},
+	},
+	"GET /healthz": {
+		OperationID: "getHealth",
+		Summary:     "Check that the server is alive",
+		Description: "Passes as long as the process is running, including while it shuts down. Use it as a liveness probe.",
+		Tags:        []string{"Operations"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The server is alive", Content: openapi.JSON("application/json", openapi.Ref("StatusResponse"))},
+		},
+	},
+	"GET /readyz": {
+		OperationID: "getReadiness",
+		Summary:     "Check that the server can handle requests",
+		Description: "Fails if the database is unreachable, migrations are pending, the signing key is not loaded, or the server is shutting down. Use it as a readiness probe.",
+		Tags:        []string{"Operations"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The server is ready", Content: openapi.JSON("application/json", openapi.Ref("StatusResponse"))},
+		},
+		Errors: map[int][]string{http.StatusServiceUnavailable: {utilities.CodeNotReady}},
+	},
+	"GET /status": {
+		OperationID: "getStatus",
+		Summary:     "Get the status of each component and the build",
+		Description: "Only admins can view the status: requests on server.admin_address, mapped client certificates, and tokens of admin users. Only served here when server.admin_address is not set.",
+		Tags:        []string{"Operations"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "The server status", Content: openapi.JSON("application/json", openapi.Ref("ServerStatus"))},
+		},
+		Errors: map[int][]string{http.StatusForbidden: {utilities.CodeForbidden}},
+	},
+	"GET /events": {
+		OperationID: "streamEvents",
+		Summary:     "Stream events",
+		Description: "Streams the service's user and login events as Server-Sent Events, with the event id, the event type, and an Event as the data. The stream starts after the newest event, or after the given event id, and ends periodically; EventSource clients reconnect with the Last-Event-ID header to resume. Only admins can stream events.",
+		Tags:        []string{"Events"},
+		Parameters: []openapi.Parameter{
+			{Name: "types", In: "query", Description: "A comma-separated list of event types to stream; every type if omitted", Schema: openapi.Schema{"type": "string"}},
+			{Name: "last_event_id", In: "query", Description: "Stream the events after this id", Schema: openapi.Schema{"type": "integer", "minimum": 0}},
+			{Name: "Last-Event-ID", In: "header", Description: "Sent by reconnecting clients; takes precedence over last_event_id", Schema: openapi.Schema{"type": "integer", "minimum": 0}},
+		},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A stream of events", Content: openapi.JSON("text/event-stream", openapi.Schema{"type": "string"})},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeValidationFailed},
+			http.StatusForbidden:  {utilities.CodeForbidden},
+		},
+	},
+	"GET /audit": {
+		OperationID: "listAuditEvents",
+		Summary:     "List audit events",
+		Description: "Returns logins, failed logins, signups, updates and deletions, newest first. The Link header contains the first and next page URLs. Only admins can view the audit log; only served here when server.admin_address is not set.",
+		Tags:        []string{"Operations"},
+		Parameters: []openapi.Parameter{
+			{Name: "actor", In: "query", Description: "Who made the request, such as user:5, client:billing or anonymous", Schema: openapi.Schema{"type": "string"}},
+			{Name: "target", In: "query", Description: "The affected user, such as user:5", Schema: openapi.Schema{"type": "string"}},
+			{Name: "action", In: "query", Schema: openapi.Schema{"type": "string", "enum": []string{models.AuditLoginSucceeded, models.AuditLoginFailed, models.AuditUserCreated, models.AuditUserUpdated, models.AuditUserDeleted, models.AuditGroupCreated, models.AuditGroupUpdated, models.AuditGroupDeleted, models.AuditWebhookRedelivered, models.AuditIdentityLinked, models.AuditIdentityUnlinked}}},
+			{Name: "request_id", In: "query", Description: "The X-Request-ID of the request", Schema: openapi.Schema{"type": "string"}},
+			{Name: "since", In: "query", Schema: openapi.Schema{"type": "string", "format": "date-time"}},
+			{Name: "until", In: "query", Schema: openapi.Schema{"type": "string", "format": "date-time"}},
+			{Name: "limit", In: "query", Schema: openapi.Schema{"type": "integer", "minimum": 1, "maximum": utilities.MaxPageLimit, "default": utilities.DefaultPageLimit}},
+			{Name: "cursor", In: "query", Description: "The next_cursor of the previous page", Schema: openapi.Schema{"type": "string"}},
+		},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A page of audit events", Headers: linkHeader, Content: openapi.JSON("application/json", openapi.Ref("AuditPage"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeValidationFailed},
+			http.StatusForbidden:  {utilities.CodeForbidden},
+		},
+	},
+	"GET /webhooks/deliveries": {
+		OperationID: "listWebhookDeliveries",
+		Summary:     "List webhook deliveries",
+		Description: "Returns deliveries newest first; use status=dead to find deliveries that ran out of attempts. The Link header contains the first and next page URLs. Only admins can view deliveries; only served here when server.admin_address is not set.",
+		Tags:        []string{"Operations"},
+		Parameters: []openapi.Parameter{
+			{Name: "status", In: "query", Schema: openapi.Schema{"type": "string", "enum": []string{models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead}}},
+			{Name: "webhook", In: "query", Description: "The name of the webhook in the service's config", Schema: openapi.Schema{"type": "string"}},
+			{Name: "limit", In: "query", Schema: openapi.Schema{"type": "integer", "minimum": 1, "maximum": utilities.MaxPageLimit, "default": utilities.DefaultPageLimit}},
+			{Name: "cursor", In: "query", Description: "The next_cursor of the previous page", Schema: openapi.Schema{"type": "string"}},
+		},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "A page of webhook deliveries", Headers: linkHeader, Content: openapi.JSON("application/json", openapi.Ref("WebhookDeliveryPage"))},
+		},
+		Errors: map[int][]string{
+			http.StatusBadRequest: {utilities.CodeValidationFailed},
+			http.StatusForbidden:  {utilities.CodeForbidden},
+		},
+	},
+	"POST /webhooks/deliveries/{id}/redeliver": {
+		OperationID: "redeliverWebhook",
+		Summary:     "Send a webhook delivery again",
+		Description: "Queues the delivery to be sent now with a fresh set of attempts, such as a dead delivery after its receiver has been fixed. Only admins can redeliver webhooks.",
+		Tags:        []string{"Operations"},
+		Responses: map[string]openapi.Response{
+			"202": {Description: "The queued delivery", Content: openapi.JSON("application/json", openapi.Ref("WebhookDeliveryResponse"))},
+		},
+		Errors: map[int][]string{
+			http.StatusForbidden: {utilities.CodeForbidden},
+			http.StatusNotFound:  {utilities.CodeDeliveryNotFound},
+		},
+	},
+	"GET /docs": {
+		OperationID: "getDocs",
+		Summary:     "Browse the API documentation",
+		Tags:        []string{"Documentation"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "An HTML page that renders this document", Content: openapi.JSON("text/html", openapi.Schema{"type": "string"})},
+		},
+	},
+	"GET /scim/v2/ServiceProviderConfig": scimOperation("getSCIMServiceProviderConfig", "Describe SCIM support",
+		"Returns the SCIM features Gram supports: filtering, PATCH and ETags, but not bulk operations or sorting.",
+		nil, nil, scimResponse("200", "The service provider configuration", openapi.Schema{"type": "object"}), nil),
+	"GET /scim/v2/ResourceTypes": scimOperation("listSCIMResourceTypes", "List SCIM resource types", "Returns the User and Group resource types.",
+		nil, nil, scimResponse("200", "The resource types", openapi.Ref("SCIMListResponse")), nil),
+	"GET /scim/v2/ResourceTypes/{id}": scimOperation("getSCIMResourceType", "Get a SCIM resource type", "", nil, nil,
+		scimResponse("200", "The resource type", openapi.Schema{"type": "object"}), map[int][]string{http.StatusNotFound: {"not found"}}),
+	"GET /scim/v2/Schemas": scimOperation("listSCIMSchemas", "List SCIM schemas", "Returns the attributes of users and groups that Gram stores.",
+		nil, nil, scimResponse("200", "The schemas", openapi.Ref("SCIMListResponse")), nil),
+	"GET /scim/v2/Schemas/{id}": scimOperation("getSCIMSchema", "Get a SCIM schema", "The id is the schema's URN.", nil, nil,
+		scimResponse("200", "The schema", openapi.Schema{"type": "object"}), map[int][]string{http.StatusNotFound: {"not found"}}),
+	"GET /scim/v2/Users": scimOperation("listSCIMUsers", "List users for provisioning",
+		"Filters by userName, name.givenName, name.familyName, emails, phoneNumbers, active, externalId, id, meta.created and meta.lastModified. Results are ordered by id and paged by startIndex and count.",
+		scimListParameters, nil, scimResponse("200", "A page of users", openapi.Ref("SCIMListResponse")),
+		map[int][]string{http.StatusBadRequest: {scim.ErrInvalidFilter, scim.ErrInvalidValue}}),
+	"POST /scim/v2/Users": scimOperation("createSCIMUser", "Provision a user",
+		"Creates a user whether or not the service allows signups. Users created without a password cannot log in with one until it is set.",
+		scimResourceParameters, scimRequest(openapi.Ref("SCIMUser")), scimResponse("201", "The created user", openapi.Ref("SCIMUser")),
+		map[int][]string{http.StatusBadRequest: {scim.ErrInvalidSyntax, scim.ErrInvalidValue}, http.StatusConflict: {scim.ErrUniqueness}}),
+	"GET /scim/v2/Users/{id}": scimOperation("getSCIMUser", "Get a provisioned user", "", scimResourceParameters, nil,
+		scimResponse("200", "The user", openapi.Ref("SCIMUser")), map[int][]string{http.StatusNotFound: {utilities.CodeUserNotFound}}),
+	"PUT /scim/v2/Users/{id}": scimOperation("replaceSCIMUser", "Replace a provisioned user",
+		"Replaces the user's provisioned attributes. Attributes that are left out are cleared, except active and password, which are left unchanged.",
+		append(scimResourceParameters, scimIfMatchParameter), scimRequest(openapi.Ref("SCIMUser")), scimResponse("200", "The updated user", openapi.Ref("SCIMUser")), scimUpdateErrors(utilities.CodeUserNotFound)),
+	"PATCH /scim/v2/Users/{id}": scimOperation("patchSCIMUser", "Patch a provisioned user",
+		"Applies add, replace and remove operations. Read-only attributes such as groups are ignored.",
+		append(scimResourceParameters, scimIfMatchParameter), scimRequest(openapi.Ref("SCIMPatchOp")), scimResponse("200", "The updated user", openapi.Ref("SCIMUser")), scimUpdateErrors(utilities.CodeUserNotFound)),
+	"DELETE /scim/v2/Users/{id}": scimOperation("deleteSCIMUser", "Delete a provisioned user",
+		"Deletes the user. To keep the user but stop them logging in, set active to false instead.", nil, nil,
+		map[string]openapi.Response{"204": {Description: "The user was deleted"}}, map[int][]string{http.StatusNotFound: {utilities.CodeUserNotFound}}),
+	"GET /scim/v2/Groups": scimOperation("listSCIMGroups", "List groups for provisioning",
+		"Filters by displayName, externalId, id, meta.created and meta.lastModified. Use excludedAttributes=members to leave out members.",
+		scimListParameters, nil, scimResponse("200", "A page of groups", openapi.Ref("SCIMListResponse")),
+		map[int][]string{http.StatusBadRequest: {scim.ErrInvalidFilter, scim.ErrInvalidValue}}),
+	"POST /scim/v2/Groups": scimOperation("createSCIMGroup", "Provision a group", "", scimResourceParameters, scimRequest(openapi.Ref("SCIMGroup")),
+		scimResponse("201", "The created group", openapi.Ref("SCIMGroup")),
+		map[int][]string{http.StatusBadRequest: {scim.ErrInvalidSyntax, scim.ErrInvalidValue}, http.StatusConflict: {scim.ErrUniqueness}}),
+	"GET /scim/v2/Groups/{id}": scimOperation("getSCIMGroup", "Get a provisioned group", "", scimResourceParameters, nil,
+		scimResponse("200", "The group", openapi.Ref("SCIMGroup")), map[int][]string{http.StatusNotFound: {utilities.CodeGroupNotFound}}),
+	"PUT /scim/v2/Groups/{id}": scimOperation("replaceSCIMGroup", "Replace a provisioned group", "Replaces the group's name, external id and members.",
+		append(scimResourceParameters, scimIfMatchParameter), scimRequest(openapi.Ref("SCIMGroup")), scimResponse("200", "The updated group", openapi.Ref("SCIMGroup")), scimUpdateErrors(utilities.CodeGroupNotFound)),
+	"PATCH /scim/v2/Groups/{id}": scimOperation("patchSCIMGroup", "Patch a provisioned group",
+		"Applies add, replace and remove operations. Members can be removed by a filter such as members[value eq \"42\"] or by listing them in the value. Returns 204 unless attributes are requested.",
+		append(scimResourceParameters, scimIfMatchParameter), scimRequest(openapi.Ref("SCIMPatchOp")),
+		map[string]openapi.Response{
+			"200": {Description: "The updated group, when attributes are requested", Content: openapi.JSON(scim.MediaType, openapi.Ref("SCIMGroup"))},
+			"204": {Description: "The group was updated"},
+		}, scimUpdateErrors(utilities.CodeGroupNotFound)),
+	"DELETE /scim/v2/Groups/{id}": scimOperation("deleteSCIMGroup", "Delete a provisioned group", "Deletes the group. Its members are not deleted.", nil, nil,
+		map[string]openapi.Response{"204": {Description: "The group was deleted"}}, map[int][]string{http.StatusNotFound: {utilities.CodeGroupNotFound}}),
+}
+
+var updateErrors = map[int][]string{
+	http.StatusBadRequest:         {utilities.CodeInvalidRequest, utilities.CodeValidationFailed},
+	http.StatusForbidden:          {utilities.CodeForbidden},
+	http.StatusNotFound:           {utilities.CodeUserNotFound},
+	http.StatusConflict:           {utilities.CodeUserConflict},
+	http.StatusPreconditionFailed: {utilities.CodePreconditionFailed},
+}
+
+var etagHeader = map[string]openapi.Header{
+	"ETag": {Description: "The user's version, for If-Match", Schema: openapi.Schema{"type": "string"}},
+}
+
+var locationHeader = map[string]openapi.Header{
+	"Location": {Schema: openapi.Schema{"type": "string", "format": "uri"}},
+}
+
+var linkHeader = map[string]openapi.Header{
+	"Link": {Description: "RFC 8288 links to the first and next pages", Schema: openapi.Schema{"type": "string"}},
+}
+
+var ifMatchParameter = openapi.Parameter{
+	Name:        "If-Match",
+	In:          "header",
+	Description: "Only apply the update if the user's ETag matches",
+	Schema:      openapi.Schema{"type": "string"},
+}
+
+var listParameters = []openapi.Parameter{
+	{Name: "limit", In: "query", Description: "The page size", Schema: openapi.Schema{"type": "integer", "minimum": 1, "maximum": utilities.MaxPageLimit, "default": utilities.DefaultPageLimit}},
+	{Name: "cursor", In: "query", Description: "The next_cursor of the previous page", Schema: openapi.Schema{"type": "string"}},
+	{Name: "sort", In: "query", Description: "The field to sort by, prefixed with - for descending order", Schema: openapi.Schema{"type": "string", "enum": []string{"id", "-id", "first_name", "-first_name", "last_name", "-last_name", "time_created", "-time_created"}, "default": "id"}},
+	{Name: "created_after", In: "query", Schema: openapi.Schema{"type": "string", "format": "date-time"}},
+	{Name: "created_before", In: "query", Schema: openapi.Schema{"type": "string", "format": "date-time"}},
+	{Name: "include_total", In: "query", Description: "Also return the number of matching users", Schema: openapi.Schema{"type": "boolean"}},
+}
+
+var identifierProperties = map[string]interface{}{
+	"Email":    openapi.Schema{"type": "string", "format": "email"},
+	"Username": openapi.Schema{"type": "string", "minLength": 3, "maxLength": 32},
+	"Phone":    openapi.Schema{"type": "string", "description": "An E.164 phone number", "examples": []string{"+14155550123"}},
+}
+
+func withIdentifiers(properties map[string]interface{}) map[string]interface{} {
+	for name, schema := range identifierProperties {
+		properties[name] = schema
+	}
+	return properties
+}
+
+// scimOperation describes a SCIM endpoint, which is authenticated by the service's SCIM token and returns SCIM errors.
+// Errors are listed by scimType, or by the code Gram reports in the detail.
+func scimOperation(id, summary, description string, parameters []openapi.Parameter, body *openapi.RequestBody, responses map[string]openapi.Response, errs map[int][]string) openapi.Operation {
+	all := map[int][]string{
+		http.StatusUnauthorized: {"the SCIM token is missing or wrong"},
+		http.StatusForbidden:    {"SCIM is not enabled for the service"},
+	}
+	for status, codes := range errs {
+		all[status] = codes
+	}
+	return openapi.Operation{
+		OperationID:  id,
+		Summary:      summary,
+		Description:  description,
+		Tags:         []string{"SCIM"},
+		Parameters:   parameters,
+		RequestBody:  body,
+		Responses:    responses,
+		Security:     []map[string][]string{{"scimToken": {}}},
+		Errors:       all,
+		ErrorContent: openapi.JSON(scim.MediaType, openapi.Ref("SCIMError")),
+	}
+}
+
+func scimRequest(schema openapi.Schema) *openapi.RequestBody {
+	return &openapi.RequestBody{Required: true, Content: openapi.JSON(scim.MediaType, schema)}
+}
+
+func scimResponse(status, description string, schema openapi.Schema) map[string]openapi.Response {
+	return map[string]openapi.Response{status: {Description: description, Content: openapi.JSON(scim.MediaType, schema)}}
+}
+
+func scimUpdateErrors(notFound string) map[int][]string {
+	return map[int][]string{
+		http.StatusBadRequest:         {scim.ErrInvalidSyntax, scim.ErrInvalidPath, scim.ErrInvalidValue, scim.ErrNoTarget, scim.ErrMutability},
+		http.StatusNotFound:           {notFound},
+		http.StatusConflict:           {scim.ErrUniqueness},
+		http.StatusPreconditionFailed: {utilities.CodePreconditionFailed},
+	}
+}
+
+var scimResourceParameters = []openapi.Parameter{
+	{Name: "attributes", In: "query", Description: "A comma-separated list of the attributes to return", Schema: openapi.Schema{"type": "string"}},
+	{Name: "excludedAttributes", In: "query", Description: "A comma-separated list of attributes to leave out", Schema: openapi.Schema{"type": "string"}},
+}
+
+var scimListParameters = append([]openapi.Parameter{
+	{Name: "filter", In: "query", Description: "A SCIM filter, such as userName eq \"bjensen@example.com\"", Schema: openapi.Schema{"type": "string", "maxLength": scim.MaxFilterLength}},
+	{Name: "startIndex", In: "query", Description: "The 1-based index of the first result", Schema: openapi.Schema{"type": "integer", "minimum": 1, "default": 1}},
+	{Name: "count", In: "query", Description: "The page size", Schema: openapi.Schema{"type": "integer", "minimum": 0, "maximum": utilities.MaxPageLimit, "default": utilities.DefaultPageLimit}},
+}, scimResourceParameters...)
+
+var scimIfMatchParameter = openapi.Parameter{
+	Name:        "If-Match",
+	In:          "header",
+	Description: "Only apply the update if meta.version matches",
+	Schema:      openapi.Schema{"type": "string"},
+}
+
+// Components are the schemas the operations refer to
+var Components = openapi.Components{
+	Schemas: map[string]openapi.Schema{
+		"User": {
+			"type":        "object",
+			"description": "A user. Email, Phone and Attributes are only visible to the user and admins.",
+			"properties": withIdentifiers(map[string]interface{}{
+				"Id":           openapi.Schema{"type": "integer"},
+				"First_name":   openapi.Schema{"type": "string"},
+				"Last_name":    openapi.Schema{"type": "string"},
+				"Attributes":   openapi.Schema{"type": "object", "description": "Custom attributes defined by the service's attribute schema"},
+				"Time_created": openapi.Schema{"type": "string", "format": "date-time"},
+				"Updated_at":   openapi.Schema{"type": "string", "format": "date-time"},
+				"Version":      openapi.Schema{"type": "integer"},
+			}),
+		},
+		"UserInput": {
+			"type": "object",
+			"properties": withIdentifiers(map[string]interface{}{
+				"First_name": openapi.Schema{"type": "string"},
+				"Last_name":  openapi.Schema{"type": "string"},
+				"Password":   openapi.Schema{"type": "string", "contentEncoding": "base64"},
+				"Attributes": openapi.Schema{"type": "object"},
+			}),
+		},
+		"UserPatchDocument": {
+			"type":        "object",
+			"description": "The document patches apply to. Null or removed fields are cleared, and Password is only changed if added.",
+			"properties": withIdentifiers(map[string]interface{}{
+				"First_name": openapi.Schema{"type": []string{"string", "null"}},
+				"Last_name":  openapi.Schema{"type": []string{"string", "null"}},
+				"Password":   openapi.Schema{"type": "string", "contentEncoding": "base64"},
+				"Attributes": openapi.Schema{"type": []string{"object", "null"}},
+			}),
+		},
+		"PatchOperation": {
+			"type":     "object",
+			"required": []string{"op", "path"},
+			"properties": map[string]interface{}{
+				"op":    openapi.Schema{"type": "string", "enum": []string{"add", "remove", "replace", "move", "copy", "test"}},
+				"path":  openapi.Schema{"type": "string", "description": "An RFC 6901 JSON pointer"},
+				"from":  openapi.Schema{"type": "string"},
+				"value": openapi.Schema{},
+			},
+		},
+		"Credentials": {
+			"type":     "object",
+			"required": []string{"Password"},
+			"properties": withIdentifiers(map[string]interface{}{
+				"Password": openapi.Schema{"type": "string", "contentEncoding": "base64"},
+			}),
+		},
+		"UserFilter": {
+			"type":        "object",
+			"description": "A condition on one field, or an and/or group of filters",
+			"properties": map[string]interface{}{
+				"and":   openapi.Schema{"type": "array", "items": openapi.Ref("UserFilter")},
+				"or":    openapi.Schema{"type": "array", "items": openapi.Ref("UserFilter")},
+				"field": openapi.Schema{"type": "string", "description": "id, first_name, last_name, email, username, phone, time_created or attributes.<name>"},
+				"op":    openapi.Schema{"type": "string", "enum": []string{"eq", "ne", "prefix", "contains", "in", "range"}},
+				"value": openapi.Schema{},
+			},
+		},
+		"SearchRequest": {
+			"oneOf": []interface{}{
+				openapi.Schema{"type": "object", "required": []string{"filter"}, "properties": map[string]interface{}{"filter": openapi.Ref("UserFilter")}},
+				openapi.Schema{"type": "object", "description": "Fields that must all be equal, such as {\"last_name\": \"Smith\"}"},
+			},
+		},
+		"StatusResponse": statusResponse(nil),
+		"UserResponse":   statusResponse(map[string]interface{}{"user": openapi.Ref("User")}),
+		"TokenResponse":  statusResponse(map[string]interface{}{"token": openapi.Schema{"type": "string"}}),
+		"FederatedLoginResponse": statusResponse(map[string]interface{}{
+			"token":      openapi.Schema{"type": "string", "description": "Set when the identity is linked to a user"},
+			"link_token": openapi.Schema{"type": "string", "description": "Set when the identity must be linked with POST /identities"},
+			"provider":   openapi.Schema{"type": "string"},
+		}),
+		"Identity": {
+			"type": "object",
+			"properties": map[string]interface{}{
+				"provider":   openapi.Schema{"type": "string"},
+				"subject":    openapi.Schema{"type": "string", "description": "The user's id with the provider"},
+				"email":      openapi.Schema{"type": "string", "description": "The email the provider gave when the identity was linked"},
+				"created_at": openapi.Schema{"type": "string", "format": "date-time"},
+			},
+		},
+		"IdentityResponse": statusResponse(map[string]interface{}{"identity": openapi.Ref("Identity")}),
+		"IdentityList":     statusResponse(map[string]interface{}{"identities": openapi.Schema{"type": "array", "items": openapi.Ref("Identity")}}),
+		"ComponentStatus": {
+			"type":     "object",
+			"required": []string{"name", "status", "latency_ms"},
+			"properties": map[string]interface{}{
+				"name":       openapi.Schema{"type": "string", "enum": []string{"server", "database", "migrations", "signing_keys"}},
+				"status":     openapi.Schema{"type": "string", "enum": []string{"pass", "fail"}},
+				"message":    openapi.Schema{"type": "string", "description": "Why the check failed"},
+				"latency_ms": openapi.Schema{"type": "number"},
+			},
+		},
+		"ServerStatus": statusResponse(map[string]interface{}{
+			"ready":         openapi.Schema{"type": "boolean"},
+			"shutting_down": openapi.Schema{"type": "boolean"},
+			"service":       openapi.Schema{"type": "string"},
+			"components":    openapi.Schema{"type": "array", "items": openapi.Ref("ComponentStatus")},
+			"build": openapi.Schema{"type": "object", "properties": map[string]interface{}{
+				"version":    openapi.Schema{"type": "string"},
+				"commit":     openapi.Schema{"type": "string"},
+				"build_time": openapi.Schema{"type": "string"},
+				"go_version": openapi.Schema{"type": "string"},
+			}},
+			"started_at":     openapi.Schema{"type": "string", "format": "date-time"},
+			"uptime_seconds": openapi.Schema{"type": "integer"},
+		}),
+		"AuditEvent": {
+			"type":        "object",
+			"description": "A security event. hash is the SHA-256 of prev_hash and the event's fields, chaining each event to the one before it.",
+			"properties": map[string]interface{}{
+				"id":         openapi.Schema{"type": "integer"},
+				"time":       openapi.Schema{"type": "string", "format": "date-time"},
+				"actor":      openapi.Schema{"type": "string"},
+				"target":     openapi.Schema{"type": "string"},
+				"action":     openapi.Schema{"type": "string"},
+				"details":    openapi.Schema{"type": "object", "description": "Such as the reason a login failed, or the fields an update changed"},
+				"ip":         openapi.Schema{"type": "string"},
+				"user_agent": openapi.Schema{"type": "string"},
+				"request_id": openapi.Schema{"type": "string"},
+				"prev_hash":  openapi.Schema{"type": "string", "description": "Hex"},
+				"hash":       openapi.Schema{"type": "string", "description": "Hex"},
+			},
+		},
+		"AuditPage": statusResponse(map[string]interface{}{
+			"events":      openapi.Schema{"type": "array", "items": openapi.Ref("AuditEvent")},
+			"next_cursor": openapi.Schema{"type": "string", "description": "Empty on the last page"},
+		}),
+		"Event": {
+			"type":        "object",
+			"description": "The body of a webhook delivery, signed in the X-Gram-Signature header, and the data of a streamed event",
+			"properties": map[string]interface{}{
+				"id":      openapi.Schema{"type": "integer"},
+				"type":    openapi.Schema{"type": "string", "enum": events.All},
+				"time":    openapi.Schema{"type": "string", "format": "date-time"},
+				"service": openapi.Schema{"type": "string"},
+				"data": openapi.Schema{"type": "object", "properties": map[string]interface{}{
+					"user":           openapi.Ref("User"),
+					"changed_fields": openapi.Schema{"type": "array", "items": openapi.Schema{"type": "string"}, "description": "Only for user.updated"},
+					"expires_at":     openapi.Schema{"type": "string", "format": "date-time", "description": "When the token expires; only for session.created"},
+				}},
+			},
+		},
+		"WebhookDelivery": {
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id":              openapi.Schema{"type": "integer"},
+				"webhook":         openapi.Schema{"type": "string"},
+				"status":          openapi.Schema{"type": "string", "enum": []string{models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead}},
+				"attempts":        openapi.Schema{"type": "integer"},
+				"next_attempt_at": openapi.Schema{"type": "string", "format": "date-time"},
+				"last_status":     openapi.Schema{"type": "integer", "description": "The HTTP status of the last attempt, or 0 if there was no response"},
+				"last_error":      openapi.Schema{"type": "string"},
+				"created_at":      openapi.Schema{"type": "string", "format": "date-time"},
+				"delivered_at":    openapi.Schema{"type": []string{"string", "null"}, "format": "date-time"},
+				"event":           openapi.Ref("Event"),
+			},
+		},
+		"WebhookDeliveryResponse": statusResponse(map[string]interface{}{"delivery": openapi.Ref("WebhookDelivery")}),
+		"WebhookDeliveryPage": statusResponse(map[string]interface{}{
+			"deliveries":  openapi.Schema{"type": "array", "items": openapi.Ref("WebhookDelivery")},
+			"next_cursor": openapi.Schema{"type": "string", "description": "Empty on the last page"},
+		}),
+		"SCIMUser": {
+			"type":        "object",
+			"description": "A user in the SCIM core User schema. userName is stored as the user's email or username, as scim.user_name configures.",
+			"required":    []string{"userName"},
+			"properties": map[string]interface{}{
+				"schemas":    openapi.Schema{"type": "array", "items": openapi.Schema{"type": "string"}},
+				"id":         openapi.Schema{"type": "string", "readOnly": true},
+				"externalId": openapi.Schema{"type": "string"},
+				"userName":   openapi.Schema{"type": "string"},
+				"name": openapi.Schema{"type": "object", "properties": map[string]interface{}{
+					"givenName":  openapi.Schema{"type": "string"},
+					"familyName": openapi.Schema{"type": "string"},
+					"formatted":  openapi.Schema{"type": "string", "readOnly": true},
+				}},
+				"displayName":  openapi.Schema{"type": "string", "readOnly": true},
+				"emails":       openapi.Schema{"type": "array", "items": openapi.Ref("SCIMMultiValue")},
+				"phoneNumbers": openapi.Schema{"type": "array", "items": openapi.Ref("SCIMMultiValue")},
+				"active":       openapi.Schema{"type": "boolean", "description": "Inactive users cannot log in"},
+				"password":     openapi.Schema{"type": "string", "writeOnly": true},
+				"groups":       openapi.Schema{"type": "array", "readOnly": true, "items": openapi.Ref("SCIMReference")},
+				"meta":         openapi.Ref("SCIMMeta"),
+			},
+		},
+		"SCIMGroup": {
+			"type":     "object",
+			"required": []string{"displayName"},
+			"properties": map[string]interface{}{
+				"schemas":     openapi.Schema{"type": "array", "items": openapi.Schema{"type": "string"}},
+				"id":          openapi.Schema{"type": "string", "readOnly": true},
+				"externalId":  openapi.Schema{"type": "string"},
+				"displayName": openapi.Schema{"type": "string"},
+				"members":     openapi.Schema{"type": "array", "items": openapi.Ref("SCIMReference")},
+				"meta":        openapi.Ref("SCIMMeta"),
+			},
+		},
+		"SCIMMultiValue": {
+			"type":        "object",
+			"description": "Gram stores one value, which is returned as the primary work value",
+			"properties": map[string]interface{}{
+				"value":   openapi.Schema{"type": "string"},
+				"type":    openapi.Schema{"type": "string"},
+				"primary": openapi.Schema{"type": "boolean"},
+			},
+		},
+		"SCIMReference": {
+			"type": "object",
+			"properties": map[string]interface{}{
+				"value":   openapi.Schema{"type": "string", "description": "The id of the user or group"},
+				"$ref":    openapi.Schema{"type": "string", "format": "uri", "readOnly": true},
+				"display": openapi.Schema{"type": "string", "readOnly": true},
+			},
+		},
+		"SCIMMeta": {
+			"type":     "object",
+			"readOnly": true,
+			"properties": map[string]interface{}{
+				"resourceType": openapi.Schema{"type": "string"},
+				"created":      openapi.Schema{"type": "string", "format": "date-time"},
+				"lastModified": openapi.Schema{"type": "string", "format": "date-time"},
+				"location":     openapi.Schema{"type": "string", "format": "uri"},
+				"version":      openapi.Schema{"type": "string", "description": "The resource's ETag, for If-Match"},
+			},
+		},
+		"SCIMListResponse": {
+			"type": "object",
+			"properties": map[string]interface{}{
+				"schemas":      openapi.Schema{"type": "array", "items": openapi.Schema{"const": scim.ListResponseSchema}},
+				"totalResults": openapi.Schema{"type": "integer"},
+				"startIndex":   openapi.Schema{"type": "integer"},
+				"itemsPerPage": openapi.Schema{"type": "integer"},
+				"Resources":    openapi.Schema{"type": "array", "items": openapi.Schema{"type": "object"}},
+			},
+		},
+		"SCIMPatchOp": {
+			"type":     "object",
+			"required": []string{"schemas", "Operations"},
+			"properties": map[string]interface{}{
+				"schemas": openapi.Schema{"type": "array", "items": openapi.Schema{"const": scim.PatchOpSchema}},
+				"Operations": openapi.Schema{"type": "array", "minItems": 1, "items": openapi.Schema{
+					"type":     "object",
+					"required": []string{"op"},
+					"properties": map[string]interface{}{
+						"op":    openapi.Schema{"type": "string", "enum": []string{"add", "replace", "remove"}},
+						"path":  openapi.Schema{"type": "string", "examples": []string{"name.givenName", `members[value eq "42"]`}},
+						"value": openapi.Schema{},
+					},
+				}},
+			},
+		},
+		"SCIMError": {
+			"type":     "object",
+			"required": []string{"schemas", "status"},
+			"properties": map[string]interface{}{
+				"schemas":  openapi.Schema{"type": "array", "items": openapi.Schema{"const": scim.ErrorSchema}},
+				"status":   openapi.Schema{"type": "string", "description": "The HTTP status code"},
+				"scimType": openapi.Schema{"type": "string"},
+				"detail":   openapi.Schema{"type": "string"},
+			},
+		},
+		"UserPage": statusResponse(map[string]interface{}{
+			"users":       openapi.Schema{"type": "array", "items": openapi.Ref("User")},
+			"next_cursor": openapi.Schema{"type": "string", "description": "Empty on the last page"},
+			"total":       openapi.Schema{"type": "integer", "description": "Only returned when include_total=true"},
+		}),
+	},
+	SecuritySchemes: map[string]openapi.SecurityScheme{
+		"scimToken": {Type: "http", Scheme: "bearer", Description: "The service's scim.token, for identity providers"},
+	},
+}
+
+func statusResponse(properties map[string]interface{}) openapi.Schema {
+	if properties == nil {
+		properties = make(map[string]interface{})
+	}
+	properties["status"] = openapi.Schema{"type": "string", "const": "success"}
+	properties["message"] = openapi.Schema{"type": "string"}
+	return openapi.Schema{"type": "object", "required": []string{"status", "message"}, "properties": properties}
+}
+
+// OpenAPIDocument is the document served by OpenAPIShow, built from the route table when the router is created
+var OpenAPIDocument *openapi.Document
+
+var OpenAPIShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	JSON, _ := json.Marshal(OpenAPIDocument)
+	w.Write(JSON)
+})
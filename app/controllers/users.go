@@ -2,7 +2,6 @@ package controllers
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/omar-ozgur/gram/app/models"
 	"github.com/omar-ozgur/gram/utilities"
@@ -10,155 +9,241 @@ import (
 	"net/http"
 )
 
-var UsersCreate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// readJSON decodes a request body, reporting malformed JSON as an invalid request
+func readJSON(r *http.Request, v interface{}) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, "The request body could not be read")
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidRequest, "The request body must be valid JSON: "+err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body map[string]interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	JSON, _ := json.Marshal(body)
+	w.Write(JSON)
+}
 
+var UsersCreate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	var user models.User
-	b, _ := ioutil.ReadAll(r.Body)
-	json.Unmarshal(b, &user)
+	err := readJSON(r, &user)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	status, message, createdUser := models.CreateUser(user)
+	createdUser, err := models.CreateUser(r.Context(), user)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"user":    createdUser,
+	w.Header().Set("ETag", createdUser.ETag())
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":  "success",
+		"message": "User created",
+		"user":    createdUser.View(models.VisibilitySelf),
 	})
-	w.Write(JSON)
 })
 
 var UsersLogin = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	var user models.User
-	b, _ := ioutil.ReadAll(r.Body)
-	json.Unmarshal(b, &user)
+	err := readJSON(r, &user)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	status, message, loginToken := models.LoginUser(user)
+	loginToken, err := models.LoginUser(r.Context(), user)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Logged in",
 		"token":   loginToken,
 	})
-	w.Write(JSON)
 })
 
 var UsersProfile = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	claims := utilities.GetClaims(r.Header.Get("Authorization")[len("Bearer "):])
-	current_user_id := fmt.Sprintf("%v", claims["user_id"])
+	current_user_id, _ := GetCurrentUserId(r)
 
-	status, message, retrievedUser := models.GetUser(current_user_id)
+	retrievedUser, err := models.GetUser(r.Context(), current_user_id)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"user":    retrievedUser,
+	w.Header().Set("ETag", retrievedUser.ETag())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Retrieved user",
+		"user":    viewUser(r, retrievedUser),
 	})
-	w.Write(JSON)
 })
 
-var UsersIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func writeUserPage(w http.ResponseWriter, r *http.Request, params models.UserListParams) {
+	page, err := models.GetUsers(r.Context(), params)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":      "success",
+		"message":     "Retrieved users",
+		"users":       viewUsers(r, page.Users),
+		"next_cursor": page.NextCursor,
+	}
+	if page.Total != nil {
+		response["total"] = *page.Total
+	}
+	SetLinkHeader(w, r, page.NextCursor)
 
-	status, message, retrievedUsers := models.GetUsers()
+	writeJSON(w, http.StatusOK, response)
+}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"users":   retrievedUsers,
-	})
-	w.Write(JSON)
+var UsersIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	params, err := ParseUserListParams(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	writeUserPage(w, r, params)
 })
 
 var UsersSearch = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	params, err := ParseUserListParams(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
 	b, _ := ioutil.ReadAll(r.Body)
-	params := make(map[string]interface{})
-
-	json.Unmarshal(b, &params)
+	filter, err := ParseUserFilter(b)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	status, message, retrievedUsers := models.SearchUsers(params, "AND")
+	if filter != nil {
+		params.Filter = filter
+		params.Visibility = GetSearchVisibility(r)
+		_, _, err = filter.Compile(params.Visibility, nil)
+		if err != nil {
+			utilities.WriteProblem(w, r, err)
+			return
+		}
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"users":   retrievedUsers,
-	})
-	w.Write(JSON)
+	writeUserPage(w, r, params)
 })
 
 var UsersShow = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	vars := mux.Vars(r)
 
-	status, message, retrievedUser := models.GetUser(vars["id"])
+	retrievedUser, err := models.GetUser(r.Context(), vars["id"])
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"user":    retrievedUser,
+	w.Header().Set("ETag", retrievedUser.ETag())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Retrieved user",
+		"user":    viewUser(r, retrievedUser),
 	})
-	w.Write(JSON)
 })
 
 var UsersUpdate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+
+	current_user_id, _ := GetCurrentUserId(r)
+
+	if vars["id"] != current_user_id {
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, "You do not have permission to update this user"))
+		return
+	}
 
 	var user models.User
+	err := readJSON(r, &user)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	updatedUser, err := models.UpdateUser(r.Context(), vars["id"], user, r.Header.Get("If-Match"))
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", updatedUser.ETag())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "User updated",
+		"user":    viewUser(r, updatedUser),
+	})
+})
+
+var UsersPatch = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	b, _ := ioutil.ReadAll(r.Body)
-	json.Unmarshal(b, &user)
 
-	claims := utilities.GetClaims(r.Header.Get("Authorization")[len("Bearer "):])
-	current_user_id := fmt.Sprintf("%v", claims["user_id"])
+	current_user_id, _ := GetCurrentUserId(r)
 
 	if vars["id"] != current_user_id {
-		JSON, _ := json.Marshal(map[string]interface{}{
-			"status":  "error",
-			"message": "You do not have permission to update this user",
-			"user":    models.User{},
-		})
-		w.Write(JSON)
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, "You do not have permission to update this user"))
+		return
+	}
+
+	patch, err := ParsePatch(r)
+	if err != nil {
+		w.Header().Set("Accept-Patch", utilities.MergePatchType+", "+utilities.JSONPatchType)
+		utilities.WriteProblem(w, r, err)
 		return
 	}
 
-	status, message, updatedUser := models.UpdateUser(vars["id"], user)
+	updatedUser, err := models.PatchUser(r.Context(), vars["id"], patch, r.Header.Get("If-Match"))
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
-		"user":    updatedUser,
+	w.Header().Set("ETag", updatedUser.ETag())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "User updated",
+		"user":    viewUser(r, updatedUser),
 	})
-	w.Write(JSON)
 })
 
 var UsersDelete = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	vars := mux.Vars(r)
 
-	claims := utilities.GetClaims(r.Header.Get("Authorization")[len("Bearer "):])
-	current_user_id := fmt.Sprintf("%v", claims["user_id"])
+	current_user_id, _ := GetCurrentUserId(r)
 
 	if vars["id"] != current_user_id {
-		JSON, _ := json.Marshal(map[string]interface{}{
-			"status":  "error",
-			"message": "You do not have permission to delete this user",
-		})
-		w.Write(JSON)
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, "You do not have permission to delete this user"))
 		return
 	}
 
-	status, message := models.DeleteUser(vars["id"])
+	err := models.DeleteUser(r.Context(), vars["id"])
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
 
-	JSON, _ := json.Marshal(map[string]interface{}{
-		"status":  status,
-		"message": message,
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "User deleted",
 	})
-	w.Write(JSON)
 })
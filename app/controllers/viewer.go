@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/middleware"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GetCurrentUserId returns the id of the user authenticated by the request's bearer token, if any
+func GetCurrentUserId(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+
+	claims := utilities.GetClaims(header[len("Bearer "):])
+	switch id := claims["user_id"].(type) {
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprintf("%v", id), true
+	}
+}
+
+// RequireActiveUser rejects requests whose bearer token belongs to a user who has since been deactivated or deleted,
+// so that tokens stop working as soon as an identity provider deactivates their user
+func RequireActiveUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := GetCurrentUserId(r); ok {
+			active, err := models.IsActiveUser(r.Context(), id)
+			if err != nil {
+				utilities.WriteProblem(w, r, err)
+				return
+			}
+			if !active {
+				utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorUnauthorized, utilities.CodeUnauthorized, "The bearer token's user has been deactivated or deleted"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsAdmin reports whether the requester is an operator: a request on the loopback admin listener,
+// a client certificate mapped to one of the service's admin_identities, or a token issued to one of its admin users
+func IsAdmin(r *http.Request) bool {
+	if middleware.OnAdminListener(r) {
+		return true
+	}
+	if isAdminClient(r) {
+		return true
+	}
+	currentUserId, ok := GetCurrentUserId(r)
+	return ok && utilities.CurrentConfig().Policy().IsAdmin(currentUserId)
+}
+
+// requireAdmin writes a forbidden problem with the message and returns false unless the requester is an admin
+func requireAdmin(w http.ResponseWriter, r *http.Request, message string) bool {
+	if IsAdmin(r) {
+		return true
+	}
+	utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, message))
+	return false
+}
+
+// isAdminClient reports whether the request's client certificate is mapped to one of the service's
+// admin_identities. Other mapped certificates identify the client without granting it more access.
+func isAdminClient(r *http.Request) bool {
+	identity, ok := middleware.ClientIdentity(r)
+	return ok && utilities.CurrentConfig().Policy().IsAdminIdentity(identity)
+}
+
+// GetVisibility returns how much of a user the requester is allowed to see
+func GetVisibility(r *http.Request, user models.User) models.Visibility {
+	if isAdminClient(r) {
+		return models.VisibilityAdmin
+	}
+
+	currentUserId, ok := GetCurrentUserId(r)
+	if !ok {
+		return models.VisibilityPublic
+	}
+	if utilities.CurrentConfig().Policy().IsAdmin(currentUserId) {
+		return models.VisibilityAdmin
+	}
+	if currentUserId == strconv.Itoa(user.Id) {
+		return models.VisibilitySelf
+	}
+
+	return models.VisibilityPublic
+}
+
+// GetSearchVisibility returns the most restricted field the requester may search users by.
+// Only admins may search by fields that are hidden from the public.
+func GetSearchVisibility(r *http.Request) models.Visibility {
+	if isAdminClient(r) {
+		return models.VisibilityAdmin
+	}
+	if currentUserId, ok := GetCurrentUserId(r); ok && utilities.CurrentConfig().Policy().IsAdmin(currentUserId) {
+		return models.VisibilityAdmin
+	}
+	return models.VisibilityPublic
+}
+
+func viewUser(r *http.Request, user models.User) map[string]interface{} {
+	return user.View(GetVisibility(r, user))
+}
+
+func viewUsers(r *http.Request, users []models.User) []map[string]interface{} {
+	return models.ViewUsers(users, func(user models.User) models.Visibility {
+		return GetVisibility(r, user)
+	})
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/middleware"
+	"github.com/omar-ozgur/gram/utilities"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useViewerConfig maps two client certificates to identities, of which only ops is an admin, and makes user 1 an admin
+func useViewerConfig(t *testing.T) {
+	t.Helper()
+	previous := utilities.CurrentConfig()
+	t.Cleanup(func() { utilities.SetConfig(previous) })
+
+	config := utilities.DefaultConfig()
+	config.Tokens.Secret = "test-secret"
+	config.TLS.ClientIdentities = map[string]string{"billing": "service:billing", "ops": "service:ops"}
+	var policy utilities.ServicePolicy
+	policy.SetDefaults()
+	policy.AdminUserIds = []int{1}
+	policy.AdminIdentities = []string{"service:ops"}
+	config.Services = map[string]utilities.ServicePolicy{config.Server.Service: policy}
+	utilities.SetConfig(config)
+}
+
+// viewerRequest returns a request with a verified client certificate for the common name, if any, and a token for
+// the user id, if any, as it reaches the handlers
+func viewerRequest(t *testing.T, commonName string, userId int) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/v1/users/2", nil)
+	if commonName != "" {
+		certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+	}
+	if userId != 0 {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": userId, "exp": time.Now().Add(time.Hour).Unix()})
+		signed, err := token.SignedString([]byte("test-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+signed)
+	}
+
+	var mapped *http.Request
+	middleware.ClientCertMiddleware(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) { mapped = r })
+	return mapped
+}
+
+func TestGetVisibility(t *testing.T) {
+	useViewerConfig(t)
+	user := models.User{Id: 2}
+
+	cases := []struct {
+		name       string
+		commonName string
+		userId     int
+		want       models.Visibility
+	}{
+		{"anonymous", "", 0, models.VisibilityPublic},
+		{"the user", "", 2, models.VisibilitySelf},
+		{"another user", "", 3, models.VisibilityPublic},
+		{"admin user", "", 1, models.VisibilityAdmin},
+		{"client identity", "billing", 0, models.VisibilityPublic},
+		{"admin identity", "ops", 0, models.VisibilityAdmin},
+		{"unmapped certificate", "unknown", 0, models.VisibilityPublic},
+		{"client identity with the user's token", "billing", 2, models.VisibilitySelf},
+	}
+
+	for _, c := range cases {
+		r := viewerRequest(t, c.commonName, c.userId)
+		if got := GetVisibility(r, user); got != c.want {
+			t.Errorf("%s: got visibility %v, want %v", c.name, got, c.want)
+		}
+		wantSearch := models.VisibilityPublic
+		if c.want == models.VisibilityAdmin {
+			wantSearch = models.VisibilityAdmin
+		}
+		if got := GetSearchVisibility(r); got != wantSearch {
+			t.Errorf("%s: got search visibility %v, want %v", c.name, got, wantSearch)
+		}
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	useViewerConfig(t)
+
+	cases := []struct {
+		name       string
+		commonName string
+		userId     int
+		want       bool
+	}{
+		{"anonymous", "", 0, false},
+		{"user", "", 2, false},
+		{"admin user", "", 1, true},
+		{"client identity", "billing", 0, false},
+		{"admin identity", "ops", 0, true},
+	}
+
+	for _, c := range cases {
+		if got := IsAdmin(viewerRequest(t, c.commonName, c.userId)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	var onAdminListener bool
+	middleware.AdminListener(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		onAdminListener = IsAdmin(r)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status", nil))
+	if !onAdminListener {
+		t.Error("requests on the admin listener should be admin requests")
+	}
+}
+
+// activeUsersDB is a database/sql driver that answers IsActiveUser from a map of user ids to whether they are active
+type activeUsersDB map[string]bool
+
+func (d activeUsersDB) Open(string) (driver.Conn, error)             { return d, nil }
+func (d activeUsersDB) Connect(context.Context) (driver.Conn, error) { return d, nil }
+func (d activeUsersDB) Driver() driver.Driver                        { return d }
+func (d activeUsersDB) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unsupported statement: %s", query)
+}
+func (d activeUsersDB) Close() error { return nil }
+func (d activeUsersDB) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+func (d activeUsersDB) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT active FROM "+models.UserTableName+" WHERE id=$1") {
+		return nil, fmt.Errorf("unsupported statement: %s", query)
+	}
+	rows := &activeRows{}
+	if active, ok := d[args[0].Value.(string)]; ok {
+		rows.values = []bool{active}
+	}
+	return rows, nil
+}
+
+type activeRows struct {
+	values []bool
+}
+
+func (r *activeRows) Columns() []string { return []string{"active"} }
+func (r *activeRows) Close() error      { return nil }
+
+func (r *activeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func TestRequireActiveUser(t *testing.T) {
+	useViewerConfig(t)
+	previousDB := db.DB
+	db.DB = sql.OpenDB(activeUsersDB{"1": true, "2": false})
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = previousDB
+	})
+
+	cases := []struct {
+		name   string
+		userId int
+		status int
+	}{
+		{"anonymous", 0, http.StatusOK},
+		{"active user", 1, http.StatusOK},
+		{"deactivated user", 2, http.StatusUnauthorized},
+		{"deleted user", 3, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		RequireActiveUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, viewerRequest(t, "", c.userId))
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"strconv"
+)
+
+var deliveryStatuses = map[string]bool{models.DeliveryPending: true, models.DeliveryDelivered: true, models.DeliveryDead: true}
+
+// ParseWebhookDeliveryQuery reads the filters and paging parameters of a webhook delivery listing
+func ParseWebhookDeliveryQuery(r *http.Request) (query models.WebhookDeliveryQuery, err error) {
+	values := r.URL.Query()
+
+	query.Status = values.Get("status")
+	if query.Status != "" && !deliveryStatuses[query.Status] {
+		return query, invalidListParam("status", "status must be pending, delivered or dead")
+	}
+	query.Webhook = values.Get("webhook")
+	query.Cursor = values.Get("cursor")
+
+	query.Limit = utilities.DefaultPageLimit
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > utilities.MaxPageLimit {
+			return query, invalidListParam("limit", fmt.Sprintf("limit must be a number between 1 and %d", utilities.MaxPageLimit))
+		}
+	}
+
+	return query, nil
+}
+
+var WebhookDeliveriesIndex = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "Only admins can view webhook deliveries") {
+		return
+	}
+
+	query, err := ParseWebhookDeliveryQuery(r)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	page, err := models.ListWebhookDeliveries(r.Context(), query)
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	SetLinkHeader(w, r, page.NextCursor)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"message":     "Retrieved webhook deliveries",
+		"deliveries":  page.Deliveries,
+		"next_cursor": page.NextCursor,
+	})
+})
+
+var WebhookDeliveriesRedeliver = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "Only admins can redeliver webhooks") {
+		return
+	}
+
+	delivery, err := models.RedeliverWebhook(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		utilities.WriteProblem(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":   "success",
+		"message":  "Queued webhook delivery",
+		"delivery": delivery,
+	})
+})
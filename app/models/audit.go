@@ -0,0 +1,319 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditLoginSucceeded = "login.succeeded"
+	AuditLoginFailed    = "login.failed"
+	AuditUserCreated    = "user.created"
+	AuditUserUpdated    = "user.updated"
+	AuditUserDeleted    = "user.deleted"
+
+	AuditGroupCreated = "group.created"
+	AuditGroupUpdated = "group.updated"
+	AuditGroupDeleted = "group.deleted"
+
+	AuditIdentityLinked   = "identity.linked"
+	AuditIdentityUnlinked = "identity.unlinked"
+
+	AuditWebhookRedelivered = "webhook.redelivered"
+)
+
+var AuditTableName string
+
+const auditColumns = "id, time, actor, target, action, details, ip, user_agent, request_id, prev_hash, hash"
+
+// auditTimeFormat is the fixed precision that event times are hashed with; Postgres stores microseconds
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// genesisHash is the previous hash of the first event
+var genesisHash = make([]byte, sha256.Size)
+
+// AuditEvent is a security-relevant change, such as a login or an update to a user.
+// Each event includes the hash of the one before it, so that changing or removing an event breaks the chain.
+type AuditEvent struct {
+	Id        int64           `json:"id"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	Target    string          `json:"target"`
+	Action    string          `json:"action"`
+	Details   json.RawMessage `json:"details"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	RequestID string          `json:"request_id"`
+	PrevHash  []byte          `json:"-"`
+	Hash      []byte          `json:"-"`
+}
+
+// MarshalJSON shows hashes in hex
+func (event AuditEvent) MarshalJSON() ([]byte, error) {
+	type plain AuditEvent
+	return json.Marshal(struct {
+		plain
+		PrevHash string `json:"prev_hash"`
+		Hash     string `json:"hash"`
+	}{plain(event), hex.EncodeToString(event.PrevHash), hex.EncodeToString(event.Hash)})
+}
+
+// computeHash hashes the previous hash with every recorded field of the event
+func (event AuditEvent) computeHash() []byte {
+	fields, _ := json.Marshal([]string{
+		event.Time.UTC().Format(auditTimeFormat),
+		event.Actor,
+		event.Target,
+		event.Action,
+		string(event.Details),
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+	})
+	hash := sha256.New()
+	hash.Write(event.PrevHash)
+	hash.Write(fields)
+	return hash.Sum(nil)
+}
+
+func userTarget(id interface{}) string {
+	return fmt.Sprintf("user:%v", id)
+}
+
+func scanAuditEvent(row rowScanner) (event AuditEvent, err error) {
+	var details string
+	err = row.Scan(&event.Id, &event.Time, &event.Actor, &event.Target, &event.Action, &details, &event.IP, &event.UserAgent, &event.RequestID, &event.PrevHash, &event.Hash)
+	event.Details = json.RawMessage(details)
+	return
+}
+
+// recordAudit appends an event for the request in ctx. A failure to record is logged and counted rather than
+// failing the action it describes, such as a login, which has already happened.
+func recordAudit(ctx context.Context, action, target string, details map[string]interface{}) {
+	if err := appendAuditEvent(ctx, nil, newAuditEvent(ctx, action, target, details)); err != nil {
+		auditFailuresTotal.Inc()
+		utilities.Log(ctx).Error("Failed to record audit event", zap.String("action", action), zap.String("target", target), zap.Error(err))
+	}
+}
+
+// recordAuditInTx appends an event for the request in ctx in the transaction that makes the change it describes,
+// so that the event is recorded if and only if the change is
+func recordAuditInTx(ctx context.Context, tx *sql.Tx, action, target string, details map[string]interface{}) error {
+	if err := appendAuditEvent(ctx, tx, newAuditEvent(ctx, action, target, details)); err != nil {
+		auditFailuresTotal.Inc()
+		return utilities.NewInternalError("Failed to record audit event", err)
+	}
+	return nil
+}
+
+func newAuditEvent(ctx context.Context, action, target string, details map[string]interface{}) AuditEvent {
+	source := utilities.GetRequestSource(ctx)
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	detailsJSON, _ := json.Marshal(details)
+
+	return AuditEvent{
+		Time:      time.Now().UTC().Truncate(time.Microsecond),
+		Actor:     source.Actor(),
+		Target:    target,
+		Action:    action,
+		Details:   detailsJSON,
+		IP:        source.IP,
+		UserAgent: source.UserAgent,
+		RequestID: source.RequestID,
+	}
+}
+
+// appendAuditEvent links the event to the last one and inserts it in tx, or in its own transaction if tx is nil.
+// The lock orders concurrent appends, so that each event follows the one inserted before it, and is held until
+// the transaction ends.
+func appendAuditEvent(ctx context.Context, tx *sql.Tx, event AuditEvent) error {
+	if tx == nil {
+		tx, err := db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = appendAuditEvent(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	queryStr := fmt.Sprintf("INSERT INTO %s (time, actor, target, action, details, ip, user_agent, request_id, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);", AuditTableName)
+	ctx, done := startTableQuery(ctx, AuditTableName, "append_audit_event", queryStr, event.Time, event.Actor, event.Target, event.Action, string(event.Details), event.IP, event.UserAgent, event.RequestID)
+
+	err := func() error {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", AuditTableName)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT hash FROM %s ORDER BY id DESC LIMIT 1;", AuditTableName)).Scan(&event.PrevHash)
+		if err == sql.ErrNoRows {
+			event.PrevHash = genesisHash
+		} else if err != nil {
+			return err
+		}
+
+		event.Hash = event.computeHash()
+		_, err = tx.ExecContext(ctx, queryStr, event.Time, event.Actor, event.Target, event.Action, string(event.Details), event.IP, event.UserAgent, event.RequestID, event.PrevHash, event.Hash)
+		return err
+	}()
+	done(err)
+	return err
+}
+
+// AuditQuery filters the audit log. Empty fields match every event.
+type AuditQuery struct {
+	Actor     string
+	Target    string
+	Action    string
+	RequestID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Cursor    string
+}
+
+// AuditPage is a page of events, newest first
+type AuditPage struct {
+	Events     []AuditEvent
+	NextCursor string
+}
+
+// ListAuditEvents returns the events matching the query, newest first.
+// The cursor is the id of the last event of the previous page.
+func ListAuditEvents(ctx context.Context, query AuditQuery) (AuditPage, error) {
+	ctx, span := startOperation(ctx, "ListAuditEvents")
+	page, err := listAuditEvents(ctx, query)
+	span.Finish(err)
+	return page, err
+}
+
+func listAuditEvents(ctx context.Context, query AuditQuery) (AuditPage, error) {
+	var conditions []string
+	var values []interface{}
+	for _, filter := range []struct{ column, value string }{
+		{"actor", query.Actor},
+		{"target", query.Target},
+		{"action", query.Action},
+		{"request_id", query.RequestID},
+	} {
+		if filter.value != "" {
+			values = append(values, filter.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.column, len(values)))
+		}
+	}
+	if !query.Since.IsZero() {
+		values = append(values, query.Since)
+		conditions = append(conditions, fmt.Sprintf("time >= $%d", len(values)))
+	}
+	if !query.Until.IsZero() {
+		values = append(values, query.Until)
+		conditions = append(conditions, fmt.Sprintf("time < $%d", len(values)))
+	}
+	if query.Cursor != "" {
+		before, err := strconv.ParseInt(query.Cursor, 10, 64)
+		if err != nil || before < 1 {
+			return AuditPage{}, utilities.NewValidationError("The listing parameters are invalid", utilities.FieldError{
+				Field:   "cursor",
+				Code:    utilities.FieldInvalid,
+				Message: "The cursor is invalid",
+			})
+		}
+		values = append(values, before)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(values)))
+	}
+
+	// Fetch one extra event to find out whether there is a next page
+	values = append(values, query.Limit+1)
+	queryStr := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY id DESC LIMIT $%d;", auditColumns, AuditTableName, whereClause(conditions), len(values))
+	ctx, done := startTableQuery(ctx, AuditTableName, "list_audit_events", queryStr, values...)
+	rows, err := db.DB.QueryContext(ctx, queryStr, values...)
+	if err != nil {
+		done(err)
+		return AuditPage{}, utilities.NewInternalError("Failed to query the audit log", err)
+	}
+	defer rows.Close()
+
+	page := AuditPage{Events: []AuditEvent{}}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			done(err)
+			return AuditPage{}, utilities.NewInternalError("Failed to read the audit log", err)
+		}
+		page.Events = append(page.Events, event)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return AuditPage{}, utilities.NewInternalError("Failed to read the audit log", err)
+	}
+
+	if len(page.Events) > query.Limit {
+		page.Events = page.Events[:query.Limit]
+		page.NextCursor = strconv.FormatInt(page.Events[len(page.Events)-1].Id, 10)
+	}
+	return page, nil
+}
+
+// AuditVerification is the result of checking the audit log's hash chain
+type AuditVerification struct {
+	Events int
+	Head   []byte
+
+	// BrokenAt is the id of the first event that does not match the chain, or 0 if the chain is intact
+	BrokenAt int64
+	Problem  string
+}
+
+// VerifyAuditLog checks that every event follows the one before it and matches its hash.
+// Removing events from the end of the log cannot be detected from the log itself, so keep a copy of the head hash
+// elsewhere and compare it with later verifications.
+func VerifyAuditLog(ctx context.Context) (AuditVerification, error) {
+	queryStr := fmt.Sprintf("SELECT %s FROM %s ORDER BY id;", auditColumns, AuditTableName)
+	ctx, done := startTableQuery(ctx, AuditTableName, "verify_audit_log", queryStr)
+	rows, err := db.DB.QueryContext(ctx, queryStr)
+	if err != nil {
+		done(err)
+		return AuditVerification{}, err
+	}
+	defer rows.Close()
+
+	result := AuditVerification{Head: genesisHash}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			done(err)
+			return AuditVerification{}, err
+		}
+		if result.BrokenAt == 0 {
+			switch {
+			case !bytes.Equal(event.PrevHash, result.Head):
+				result.BrokenAt, result.Problem = event.Id, "its previous hash does not match the event before it, which was changed or removed"
+			case !bytes.Equal(event.Hash, event.computeHash()):
+				result.BrokenAt, result.Problem = event.Id, "its hash does not match its contents, which were changed"
+			}
+		}
+		result.Events++
+		result.Head = event.Hash
+	}
+	err = rows.Err()
+	done(err)
+	return result, err
+}
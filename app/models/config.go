@@ -1,9 +1,17 @@
 package models
 
 import (
+	"github.com/omar-ozgur/gram/db"
 	"github.com/omar-ozgur/gram/utilities"
 )
 
 func Init() {
-	UserTableName = utilities.Service
+	UserTableName = utilities.CurrentConfig().Server.Service
+	AuditTableName = db.AuditTable(UserTableName)
+	EventsTableName = db.EventsTable(UserTableName)
+	WebhookDeliveriesTableName = db.WebhookDeliveriesTable(UserTableName)
+	GroupsTableName = db.GroupsTable(UserTableName)
+	GroupMembersTableName = db.GroupMembersTable(UserTableName)
+	IdentitiesTableName = db.IdentitiesTable(UserTableName)
+	LoginFlowsTableName = db.LoginFlowsTable(UserTableName)
 }
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"sort"
+	"time"
+)
+
+var EventsTableName string
+
+// Event is a change to a user or a login, as delivered to webhooks and event streams
+type Event struct {
+	Id      int64           `json:"id"`
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Service string          `json:"service"`
+	Data    json.RawMessage `json:"data"`
+}
+
+const eventColumns = "id, type, time, data"
+
+func scanEvent(row rowScanner) (event Event, err error) {
+	var data string
+	err = row.Scan(&event.Id, &event.Type, &event.Time, &data)
+	event.Data = json.RawMessage(data)
+	event.Service = UserTableName
+	return
+}
+
+// inTransaction runs fn in a transaction, which is committed if fn succeeds
+func inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return utilities.NewInternalError("Failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utilities.NewInternalError("Failed to commit transaction", err)
+	}
+	return nil
+}
+
+// publishUserEvent adds an event to the outbox in the transaction that changes the user, so that the event is
+// recorded if and only if the change is
+func publishUserEvent(ctx context.Context, tx *sql.Tx, eventType string, user User, changedFields []string) error {
+	data := map[string]interface{}{"user": user.View(VisibilityAdmin)}
+	if changedFields != nil {
+		data["changed_fields"] = changedFields
+	}
+	return publishEvent(ctx, tx, eventType, data)
+}
+
+// publishEvent records an event, and queues a delivery for each webhook subscribed to it
+func publishEvent(ctx context.Context, tx *sql.Tx, eventType string, data map[string]interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return utilities.NewInternalError("Failed to encode event", err)
+	}
+
+	var eventId int64
+	queryStr := fmt.Sprintf("INSERT INTO %s (type, data, request_id) VALUES ($1, $2, $3) RETURNING id;", EventsTableName)
+	queryCtx, done := startTableQuery(ctx, EventsTableName, "publish_event", queryStr, eventType)
+	err = tx.QueryRowContext(queryCtx, queryStr, eventType, string(dataJSON), utilities.GetRequestSource(ctx).RequestID).Scan(&eventId)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to publish event", err)
+	}
+
+	webhooks := utilities.CurrentConfig().Policy().Webhooks
+	var names []string
+	for name, webhook := range webhooks {
+		if webhook.Subscribed(eventType) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	queryStr = fmt.Sprintf("INSERT INTO %s (event_id, webhook) VALUES ($1, $2);", WebhookDeliveriesTableName)
+	for _, name := range names {
+		queryCtx, done := startTableQuery(ctx, WebhookDeliveriesTableName, "queue_webhook_delivery", queryStr, eventId, name)
+		_, err = tx.ExecContext(queryCtx, queryStr, eventId, name)
+		done(err)
+		if err != nil {
+			return utilities.NewInternalError("Failed to queue webhook delivery", err)
+		}
+	}
+	return nil
+}
+
+// ListEvents returns up to limit events after the given id, oldest first
+func ListEvents(ctx context.Context, after int64, limit int) ([]Event, error) {
+	ctx, span := startOperation(ctx, "ListEvents")
+	list, err := listEvents(ctx, after, limit)
+	span.Finish(err)
+	return list, err
+}
+
+func listEvents(ctx context.Context, after int64, limit int) ([]Event, error) {
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE id > $1 ORDER BY id LIMIT $2;", eventColumns, EventsTableName)
+	ctx, done := startTableQuery(ctx, EventsTableName, "list_events", queryStr, after, limit)
+	rows, err := db.DB.QueryContext(ctx, queryStr, after, limit)
+	if err != nil {
+		done(err)
+		return nil, utilities.NewInternalError("Failed to query events", err)
+	}
+	defer rows.Close()
+
+	list := []Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			done(err)
+			return nil, utilities.NewInternalError("Failed to read events", err)
+		}
+		list = append(list, event)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return nil, utilities.NewInternalError("Failed to read events", err)
+	}
+	return list, nil
+}
+
+// LastEventId returns the id of the newest event, or 0 if there are none
+func LastEventId(ctx context.Context) (int64, error) {
+	var id int64
+	queryStr := fmt.Sprintf("SELECT coalesce(max(id), 0) FROM %s;", EventsTableName)
+	ctx, done := startTableQuery(ctx, EventsTableName, "last_event_id", queryStr)
+	err := db.DB.QueryRowContext(ctx, queryStr).Scan(&id)
+	done(err)
+	if err != nil {
+		return 0, utilities.NewInternalError("Failed to query events", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,503 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/identifiers"
+	"github.com/omar-ozgur/gram/oidc"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var IdentitiesTableName string
+var LoginFlowsTableName string
+
+// loginFlowLifetime limits how long users have to log in with a provider, and to link an identity afterwards
+const loginFlowLifetime = 10 * time.Minute
+
+// Kinds of login flows
+const (
+	loginFlowState = "state"
+	loginFlowLink  = "link"
+)
+
+const identityColumns = "provider, subject, email, created_at"
+
+// Identity links a user to their account with an upstream identity provider
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FederatedLogin is the result of a login with an upstream provider. Users whose identity is not linked to a
+// Gram user, and cannot be linked or created automatically, get a LinkToken instead of a Token. They can link
+// the identity to their user with LinkIdentity after logging in another way.
+type FederatedLogin struct {
+	Provider  string
+	ReturnTo  string
+	Token     string
+	LinkToken string
+}
+
+// federatedIdentity is a user as an upstream provider describes them
+type federatedIdentity struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Username      string `json:"username"`
+}
+
+// loginState is what a login remembers between sending the user to the provider and their return
+type loginState struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+var providerClient = &http.Client{Timeout: 10 * time.Second}
+
+// upstreamProviders caches providers by name, so that discovery documents and keys are only fetched again
+// when a provider's configuration changes
+var upstreamProviders = struct {
+	sync.Mutex
+	cache map[string]cachedProvider
+}{cache: make(map[string]cachedProvider)}
+
+type cachedProvider struct {
+	config   utilities.ProviderConfig
+	provider *oidc.Provider
+}
+
+// upstreamProvider returns a configured provider, discovering its endpoints if it is an OpenID Connect provider
+func upstreamProvider(ctx context.Context, name string) (*oidc.Provider, utilities.ProviderConfig, error) {
+	config, ok := utilities.CurrentConfig().Policy().Federation.Providers[name]
+	if !ok {
+		return nil, config, utilities.NewError(utilities.ErrorNotFound, utilities.CodeProviderNotFound, fmt.Sprintf("Provider %s is not configured", name))
+	}
+
+	upstreamProviders.Lock()
+	cached, ok := upstreamProviders.cache[name]
+	upstreamProviders.Unlock()
+	if ok && reflect.DeepEqual(cached.config, config) {
+		return cached.provider, config, nil
+	}
+
+	metadata := oidc.Metadata{AuthorizationEndpoint: config.AuthorizationURL, TokenEndpoint: config.TokenURL, UserinfoEndpoint: config.UserinfoURL}
+	scopes := config.Scopes
+	if config.IsOIDC() {
+		var err error
+		metadata, err = oidc.Discover(ctx, providerClient, config.Issuer)
+		if err != nil {
+			utilities.Log(ctx).Error("Provider discovery failed", zap.String("provider", name), zap.Error(err))
+			return nil, config, utilities.NewError(utilities.ErrorUnavailable, utilities.CodeProviderUnavailable, fmt.Sprintf("Provider %s could not be reached", name))
+		}
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+	}
+	provider := oidc.NewProvider(metadata, config.ClientID, config.ClientSecret, config.RedirectURL, scopes, providerClient)
+
+	upstreamProviders.Lock()
+	upstreamProviders.cache[name] = cachedProvider{config, provider}
+	upstreamProviders.Unlock()
+	return provider, config, nil
+}
+
+// StartFederatedLogin begins a login with an upstream provider, and returns the provider URL to send the user to
+// and the state that must come back with them. returnTo, if given, must be one of the service's return URLs.
+func StartFederatedLogin(ctx context.Context, providerName, returnTo string) (authURL, state string, err error) {
+	ctx, span := startOperation(ctx, "StartFederatedLogin", "provider", providerName)
+	authURL, state, err = startFederatedLogin(ctx, providerName, returnTo)
+	span.Finish(err)
+	return authURL, state, err
+}
+
+func startFederatedLogin(ctx context.Context, providerName, returnTo string) (string, string, error) {
+	if returnTo != "" && !utilities.CurrentConfig().Policy().Federation.AllowsReturnURL(returnTo) {
+		return "", "", utilities.NewValidationError("The login request is invalid", utilities.FieldError{
+			Field:   "return_to",
+			Code:    utilities.FieldInvalid,
+			Message: "return_to must be one of the service's return URLs",
+		})
+	}
+
+	provider, _, err := upstreamProvider(ctx, providerName)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The state ties the callback to this login, the nonce ties the ID token to it, and
+	// the PKCE code verifier proves to the provider that Gram started it
+	var values [3]string
+	for i := range values {
+		values[i], err = oidc.RandomString()
+		if err != nil {
+			return "", "", utilities.NewInternalError("Failed to generate login state", err)
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	err = saveLoginFlow(ctx, loginFlowState, providerName, state, loginState{Nonce: nonce, Verifier: verifier, ReturnTo: returnTo})
+	if err != nil {
+		return "", "", err
+	}
+	return provider.AuthCodeURL(state, nonce, verifier), state, nil
+}
+
+// FinishFederatedLogin completes a login when the provider sends the user back with an authorization code, or with
+// an error. The state is used up, so the callback cannot be replayed. The ReturnTo of the result is set as soon as
+// the state is known to be valid, so that errors after that point can be sent back to the client.
+func FinishFederatedLogin(ctx context.Context, providerName, state, code, providerError string) (FederatedLogin, error) {
+	ctx, span := startOperation(ctx, "FinishFederatedLogin", "provider", providerName)
+	login, err := finishFederatedLogin(ctx, providerName, state, code, providerError)
+	span.Finish(err)
+	return login, err
+}
+
+func finishFederatedLogin(ctx context.Context, providerName, state, code, providerError string) (FederatedLogin, error) {
+	login := FederatedLogin{Provider: providerName}
+
+	var st loginState
+	_, err := takeLoginFlow(ctx, loginFlowState, providerName, state, &st)
+	if err != nil {
+		_, err = loginFailed(ctx, "", "invalid_state", err)
+		return login, err
+	}
+	login.ReturnTo = st.ReturnTo
+
+	failed := func(reason string, cause error) (FederatedLogin, error) {
+		utilities.Log(ctx).Warn("Federated login failed", zap.String("provider", providerName), zap.String("reason", reason), zap.Error(cause))
+		_, err := loginFailed(ctx, "", reason, utilities.NewError(utilities.ErrorUnauthorized, utilities.CodeFederationFailed, fmt.Sprintf("Logging in with %s failed", providerName)))
+		return login, err
+	}
+	if providerError != "" {
+		return failed("provider_error", &oidc.Error{Code: providerError})
+	}
+	if code == "" {
+		return failed("provider_error", fmt.Errorf("the provider sent no authorization code"))
+	}
+
+	provider, config, err := upstreamProvider(ctx, providerName)
+	if err != nil {
+		_, err = loginFailed(ctx, "", utilities.AsError(err).Code, err)
+		return login, err
+	}
+
+	// Redeem the code and read the user's claims
+	token, err := provider.Exchange(ctx, code, st.Verifier)
+	if err != nil {
+		return failed("token_exchange", err)
+	}
+	var claims oidc.Claims
+	if provider.IsOIDC() {
+		claims, err = provider.VerifyIDToken(ctx, token.IDToken, st.Nonce)
+		if err != nil {
+			return failed("invalid_id_token", err)
+		}
+
+		// Some providers only return profile claims from the userinfo endpoint
+		if claims.String(config.Claims.Email) == "" && provider.UserinfoURL != "" {
+			userinfo, err := provider.Userinfo(ctx, token.AccessToken)
+			if err != nil {
+				return failed("userinfo", err)
+			}
+			if userinfo.String("sub") != claims.String("sub") {
+				return failed("userinfo", fmt.Errorf("the userinfo subject does not match the ID token"))
+			}
+			for name, value := range userinfo {
+				if _, ok := claims[name]; !ok {
+					claims[name] = value
+				}
+			}
+		}
+	} else {
+		claims, err = provider.Userinfo(ctx, token.AccessToken)
+		if err != nil {
+			return failed("userinfo", err)
+		}
+	}
+	identity := identityFromClaims(config, claims)
+	if identity.Subject == "" {
+		return failed("invalid_claims", fmt.Errorf("the %s claim is missing", config.Claims.Subject))
+	}
+
+	// Find, link or create the user
+	user, found, err := resolveFederatedUser(ctx, providerName, config, identity)
+	if err != nil {
+		_, err = loginFailed(ctx, "", utilities.AsError(err).Code, err)
+		return login, err
+	}
+	if !found {
+		linkToken, err := oidc.RandomString()
+		if err != nil {
+			return login, utilities.NewInternalError("Failed to generate link token", err)
+		}
+		if err := saveLoginFlow(ctx, loginFlowLink, providerName, linkToken, identity); err != nil {
+			return login, err
+		}
+		loginsTotal.Inc("failure", "not_linked")
+		recordAudit(ctx, AuditLoginFailed, "", map[string]interface{}{"reason": "not_linked", "provider": providerName})
+		login.LinkToken = linkToken
+		return login, nil
+	}
+
+	login.Token, err = completeLogin(ctx, user, map[string]interface{}{"provider": providerName})
+	return login, err
+}
+
+// identityFromClaims reads an identity from the claims the provider's configuration names. A name that is not
+// split into first and last names is split at its last space.
+func identityFromClaims(config utilities.ProviderConfig, claims oidc.Claims) federatedIdentity {
+	identity := federatedIdentity{
+		Subject:       claims.String(config.Claims.Subject),
+		Email:         strings.TrimSpace(claims.String(config.Claims.Email)),
+		EmailVerified: config.TrustEmail || claims.Bool(config.Claims.EmailVerified),
+		FirstName:     claims.String(config.Claims.FirstName),
+		LastName:      claims.String(config.Claims.LastName),
+	}
+	if config.Claims.Username != "" {
+		identity.Username = claims.String(config.Claims.Username)
+	}
+
+	name := strings.TrimSpace(claims.String(config.Claims.Name))
+	if identity.FirstName == "" && identity.LastName == "" && name != "" {
+		identity.FirstName = name
+		if space := strings.LastIndex(name, " "); space > 0 {
+			identity.FirstName, identity.LastName = strings.TrimSpace(name[:space]), name[space+1:]
+		}
+	}
+	return identity
+}
+
+// resolveFederatedUser returns the user an identity is linked to. An identity that is not linked yet is linked to
+// the user with its email if the provider verified the email, or to a new user if signups are allowed.
+// found is false if the user must link the identity themselves.
+func resolveFederatedUser(ctx context.Context, providerName string, config utilities.ProviderConfig, identity federatedIdentity) (user User, found bool, err error) {
+	queryStr := fmt.Sprintf("SELECT user_id FROM %s WHERE provider = $1 AND subject = $2;", IdentitiesTableName)
+	queryCtx, done := startTableQuery(ctx, IdentitiesTableName, "find_identity", queryStr, providerName, identity.Subject)
+	var userId int
+	err = db.DB.QueryRowContext(queryCtx, queryStr, providerName, identity.Subject).Scan(&userId)
+	done(err)
+	if err == nil {
+		user, err = getUser(ctx, strconv.Itoa(userId))
+		return user, err == nil, err
+	} else if err != sql.ErrNoRows {
+		return User{}, false, utilities.NewInternalError("Failed to retrieve identity", err)
+	}
+
+	// Link by verified email
+	if linksByEmail(config, identity) {
+		user, err = findUserByEmail(ctx, identity.Email)
+		if err == nil {
+			if _, err := linkIdentity(ctx, user.Id, providerName, identity, "email"); err != nil {
+				return User{}, false, err
+			}
+			return user, true, nil
+		} else if err != sql.ErrNoRows {
+			return User{}, false, utilities.NewInternalError("Failed to retrieve user", err)
+		}
+	}
+
+	// Create a user, with the email only if the provider verified it
+	policy := utilities.CurrentConfig().Policy()
+	if !policy.AllowSignup || !config.AllowSignup {
+		return User{}, false, nil
+	}
+	desired := User{First_name: identity.FirstName, Last_name: identity.LastName, Username: identity.Username, Active: true}
+	if identity.EmailVerified {
+		desired.Email = identity.Email
+	} else if policy.IdentifierRequired(identifiers.Email) {
+		return User{}, false, utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, fmt.Sprintf("%s has not verified your email address", providerName))
+	}
+	user, err = ProvisionUser(ctx, desired)
+	if err != nil {
+		return User{}, false, err
+	}
+	if _, err := linkIdentity(ctx, user.Id, providerName, identity, "signup"); err != nil {
+		return User{}, false, err
+	}
+	return user, true, nil
+}
+
+// linksByEmail reports whether an identity may be linked to the user with its email. Only emails that the
+// provider verified, or is trusted to have verified, are linked.
+func linksByEmail(config utilities.ProviderConfig, identity federatedIdentity) bool {
+	return config.LinkByEmail && identity.EmailVerified && identity.Email != ""
+}
+
+// linkIdentity links an identity to a user. by records how the link was made: email, signup or user.
+func linkIdentity(ctx context.Context, userId int, providerName string, identity federatedIdentity, by string) (Identity, error) {
+	queryStr := fmt.Sprintf("INSERT INTO %s (provider, subject, user_id, email) VALUES ($1, $2, $3, $4) RETURNING %s;", IdentitiesTableName, identityColumns)
+	values := []interface{}{providerName, identity.Subject, userId, identity.Email}
+	queryCtx, done := startTableQuery(ctx, IdentitiesTableName, "link_identity", queryStr, values...)
+	var linked Identity
+	err := db.DB.QueryRowContext(queryCtx, queryStr, values...).Scan(&linked.Provider, &linked.Subject, &linked.Email, &linked.CreatedAt)
+	done(err)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		message := fmt.Sprintf("This %s account is already linked to another user", providerName)
+		if strings.HasSuffix(pqErr.Constraint, "_user_provider_key") {
+			message = fmt.Sprintf("The user is already linked to another %s account", providerName)
+		}
+		return Identity{}, utilities.NewError(utilities.ErrorConflict, utilities.CodeIdentityConflict, message)
+	} else if err != nil {
+		return Identity{}, utilities.NewInternalError("Failed to link identity", err)
+	}
+
+	recordAudit(ctx, AuditIdentityLinked, userTarget(userId), map[string]interface{}{"provider": providerName, "by": by})
+	return linked, nil
+}
+
+// LinkIdentity links the identity of a link token, from a federated login that could not be linked
+// automatically, to a user who has logged in another way
+func LinkIdentity(ctx context.Context, userId string, linkToken string) (Identity, error) {
+	ctx, span := startOperation(ctx, "LinkIdentity", "user.id", userId)
+	identity, err := linkIdentityByToken(ctx, userId, linkToken)
+	span.Finish(err)
+	return identity, err
+}
+
+func linkIdentityByToken(ctx context.Context, userId string, linkToken string) (Identity, error) {
+	user, err := getUser(ctx, userId)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var identity federatedIdentity
+	providerName, err := takeLoginFlow(ctx, loginFlowLink, "", linkToken, &identity)
+	if err != nil {
+		return Identity{}, err
+	}
+	if _, ok := utilities.CurrentConfig().Policy().Federation.Providers[providerName]; !ok {
+		return Identity{}, utilities.NewError(utilities.ErrorNotFound, utilities.CodeProviderNotFound, fmt.Sprintf("Provider %s is not configured", providerName))
+	}
+	return linkIdentity(ctx, user.Id, providerName, identity, "user")
+}
+
+// ListIdentities returns the identities linked to a user, by provider
+func ListIdentities(ctx context.Context, userId string) ([]Identity, error) {
+	ctx, span := startOperation(ctx, "ListIdentities", "user.id", userId)
+	identities, err := listIdentities(ctx, userId)
+	span.Finish(err)
+	return identities, err
+}
+
+func listIdentities(ctx context.Context, userId string) ([]Identity, error) {
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 ORDER BY provider;", identityColumns, IdentitiesTableName)
+	queryCtx, done := startTableQuery(ctx, IdentitiesTableName, "list_identities", queryStr, userId)
+	rows, err := db.DB.QueryContext(queryCtx, queryStr, userId)
+	if err != nil {
+		done(err)
+		return nil, utilities.NewInternalError("Failed to retrieve identities", err)
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err = rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt); err != nil {
+			break
+		}
+		identities = append(identities, identity)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	done(err)
+	if err != nil {
+		return nil, utilities.NewInternalError("Failed to retrieve identities", err)
+	}
+	return identities, nil
+}
+
+// UnlinkIdentity removes the link between a user and their account with a provider
+func UnlinkIdentity(ctx context.Context, userId string, providerName string) error {
+	ctx, span := startOperation(ctx, "UnlinkIdentity", "user.id", userId, "provider", providerName)
+	err := unlinkIdentity(ctx, userId, providerName)
+	span.Finish(err)
+	return err
+}
+
+func unlinkIdentity(ctx context.Context, userId string, providerName string) error {
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND provider = $2;", IdentitiesTableName)
+	queryCtx, done := startTableQuery(ctx, IdentitiesTableName, "unlink_identity", queryStr, userId, providerName)
+	result, err := db.DB.ExecContext(queryCtx, queryStr, userId, providerName)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to unlink identity", err)
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return utilities.NewError(utilities.ErrorNotFound, utilities.CodeIdentityNotFound, fmt.Sprintf("The user is not linked to a %s account", providerName))
+	}
+
+	recordAudit(ctx, AuditIdentityUnlinked, userTarget(userId), map[string]interface{}{"provider": providerName})
+	return nil
+}
+
+// saveLoginFlow stores the data of a login in progress under a hash of its token, and removes expired logins
+func saveLoginFlow(ctx context.Context, kind, providerName, token string, data interface{}) error {
+	dataJSON, _ := json.Marshal(data)
+	hash := sha256.Sum256([]byte(token))
+
+	deleteStr := fmt.Sprintf("DELETE FROM %s WHERE expires_at < now();", LoginFlowsTableName)
+	queryCtx, done := startTableQuery(ctx, LoginFlowsTableName, "expire_login_flows", deleteStr)
+	_, err := db.DB.ExecContext(queryCtx, deleteStr)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to expire logins", err)
+	}
+
+	queryStr := fmt.Sprintf("INSERT INTO %s (token_hash, kind, provider, data, expires_at) VALUES ($1, $2, $3, $4, $5);", LoginFlowsTableName)
+	values := []interface{}{hash[:], kind, providerName, string(dataJSON), time.Now().Add(loginFlowLifetime)}
+	queryCtx, done = startTableQuery(ctx, LoginFlowsTableName, "save_login_flow", queryStr, values...)
+	_, err = db.DB.ExecContext(queryCtx, queryStr, values...)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to save login", err)
+	}
+	return nil
+}
+
+// takeLoginFlow removes a login in progress and decodes its data, so that each token can only be used once.
+// A providerName of "" matches any provider. The provider of the login is returned.
+func takeLoginFlow(ctx context.Context, kind, providerName, token string, data interface{}) (string, error) {
+	invalid := utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidLoginState, "The login is invalid or has expired. Start the login again")
+	if kind == loginFlowLink {
+		invalid = utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidLinkToken, "The link token is invalid or has expired")
+	}
+	if token == "" {
+		return "", invalid
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE token_hash = $1 AND kind = $2 AND ($3 = '' OR provider = $3) AND expires_at > now() RETURNING provider, data;", LoginFlowsTableName)
+	values := []interface{}{hash[:], kind, providerName}
+	queryCtx, done := startTableQuery(ctx, LoginFlowsTableName, "take_login_flow", queryStr, values...)
+	var provider, dataJSON string
+	err := db.DB.QueryRowContext(queryCtx, queryStr, values...).Scan(&provider, &dataJSON)
+	done(err)
+	if err == sql.ErrNoRows {
+		return "", invalid
+	} else if err != nil {
+		return "", utilities.NewInternalError("Failed to retrieve login", err)
+	}
+
+	if err := json.Unmarshal([]byte(dataJSON), data); err != nil {
+		return "", utilities.NewInternalError("Failed to decode login", err)
+	}
+	return provider, nil
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/oidc"
+	"github.com/omar-ozgur/gram/oidc/oidctest"
+	"github.com/omar-ozgur/gram/utilities"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testProviderName = "mock"
+
+// federationTest starts a mock provider and configures it as the service's only provider. Login flows are kept
+// by a loginFlowDB in place of Postgres.
+func federationTest(t *testing.T, configure func(config *utilities.ProviderConfig)) (*oidctest.Provider, *loginFlowDB) {
+	t.Helper()
+	mock := oidctest.NewProvider("gram-client", "gram-secret")
+	t.Cleanup(mock.Close)
+
+	var provider utilities.ProviderConfig
+	provider.SetDefaults()
+	provider.Issuer = mock.URL
+	provider.ClientID = mock.ClientID
+	provider.ClientSecret = mock.ClientSecret
+	provider.RedirectURL = "https://gram.example.com/v1/auth/mock/callback"
+	provider.AllowSignup = false
+	if configure != nil {
+		configure(&provider)
+	}
+
+	var policy utilities.ServicePolicy
+	policy.SetDefaults()
+	policy.Federation.Providers = map[string]utilities.ProviderConfig{testProviderName: provider}
+	config := utilities.DefaultConfig()
+	config.Services = map[string]utilities.ServicePolicy{config.Server.Service: policy}
+
+	previousConfig, previousDB := utilities.CurrentConfig(), db.DB
+	flows := &loginFlowDB{flows: make(map[string]storedLoginFlow)}
+	utilities.SetConfig(config)
+	Init()
+	db.DB = sql.OpenDB(flows)
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = previousDB
+		utilities.SetConfig(previousConfig)
+		Init()
+	})
+	return mock, flows
+}
+
+// federatedLogin logs a user with the claims in at the mock provider, and returns to Gram with the code
+func federatedLogin(t *testing.T, mock *oidctest.Provider, claims map[string]interface{}) (FederatedLogin, string, error) {
+	t.Helper()
+	authURL, state, err := startFederatedLogin(context.Background(), testProviderName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := mock.Authorize(authURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := finishFederatedLogin(context.Background(), testProviderName, state, code, "")
+	return login, state, err
+}
+
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	return utilities.AsError(err).Code
+}
+
+func TestFinishFederatedLogin(t *testing.T) {
+	claims := map[string]interface{}{"sub": "user-1", "email": "jdoe@example.com", "email_verified": true}
+
+	cases := []struct {
+		name     string
+		idToken  func(claims jwt.MapClaims)
+		wantCode string
+	}{
+		{"valid login", nil, ""},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "another-nonce" }, utilities.CodeFederationFailed},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "another-client" }, utilities.CodeFederationFailed},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, utilities.CodeFederationFailed},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }, utilities.CodeFederationFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mock, _ := federationTest(t, nil)
+			if c.idToken != nil {
+				mock.IDTokenClaims = c.idToken
+			}
+
+			login, _, err := federatedLogin(t, mock, claims)
+			if got := errorCode(err); got != c.wantCode {
+				t.Fatalf("got %v, want %q", err, c.wantCode)
+			}
+			// Signup is off, so the valid login ends with an identity to link
+			if c.wantCode == "" && (login.LinkToken == "" || login.Token != "") {
+				t.Errorf("got login %+v, want a link token", login)
+			}
+		})
+	}
+}
+
+func TestFinishFederatedLoginUnsignedToken(t *testing.T) {
+	mock, _ := federationTest(t, nil)
+	mock.SignIDToken = func(claims jwt.MapClaims) (string, error) {
+		return jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	}
+
+	_, _, err := federatedLogin(t, mock, map[string]interface{}{"sub": "user-1"})
+	if errorCode(err) != utilities.CodeFederationFailed {
+		t.Errorf("got %v, want federation_failed", err)
+	}
+}
+
+func TestFinishFederatedLoginReplayedState(t *testing.T) {
+	mock, _ := federationTest(t, nil)
+	claims := map[string]interface{}{"sub": "user-1", "email": "jdoe@example.com"}
+
+	_, state, err := federatedLogin(t, mock, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := mock.TokenRequests()
+
+	// The state was used up by the first callback, even with a code the provider would accept
+	authURL, _, err := startFederatedLogin(context.Background(), testProviderName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := mock.Authorize(authURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = finishFederatedLogin(context.Background(), testProviderName, state, code, "")
+	if errorCode(err) != utilities.CodeInvalidLoginState {
+		t.Errorf("got %v, want invalid_login_state", err)
+	}
+	if mock.TokenRequests() != requests {
+		t.Error("a replayed state redeemed a code")
+	}
+}
+
+func TestFinishFederatedLoginProviderError(t *testing.T) {
+	mock, _ := federationTest(t, nil)
+	authURL, state, err := startFederatedLogin(context.Background(), testProviderName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := mock.Authorize(authURL, map[string]interface{}{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = finishFederatedLogin(context.Background(), testProviderName, state, "", "access_denied")
+	if errorCode(err) != utilities.CodeFederationFailed {
+		t.Errorf("got %v, want federation_failed", err)
+	}
+	// The error used up the state too
+	_, err = finishFederatedLogin(context.Background(), testProviderName, state, code, "")
+	if errorCode(err) != utilities.CodeInvalidLoginState {
+		t.Errorf("got %v, want invalid_login_state", err)
+	}
+}
+
+func TestFinishFederatedLoginLinkByEmail(t *testing.T) {
+	cases := []struct {
+		name          string
+		emailVerified interface{}
+		trustEmail    bool
+		lookup        bool
+	}{
+		{"verified", true, false, true},
+		{"verified as a string", "true", false, true},
+		{"not verified", false, false, false},
+		{"not verified as a string", "false", false, false},
+		{"verification unknown", nil, false, false},
+		{"trusted provider", nil, true, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mock, flows := federationTest(t, func(config *utilities.ProviderConfig) { config.TrustEmail = c.trustEmail })
+			claims := map[string]interface{}{"sub": "user-1", "email": "jdoe@example.com"}
+			if c.emailVerified != nil {
+				claims["email_verified"] = c.emailVerified
+			}
+
+			if _, _, err := federatedLogin(t, mock, claims); err != nil {
+				t.Fatal(err)
+			}
+			if lookup := flows.queried("lower(email)"); lookup != c.lookup {
+				t.Errorf("looked up the user by email: %v, want %v", lookup, c.lookup)
+			}
+		})
+	}
+}
+
+func TestLinksByEmail(t *testing.T) {
+	var config utilities.ProviderConfig
+	config.SetDefaults()
+	noLinking := config
+	noLinking.LinkByEmail = false
+	trusted := config
+	trusted.TrustEmail = true
+
+	cases := []struct {
+		name   string
+		config utilities.ProviderConfig
+		claims oidc.Claims
+		links  bool
+	}{
+		{"verified", config, oidc.Claims{"email": "jdoe@example.com", "email_verified": true}, true},
+		{"verified as a string", config, oidc.Claims{"email": "jdoe@example.com", "email_verified": "true"}, true},
+		{"not verified", config, oidc.Claims{"email": "jdoe@example.com", "email_verified": false}, false},
+		{"not verified as a string", config, oidc.Claims{"email": "jdoe@example.com", "email_verified": "false"}, false},
+		{"verification unknown", config, oidc.Claims{"email": "jdoe@example.com"}, false},
+		{"trusted provider", trusted, oidc.Claims{"email": "jdoe@example.com"}, true},
+		{"linking disabled", noLinking, oidc.Claims{"email": "jdoe@example.com", "email_verified": true}, false},
+		{"no email", config, oidc.Claims{"email": " ", "email_verified": true}, false},
+	}
+
+	for _, c := range cases {
+		c.claims["sub"] = "user-1"
+		if got := linksByEmail(c.config, identityFromClaims(c.config, c.claims)); got != c.links {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.links)
+		}
+	}
+}
+
+// loginFlowDB is a database/sql driver that keeps login flows in memory. It finds no identities, finds users by
+// email among users, and fails every other statement, audit events included, which are only logged when they fail.
+type loginFlowDB struct {
+	mutex   sync.Mutex
+	flows   map[string]storedLoginFlow
+	users   []User
+	queries []string
+}
+
+type storedLoginFlow struct {
+	kind, provider, data string
+	expiresAt            time.Time
+}
+
+func (d *loginFlowDB) Open(string) (driver.Conn, error)             { return loginFlowConn{d}, nil }
+func (d *loginFlowDB) Connect(context.Context) (driver.Conn, error) { return loginFlowConn{d}, nil }
+func (d *loginFlowDB) Driver() driver.Driver                        { return d }
+
+// queried reports whether a statement containing text was run
+func (d *loginFlowDB) queried(text string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, query := range d.queries {
+		if strings.Contains(query, text) {
+			return true
+		}
+	}
+	return false
+}
+
+type loginFlowConn struct {
+	db *loginFlowDB
+}
+
+func (c loginFlowConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unsupported statement: %s", query)
+}
+
+func (c loginFlowConn) Close() error { return nil }
+
+func (c loginFlowConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+func (c loginFlowConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	d := c.db
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queries = append(d.queries, query)
+
+	switch {
+	case strings.HasPrefix(query, "DELETE FROM "+LoginFlowsTableName+" WHERE expires_at < now()"):
+		var expired int64
+		for hash, flow := range d.flows {
+			if flow.expiresAt.Before(time.Now()) {
+				delete(d.flows, hash)
+				expired++
+			}
+		}
+		return driver.RowsAffected(expired), nil
+	case strings.HasPrefix(query, "INSERT INTO "+LoginFlowsTableName+" "):
+		d.flows[string(args[0].Value.([]byte))] = storedLoginFlow{
+			kind:      args[1].Value.(string),
+			provider:  args[2].Value.(string),
+			data:      args[3].Value.(string),
+			expiresAt: args[4].Value.(time.Time),
+		}
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", query)
+}
+
+func (c loginFlowConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	d := c.db
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queries = append(d.queries, query)
+
+	switch {
+	case strings.HasPrefix(query, "DELETE FROM "+LoginFlowsTableName+" WHERE token_hash"):
+		rows := &memoryRows{columns: []string{"provider", "data"}}
+		hash, kind, provider := string(args[0].Value.([]byte)), args[1].Value.(string), args[2].Value.(string)
+		flow, ok := d.flows[hash]
+		if ok && flow.kind == kind && (provider == "" || flow.provider == provider) && flow.expiresAt.After(time.Now()) {
+			delete(d.flows, hash)
+			rows.values = [][]driver.Value{{flow.provider, flow.data}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT user_id FROM "+IdentitiesTableName+" "):
+		return &memoryRows{columns: []string{"user_id"}}, nil
+	case strings.Contains(query, "FROM "+UserTableName+" WHERE lower(email)=lower($1)"):
+		rows := &memoryRows{columns: strings.Split(UserColumns, ", ")}
+		for _, user := range d.users {
+			if strings.EqualFold(user.Email, args[0].Value.(string)) {
+				rows.values = append(rows.values, []driver.Value{int64(user.Id), user.First_name, user.Last_name, user.Email, nil, nil,
+					user.Password, user.Time_created, []byte("{}"), user.Updated_at, int64(user.Version), user.Active, user.External_id})
+			}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", query)
+}
+
+type memoryRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *memoryRows) Columns() []string { return r.columns }
+func (r *memoryRows) Close() error      { return nil }
+
+func (r *memoryRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
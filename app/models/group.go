@@ -0,0 +1,540 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var GroupsTableName string
+var GroupMembersTableName string
+
+// Group is a set of users, such as a team or role that an identity provider manages with SCIM
+type Group struct {
+	Id          int64         `json:"id"`
+	DisplayName string        `json:"display_name"`
+	ExternalId  string        `json:"external_id"`
+	Members     []GroupMember `json:"members"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Version     int           `json:"version"`
+}
+
+// GroupMember is a user in a group, with their full name
+type GroupMember struct {
+	UserId int    `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// GroupRef is a group that a user belongs to
+type GroupRef struct {
+	Id          int64  `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+const groupColumns = "id, display_name, external_id, created_at, updated_at, version"
+
+// GroupSearchFields whitelists the fields groups can be filtered by
+var GroupSearchFields = map[string]searchField{
+	"id":           {Column: "id", Type: "int"},
+	"display_name": {Column: "display_name", Type: "string", CaseInsensitive: true},
+	"external_id":  {Column: "external_id", Type: "string"},
+	"created_at":   {Column: "created_at", Type: "time"},
+	"updated_at":   {Column: "updated_at", Type: "time"},
+}
+
+// ETag identifies the current version of a group for conditional requests
+func (group Group) ETag() string {
+	return fmt.Sprintf(`"%d"`, group.Version)
+}
+
+// MatchesETag reports whether the group satisfies an If-Match header
+func (group Group) MatchesETag(ifMatch string) bool {
+	return matchesETag(group.ETag(), ifMatch)
+}
+
+// MemberIds returns the ids of the group's members in ascending order
+func (group Group) MemberIds() []int {
+	ids := make([]int, 0, len(group.Members))
+	seen := make(map[int]bool)
+	for _, member := range group.Members {
+		if !seen[member.UserId] {
+			seen[member.UserId] = true
+			ids = append(ids, member.UserId)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func groupTarget(id interface{}) string {
+	return fmt.Sprintf("group:%v", id)
+}
+
+func groupNotFoundError(id string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorNotFound, utilities.CodeGroupNotFound, fmt.Sprintf("Group %s was not found", id))
+}
+
+func groupPreconditionError(id string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorPreconditionFailed, utilities.CodePreconditionFailed, fmt.Sprintf("Group %s has been changed since it was retrieved", id))
+}
+
+// groupConflictError converts a violation of the unique display name index to a conflict, or returns nil
+func groupConflictError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != uniqueViolation {
+		return nil
+	}
+	e := utilities.NewError(utilities.ErrorConflict, utilities.CodeGroupConflict, "A group with the same name already exists")
+	e.Fields = []utilities.FieldError{{Field: "DisplayName", Code: utilities.FieldTaken, Message: "DisplayName is already in use"}}
+	return e
+}
+
+func scanGroup(row rowScanner) (group Group, err error) {
+	err = row.Scan(&group.Id, &group.DisplayName, &group.ExternalId, &group.CreatedAt, &group.UpdatedAt, &group.Version)
+	group.Members = []GroupMember{}
+	return
+}
+
+// queryer runs queries on the database or in a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// validateGroup checks a group's name, and that its members exist
+func validateGroup(ctx context.Context, group Group) error {
+	if strings.TrimSpace(group.DisplayName) == "" {
+		return utilities.NewValidationError("The group is invalid", utilities.FieldError{Field: "DisplayName", Code: utilities.FieldRequired, Message: "DisplayName cannot be blank"})
+	}
+
+	ids := group.MemberIds()
+	if len(ids) == 0 {
+		return nil
+	}
+	queryStr := fmt.Sprintf("SELECT id FROM %s WHERE id = ANY($1);", UserTableName)
+	ctx, done := startQuery(ctx, "find_group_members", queryStr, pq.Array(ids))
+	rows, err := db.DB.QueryContext(ctx, queryStr, pq.Array(ids))
+	if err != nil {
+		done(err)
+		return utilities.NewInternalError("Failed to find group members", err)
+	}
+	defer rows.Close()
+
+	found := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			done(err)
+			return utilities.NewInternalError("Failed to find group members", err)
+		}
+		found[id] = true
+	}
+	done(rows.Err())
+
+	var missing []string
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, strconv.Itoa(id))
+		}
+	}
+	if len(missing) > 0 {
+		return utilities.NewValidationError("The group is invalid", utilities.FieldError{
+			Field:   "Members",
+			Code:    utilities.FieldInvalid,
+			Message: fmt.Sprintf("Users %s do not exist", strings.Join(missing, ", ")),
+		})
+	}
+	return nil
+}
+
+// loadGroupMembers fills in the members of the given groups
+func loadGroupMembers(ctx context.Context, q queryer, groups []Group) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(groups))
+	index := make(map[int64]int)
+	for i, group := range groups {
+		ids[i] = group.Id
+		index[group.Id] = i
+	}
+
+	queryStr := fmt.Sprintf(`SELECT m.group_id, m.user_id, u.first_name || ' ' || u.last_name FROM %s m
+           JOIN %s u ON u.id = m.user_id WHERE m.group_id = ANY($1) ORDER BY m.group_id, m.user_id;`, GroupMembersTableName, UserTableName)
+	ctx, done := startTableQuery(ctx, GroupMembersTableName, "list_group_members", queryStr, pq.Array(ids))
+	rows, err := q.QueryContext(ctx, queryStr, pq.Array(ids))
+	if err != nil {
+		done(err)
+		return utilities.NewInternalError("Failed to retrieve group members", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupId int64
+		var member GroupMember
+		if err := rows.Scan(&groupId, &member.UserId, &member.Name); err != nil {
+			done(err)
+			return utilities.NewInternalError("Failed to retrieve group members", err)
+		}
+		i := index[groupId]
+		groups[i].Members = append(groups[i].Members, member)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to retrieve group members", err)
+	}
+	return nil
+}
+
+// changeGroupMembers adds and removes members of a group
+func changeGroupMembers(ctx context.Context, tx *sql.Tx, groupId int64, added, removed []int) error {
+	if len(added) > 0 {
+		queryStr := fmt.Sprintf("INSERT INTO %s (group_id, user_id) SELECT $1, unnest($2::integer[]) ON CONFLICT DO NOTHING;", GroupMembersTableName)
+		queryCtx, done := startTableQuery(ctx, GroupMembersTableName, "add_group_members", queryStr, groupId, pq.Array(added))
+		_, err := tx.ExecContext(queryCtx, queryStr, groupId, pq.Array(added))
+		done(err)
+		if err != nil {
+			return utilities.NewInternalError("Failed to add group members", err)
+		}
+	}
+	if len(removed) > 0 {
+		queryStr := fmt.Sprintf("DELETE FROM %s WHERE group_id = $1 AND user_id = ANY($2);", GroupMembersTableName)
+		queryCtx, done := startTableQuery(ctx, GroupMembersTableName, "remove_group_members", queryStr, groupId, pq.Array(removed))
+		_, err := tx.ExecContext(queryCtx, queryStr, groupId, pq.Array(removed))
+		done(err)
+		if err != nil {
+			return utilities.NewInternalError("Failed to remove group members", err)
+		}
+	}
+	return nil
+}
+
+// diffMembers returns the ids in desired but not current, and in current but not desired
+func diffMembers(current, desired []int) (added, removed []int) {
+	inCurrent, inDesired := make(map[int]bool), make(map[int]bool)
+	for _, id := range current {
+		inCurrent[id] = true
+	}
+	for _, id := range desired {
+		inDesired[id] = true
+		if !inCurrent[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range current {
+		if !inDesired[id] {
+			removed = append(removed, id)
+		}
+	}
+	return
+}
+
+func CreateGroup(ctx context.Context, group Group) (Group, error) {
+	ctx, span := startOperation(ctx, "CreateGroup")
+	created, err := createGroup(ctx, group)
+	span.Finish(err)
+	return created, err
+}
+
+func createGroup(ctx context.Context, group Group) (Group, error) {
+	err := validateGroup(ctx, group)
+	if err != nil {
+		return Group{}, err
+	}
+
+	queryStr := fmt.Sprintf("INSERT INTO %s (display_name, external_id) VALUES ($1, $2) RETURNING %s;", GroupsTableName, groupColumns)
+	var created Group
+	err = inTransaction(ctx, func(tx *sql.Tx) error {
+		queryCtx, done := startTableQuery(ctx, GroupsTableName, "create_group", queryStr, group.DisplayName, group.ExternalId)
+		created, err = scanGroup(tx.QueryRowContext(queryCtx, queryStr, group.DisplayName, group.ExternalId))
+		done(err)
+		if conflict := groupConflictError(err); conflict != nil {
+			return conflict
+		} else if err != nil {
+			return utilities.NewInternalError("Failed to create group", err)
+		}
+
+		err = changeGroupMembers(ctx, tx, created.Id, group.MemberIds(), nil)
+		if err != nil {
+			return err
+		}
+		groups := []Group{created}
+		err = loadGroupMembers(ctx, tx, groups)
+		created = groups[0]
+		return err
+	})
+	if err != nil {
+		return Group{}, err
+	}
+
+	recordAudit(ctx, AuditGroupCreated, groupTarget(created.Id), map[string]interface{}{"display_name": created.DisplayName, "members": created.MemberIds()})
+	return created, nil
+}
+
+func GetGroup(ctx context.Context, id string) (Group, error) {
+	ctx, span := startOperation(ctx, "GetGroup", "group.id", id)
+	group, err := getGroup(ctx, id)
+	span.Finish(err)
+	return group, err
+}
+
+func getGroup(ctx context.Context, id string) (Group, error) {
+	groupId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Group{}, groupNotFoundError(id)
+	}
+
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE id = $1;", groupColumns, GroupsTableName)
+	queryCtx, done := startTableQuery(ctx, GroupsTableName, "get_group", queryStr, groupId)
+	group, err := scanGroup(db.DB.QueryRowContext(queryCtx, queryStr, groupId))
+	done(err)
+	if err == sql.ErrNoRows {
+		return Group{}, groupNotFoundError(id)
+	} else if err != nil {
+		return Group{}, utilities.NewInternalError("Failed to retrieve group", err)
+	}
+
+	groups := []Group{group}
+	err = loadGroupMembers(ctx, db.DB, groups)
+	return groups[0], err
+}
+
+// GroupQuery filters and pages groups by index
+type GroupQuery struct {
+	Filter         *UserFilter
+	Offset         int
+	Limit          int
+	ExcludeMembers bool
+}
+
+// GroupPage is a page of groups by id, with the number of groups that match the query
+type GroupPage struct {
+	Groups []Group
+	Total  int
+}
+
+func ListGroups(ctx context.Context, query GroupQuery) (GroupPage, error) {
+	ctx, span := startOperation(ctx, "ListGroups", "page.limit", query.Limit)
+	page, err := listGroups(ctx, query)
+	span.Finish(err)
+	return page, err
+}
+
+func listGroups(ctx context.Context, query GroupQuery) (GroupPage, error) {
+	var conditions []string
+	var values []interface{}
+	if query.Filter != nil {
+		condition, filterValues, err := compileGroupFilter(*query.Filter, values)
+		if err != nil {
+			return GroupPage{}, err
+		}
+		conditions, values = append(conditions, condition), filterValues
+	}
+
+	var page GroupPage
+	queryStr := fmt.Sprintf("SELECT count(*) FROM %s%s;", GroupsTableName, whereClause(conditions))
+	queryCtx, done := startTableQuery(ctx, GroupsTableName, "count_groups", queryStr, values...)
+	err := db.DB.QueryRowContext(queryCtx, queryStr, values...).Scan(&page.Total)
+	done(err)
+	if err != nil {
+		return GroupPage{}, utilities.NewInternalError("Failed to count groups", err)
+	}
+
+	values = append(values, query.Limit, query.Offset)
+	queryStr = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY id LIMIT $%d OFFSET $%d;", groupColumns, GroupsTableName, whereClause(conditions), len(values)-1, len(values))
+	queryCtx, done = startTableQuery(ctx, GroupsTableName, "list_groups", queryStr, values...)
+	rows, err := db.DB.QueryContext(queryCtx, queryStr, values...)
+	if err != nil {
+		done(err)
+		return GroupPage{}, utilities.NewInternalError("Failed to query groups", err)
+	}
+	defer rows.Close()
+
+	page.Groups = []Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			done(err)
+			return GroupPage{}, utilities.NewInternalError("Failed to retrieve groups", err)
+		}
+		page.Groups = append(page.Groups, group)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return GroupPage{}, utilities.NewInternalError("Failed to retrieve groups", err)
+	}
+
+	if !query.ExcludeMembers {
+		err = loadGroupMembers(ctx, db.DB, page.Groups)
+		if err != nil {
+			return GroupPage{}, err
+		}
+	}
+	return page, nil
+}
+
+// UpdateGroup changes a group's name, external id and members, if the group still matches ifMatch.
+// update returns the group as it should be; a group that already matches is returned without a new version.
+func UpdateGroup(ctx context.Context, id string, update func(current Group) (Group, error), ifMatch string) (Group, error) {
+	ctx, span := startOperation(ctx, "UpdateGroup", "group.id", id)
+	updated, err := updateGroup(ctx, id, update, ifMatch)
+	span.Finish(err)
+	return updated, err
+}
+
+func updateGroup(ctx context.Context, id string, update func(current Group) (Group, error), ifMatch string) (Group, error) {
+
+	// Check preconditions
+	current, err := GetGroup(ctx, id)
+	if err != nil {
+		return Group{}, err
+	}
+	if !current.MatchesETag(ifMatch) {
+		return Group{}, groupPreconditionError(id)
+	}
+
+	desired, err := update(current)
+	if err != nil {
+		return Group{}, err
+	}
+	err = validateGroup(ctx, desired)
+	if err != nil {
+		return Group{}, err
+	}
+
+	var changed []string
+	if desired.DisplayName != current.DisplayName {
+		changed = append(changed, "display_name")
+	}
+	if desired.ExternalId != current.ExternalId {
+		changed = append(changed, "external_id")
+	}
+	added, removed := diffMembers(current.MemberIds(), desired.MemberIds())
+	if len(changed) == 0 && len(added) == 0 && len(removed) == 0 {
+		return current, nil
+	}
+
+	// Bump the version even if only the members changed, so that ETags change with them
+	queryStr := fmt.Sprintf("UPDATE %s SET display_name = $1, external_id = $2, updated_at = now(), version = version + 1 WHERE id = $3 AND version = $4 RETURNING %s;",
+		GroupsTableName, groupColumns)
+	var updated Group
+	err = inTransaction(ctx, func(tx *sql.Tx) error {
+		queryCtx, done := startTableQuery(ctx, GroupsTableName, "update_group", queryStr, desired.DisplayName, desired.ExternalId, current.Id, current.Version)
+		updated, err = scanGroup(tx.QueryRowContext(queryCtx, queryStr, desired.DisplayName, desired.ExternalId, current.Id, current.Version))
+		done(err)
+		if conflict := groupConflictError(err); conflict != nil {
+			return conflict
+		} else if err == sql.ErrNoRows {
+
+			// The group was changed or deleted after it was retrieved
+			_, err = GetGroup(ctx, id)
+			if err != nil {
+				return err
+			}
+			return groupPreconditionError(id)
+		} else if err != nil {
+			return utilities.NewInternalError("Failed to update group", err)
+		}
+
+		err = changeGroupMembers(ctx, tx, current.Id, added, removed)
+		if err != nil {
+			return err
+		}
+		groups := []Group{updated}
+		err = loadGroupMembers(ctx, tx, groups)
+		updated = groups[0]
+		return err
+	})
+	if err != nil {
+		return Group{}, err
+	}
+
+	details := map[string]interface{}{"fields": changed}
+	if len(added) > 0 {
+		details["added_members"] = added
+	}
+	if len(removed) > 0 {
+		details["removed_members"] = removed
+	}
+	recordAudit(ctx, AuditGroupUpdated, groupTarget(id), details)
+	return updated, nil
+}
+
+func DeleteGroup(ctx context.Context, id string) error {
+	ctx, span := startOperation(ctx, "DeleteGroup", "group.id", id)
+	err := deleteGroup(ctx, id)
+	span.Finish(err)
+	return err
+}
+
+func deleteGroup(ctx context.Context, id string) error {
+	groupId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return groupNotFoundError(id)
+	}
+
+	// Members are removed with the group
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE id = $1;", GroupsTableName)
+	queryCtx, done := startTableQuery(ctx, GroupsTableName, "delete_group", queryStr, groupId)
+	result, err := db.DB.ExecContext(queryCtx, queryStr, groupId)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to delete group", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return groupNotFoundError(id)
+	}
+
+	recordAudit(ctx, AuditGroupDeleted, groupTarget(id), nil)
+	return nil
+}
+
+// GetUserGroups returns the groups each of the given users belongs to, by user id
+func GetUserGroups(ctx context.Context, userIds []int) (map[int][]GroupRef, error) {
+	ctx, span := startOperation(ctx, "GetUserGroups")
+	groups, err := getUserGroups(ctx, userIds)
+	span.Finish(err)
+	return groups, err
+}
+
+func getUserGroups(ctx context.Context, userIds []int) (map[int][]GroupRef, error) {
+	groups := make(map[int][]GroupRef)
+	if len(userIds) == 0 {
+		return groups, nil
+	}
+
+	queryStr := fmt.Sprintf("SELECT m.user_id, g.id, g.display_name FROM %s m JOIN %s g ON g.id = m.group_id WHERE m.user_id = ANY($1) ORDER BY g.id;",
+		GroupMembersTableName, GroupsTableName)
+	queryCtx, done := startTableQuery(ctx, GroupMembersTableName, "list_user_groups", queryStr, pq.Array(userIds))
+	rows, err := db.DB.QueryContext(queryCtx, queryStr, pq.Array(userIds))
+	if err != nil {
+		done(err)
+		return nil, utilities.NewInternalError("Failed to retrieve groups", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId int
+		var group GroupRef
+		if err := rows.Scan(&userId, &group.Id, &group.DisplayName); err != nil {
+			done(err)
+			return nil, utilities.NewInternalError("Failed to retrieve groups", err)
+		}
+		groups[userId] = append(groups[userId], group)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return nil, utilities.NewInternalError("Failed to retrieve groups", err)
+	}
+	return groups, nil
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"github.com/omar-ozgur/gram/metrics"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+var loginsTotal = metrics.NewCounter("gram_logins_total", "Login attempts by result and failure reason.", "result", "reason")
+
+var signupsTotal = metrics.NewCounter("gram_signups_total", "Signup attempts by result and failure code.", "result", "reason")
+
+var tokensIssuedTotal = metrics.NewCounter("gram_tokens_issued_total", "Tokens issued by logins.")
+
+var auditFailuresTotal = metrics.NewCounter("gram_audit_failures_total", "Audit events that could not be recorded.")
+
+var bcryptDuration = metrics.NewHistogram("gram_bcrypt_duration_seconds", "Time spent hashing and comparing passwords.",
+	[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5}, "operation")
+
+var queryDuration = metrics.NewHistogram("gram_db_query_duration_seconds", "Latency of database queries by operation.",
+	metrics.DefaultBuckets, "operation")
+
+func recordSignup(err error) {
+	if err == nil {
+		signupsTotal.Inc("success", "")
+		return
+	}
+	signupsTotal.Inc("failure", utilities.AsError(err).Code)
+}
+
+// loginFailed counts and audits a failed login by reason, such as unknown_user or wrong_password.
+// The target is the user whose password was wrong, if the user was found.
+func loginFailed(ctx context.Context, target, reason string, err error) (string, error) {
+	loginsTotal.Inc("failure", reason)
+	recordAudit(ctx, AuditLoginFailed, target, map[string]interface{}{"reason": reason})
+	return "", err
+}
+
+func hashPassword(ctx context.Context, password []byte) (hash []byte, err error) {
+	_, span := tracing.Start(ctx, "bcrypt.hash", tracing.KindInternal)
+	defer bcryptDuration.Since(time.Now(), "hash")
+	hash, err = bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	span.Finish(err)
+	return hash, err
+}
+
+func comparePassword(ctx context.Context, hash, password []byte) error {
+	_, span := tracing.Start(ctx, "bcrypt.compare", tracing.KindInternal)
+	defer bcryptDuration.Since(time.Now(), "compare")
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	span.Finish(nil)
+	return err
+}
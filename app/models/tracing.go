@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"time"
+)
+
+// startOperation starts a span for a model operation, such as CreateUser
+func startOperation(ctx context.Context, name string, attributes ...interface{}) (context.Context, *tracing.Span) {
+	return tracing.Start(ctx, "models."+name, tracing.KindInternal, attributes...)
+}
+
+// startQuery starts timing and tracing a SQL statement. Call the returned function with the statement's error when it completes.
+// Statements are traced without their values, which may include password hashes, and logged at debug level with them redacted.
+func startQuery(ctx context.Context, operation, query string, values ...interface{}) (context.Context, func(error)) {
+	return startTableQuery(ctx, UserTableName, operation, query, values...)
+}
+
+// startTableQuery is startQuery for a statement on a table other than the users table
+func startTableQuery(ctx context.Context, table, operation, query string, values ...interface{}) (context.Context, func(error)) {
+	utilities.Log(ctx).Debug("SQL query",
+		zap.String("operation", operation),
+		zap.String("query", query),
+		zap.Strings("values", redactValues(values)))
+
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "db "+operation, tracing.KindClient,
+		"db.system", "postgresql",
+		"db.operation.name", operation,
+		"db.collection.name", table,
+		"db.query.text", query)
+
+	return ctx, func(err error) {
+		queryDuration.Since(start, operation)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		span.Finish(err)
+	}
+}
+
+// redactValues formats statement values for logs. Bytes are only used for password hashes, so they are never logged.
+func redactValues(values []interface{}) []string {
+	redacted := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case []byte:
+			redacted[i] = utilities.Redacted
+		default:
+			redacted[i] = utilities.RedactString(fmt.Sprint(v))
+		}
+	}
+	return redacted
+}
@@ -2,83 +2,317 @@ package models
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/asaskevich/govalidator"
 	"github.com/dgrijalva/jwt-go"
 	_ "github.com/lib/pq"
 	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/events"
 	"github.com/omar-ozgur/gram/utilities"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/oleiade/reflections.v1"
-	"os"
 	"reflect"
+	"strings"
 	"time"
 )
 
 type User struct {
-	Id           int       `valid:"-"`
-	First_name   string    `valid:"required"`
-	Last_name    string    `valid:"required"`
-	Email        string    `valid:"email,required"`
-	Password     []byte    `valid:"required"`
-	Time_created time.Time `valid:"-"`
+	Id           int            `valid:"-" visibility:"public"`
+	First_name   string         `valid:"required" visibility:"public"`
+	Last_name    string         `valid:"required" visibility:"public"`
+	Email        string         `valid:"email" visibility:"self"`
+	Username     string         `valid:"-" visibility:"public"`
+	Phone        string         `valid:"-" visibility:"self"`
+	Password     []byte         `valid:"required" visibility:"none"`
+	Time_created time.Time      `valid:"-" visibility:"public"`
+	Attributes   UserAttributes `valid:"-" visibility:"self"`
+	Updated_at   time.Time      `valid:"-" visibility:"public"`
+	Version      int            `valid:"-" visibility:"public"`
+	Active       bool           `valid:"-" visibility:"admin"`
+	External_id  string         `valid:"-" visibility:"admin"`
+}
+
+// Visibility is the level of access a viewer has to a user's fields
+type Visibility int
+
+const (
+	VisibilityPublic Visibility = iota
+	VisibilitySelf
+	VisibilityAdmin
+)
+
+var visibilityLevels = map[string]Visibility{
+	"public": VisibilityPublic,
+	"self":   VisibilitySelf,
+	"admin":  VisibilityAdmin,
 }
 
 var UserTableName string
 
-var UserAutoParams = map[string]bool{"Id": true, "Time_created": true}
-var UserUniqueParams = map[string]bool{"Email": true}
+const UserColumns = "id, first_name, last_name, email, username, phone, password, time_created, attributes, updated_at, version, active, external_id"
+
+// UserSortColumns whitelists the fields users can be sorted by
+var UserSortColumns = map[string]string{
+	"id":           "id",
+	"first_name":   "first_name",
+	"last_name":    "last_name",
+	"time_created": "time_created",
+}
+
+// UserColumnCasts are applied to parameters compared against columns of other types
+var UserColumnCasts = map[string]string{
+	"time_created": "::timestamp",
+	"updated_at":   "::timestamp",
+}
+
+type UserListParams struct {
+	Limit         int
+	Offset        int // Skips users, for clients such as SCIM that page by index rather than by cursor
+	Cursor        string
+	Sort          string
+	Descending    bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	IncludeTotal  bool
+	Filter        *UserFilter
+	Visibility    Visibility
+}
+
+type UserPage struct {
+	Users      []User
+	NextCursor string
+	Total      *int
+}
+
+// userCursor identifies the last user of a page by its sort value and id
+type userCursor struct {
+	Sort       string
+	Descending bool
+	Value      interface{}
+	Id         int
+}
+
+// UserAutoParams are set by Gram rather than by clients. Identity providers set Active and External_id.
+var UserAutoParams = map[string]bool{"Id": true, "Time_created": true, "Updated_at": true, "Version": true, "Active": true, "External_id": true}
 var UserRequiredParams = map[string]bool{"First_name": true, "Last_name": true, "Email": true, "Password": true}
 
-func CreateUser(user User) (status string, message string, createdUser User) {
+// View returns the fields of a user that a viewer with the given visibility may see.
+// Fields without a visibility tag, or tagged "none", are never returned.
+func (user User) View(visibility Visibility) map[string]interface{} {
+	view := make(map[string]interface{})
 
-	// Encrypt password
-	hash, err := bcrypt.GenerateFromPassword(user.Password, bcrypt.DefaultCost)
-	if err != nil {
-		return "error", fmt.Sprintf("Failed to encrypt password: %s", err.Error()), User{}
+	value := reflect.ValueOf(user)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		level, ok := visibilityLevels[field.Tag.Get("visibility")]
+		if !ok || level > visibility {
+			continue
+		}
+		view[field.Name] = value.Field(i).Interface()
 	}
-	reflections.SetField(&user, "Password", hash)
 
-	// Get user fields
-	value := reflect.ValueOf(user)
-	if value.NumField() <= len(UserRequiredParams) {
-		return "error", "Invalid number of user parameters", User{}
+	return view
+}
+
+func ViewUsers(users []User, visibility func(User) Visibility) []map[string]interface{} {
+	views := make([]map[string]interface{}, len(users))
+	for i, user := range users {
+		views[i] = user.View(visibility(user))
 	}
+	return views
+}
 
-	// Validate user
-	_, err = govalidator.ValidateStruct(user)
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (user User, err error) {
+	var email, username, phone sql.NullString
+	err = row.Scan(&user.Id, &user.First_name, &user.Last_name, &email, &username, &phone, &user.Password, &user.Time_created, &user.Attributes, &user.Updated_at, &user.Version, &user.Active, &user.External_id)
+	user.Email, user.Username, user.Phone = email.String, username.String, phone.String
+	return
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func encodeUserCursor(user User, params UserListParams) string {
+	cursor := userCursor{Sort: params.Sort, Descending: params.Descending, Id: user.Id}
+	switch params.Sort {
+	case "first_name":
+		cursor.Value = user.First_name
+	case "last_name":
+		cursor.Value = user.Last_name
+	case "time_created":
+		cursor.Value = user.Time_created.UTC().Format(time.RFC3339Nano)
+	}
+
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeUserCursor(encoded string, params UserListParams) (cursor userCursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cursor)
 	if err != nil {
-		return "error", fmt.Sprintf("Failed to validate user: %s", err.Error()), User{}
+		return
+	}
+
+	// Cursors are only valid for the ordering they were created with
+	if cursor.Sort != params.Sort || cursor.Descending != params.Descending {
+		return cursor, errors.New("cursor does not match the requested sort order")
 	}
+	if params.Sort == "time_created" {
+		value, _ := cursor.Value.(string)
+		cursor.Value, err = time.Parse(time.RFC3339Nano, value)
+	} else if _, ok := cursor.Value.(string); !ok && params.Sort != "id" {
+		err = errors.New("cursor value must be a string")
+	}
+	return
+}
+
+// userValidationError converts govalidator errors to per-field validation errors
+func userValidationError(err error) *utilities.Error {
+	var fields []utilities.FieldError
 
-	// Check user uniqueness
-	uniqueMap := make(map[string]interface{})
-	for key, _ := range UserUniqueParams {
-		fieldValue, err := reflections.GetField(&user, key)
+	errs, ok := err.(govalidator.Errors)
+	if !ok {
+		errs = govalidator.Errors{err}
+	}
+	for _, e := range errs.Errors() {
+		fieldErr, ok := e.(govalidator.Error)
+		if !ok {
+			fields = append(fields, utilities.FieldError{Code: utilities.FieldInvalid, Message: e.Error()})
+			continue
+		}
+		code := utilities.FieldInvalid
+		if strings.Contains(fieldErr.Err.Error(), "non zero value required") {
+			code = utilities.FieldRequired
+		}
+		fields = append(fields, utilities.FieldError{Field: fieldErr.Name, Code: code, Message: fieldErr.Error()})
+	}
+
+	return utilities.NewValidationError("The user is invalid", fields...)
+}
+
+func userConflictError(field string) *utilities.Error {
+	err := utilities.NewError(utilities.ErrorConflict, utilities.CodeUserConflict, "A user with the same details already exists")
+	err.Fields = []utilities.FieldError{{Field: field, Code: utilities.FieldTaken, Message: fmt.Sprintf("%s is already in use", field)}}
+	return err
+}
+
+func userNotFoundError(id string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorNotFound, utilities.CodeUserNotFound, fmt.Sprintf("User %s was not found", id))
+}
+
+// decodeLegacyHash recovers bcrypt hashes that older versions stored as formatted byte lists, such as "[36 50 97 ...]"
+func decodeLegacyHash(stored []byte) []byte {
+	if len(stored) < 2 || stored[0] != '[' || stored[len(stored)-1] != ']' {
+		return stored
+	}
+
+	var hash []byte
+	for _, part := range strings.Fields(string(stored[1 : len(stored)-1])) {
+		var b byte
+		_, err := fmt.Sscanf(part, "%d", &b)
+		if err != nil {
+			return stored
+		}
+		hash = append(hash, b)
+	}
+	return hash
+}
+
+func CreateUser(ctx context.Context, user User) (User, error) {
+	ctx, span := startOperation(ctx, "CreateUser")
+	created, err := createUser(ctx, user, false)
+	recordSignup(err)
+	span.Finish(err)
+	return created, err
+}
+
+// ProvisionUser creates a user on behalf of an identity provider. The signup policy does not apply, and a user
+// without a password is given a random one, so that they can only log in through the provider.
+func ProvisionUser(ctx context.Context, user User) (User, error) {
+	ctx, span := startOperation(ctx, "ProvisionUser")
+	created, err := createUser(ctx, user, true)
+	span.Finish(err)
+	return created, err
+}
+
+func createUser(ctx context.Context, user User, provisioned bool) (User, error) {
+
+	// Apply service policy
+	policy := utilities.CurrentConfig().Policy()
+	if !provisioned {
+		if !policy.AllowSignup {
+			return User{}, utilities.NewError(utilities.ErrorForbidden, utilities.CodeSignupDisabled, "Signups are disabled for this service")
+		}
+		user.Active, user.External_id = true, ""
+	} else if len(user.Password) == 0 {
+		password, err := randomPassword()
 		if err != nil {
-			return "error", fmt.Sprintf("Failed to get field: %s", err.Error()), User{}
+			return User{}, utilities.NewInternalError("Failed to generate password", err)
 		}
-		uniqueMap[key] = fieldValue
+		user.Password = password
 	}
-	status, message, retrievedUsers := SearchUsers(uniqueMap, "AND")
-	if status != "success" {
-		return "error", "Failed to check user uniqueness", User{}
-	} else if retrievedUsers != nil {
-		return "error", "User is not unique", User{}
+	if len(user.Password) < policy.MinPasswordLength {
+		return User{}, utilities.NewValidationError("The user is invalid", utilities.FieldError{
+			Field:   "Password",
+			Code:    utilities.FieldTooShort,
+			Message: fmt.Sprintf("Password must be at least %d characters long", policy.MinPasswordLength),
+		})
 	}
 
+	// Validate user
+	_, err := govalidator.ValidateStruct(user)
+	if err != nil {
+		return User{}, userValidationError(err)
+	}
+	identifierFields := map[string]interface{}{"Email": user.Email, "Username": user.Username, "Phone": user.Phone}
+	fieldErrors := normalizeIdentifierFields(User{}, identifierFields)
+	if len(fieldErrors) > 0 {
+		return User{}, utilities.NewValidationError("The user is invalid", fieldErrors...)
+	}
+	user.Email = identifierFields["Email"].(string)
+	user.Username = identifierFields["Username"].(string)
+	user.Phone = identifierFields["Phone"].(string)
+	err = validateUserAttributes(user.Attributes)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Encrypt password
+	hash, err := hashPassword(ctx, user.Password)
+	if err != nil {
+		return User{}, utilities.NewInternalError("Failed to encrypt password", err)
+	}
+	reflections.SetField(&user, "Password", hash)
+
 	// Create query string
 	var queryStr bytes.Buffer
 	queryStr.WriteString(fmt.Sprintf("INSERT INTO %s (", UserTableName))
 
 	// Set present column names
+	value := reflect.ValueOf(user)
 	var fieldsStr, valuesStr bytes.Buffer
 	var values []interface{}
 	parameterIndex := 1
 	var first = true
 	for i := 0; i < value.NumField(); i++ {
 		fieldName := value.Type().Field(i).Name
-		fieldValue := fmt.Sprintf("%v", value.Field(i).Interface())
+		fieldValue := value.Field(i).Interface()
 		if UserAutoParams[fieldName] {
 			continue
 		}
@@ -88,162 +322,285 @@ func CreateUser(user User) (status string, message string, createdUser User) {
 		} else {
 			first = false
 		}
+		if isIdentifierColumn(fieldName) {
+			fieldValue = identifierValue(fieldValue)
+		}
 		fieldsStr.WriteString(fieldName)
 		valuesStr.WriteString(fmt.Sprintf("$%d", parameterIndex))
 		parameterIndex += 1
 		values = append(values, fieldValue)
 	}
-
-	// Finish and prepare query
-	queryStr.WriteString(fmt.Sprintf("%s) VALUES(%s) RETURNING id;", fieldsStr.String(), valuesStr.String()))
-	utilities.Sugar.Infof("SQL Query: %s", queryStr.String())
-	utilities.Sugar.Infof("Values: %v", values)
-	stmt, err := db.DB.Prepare(queryStr.String())
-	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error()), User{}
-	}
-
-	// Execute query
-	err = stmt.QueryRow(values...).Scan(&user.Id)
+	fieldsStr.WriteString(", username_skeleton, active, external_id")
+	valuesStr.WriteString(fmt.Sprintf(", $%d, $%d, $%d", parameterIndex, parameterIndex+1, parameterIndex+2))
+	values = append(values, identifierValue(identifierFields["Username_skeleton"]), user.Active, user.External_id)
+
+	// Finish and execute query, publishing the event and recording the audit event in the same transaction
+	queryStr.WriteString(fmt.Sprintf("%s) VALUES(%s) RETURNING %s;", fieldsStr.String(), valuesStr.String(), UserColumns))
+	var created User
+	err = inTransaction(ctx, func(tx *sql.Tx) error {
+		queryCtx, done := startQuery(ctx, "create_user", queryStr.String(), values...)
+		created, err = scanUser(tx.QueryRowContext(queryCtx, queryStr.String(), values...))
+		done(err)
+		if conflict := uniqueViolationError(err); conflict != nil {
+			return conflict
+		} else if err != nil {
+			return utilities.NewInternalError("Failed to create new user", err)
+		}
+		err = publishUserEvent(ctx, tx, events.UserCreated, created, nil)
+		if err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, AuditUserCreated, userTarget(created.Id), nil)
+	})
 	if err != nil {
-		return "error", fmt.Sprintf("Failed to create new user: %s", err.Error()), User{}
+		return User{}, err
 	}
 
-	// Get created user
-	status, _, createdUser = GetUser(fmt.Sprintf("%v", user.Id))
-	if status != "success" {
-		return "error", "Failed to retrieve created user", User{}
-	}
+	return created, nil
+}
 
-	return "success", "New user created", createdUser
+func LoginUser(ctx context.Context, user User) (string, error) {
+	ctx, span := startOperation(ctx, "LoginUser")
+	token, err := loginUser(ctx, user)
+	span.Finish(err)
+	return token, err
 }
 
-func LoginUser(user User) (status string, message string, createdToken string) {
+func loginUser(ctx context.Context, user User) (string, error) {
 
 	// Check login parameter presence
-	if user.Email == "" {
-		return "error", "Email cannot be blank", ""
-	} else if len(user.Password) == 0 {
-		return "error", "Password cannot be blank", ""
+	if len(user.Password) == 0 {
+		return loginFailed(ctx, "", "invalid_request", utilities.NewValidationError("The login request is invalid", utilities.FieldError{Field: "Password", Code: utilities.FieldRequired, Message: "Password cannot be blank"}))
 	}
 
-	// Find user by email
-	var foundUser User
-	queryStr := fmt.Sprintf("SELECT * FROM %s WHERE email=$1;", UserTableName)
-	utilities.Sugar.Infof("SQL Query: %s", queryStr)
-	utilities.Sugar.Infof("Values: %v", user.Email)
-	stmt, err := db.DB.Prepare(queryStr)
-	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error()), ""
+	// Verify credentials with the service's authentication backend
+	verifier, ok := CredentialVerifiers[utilities.CurrentConfig().Policy().Authentication]
+	if !ok {
+		verifier = PasswordVerifier{}
 	}
-	row := stmt.QueryRow(user.Email)
-	err = row.Scan(&foundUser.Id, &foundUser.First_name, &foundUser.Last_name, &foundUser.Email, &foundUser.Password, &foundUser.Time_created)
-	if err != nil {
-		return "error", "Error while retrieving user", ""
+	foundUser, err := verifier.VerifyCredentials(ctx, user)
+	if failure, ok := err.(*LoginFailure); ok {
+		return loginFailed(ctx, failure.Target, failure.Reason, failure.Err)
+	} else if err != nil {
+		return loginFailed(ctx, "", utilities.AsError(err).Code, err)
 	}
+	return completeLogin(ctx, foundUser, nil)
+}
 
-	// Check password
-	var hash []byte
-	hash, err = bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return "error", "Error while encrypting password", ""
-	}
-	err = bcrypt.CompareHashAndPassword(hash, user.Password)
-	if err != nil {
-		return "error", "Error while checking password", ""
+// completeLogin issues a token to a user whose credentials have been verified, unless they are deactivated.
+// details are recorded in the audit event, such as the provider of a federated login.
+func completeLogin(ctx context.Context, foundUser User, details map[string]interface{}) (string, error) {
+
+	// Users deactivated by an identity provider cannot log in
+	if !foundUser.Active {
+		return loginFailed(ctx, userTarget(foundUser.Id), "inactive", invalidCredentialsError())
 	}
 
 	// Create jwt token
-	var secretKey = []byte(os.Getenv("GRAM_TOKEN_SECRET"))
+	config := utilities.CurrentConfig()
+	secretKey := []byte(config.Tokens.Secret)
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 	claims["user_id"] = foundUser.Id
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-	tokenString, _ := token.SignedString(secretKey)
+	expiresAt := time.Now().Add(config.TokenLifetime())
+	claims["exp"] = expiresAt.Unix()
+	for name, value := range attributeClaims(foundUser) {
+		claims[name] = value
+	}
+	tokenString, err := token.SignedString(secretKey)
+	if err != nil {
+		return loginFailed(ctx, userTarget(foundUser.Id), utilities.CodeInternal, utilities.NewInternalError("Failed to sign token", err))
+	}
 
-	return "success", "Login token generated", tokenString
+	// Publish the login to webhooks and event streams
+	err = inTransaction(ctx, func(tx *sql.Tx) error {
+		return publishEvent(ctx, tx, events.SessionCreated, map[string]interface{}{
+			"user":       foundUser.View(VisibilityAdmin),
+			"expires_at": expiresAt.UTC().Truncate(time.Second),
+		})
+	})
+	if err != nil {
+		return loginFailed(ctx, userTarget(foundUser.Id), utilities.CodeInternal, err)
+	}
+
+	loginsTotal.Inc("success", "")
+	tokensIssuedTotal.Inc()
+	utilities.GetRequestSource(ctx).SetActor(userTarget(foundUser.Id))
+	recordAudit(ctx, AuditLoginSucceeded, userTarget(foundUser.Id), details)
+	return tokenString, nil
+}
+
+func GetUser(ctx context.Context, id string) (User, error) {
+	ctx, span := startOperation(ctx, "GetUser", "user.id", id)
+	user, err := getUser(ctx, id)
+	span.Finish(err)
+	return user, err
 }
 
-func GetUser(id string) (status string, message string, retrievedUser User) {
+func getUser(ctx context.Context, id string) (User, error) {
 
 	// Create and execute query
-	queryStr := fmt.Sprintf("SELECT * FROM %s WHERE id=$1;", UserTableName)
-	utilities.Sugar.Infof("SQL Query: %s", queryStr)
-	utilities.Sugar.Infof("Values: %v", id)
-	stmt, err := db.DB.Prepare(queryStr)
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE id=$1;", UserColumns, UserTableName)
+	ctx, done := startQuery(ctx, "get_user", queryStr, id)
+	stmt, err := db.DB.PrepareContext(ctx, queryStr)
 	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error()), User{}
+		done(err)
+		return User{}, utilities.NewInternalError("Failed to prepare DB query", err)
 	}
-	row := stmt.QueryRow(id)
+	row := stmt.QueryRowContext(ctx, id)
 
 	// Get user info
-	var user User
-	err = row.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Time_created)
-	if err != nil {
-		return "error", "Failed to retrieve user information", User{}
+	user, err := scanUser(row)
+	done(err)
+	if err == sql.ErrNoRows {
+		return User{}, userNotFoundError(id)
+	} else if err != nil {
+		return User{}, utilities.NewInternalError("Failed to retrieve user information", err)
 	}
 
-	return "success", "Retrieved user", user
+	return user, nil
+}
+
+// IsActiveUser reports whether the user exists and has not been deactivated
+func IsActiveUser(ctx context.Context, id string) (bool, error) {
+	queryStr := fmt.Sprintf("SELECT active FROM %s WHERE id=$1;", UserTableName)
+	ctx, done := startQuery(ctx, "get_user_active", queryStr, id)
+	var active bool
+	err := db.DB.QueryRowContext(ctx, queryStr, id).Scan(&active)
+	done(err)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, utilities.NewInternalError("Failed to retrieve user information", err)
+	}
+	return active, nil
 }
 
-func GetUsers() (status string, message string, retrievedUsers []User) {
+func GetUsers(ctx context.Context, params UserListParams) (UserPage, error) {
+	ctx, span := startOperation(ctx, "GetUsers", "page.limit", params.Limit, "page.sort", params.Sort)
+	page, err := getUsers(ctx, params)
+	span.Finish(err)
+	return page, err
+}
 
-	// Create and execute query
-	queryStr := fmt.Sprintf("SELECT * FROM %s;", UserTableName)
-	utilities.Sugar.Infof("SQL Query: %s", queryStr)
-	rows, err := db.DB.Query(queryStr)
-	if err != nil {
-		return "error", "Failed to query users", nil
+func getUsers(ctx context.Context, params UserListParams) (UserPage, error) {
+	var page UserPage
+
+	// Validate sort field
+	column, ok := UserSortColumns[params.Sort]
+	if !ok {
+		return UserPage{}, utilities.NewValidationError("The listing parameters are invalid", utilities.FieldError{
+			Field:   "sort",
+			Code:    utilities.FieldInvalid,
+			Message: fmt.Sprintf("Users cannot be sorted by '%s'", params.Sort),
+		})
+	}
+	direction, comparison := "ASC", ">"
+	if params.Descending {
+		direction, comparison = "DESC", "<"
 	}
 
-	// Get user info
-	var users []User
-	for rows.Next() {
-		var user User
-		err = rows.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Time_created)
+	// Apply filters
+	var conditions []string
+	var values []interface{}
+	if !params.CreatedAfter.IsZero() {
+		values = append(values, params.CreatedAfter.UTC())
+		conditions = append(conditions, fmt.Sprintf("time_created >= $%d::timestamp", len(values)))
+	}
+	if !params.CreatedBefore.IsZero() {
+		values = append(values, params.CreatedBefore.UTC())
+		conditions = append(conditions, fmt.Sprintf("time_created < $%d::timestamp", len(values)))
+	}
+
+	if params.Filter != nil {
+		var condition string
+		var err error
+		condition, values, err = params.Filter.Compile(params.Visibility, values)
 		if err != nil {
-			return "error", "Failed to retrieve user information", nil
+			return UserPage{}, err
 		}
-		users = append(users, user)
+		conditions = append(conditions, condition)
 	}
 
-	return "success", "Retrieved users", users
-}
+	// Count matching users before the cursor is applied
+	if params.IncludeTotal {
+		queryStr := fmt.Sprintf("SELECT count(*) FROM %s%s;", UserTableName, whereClause(conditions))
+		var total int
+		queryCtx, done := startQuery(ctx, "count_users", queryStr, values...)
+		err := db.DB.QueryRowContext(queryCtx, queryStr, values...).Scan(&total)
+		done(err)
+		if err != nil {
+			return UserPage{}, utilities.NewInternalError("Failed to count users", err)
+		}
+		page.Total = &total
+	}
 
-func UpdateUser(id string, user User) (status string, message string, updatedUser User) {
+	// Continue after the last user of the previous page
+	if params.Cursor != "" {
+		cursor, err := decodeUserCursor(params.Cursor, params)
+		if err != nil {
+			return UserPage{}, utilities.NewValidationError("The listing parameters are invalid", utilities.FieldError{
+				Field:   "cursor",
+				Code:    utilities.FieldInvalid,
+				Message: "The cursor is invalid or does not match the requested sort order",
+			})
+		}
+		if column == "id" {
+			values = append(values, cursor.Id)
+			conditions = append(conditions, fmt.Sprintf("id %s $%d", comparison, len(values)))
+		} else {
+			values = append(values, cursor.Value, cursor.Id)
+			conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d%s, $%d)", column, comparison, len(values)-1, UserColumnCasts[column], len(values)))
+		}
+	}
 
-	// Get user fields
-	value := reflect.ValueOf(user)
-	if value.NumField() <= 0 {
-		return "error", "Invalid number of fields", user
+	// Fetch one extra user to find out whether there is a next page
+	values = append(values, params.Limit+1, params.Offset)
+	queryStr := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s %s, id %s LIMIT $%d OFFSET $%d;",
+		UserColumns, UserTableName, whereClause(conditions), column, direction, direction, len(values)-1, len(values))
+	queryCtx, done := startQuery(ctx, "list_users", queryStr, values...)
+	rows, err := db.DB.QueryContext(queryCtx, queryStr, values...)
+	if err != nil {
+		done(err)
+		return UserPage{}, utilities.NewInternalError("Failed to query users", err)
 	}
+	defer rows.Close()
 
-	// Check user uniqueness
-	uniqueMap := make(map[string]interface{})
-	for key, _ := range UserUniqueParams {
-		fieldValue, err := reflections.GetField(&user, key)
-		if err != nil || reflect.DeepEqual(fieldValue, reflect.Zero(reflect.TypeOf(fieldValue)).Interface()) {
-			continue
+	// Get user info
+	page.Users = []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			done(err)
+			return UserPage{}, utilities.NewInternalError("Failed to retrieve user information", err)
 		}
-		uniqueMap[key] = fieldValue
-	}
-	if len(uniqueMap) > 0 {
-		status, _, retrievedUsers := SearchUsers(uniqueMap, "OR")
-		if status != "success" {
-			return "error", "Failed to check user uniqueness", User{}
-		} else if retrievedUsers != nil {
-			return "error", "User is not unique", User{}
+		page.Users = append(page.Users, user)
+	}
+	done(rows.Err())
+
+	if len(page.Users) > params.Limit {
+		page.Users = page.Users[:params.Limit]
+		if params.Limit > 0 {
+			page.NextCursor = encodeUserCursor(page.Users[len(page.Users)-1], params)
 		}
 	}
 
-	// Create query string
-	var queryStr bytes.Buffer
-	queryStr.WriteString(fmt.Sprintf("UPDATE %s SET", UserTableName))
+	return page, nil
+}
 
-	// Set present column names and values
-	var values []interface{}
-	parameterIndex := 1
-	var first = true
+// UpdateUser changes the non-empty fields of the given user, if the user still matches ifMatch
+func UpdateUser(ctx context.Context, id string, user User, ifMatch string) (User, error) {
+	ctx, span := startOperation(ctx, "UpdateUser", "user.id", id)
+	updated, err := retryUpdate(id, ifMatch, func() (User, error) { return updateUser(ctx, id, user, ifMatch) })
+	span.Finish(err)
+	return updated, err
+}
+
+func updateUser(ctx context.Context, id string, user User, ifMatch string) (User, error) {
+
+	// Collect given fields
+	fields := make(map[string]interface{})
+	value := reflect.ValueOf(user)
 	for i := 0; i < value.NumField(); i++ {
 		fieldName := value.Type().Field(i).Name
 		fieldValue := value.Field(i).Interface()
@@ -253,116 +610,105 @@ func UpdateUser(id string, user User) (status string, message string, updatedUse
 		if reflect.DeepEqual(fieldValue, reflect.Zero(reflect.TypeOf(fieldValue)).Interface()) {
 			continue
 		}
-		if !first {
-			queryStr.WriteString(", ")
-		} else {
-			queryStr.WriteString(" ")
-			first = false
-		}
 		if fieldName == "Password" {
-			hash, err := bcrypt.GenerateFromPassword([]byte(fieldValue.(string)), bcrypt.DefaultCost)
-			if err != nil {
-				return "error", "Failed to encrypt password", User{}
-			}
-			queryStr.WriteString(fmt.Sprintf("%v=$%d", fieldName, parameterIndex))
-			values = append(values, hash)
-		} else {
-			queryStr.WriteString(fmt.Sprintf("%v=$%d", fieldName, parameterIndex))
-			values = append(values, fieldValue)
+			fieldValue = string(user.Password)
 		}
-		parameterIndex += 1
+		fields[fieldName] = fieldValue
 	}
-
-	// Finish and execute query
-	queryStr.WriteString(fmt.Sprintf(" WHERE id=$%d;", parameterIndex))
-	values = append(values, id)
-	utilities.Sugar.Infof("SQL Query: %s", queryStr.String())
-	utilities.Sugar.Infof("Values: %v", values)
-	stmt, err := db.DB.Prepare(queryStr.String())
-	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error()), User{}
+	if len(fields) == 0 {
+		return User{}, utilities.NewValidationError("No fields were given")
 	}
 
-	// Execute query
-	_, err = stmt.Exec(values...)
+	// Check preconditions
+	current, err := GetUser(ctx, id)
 	if err != nil {
-		return "error", fmt.Sprintf("Failed to update user: %s", err.Error()), User{}
+		return User{}, err
 	}
-
-	// Get update user
-	status, message, retrievedUser := GetUser(id)
-	if status == "success" {
-		return "success", "Updated user", retrievedUser
-	} else {
-		return "error", "Failed to retrieve updated user", User{}
+	if !current.MatchesETag(ifMatch) {
+		return User{}, userPreconditionError(id)
 	}
-}
 
-func DeleteUser(id string) (status string, message string) {
-
-	// Create and execute query
-	queryStr := fmt.Sprintf("DELETE FROM %s WHERE id=$1;", UserTableName)
-	utilities.Sugar.Infof("SQL Query: %s", queryStr)
-	utilities.Sugar.Infof("Values: %v", id)
-	stmt, err := db.DB.Prepare(queryStr)
-	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error())
-	}
-	_, err = stmt.Exec(id)
-	if err != nil {
-		return "error", "Failed to delete user"
-	}
+	return updateUserFields(ctx, current, fields)
+}
 
-	return "success", "Deleted user"
+func DeleteUser(ctx context.Context, id string) error {
+	ctx, span := startOperation(ctx, "DeleteUser", "user.id", id)
+	err := deleteUser(ctx, id)
+	span.Finish(err)
+	return err
 }
 
-func SearchUsers(parameters map[string]interface{}, operator string) (status string, message string, retrievedUsers []User) {
+func deleteUser(ctx context.Context, id string) error {
+
+	// Create and execute query, publishing the event and recording the audit event in the same transaction
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE id=$1 RETURNING %s;", UserTableName, UserColumns)
+	err := inTransaction(ctx, func(tx *sql.Tx) error {
+		queryCtx, done := startQuery(ctx, "delete_user", queryStr, id)
+		deleted, err := scanUser(tx.QueryRowContext(queryCtx, queryStr, id))
+		done(err)
+		if err == sql.ErrNoRows {
+			return userNotFoundError(id)
+		} else if err != nil {
+			return utilities.NewInternalError("Failed to delete user", err)
+		}
+		err = publishUserEvent(ctx, tx, events.UserDeleted, deleted, nil)
+		if err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, AuditUserDeleted, userTarget(id), nil)
+	})
+	return err
+}
 
-	// Create query string
-	var queryStr bytes.Buffer
+// SearchUsers finds users whose fields equal every given value, or any of them if operator is "OR"
+func SearchUsers(ctx context.Context, parameters map[string]interface{}, operator string) ([]User, error) {
+	ctx, span := startOperation(ctx, "SearchUsers")
+	users, err := searchUsers(ctx, parameters, operator)
+	span.Finish(err)
+	return users, err
+}
 
-	// Create and execute query
-	queryStr.WriteString(fmt.Sprintf("SELECT * FROM %s WHERE", UserTableName))
+func searchUsers(ctx context.Context, parameters map[string]interface{}, operator string) ([]User, error) {
 
-	// Set present column names and values
-	var values []interface{}
-	parameterIndex := 1
-	var first = true
+	// Build a filter from whitelisted fields
+	var conditions []UserFilter
 	for key, value := range parameters {
-		if !first {
-			queryStr.WriteString(fmt.Sprintf(" %s ", operator))
-		} else {
-			queryStr.WriteString(" ")
-			first = false
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, utilities.NewInternalError(fmt.Sprintf("Invalid value for '%s'", key), err)
 		}
-		queryStr.WriteString(fmt.Sprintf("%v=$%d", key, parameterIndex))
-		values = append(values, value)
-		parameterIndex += 1
+		conditions = append(conditions, UserFilter{Field: strings.ToLower(key), Op: "eq", Value: encoded})
 	}
-
-	// Finish and execute query
-	queryStr.WriteString(";")
-	utilities.Sugar.Infof("SQL Query: %s", queryStr.String())
-	utilities.Sugar.Infof("Values: %v", values)
-	stmt, err := db.DB.Prepare(queryStr.String())
+	filter := UserFilter{And: conditions}
+	if operator == "OR" {
+		filter = UserFilter{Or: conditions}
+	}
+	condition, values, err := filter.Compile(VisibilityAdmin, nil)
 	if err != nil {
-		return "error", fmt.Sprintf("Failed to prepare DB query: %s", err.Error()), nil
+		return nil, err
 	}
-	rows, err := stmt.Query(values...)
+
+	// Create and execute query
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE %s;", UserColumns, UserTableName, condition)
+	ctx, done := startQuery(ctx, "search_users", queryStr, values...)
+	rows, err := db.DB.QueryContext(ctx, queryStr, values...)
 	if err != nil {
-		return "error", "Failed to query users", nil
+		done(err)
+		return nil, utilities.NewInternalError("Failed to query users", err)
 	}
+	defer rows.Close()
 
 	// Return users
 	var users []User
 	for rows.Next() {
-		var user User
-		err = rows.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Time_created)
+		user, err := scanUser(rows)
 		if err != nil {
-			return "error", "Failed to retrieve user information", nil
+			done(err)
+			return nil, utilities.NewInternalError("Failed to retrieve user information", err)
 		}
 		users = append(users, user)
 	}
+	done(rows.Err())
 
-	return "success", "Retrieved users", users
+	return users, nil
 }
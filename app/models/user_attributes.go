@@ -0,0 +1,119 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/omar-ozgur/gram/utilities"
+	"regexp"
+)
+
+// UserAttributes are custom fields defined by the service's attribute schema, stored as JSONB
+type UserAttributes map[string]interface{}
+
+// attributeNameRegexp matches the attribute names that can be searched
+var attributeNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// attributeSearchTypes maps schema types to search field types and the SQL that reads an attribute as that type.
+// Values that cannot be cast, which an earlier schema may have allowed, read as NULL rather than failing the query.
+var attributeSearchTypes = map[string][2]string{
+	"string":  {"string", "(attributes->>'%[1]s')"},
+	"integer": {"int", "(CASE WHEN jsonb_typeof(attributes->'%[1]s') = 'number' AND attributes->>'%[1]s' ~ '^-?[0-9]{1,18}$' THEN (attributes->>'%[1]s')::bigint END)"},
+	"number":  {"number", "(CASE WHEN jsonb_typeof(attributes->'%[1]s') = 'number' THEN (attributes->>'%[1]s')::numeric END)"},
+	"boolean": {"bool", "(CASE WHEN jsonb_typeof(attributes->'%[1]s') = 'boolean' THEN (attributes->>'%[1]s')::boolean END)"},
+}
+
+func (a *UserAttributes) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*a = UserAttributes{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.New("attributes must be JSON")
+	}
+	return json.Unmarshal(data, (*map[string]interface{})(a))
+}
+
+func (a UserAttributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(map[string]interface{}(a))
+	return string(data), err
+}
+
+// validateUserAttributes checks attributes against the current service's attribute schema
+func validateUserAttributes(attributes UserAttributes) error {
+	s, err := utilities.CurrentConfig().Policy().Attributes()
+	if err != nil {
+		return utilities.NewInternalError("Failed to load the attribute schema", err)
+	}
+
+	if s == nil {
+		if len(attributes) == 0 {
+			return nil
+		}
+		return utilities.NewValidationError("The user is invalid", utilities.FieldError{
+			Field:   "Attributes",
+			Code:    utilities.FieldUnknown,
+			Message: "This service does not have custom attributes",
+		})
+	}
+
+	if attributes == nil {
+		attributes = UserAttributes{}
+	}
+
+	var fields []utilities.FieldError
+	for _, e := range s.Validate(map[string]interface{}(attributes)) {
+		field := "Attributes"
+		if e.Path != "" {
+			field += "." + e.Path
+		}
+		fields = append(fields, utilities.FieldError{Field: field, Code: utilities.FieldInvalid, Message: fmt.Sprintf("%s %s", field, e.Message)})
+	}
+	if len(fields) > 0 {
+		return utilities.NewValidationError("The user is invalid", fields...)
+	}
+	return nil
+}
+
+// attributeSearchFields returns the custom attributes that users can be searched by, as "attributes.<name>"
+func attributeSearchFields() (map[string]searchField, error) {
+	fields := make(map[string]searchField)
+
+	s, err := utilities.CurrentConfig().Policy().Attributes()
+	if err != nil || s == nil {
+		return fields, err
+	}
+
+	for name, property := range s.Properties {
+		searchType, ok := attributeSearchTypes[property.Type()]
+		if !ok || !attributeNameRegexp.MatchString(name) {
+			continue
+		}
+		fields["attributes."+name] = searchField{
+			Column:     fmt.Sprintf(searchType[1], name),
+			Type:       searchType[0],
+			Visibility: VisibilitySelf,
+		}
+	}
+	return fields, nil
+}
+
+// attributeClaims returns the user's attributes that the service includes in tokens
+func attributeClaims(user User) map[string]interface{} {
+	claims := make(map[string]interface{})
+	for _, name := range utilities.CurrentConfig().Policy().AttributeClaims {
+		if value, ok := user.Attributes[name]; ok {
+			claims[name] = value
+		}
+	}
+	return claims
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"github.com/omar-ozgur/gram/utilities"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttributeSearchFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attributes.json")
+	err := ioutil.WriteFile(path, []byte(`{"type": "object", "properties": {
+		"team": {"type": "string"},
+		"level": {"type": "integer"},
+		"score": {"type": ["number", "null"]},
+		"remote": {"type": "boolean"},
+		"tags": {"type": "array"},
+		"bad-name": {"type": "string"}
+	}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := utilities.CurrentConfig()
+	t.Cleanup(func() { utilities.SetConfig(previous) })
+	config := utilities.DefaultConfig()
+	var policy utilities.ServicePolicy
+	policy.SetDefaults()
+	policy.AttributeSchema = path
+	config.Services = map[string]utilities.ServicePolicy{config.Server.Service: policy}
+	utilities.SetConfig(config)
+
+	fields, err := attributeSearchFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Casts are guarded, so values stored under an earlier schema read as NULL instead of failing the search
+	want := map[string]searchField{
+		"attributes.team":   {Column: "(attributes->>'team')", Type: "string", Visibility: VisibilitySelf},
+		"attributes.level":  {Column: "(CASE WHEN jsonb_typeof(attributes->'level') = 'number' AND attributes->>'level' ~ '^-?[0-9]{1,18}$' THEN (attributes->>'level')::bigint END)", Type: "int", Visibility: VisibilitySelf},
+		"attributes.score":  {Column: "(CASE WHEN jsonb_typeof(attributes->'score') = 'number' THEN (attributes->>'score')::numeric END)", Type: "number", Visibility: VisibilitySelf},
+		"attributes.remote": {Column: "(CASE WHEN jsonb_typeof(attributes->'remote') = 'boolean' THEN (attributes->>'remote')::boolean END)", Type: "bool", Visibility: VisibilitySelf},
+	}
+	if len(fields) != len(want) {
+		t.Errorf("got fields %v", fields)
+	}
+	for name, field := range want {
+		if fields[name] != field {
+			t.Errorf("%s: got %+v, want %+v", name, fields[name], field)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"github.com/omar-ozgur/gram/utilities"
+)
+
+// CredentialVerifier checks the identifier and password of a login request and returns the user they belong to.
+// Rejected credentials are returned as a *LoginFailure, so that the login is counted and audited by reason.
+type CredentialVerifier interface {
+	VerifyCredentials(ctx context.Context, login User) (User, error)
+}
+
+// CredentialVerifiers are the authentication backends, keyed by the value of a service's authentication setting
+var CredentialVerifiers = map[string]CredentialVerifier{
+	utilities.AuthenticationPassword: PasswordVerifier{},
+	utilities.AuthenticationLDAP:     LDAPVerifier{},
+}
+
+// LoginFailure is a rejected login. Reason is reported in metrics and the audit log, and Target is the user
+// whose credentials were rejected, if the user is known. Clients only see Err.
+type LoginFailure struct {
+	Target string
+	Reason string
+	Err    error
+}
+
+func (f *LoginFailure) Error() string {
+	return f.Err.Error()
+}
+
+func (f *LoginFailure) Unwrap() error {
+	return f.Err
+}
+
+func invalidCredentialsError() error {
+	return utilities.NewError(utilities.ErrorUnauthorized, utilities.CodeInvalidCredentials, "The login details or password are incorrect")
+}
+
+// PasswordVerifier compares passwords with the hashes stored for users
+type PasswordVerifier struct{}
+
+func (PasswordVerifier) VerifyCredentials(ctx context.Context, login User) (User, error) {
+	invalidCredentials := invalidCredentialsError()
+
+	// Find user by the given identifier
+	foundUser, err := findLoginUser(ctx, login, invalidCredentials)
+	if err == invalidCredentials {
+		return User{}, &LoginFailure{Reason: "unknown_user", Err: err}
+	} else if err != nil {
+		return User{}, err
+	}
+
+	// Check password
+	err = comparePassword(ctx, decodeLegacyHash(foundUser.Password), login.Password)
+	if err != nil {
+		return User{}, &LoginFailure{Target: userTarget(foundUser.Id), Reason: "wrong_password", Err: invalidCredentials}
+	}
+	return foundUser, nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+// useUsersDB configures password logins by email, and stores the users in a loginFlowDB in place of Postgres
+func useUsersDB(t *testing.T, users ...User) {
+	t.Helper()
+	previousConfig, previousDB := utilities.CurrentConfig(), db.DB
+	config := utilities.DefaultConfig()
+	config.Tokens.Secret = "test-secret"
+	utilities.SetConfig(config)
+	db.DB = sql.OpenDB(&loginFlowDB{flows: make(map[string]storedLoginFlow), users: users})
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = previousDB
+		utilities.SetConfig(previousConfig)
+	})
+}
+
+func TestPasswordVerifier(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useUsersDB(t,
+		User{Id: 1, Email: "jdoe@example.com", Password: hash, Active: true},
+
+		// Older versions stored hashes as formatted byte lists
+		User{Id: 2, Email: "legacy@example.com", Password: []byte(fmt.Sprintf("%v", hash)), Active: true},
+	)
+
+	cases := []struct {
+		name     string
+		email    string
+		password string
+		id       int
+		reason   string
+	}{
+		{"correct password", "jdoe@example.com", "correct horse", 1, ""},
+		{"email in another case", "JDoe@Example.com", "correct horse", 1, ""},
+		{"legacy hash", "legacy@example.com", "correct horse", 2, ""},
+		{"wrong password", "jdoe@example.com", "wrong horse", 0, "wrong_password"},
+		{"wrong password with a legacy hash", "legacy@example.com", "wrong horse", 0, "wrong_password"},
+		{"password prefix", "jdoe@example.com", "correct", 0, "wrong_password"},
+		{"the stored hash as the password", "jdoe@example.com", string(hash), 0, "wrong_password"},
+		{"unknown user", "nobody@example.com", "correct horse", 0, "unknown_user"},
+	}
+
+	for _, c := range cases {
+		user, err := PasswordVerifier{}.VerifyCredentials(context.Background(), User{Email: c.email, Password: []byte(c.password)})
+		if c.reason == "" {
+			if err != nil || user.Id != c.id {
+				t.Errorf("%s: got user %d, %v", c.name, user.Id, err)
+			}
+			continue
+		}
+		failure, ok := err.(*LoginFailure)
+		if !ok || failure.Reason != c.reason || errorCode(failure.Err) != utilities.CodeInvalidCredentials {
+			t.Errorf("%s: got %v, want an invalid_credentials failure with reason %s", c.name, err, c.reason)
+		}
+	}
+}
+
+// Logging in once accepted any password, because the password was compared with a new hash of itself
+func TestLoginUserRejectsWrongPasswords(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useUsersDB(t, User{Id: 1, Email: "jdoe@example.com", Password: hash, Active: true})
+
+	for _, password := range []string{"wrong horse", "x", "correct horse "} {
+		token, err := LoginUser(context.Background(), User{Email: "jdoe@example.com", Password: []byte(password)})
+		if token != "" || errorCode(err) != utilities.CodeInvalidCredentials {
+			t.Errorf("%q: got token %q, %v, want invalid_credentials", password, token, err)
+		}
+	}
+
+	token, err := LoginUser(context.Background(), User{Email: "jdoe@example.com"})
+	if token != "" || errorCode(err) != utilities.CodeValidationFailed {
+		t.Errorf("empty password: got token %q, %v, want validation_failed", token, err)
+	}
+}
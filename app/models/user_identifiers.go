@@ -0,0 +1,213 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/identifiers"
+	"github.com/omar-ozgur/gram/utilities"
+	"strings"
+)
+
+// UserIdentifierFields maps the user fields that can identify a user to their identifier names
+var UserIdentifierFields = []struct{ Field, Identifier string }{
+	{"Email", identifiers.Email},
+	{"Username", identifiers.Username},
+	{"Phone", identifiers.Phone},
+}
+
+// uniqueConstraintFields maps unique indexes, without the service prefix, to the fields they cover
+var uniqueConstraintFields = map[string]string{
+	"email_key":             "Email",
+	"username_skeleton_key": "Username",
+	"phone_key":             "Phone",
+}
+
+const uniqueViolation = "23505"
+
+// derivedUserFields are set from other fields rather than by clients
+var derivedUserFields = map[string]bool{
+	"Username_skeleton": true,
+}
+
+// normalizeIdentifierFields normalizes the identifiers among changed fields and checks them against the service policy.
+// Usernames also set Username_skeleton, which the database keeps unique so that look-alike usernames cannot be registered.
+func normalizeIdentifierFields(current User, fields map[string]interface{}) []utilities.FieldError {
+	policy := utilities.CurrentConfig().Policy()
+	var fieldErrors []utilities.FieldError
+
+	hasLogin := false
+	for _, identifier := range UserIdentifierFields {
+		value, changed := fields[identifier.Field]
+		if !changed {
+			value, _ = current.identifier(identifier.Field)
+		}
+		text, _ := value.(string)
+		text = strings.TrimSpace(text)
+
+		if text == "" {
+			if policy.IdentifierRequired(identifier.Identifier) {
+				fieldErrors = append(fieldErrors, utilities.FieldError{Field: identifier.Field, Code: utilities.FieldRequired, Message: fmt.Sprintf("%s cannot be blank", identifier.Field)})
+			}
+			if changed {
+				fields[identifier.Field] = ""
+				if identifier.Field == "Username" {
+					fields["Username_skeleton"] = ""
+				}
+			}
+			continue
+		}
+		if policy.IdentifierEnabled(identifier.Identifier) {
+			hasLogin = true
+		}
+		if !changed {
+			continue
+		}
+
+		var err error
+		switch identifier.Field {
+		case "Username":
+			text, err = identifiers.NormalizeUsername(text)
+			fields["Username_skeleton"] = identifiers.Skeleton(text)
+		case "Phone":
+			text, err = identifiers.NormalizePhone(text)
+		}
+		if err != nil {
+			fieldErrors = append(fieldErrors, utilities.FieldError{Field: identifier.Field, Code: utilities.FieldInvalid, Message: fmt.Sprintf("%s %s", identifier.Field, err.Error())})
+			continue
+		}
+		fields[identifier.Field] = text
+	}
+
+	if !hasLogin && len(fieldErrors) == 0 {
+		fieldErrors = append(fieldErrors, utilities.FieldError{
+			Field:   loginFieldName(policy.LoginIdentifiers[0]),
+			Code:    utilities.FieldRequired,
+			Message: fmt.Sprintf("At least one of %s is required to log in", strings.Join(policy.LoginIdentifiers, ", ")),
+		})
+	}
+
+	return fieldErrors
+}
+
+func (user User) identifier(field string) (string, bool) {
+	switch field {
+	case "Email":
+		return user.Email, user.Email != ""
+	case "Username":
+		return user.Username, user.Username != ""
+	case "Phone":
+		return user.Phone, user.Phone != ""
+	}
+	return "", false
+}
+
+func loginFieldName(identifier string) string {
+	for _, field := range UserIdentifierFields {
+		if field.Identifier == identifier {
+			return field.Field
+		}
+	}
+	return identifier
+}
+
+// identifierValue stores blank identifiers as NULL, so that unique indexes ignore them
+func identifierValue(value interface{}) interface{} {
+	if text, ok := value.(string); ok && text == "" {
+		return nil
+	}
+	return value
+}
+
+func isIdentifierColumn(field string) bool {
+	return field == "Email" || field == "Username" || field == "Username_skeleton" || field == "Phone"
+}
+
+// uniqueViolationError converts a unique index violation to a conflict on the field it covers, or returns nil
+func uniqueViolationError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != uniqueViolation {
+		return nil
+	}
+
+	field, ok := uniqueConstraintFields[strings.TrimPrefix(pqErr.Constraint, UserTableName+"_")]
+	if !ok {
+		return utilities.NewError(utilities.ErrorConflict, utilities.CodeUserConflict, "A user with the same details already exists")
+	}
+	return userConflictError(field)
+}
+
+// loginIdentifier returns the field and value of the first identifier given in a login request
+func loginIdentifier(user User) (field, value string, err error) {
+	policy := utilities.CurrentConfig().Policy()
+
+	for _, identifier := range UserIdentifierFields {
+		value, ok := user.identifier(identifier.Field)
+		if !ok {
+			continue
+		}
+		if !policy.IdentifierEnabled(identifier.Identifier) {
+			return "", "", utilities.NewValidationError("The login request is invalid", utilities.FieldError{
+				Field:   identifier.Field,
+				Code:    utilities.FieldInvalid,
+				Message: fmt.Sprintf("Logging in by %s is not enabled for this service", identifier.Identifier),
+			})
+		}
+		return identifier.Field, value, nil
+	}
+	return "", "", utilities.NewValidationError("The login request is invalid", utilities.FieldError{
+		Field:   loginFieldName(policy.LoginIdentifiers[0]),
+		Code:    utilities.FieldRequired,
+		Message: fmt.Sprintf("One of %s is required", strings.Join(policy.LoginIdentifiers, ", ")),
+	})
+}
+
+// findLoginUser finds the user identified by the first identifier given in the login request
+func findLoginUser(ctx context.Context, user User, invalidCredentials error) (User, error) {
+	field, value, err := loginIdentifier(user)
+	if err != nil {
+		return User{}, err
+	}
+
+	var condition string
+	var values []interface{}
+	switch field {
+	case "Email":
+		condition, values = "lower(email)=lower($1)", []interface{}{value}
+	case "Username":
+		username, err := identifiers.NormalizeUsername(value)
+		if err != nil {
+			return User{}, invalidCredentials
+		}
+		condition, values = "username_skeleton=$1 AND lower(username)=lower($2)", []interface{}{identifiers.Skeleton(username), username}
+	case "Phone":
+		phone, err := identifiers.NormalizePhone(value)
+		if err != nil {
+			return User{}, invalidCredentials
+		}
+		condition, values = "phone=$1", []interface{}{phone}
+	}
+
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE %s;", UserColumns, UserTableName, condition)
+	ctx, done := startQuery(ctx, "find_login_user", queryStr, values...)
+	foundUser, err := scanUser(db.DB.QueryRowContext(ctx, queryStr, values...))
+	done(err)
+	if err == sql.ErrNoRows {
+		return User{}, invalidCredentials
+	} else if err != nil {
+		return User{}, utilities.NewInternalError("Failed to retrieve user", err)
+	}
+
+	return foundUser, nil
+}
+
+// findUserByEmail returns the user with an email address, ignoring case, or sql.ErrNoRows
+func findUserByEmail(ctx context.Context, email string) (User, error) {
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE lower(email)=lower($1);", UserColumns, UserTableName)
+	ctx, done := startQuery(ctx, "find_user_by_email", queryStr, email)
+	user, err := scanUser(db.DB.QueryRowContext(ctx, queryStr, email))
+	done(err)
+	return user, err
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"github.com/omar-ozgur/gram/ldap"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// LDAPVerifier verifies logins by searching the service's directory for the login identifier with the service
+// account, then binding as the entry that was found with the given password. Directory users are matched to
+// Gram users by email, and created the first time they log in if provisioning is enabled. Their names, and
+// username if mapped, are updated from the directory on every login.
+type LDAPVerifier struct{}
+
+func (LDAPVerifier) VerifyCredentials(ctx context.Context, login User) (User, error) {
+	config := utilities.CurrentConfig().Policy().LDAP
+	_, identifier, err := loginIdentifier(login)
+	if err != nil {
+		return User{}, err
+	}
+
+	ctx, span := tracing.Start(ctx, "ldap.authenticate", tracing.KindClient, "ldap.url", config.URL)
+	entry, err := authenticateLDAP(ctx, config, identifier, string(login.Password))
+	span.Finish(err)
+	if err != nil {
+		return User{}, err
+	}
+
+	desired := User{
+		First_name: entry.GetAttribute(config.Attributes.FirstName),
+		Last_name:  entry.GetAttribute(config.Attributes.LastName),
+		Email:      entry.GetAttribute(config.Attributes.Email),
+	}
+	if config.Attributes.Username != "" {
+		desired.Username = entry.GetAttribute(config.Attributes.Username)
+	}
+	if desired.Email == "" {
+		utilities.Log(ctx).Warn("Directory entry has no email address", zap.String("dn", entry.DN), zap.String("attribute", config.Attributes.Email))
+		return User{}, &LoginFailure{Reason: "missing_email", Err: utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, "Your directory entry has no email address")}
+	}
+
+	// Find or create the Gram user, and bring their details up to date
+	found, err := findUserByEmail(ctx, desired.Email)
+	if err == sql.ErrNoRows {
+		if !config.Provision {
+			return User{}, &LoginFailure{Reason: "unknown_user", Err: invalidCredentialsError()}
+		}
+		desired.Active = true
+		return ProvisionUser(ctx, desired)
+	} else if err != nil {
+		return User{}, utilities.NewInternalError("Failed to retrieve user", err)
+	}
+
+	if config.Attributes.Username == "" {
+		desired.Username = found.Username
+	}
+	if found.First_name == desired.First_name && found.Last_name == desired.Last_name && found.Username == desired.Username {
+		return found, nil
+	}
+	return UpdateProvisionedUser(ctx, fmt.Sprintf("%d", found.Id), func(current User) (User, error) {
+		current.First_name, current.Last_name, current.Username = desired.First_name, desired.Last_name, desired.Username
+		current.Password = nil
+		return current, nil
+	}, "")
+}
+
+// authenticateLDAP finds the directory entry of a login identifier and binds as it with the password
+func authenticateLDAP(ctx context.Context, config utilities.LDAPConfig, identifier, password string) (*ldap.Entry, error) {
+	conn, err := dialLDAP(ctx, config)
+	if err != nil {
+		return nil, directoryUnavailable(ctx, err)
+	}
+	defer conn.Close()
+
+	// Search as the service account, or anonymously if none is configured
+	if config.BindDN != "" {
+		if err := conn.Bind(ctx, config.BindDN, config.BindPassword); err != nil {
+			return nil, directoryUnavailable(ctx, err)
+		}
+	}
+	var attributes []string
+	for _, attribute := range []string{config.Attributes.FirstName, config.Attributes.LastName, config.Attributes.Email, config.Attributes.Username} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	entries, err := conn.Search(ctx, ldap.SearchRequest{
+		BaseDN:     config.BaseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     strings.Replace(config.UserFilter, utilities.LDAPLoginPlaceholder, ldap.EscapeFilter(identifier), -1),
+		Attributes: attributes,
+		SizeLimit:  2,
+	})
+	if err != nil {
+		return nil, directoryUnavailable(ctx, err)
+	}
+	if len(entries) == 0 {
+		return nil, &LoginFailure{Reason: "unknown_user", Err: invalidCredentialsError()}
+	}
+	if len(entries) > 1 {
+		utilities.Log(ctx).Warn("Login identifier matches more than one directory entry", zap.String("filter", config.UserFilter))
+		return nil, &LoginFailure{Reason: "ambiguous_user", Err: invalidCredentialsError()}
+	}
+
+	// Check password
+	if err := conn.Bind(ctx, entries[0].DN, password); ldap.IsInvalidCredentials(err) {
+		return nil, &LoginFailure{Reason: "wrong_password", Err: invalidCredentialsError()}
+	} else if err != nil {
+		return nil, directoryUnavailable(ctx, err)
+	}
+	return entries[0], nil
+}
+
+func dialLDAP(ctx context.Context, config utilities.LDAPConfig) (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pool, err := utilities.LoadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return ldap.Dial(ctx, ldap.Config{URL: config.URL, StartTLS: config.StartTLS, TLSConfig: tlsConfig, Timeout: config.Timeout})
+}
+
+func directoryUnavailable(ctx context.Context, err error) error {
+	utilities.Log(ctx).Error("Directory request failed", zap.Error(err))
+	return &LoginFailure{
+		Reason: utilities.CodeDirectoryUnavailable,
+		Err:    utilities.NewError(utilities.ErrorUnavailable, utilities.CodeDirectoryUnavailable, "The directory could not be reached"),
+	}
+}
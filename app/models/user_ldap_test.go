@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"encoding/pem"
+	"github.com/omar-ozgur/gram/ldap/ldaptest"
+	"github.com/omar-ozgur/gram/utilities"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testLDAPConfig(server *ldaptest.Server) utilities.LDAPConfig {
+	return utilities.LDAPConfig{
+		URL:           server.URL,
+		AllowInsecure: true,
+		BindDN:        "cn=service,dc=example,dc=com",
+		BindPassword:  "service-password",
+		BaseDN:        "ou=people,dc=example,dc=com",
+		UserFilter:    "(&(objectClass=person)(|(uid={login})(mail={login})))",
+		Timeout:       5 * time.Second,
+		Attributes:    utilities.LDAPAttributes{FirstName: "givenName", LastName: "sn", Email: "mail"},
+	}
+}
+
+func TestAuthenticateLDAP(t *testing.T) {
+	server := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=service,dc=example,dc=com", Password: "service-password"},
+		ldaptest.Entry{DN: "uid=jdoe,ou=people,dc=example,dc=com", Password: "jdoe-password", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"jdoe"}, "givenName": {"Jane"}, "sn": {"Doe"}, "mail": {"jdoe@example.com"},
+		}},
+
+		// Two entries share an email address, so logging in with it is ambiguous
+		ldaptest.Entry{DN: "uid=shared1,ou=people,dc=example,dc=com", Password: "shared-password", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"shared1"}, "mail": {"shared@example.com"},
+		}},
+		ldaptest.Entry{DN: "uid=shared2,ou=people,dc=example,dc=com", Password: "shared-password", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"shared2"}, "mail": {"shared@example.com"},
+		}},
+	)
+	defer server.Close()
+	config := testLDAPConfig(server)
+
+	cases := []struct {
+		name       string
+		identifier string
+		password   string
+		reason     string
+	}{
+		{"valid login", "jdoe", "jdoe-password", ""},
+		{"login by email", "JDOE@example.com", "jdoe-password", ""},
+		{"wrong password", "jdoe", "wrong-password", "wrong_password"},
+		{"empty password", "jdoe", "", "wrong_password"},
+		{"unknown user", "nobody", "jdoe-password", "unknown_user"},
+		{"wildcard login", "*", "jdoe-password", "unknown_user"},
+		{"filter injection", "*)(uid=*", "jdoe-password", "unknown_user"},
+		{"ambiguous user", "shared@example.com", "shared-password", "ambiguous_user"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entry, err := authenticateLDAP(context.Background(), config, c.identifier, c.password)
+			if c.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if entry.DN != "uid=jdoe,ou=people,dc=example,dc=com" || entry.GetAttribute("mail") != "jdoe@example.com" {
+					t.Errorf("got entry %+v", entry)
+				}
+				return
+			}
+			failure, ok := err.(*LoginFailure)
+			if !ok || failure.Reason != c.reason {
+				t.Errorf("got %v, want a login failure with reason %s", err, c.reason)
+			}
+		})
+	}
+
+	for _, bind := range server.Binds() {
+		if bind.Password == "" {
+			t.Errorf("an empty password was sent to the directory for %s", bind.DN)
+		}
+	}
+	for _, search := range server.Searches() {
+		if search.SizeLimit != 2 {
+			t.Errorf("searches should ask for at most 2 entries, got %d", search.SizeLimit)
+		}
+	}
+}
+
+func TestAuthenticateLDAPStartTLS(t *testing.T) {
+	server := ldaptest.NewTLSServer(
+		ldaptest.Entry{DN: "cn=service,dc=example,dc=com", Password: "service-password"},
+		ldaptest.Entry{DN: "uid=jdoe,ou=people,dc=example,dc=com", Password: "jdoe-password", Attributes: map[string][]string{
+			"objectClass": {"person"}, "uid": {"jdoe"}, "mail": {"jdoe@example.com"},
+		}},
+	)
+	server.RequireTLS = true
+	defer server.Close()
+
+	config := testLDAPConfig(server)
+	config.StartTLS = true
+
+	// The directory's certificate is not trusted without ca_file
+	_, err := authenticateLDAP(context.Background(), config, "jdoe", "jdoe-password")
+	if failure, ok := err.(*LoginFailure); !ok || failure.Reason != utilities.CodeDirectoryUnavailable {
+		t.Errorf("got %v, want directory_unavailable", err)
+	}
+	if binds := server.Binds(); len(binds) != 0 {
+		t.Errorf("credentials were sent before TLS was established: %+v", binds)
+	}
+
+	config.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(config.CAFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateLDAP(context.Background(), config, "jdoe", "jdoe-password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bind := range server.Binds() {
+		if !bind.TLS {
+			t.Errorf("%s was bound without TLS", bind.DN)
+		}
+	}
+}
+
+func TestAuthenticateLDAPUnavailable(t *testing.T) {
+	server := ldaptest.NewServer()
+	config := testLDAPConfig(server)
+	server.Close()
+
+	_, err := authenticateLDAP(context.Background(), config, "jdoe", "jdoe-password")
+	if failure, ok := err.(*LoginFailure); !ok || failure.Reason != utilities.CodeDirectoryUnavailable {
+		t.Errorf("got %v, want directory_unavailable", err)
+	}
+}
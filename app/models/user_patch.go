@@ -0,0 +1,280 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/omar-ozgur/gram/events"
+	"github.com/omar-ozgur/gram/utilities"
+	"sort"
+	"strings"
+)
+
+// UserPatchFields are the text fields of a user that can be changed by a patch
+var UserPatchFields = []string{"First_name", "Last_name", "Email", "Username", "Phone", "Password"}
+
+// ETag identifies the current version of a user for conditional requests
+func (user User) ETag() string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// MatchesETag reports whether the user satisfies an If-Match header.
+// An empty header has no precondition, and "*" matches any existing user.
+func (user User) MatchesETag(ifMatch string) bool {
+	return matchesETag(user.ETag(), ifMatch)
+}
+
+func matchesETag(etag, ifMatch string) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+
+	// If-Match uses strong comparison, so weak tags never match
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func userPreconditionError(id string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorPreconditionFailed, utilities.CodePreconditionFailed, fmt.Sprintf("User %s has been changed since it was retrieved", id))
+}
+
+// maxUpdateAttempts is how often an update without a version precondition is tried while other writers change the user
+const maxUpdateAttempts = 3
+
+// retryUpdate runs a read-modify-write update of the user. An If-Match header that names a version makes a lost race a
+// precondition failure; without one, the update is applied again to the new version, and only fails with a conflict
+// if it keeps losing.
+func retryUpdate(id, ifMatch string, update func() (User, error)) (User, error) {
+	if tag := strings.TrimSpace(ifMatch); tag != "" && tag != "*" {
+		return update()
+	}
+
+	for attempt := 1; ; attempt++ {
+		updated, err := update()
+		if err == nil || utilities.AsError(err).Code != utilities.CodePreconditionFailed {
+			return updated, err
+		}
+		if attempt == maxUpdateAttempts {
+			return User{}, utilities.NewError(utilities.ErrorConflict, utilities.CodeUpdateConflict, fmt.Sprintf("User %s kept changing while it was being updated", id))
+		}
+	}
+}
+
+// PatchDocument returns the editable fields of a user as a JSON document.
+// The password is write-only, so it is only present if a patch adds it.
+func (user User) PatchDocument() map[string]interface{} {
+	attributes := map[string]interface{}{}
+	for name, value := range user.Attributes {
+		attributes[name] = value
+	}
+
+	return map[string]interface{}{
+		"First_name": user.First_name,
+		"Last_name":  user.Last_name,
+		"Email":      user.Email,
+		"Username":   user.Username,
+		"Phone":      user.Phone,
+		"Attributes": attributes,
+	}
+}
+
+// PatchUser applies a patch to the user's patch document, if the user still matches ifMatch
+func PatchUser(ctx context.Context, id string, patch func(document interface{}) (interface{}, error), ifMatch string) (User, error) {
+	ctx, span := startOperation(ctx, "PatchUser", "user.id", id)
+	updated, err := retryUpdate(id, ifMatch, func() (User, error) { return patchUser(ctx, id, patch, ifMatch) })
+	span.Finish(err)
+	return updated, err
+}
+
+func patchUser(ctx context.Context, id string, patch func(document interface{}) (interface{}, error), ifMatch string) (User, error) {
+
+	// Check preconditions
+	current, err := GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if !current.MatchesETag(ifMatch) {
+		return User{}, userPreconditionError(id)
+	}
+
+	// Apply patch
+	patched, err := patch(current.PatchDocument())
+	if err != nil {
+		return User{}, err
+	}
+	document, ok := patched.(map[string]interface{})
+	if !ok {
+		return User{}, utilities.NewValidationError("The patched user must be a JSON object")
+	}
+
+	// Removed or null names and identifiers are cleared, and the password is only changed if given
+	fields := make(map[string]interface{})
+	var fieldErrors []utilities.FieldError
+	for _, name := range UserPatchFields {
+		value, present := document[name]
+		delete(document, name)
+		if (!present || value == nil) && name == "Password" {
+			continue
+		}
+		if !present || value == nil {
+			value = ""
+		}
+		if _, ok := value.(string); !ok {
+			fieldErrors = append(fieldErrors, utilities.FieldError{Field: name, Code: utilities.FieldInvalid, Message: fmt.Sprintf("%s must be a string", name)})
+			continue
+		}
+
+		// The password is base64 encoded, as it is when users sign up or log in
+		if name == "Password" {
+			password, err := base64.StdEncoding.DecodeString(value.(string))
+			if err != nil {
+				fieldErrors = append(fieldErrors, utilities.FieldError{Field: name, Code: utilities.FieldInvalid, Message: "Password must be base64 encoded"})
+				continue
+			}
+			value = string(password)
+		}
+		fields[name] = value
+	}
+
+	// Removed or null attributes are cleared
+	switch attributes := document["Attributes"].(type) {
+	case map[string]interface{}:
+		fields["Attributes"] = UserAttributes(attributes)
+	case nil:
+		fields["Attributes"] = UserAttributes{}
+	default:
+		fieldErrors = append(fieldErrors, utilities.FieldError{Field: "Attributes", Code: utilities.FieldInvalid, Message: "Attributes must be an object"})
+	}
+	delete(document, "Attributes")
+
+	var unknown []string
+	for name := range document {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fieldErrors = append(fieldErrors, utilities.FieldError{Field: name, Code: utilities.FieldUnknown, Message: fmt.Sprintf("%s cannot be changed", name)})
+	}
+	if len(fieldErrors) > 0 {
+		return User{}, utilities.NewValidationError("The patched user is invalid", fieldErrors...)
+	}
+
+	return updateUserFields(ctx, current, fields)
+}
+
+// validateUserFields checks and normalizes changed fields, keyed by user field name
+func validateUserFields(current User, fields map[string]interface{}) error {
+	fieldErrors := normalizeIdentifierFields(current, fields)
+
+	if value, ok := fields["Email"]; ok {
+		email, _ := value.(string)
+		if email != "" && !govalidator.IsEmail(email) {
+			fieldErrors = append(fieldErrors, utilities.FieldError{Field: "Email", Code: utilities.FieldInvalid, Message: fmt.Sprintf("Email: %s does not validate as email", email)})
+		}
+	}
+
+	if value, ok := fields["Password"]; ok {
+		password, _ := value.(string)
+		minLength := utilities.CurrentConfig().Policy().MinPasswordLength
+		if len(password) < minLength {
+			fieldErrors = append(fieldErrors, utilities.FieldError{Field: "Password", Code: utilities.FieldTooShort, Message: fmt.Sprintf("Password must be at least %d characters long", minLength)})
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return utilities.NewValidationError("The user is invalid", fieldErrors...)
+	}
+
+	if value, ok := fields["Attributes"]; ok {
+		attributes, _ := value.(UserAttributes)
+		return validateUserAttributes(attributes)
+	}
+	return nil
+}
+
+// updateUserFields writes changed fields, keyed by user field name, and bumps the user's version.
+// The update only applies if the user has not been changed since current was retrieved.
+func updateUserFields(ctx context.Context, current User, fields map[string]interface{}) (User, error) {
+	id := fmt.Sprintf("%d", current.Id)
+
+	err := validateUserFields(current, fields)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Create query string
+	var queryStr bytes.Buffer
+	queryStr.WriteString(fmt.Sprintf("UPDATE %s SET", UserTableName))
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var values []interface{}
+	for _, name := range names {
+		value := fields[name]
+		if name == "Password" {
+			hash, err := hashPassword(ctx, []byte(value.(string)))
+			if err != nil {
+				return User{}, utilities.NewInternalError("Failed to encrypt password", err)
+			}
+			value = hash
+		}
+		if isIdentifierColumn(name) {
+			value = identifierValue(value)
+		}
+		values = append(values, value)
+		queryStr.WriteString(fmt.Sprintf(" %s=$%d,", strings.ToLower(name), len(values)))
+	}
+
+	// Events and the audit log report the fields the client changed, not derived columns
+	var changed []string
+	for _, name := range names {
+		if !derivedUserFields[name] {
+			changed = append(changed, strings.ToLower(name))
+		}
+	}
+
+	// Finish and execute query, publishing the event and recording the audit event in the same transaction
+	values = append(values, current.Id, current.Version)
+	queryStr.WriteString(fmt.Sprintf(" updated_at=now(), version=version+1 WHERE id=$%d AND version=$%d RETURNING %s;", len(values)-1, len(values), UserColumns))
+	var updatedUser User
+	err = inTransaction(ctx, func(tx *sql.Tx) error {
+		queryCtx, done := startQuery(ctx, "update_user", queryStr.String(), values...)
+		updatedUser, err = scanUser(tx.QueryRowContext(queryCtx, queryStr.String(), values...))
+		done(err)
+		if conflict := uniqueViolationError(err); conflict != nil {
+			return conflict
+		} else if err == sql.ErrNoRows {
+
+			// The user was changed or deleted after it was retrieved
+			_, err = GetUser(ctx, id)
+			if err != nil {
+				return err
+			}
+			return userPreconditionError(id)
+		} else if err != nil {
+			return utilities.NewInternalError("Failed to update user", err)
+		}
+		err = publishUserEvent(ctx, tx, events.UserUpdated, updatedUser, changed)
+		if err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, AuditUserUpdated, userTarget(id), map[string]interface{}{"fields": changed})
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return updatedUser, nil
+}
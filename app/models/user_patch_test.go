@@ -0,0 +1,78 @@
+package models
+
+import (
+	"github.com/omar-ozgur/gram/utilities"
+	"testing"
+)
+
+func TestMatchesETag(t *testing.T) {
+	cases := []struct {
+		ifMatch string
+		want    bool
+	}{
+		{"", true},
+		{"*", true},
+		{`"3"`, true},
+		{` "2", "3" `, true},
+		{`"2"`, false},
+		{`W/"3"`, false},
+		{`3`, false},
+	}
+
+	for _, c := range cases {
+		if got := matchesETag(`"3"`, c.ifMatch); got != c.want {
+			t.Errorf("%q: got %v, want %v", c.ifMatch, got, c.want)
+		}
+	}
+}
+
+func TestRetryUpdate(t *testing.T) {
+	// raceUpdate loses the race to another writer the given number of times, then succeeds
+	raceUpdate := func(losses int, attempts *int) func() (User, error) {
+		return func() (User, error) {
+			*attempts++
+			if *attempts <= losses {
+				return User{}, userPreconditionError("1")
+			}
+			return User{Id: 1, Version: *attempts}, nil
+		}
+	}
+
+	cases := []struct {
+		name     string
+		ifMatch  string
+		losses   int
+		code     string
+		attempts int
+	}{
+		{"no race", "", 0, "", 1},
+		{"lost race without If-Match", "", maxUpdateAttempts - 1, "", maxUpdateAttempts},
+		{"lost race with If-Match *", "*", 1, "", 2},
+		{"kept losing the race", "", maxUpdateAttempts, utilities.CodeUpdateConflict, maxUpdateAttempts},
+		{"lost race with If-Match", `"1"`, 1, utilities.CodePreconditionFailed, 1},
+	}
+
+	for _, c := range cases {
+		attempts := 0
+		updated, err := retryUpdate("1", c.ifMatch, raceUpdate(c.losses, &attempts))
+		if got := errorCode(err); got != c.code {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.code)
+		}
+		if attempts != c.attempts {
+			t.Errorf("%s: got %d attempts, want %d", c.name, attempts, c.attempts)
+		}
+		if err == nil && updated.Id != 1 {
+			t.Errorf("%s: got %+v", c.name, updated)
+		}
+	}
+
+	// Other errors are returned without retrying
+	attempts := 0
+	_, err := retryUpdate("1", "", func() (User, error) {
+		attempts++
+		return User{}, utilities.NewValidationError("The user is invalid")
+	})
+	if errorCode(err) != utilities.CodeValidationFailed || attempts != 1 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/omar-ozgur/gram/utilities"
+	"reflect"
+)
+
+// ProvisionedFields are the fields of a user that an identity provider manages
+var ProvisionedFields = []string{"First_name", "Last_name", "Email", "Username", "Phone", "Active", "External_id"}
+
+// randomPassword returns a password that nobody knows, for users who log in through an identity provider
+func randomPassword() ([]byte, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+// UpdateProvisionedUser changes a user to match an identity provider, if the user still matches ifMatch.
+// update returns the user as the provider describes it; the provisioned fields that differ are saved, as is the
+// password if one is given. A user that already matches is returned without a new version.
+func UpdateProvisionedUser(ctx context.Context, id string, update func(current User) (User, error), ifMatch string) (User, error) {
+	ctx, span := startOperation(ctx, "UpdateProvisionedUser", "user.id", id)
+	updated, err := retryUpdate(id, ifMatch, func() (User, error) { return updateProvisionedUser(ctx, id, update, ifMatch) })
+	span.Finish(err)
+	return updated, err
+}
+
+func updateProvisionedUser(ctx context.Context, id string, update func(current User) (User, error), ifMatch string) (User, error) {
+
+	// Check preconditions
+	current, err := GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if !current.MatchesETag(ifMatch) {
+		return User{}, userPreconditionError(id)
+	}
+
+	desired, err := update(current)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Names are required, as they are when users sign up
+	var fieldErrors []utilities.FieldError
+	for _, name := range []string{"First_name", "Last_name"} {
+		if reflect.ValueOf(desired).FieldByName(name).String() == "" {
+			fieldErrors = append(fieldErrors, utilities.FieldError{Field: name, Code: utilities.FieldRequired, Message: fmt.Sprintf("%s cannot be blank", name)})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return User{}, utilities.NewValidationError("The user is invalid", fieldErrors...)
+	}
+
+	// Collect changed fields
+	fields := make(map[string]interface{})
+	currentValue, desiredValue := reflect.ValueOf(current), reflect.ValueOf(desired)
+	for _, name := range ProvisionedFields {
+		value := desiredValue.FieldByName(name).Interface()
+		if value != currentValue.FieldByName(name).Interface() {
+			fields[name] = value
+		}
+	}
+	if len(desired.Password) > 0 {
+		fields["Password"] = string(desired.Password)
+	}
+	if len(fields) == 0 {
+		return current, nil
+	}
+
+	return updateUserFields(ctx, current, fields)
+}
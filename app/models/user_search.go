@@ -0,0 +1,312 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/utilities"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserFilter is a search condition on a single field, an AND/OR group of conditions, or the negation of a filter.
+// Groups are filtered in the same format, by GroupSearchFields.
+type UserFilter struct {
+	And   []UserFilter    `json:"and,omitempty"`
+	Or    []UserFilter    `json:"or,omitempty"`
+	Not   *UserFilter     `json:"not,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type searchField struct {
+	Column          string
+	Type            string
+	Visibility      Visibility
+	CaseInsensitive bool
+}
+
+// UserSearchFields whitelists the fields users can be searched by
+var UserSearchFields = map[string]searchField{
+	"id":           {Column: "id", Type: "int", Visibility: VisibilityPublic},
+	"first_name":   {Column: "first_name", Type: "string", Visibility: VisibilityPublic},
+	"last_name":    {Column: "last_name", Type: "string", Visibility: VisibilityPublic},
+	"email":        {Column: "email", Type: "string", Visibility: VisibilitySelf, CaseInsensitive: true},
+	"username":     {Column: "username", Type: "string", Visibility: VisibilityPublic, CaseInsensitive: true},
+	"phone":        {Column: "phone", Type: "string", Visibility: VisibilitySelf},
+	"time_created": {Column: "time_created", Type: "time", Visibility: VisibilityPublic},
+	"updated_at":   {Column: "updated_at", Type: "time", Visibility: VisibilityPublic},
+	"active":       {Column: "active", Type: "bool", Visibility: VisibilityAdmin},
+	"external_id":  {Column: "external_id", Type: "string", Visibility: VisibilityAdmin},
+}
+
+const maxFilterDepth = 5
+const maxFilterConditions = 50
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type filterCompiler struct {
+	fields     map[string]searchField
+	casts      map[string]string
+	visibility Visibility
+	values     []interface{}
+	conditions int
+}
+
+// Compile converts the filter to a SQL condition, appending its parameters to values.
+// Fields above the given visibility cannot be searched, so that hidden values cannot be probed.
+func (filter UserFilter) Compile(visibility Visibility, values []interface{}) (string, []interface{}, error) {
+	fields, err := attributeSearchFields()
+	if err != nil {
+		return "", values, utilities.NewInternalError("Failed to load the attribute schema", err)
+	}
+	for name, field := range UserSearchFields {
+		fields[name] = field
+	}
+
+	c := &filterCompiler{fields: fields, casts: UserColumnCasts, visibility: visibility, values: values}
+	sql, err := c.compile(filter, 1)
+	return sql, c.values, err
+}
+
+// compileGroupFilter converts a filter on group fields to a SQL condition, appending its parameters to values
+func compileGroupFilter(filter UserFilter, values []interface{}) (string, []interface{}, error) {
+	c := &filterCompiler{fields: GroupSearchFields, visibility: VisibilityAdmin, values: values}
+	sql, err := c.compile(filter, 1)
+	return sql, c.values, err
+}
+
+func searchError(message string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorValidation, utilities.CodeInvalidSearch, message)
+}
+
+func (c *filterCompiler) compile(filter UserFilter, depth int) (string, error) {
+	if depth > maxFilterDepth {
+		return "", searchError(fmt.Sprintf("Filters cannot be nested more than %d levels deep", maxFilterDepth))
+	}
+
+	if filter.Not != nil {
+		if filter.And != nil || filter.Or != nil || filter.Field != "" {
+			return "", searchError("A filter must contain exactly one of 'and', 'or', 'not' or 'field'")
+		}
+		part, err := c.compile(*filter.Not, depth+1)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + part, nil
+	}
+
+	group, operator := filter.And, " AND "
+	if filter.Or != nil {
+		if filter.And != nil || filter.Field != "" {
+			return "", searchError("A filter must contain exactly one of 'and', 'or', 'not' or 'field'")
+		}
+		group, operator = filter.Or, " OR "
+	}
+	if group != nil {
+		if filter.Field != "" {
+			return "", searchError("A filter must contain exactly one of 'and', 'or', 'not' or 'field'")
+		}
+		if len(group) == 0 {
+			return "", searchError("Filter groups cannot be empty")
+		}
+		parts := make([]string, len(group))
+		for i, item := range group {
+			part, err := c.compile(item, depth+1)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		return "(" + strings.Join(parts, operator) + ")", nil
+	}
+
+	c.conditions++
+	if c.conditions > maxFilterConditions {
+		return "", searchError(fmt.Sprintf("Filters cannot contain more than %d conditions", maxFilterConditions))
+	}
+
+	field, ok := c.fields[filter.Field]
+	if !ok {
+		return "", searchError(fmt.Sprintf("Unknown search field '%s'. Valid fields are: %s", filter.Field, strings.Join(c.fieldNames(), ", ")))
+	}
+	if field.Visibility > c.visibility {
+		return "", utilities.NewError(utilities.ErrorForbidden, utilities.CodeForbidden, fmt.Sprintf("You do not have permission to search by '%s'", filter.Field))
+	}
+
+	column := field.Column
+	if field.CaseInsensitive {
+		column = fmt.Sprintf("lower(%s)", column)
+	}
+
+	switch filter.Op {
+	case "eq", "ne":
+		value, err := c.decodeValue(filter, field, filter.Value)
+		if err != nil {
+			return "", err
+		}
+		operator := "="
+		if filter.Op == "ne" {
+			operator = "<>"
+		}
+		return fmt.Sprintf("%s %s %s", column, operator, c.placeholder(value, field)), nil
+	case "prefix", "suffix", "contains":
+		if field.Type != "string" {
+			return "", searchError(fmt.Sprintf("The '%s' operator only applies to text fields", filter.Op))
+		}
+		value, err := c.decodeValue(filter, field, filter.Value)
+		if err != nil {
+			return "", err
+		}
+		pattern := likeEscaper.Replace(value.(string))
+		if filter.Op != "suffix" {
+			pattern += "%"
+		}
+		if filter.Op != "prefix" {
+			pattern = "%" + pattern
+		}
+		return fmt.Sprintf("%s LIKE %s", column, c.placeholder(pattern, field)), nil
+	case "present":
+		if field.Type == "string" {
+			return fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", column, column), nil
+		}
+		return fmt.Sprintf("%s IS NOT NULL", column), nil
+	case "in":
+		var raw []json.RawMessage
+		if err := json.Unmarshal(filter.Value, &raw); err != nil || len(raw) == 0 {
+			return "", searchError(fmt.Sprintf("The value of an 'in' filter on '%s' must be a non-empty array", filter.Field))
+		}
+		var items []interface{}
+		for _, item := range raw {
+			value, err := c.decodeValue(filter, field, item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return fmt.Sprintf("%s = ANY(%s)", column, c.arrayPlaceholder(items, field)), nil
+	case "range":
+		var bounds map[string]json.RawMessage
+		if err := json.Unmarshal(filter.Value, &bounds); err != nil || len(bounds) == 0 {
+			return "", searchError(fmt.Sprintf("The value of a 'range' filter on '%s' must be an object with gt, gte, lt or lte", filter.Field))
+		}
+		operators := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+		var parts []string
+		for _, bound := range []string{"gt", "gte", "lt", "lte"} {
+			raw, ok := bounds[bound]
+			if !ok {
+				continue
+			}
+			delete(bounds, bound)
+			value, err := c.decodeValue(filter, field, raw)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, fmt.Sprintf("%s %s %s", column, operators[bound], c.placeholder(value, field)))
+		}
+		for bound := range bounds {
+			return "", searchError(fmt.Sprintf("Unknown range bound '%s'. Valid bounds are: gt, gte, lt, lte", bound))
+		}
+		return "(" + strings.Join(parts, " AND ") + ")", nil
+	}
+
+	return "", searchError(fmt.Sprintf("Unknown search operator '%s'. Valid operators are: eq, ne, prefix, suffix, contains, present, in, range", filter.Op))
+}
+
+// decodeValue parses a JSON value as the field's type
+func (c *filterCompiler) decodeValue(filter UserFilter, field searchField, raw json.RawMessage) (interface{}, error) {
+	invalid := searchError(fmt.Sprintf("Invalid value for '%s': expected %s", filter.Field, field.Type))
+
+	switch field.Type {
+	case "int":
+		var value int64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, invalid
+		}
+		return value, nil
+	case "number":
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, invalid
+		}
+		return value, nil
+	case "bool":
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, invalid
+		}
+		return value, nil
+	case "time":
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, invalid
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, searchError(fmt.Sprintf("Invalid value for '%s': expected an RFC 3339 timestamp", filter.Field))
+		}
+		return t.UTC(), nil
+	default:
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, invalid
+		}
+		if field.CaseInsensitive {
+			value = strings.ToLower(value)
+		}
+		return value, nil
+	}
+}
+
+func (c *filterCompiler) placeholder(value interface{}, field searchField) string {
+	c.values = append(c.values, value)
+	return fmt.Sprintf("$%d%s", len(c.values), c.casts[field.Column])
+}
+
+func (c *filterCompiler) arrayPlaceholder(items []interface{}, field searchField) string {
+	switch field.Type {
+	case "int":
+		array := make([]int64, len(items))
+		for i, item := range items {
+			array[i] = item.(int64)
+		}
+		c.values = append(c.values, pq.Array(array))
+	case "number":
+		array := make([]float64, len(items))
+		for i, item := range items {
+			array[i] = item.(float64)
+		}
+		c.values = append(c.values, pq.Array(array))
+	case "bool":
+		array := make([]bool, len(items))
+		for i, item := range items {
+			array[i] = item.(bool)
+		}
+		c.values = append(c.values, pq.Array(array))
+	case "time":
+		array := make([]string, len(items))
+		for i, item := range items {
+			array[i] = item.(time.Time).Format(time.RFC3339Nano)
+		}
+		c.values = append(c.values, pq.Array(array))
+		return fmt.Sprintf("$%d::timestamp[]", len(c.values))
+	default:
+		array := make([]string, len(items))
+		for i, item := range items {
+			array[i] = item.(string)
+		}
+		c.values = append(c.values, pq.Array(array))
+	}
+	return fmt.Sprintf("$%d", len(c.values))
+}
+
+func (c *filterCompiler) fieldNames() []string {
+	var names []string
+	for name := range c.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/utilities"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseFilter(t *testing.T, filterJSON string) UserFilter {
+	t.Helper()
+	var filter UserFilter
+	if err := json.Unmarshal([]byte(filterJSON), &filter); err != nil {
+		t.Fatalf("%s: %s", filterJSON, err)
+	}
+	return filter
+}
+
+func TestCompileUserFilter(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		filter     string
+		visibility Visibility
+		sql        string
+		values     []interface{}
+	}{
+		{`{"field": "email", "op": "eq", "value": "JDoe@Example.com"}`, VisibilitySelf, "lower(email) = $2", []interface{}{"jdoe@example.com"}},
+		{`{"field": "id", "op": "ne", "value": 5}`, VisibilityPublic, "id <> $2", []interface{}{int64(5)}},
+		{`{"field": "first_name", "op": "prefix", "value": "50%_\\"}`, VisibilityPublic, "first_name LIKE $2", []interface{}{`50\%\_\\%`}},
+		{`{"field": "last_name", "op": "suffix", "value": "son"}`, VisibilityPublic, "last_name LIKE $2", []interface{}{"%son"}},
+		{`{"field": "username", "op": "contains", "value": "Doe"}`, VisibilityPublic, "lower(username) LIKE $2", []interface{}{"%doe%"}},
+		{`{"field": "first_name", "op": "present"}`, VisibilityPublic, "(first_name IS NOT NULL AND first_name <> '')", nil},
+		{`{"field": "active", "op": "present"}`, VisibilityAdmin, "active IS NOT NULL", nil},
+		{`{"field": "active", "op": "eq", "value": false}`, VisibilityAdmin, "active = $2", []interface{}{false}},
+		{
+			`{"field": "time_created", "op": "range", "value": {"gte": "2026-01-02T03:04:05Z", "lt": "2026-01-02T04:04:05+01:00"}}`, VisibilityPublic,
+			"(time_created >= $2::timestamp AND time_created < $3::timestamp)", []interface{}{created, created},
+		},
+		{
+			`{"or": [{"field": "id", "op": "eq", "value": 1}, {"not": {"field": "first_name", "op": "eq", "value": "Jane"}}]}`, VisibilityPublic,
+			"(id = $2 OR NOT first_name = $3)", []interface{}{int64(1), "Jane"},
+		},
+		{
+			`{"and": [{"field": "first_name", "op": "eq", "value": "Jane"}, {"field": "last_name", "op": "eq", "value": "Doe"}]}`, VisibilityPublic,
+			"(first_name = $2 AND last_name = $3)", []interface{}{"Jane", "Doe"},
+		},
+	}
+
+	for _, c := range cases {
+		sql, values, err := parseFilter(t, c.filter).Compile(c.visibility, []interface{}{"existing"})
+		if err != nil {
+			t.Errorf("%s: %s", c.filter, err)
+			continue
+		}
+		if sql != c.sql {
+			t.Errorf("%s: got %s, want %s", c.filter, sql, c.sql)
+		}
+		if want := append([]interface{}{"existing"}, c.values...); !reflect.DeepEqual(values, want) {
+			t.Errorf("%s: got values %#v, want %#v", c.filter, values, want)
+		}
+	}
+}
+
+func TestCompileUserFilterIn(t *testing.T) {
+	sql, values, err := parseFilter(t, `{"field": "id", "op": "in", "value": [1, 2, 3]}`).Compile(VisibilityPublic, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{pq.Array([]int64{1, 2, 3})}; sql != "id = ANY($1)" || !reflect.DeepEqual(values, want) {
+		t.Errorf("got %s with %#v", sql, values)
+	}
+}
+
+func TestCompileUserFilterInvalid(t *testing.T) {
+	cases := []struct {
+		filter     string
+		visibility Visibility
+		code       string
+	}{
+		// Only whitelisted fields can be searched, and only by requesters who can see them
+		{`{"field": "password", "op": "eq", "value": "x"}`, VisibilityAdmin, utilities.CodeInvalidSearch},
+		{`{"field": "id; DROP TABLE users", "op": "eq", "value": 1}`, VisibilityAdmin, utilities.CodeInvalidSearch},
+		{`{"field": "Password", "op": "present"}`, VisibilityAdmin, utilities.CodeInvalidSearch},
+		{`{"field": "email", "op": "eq", "value": "jdoe@example.com"}`, VisibilityPublic, utilities.CodeForbidden},
+		{`{"field": "phone", "op": "present"}`, VisibilityPublic, utilities.CodeForbidden},
+		{`{"field": "active", "op": "eq", "value": true}`, VisibilitySelf, utilities.CodeForbidden},
+		{`{"or": [{"field": "id", "op": "eq", "value": 1}, {"field": "external_id", "op": "present"}]}`, VisibilitySelf, utilities.CodeForbidden},
+
+		// Operators and values must match the field
+		{`{"field": "id", "op": "like", "value": 1}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "prefix", "value": "1"}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "eq", "value": "1"}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "first_name", "op": "eq", "value": 1}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "time_created", "op": "eq", "value": "yesterday"}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "in", "value": []}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "in", "value": 1}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "range", "value": {}}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"field": "id", "op": "range", "value": {"gt": 1, "between": 2}}`, VisibilityPublic, utilities.CodeInvalidSearch},
+
+		// Filters must be well formed
+		{`{"and": []}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"and": [{"field": "id", "op": "eq", "value": 1}], "field": "id"}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"and": [{"field": "id", "op": "eq", "value": 1}], "or": [{"field": "id", "op": "eq", "value": 1}]}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{"not": {"field": "id", "op": "eq", "value": 1}, "field": "id"}`, VisibilityPublic, utilities.CodeInvalidSearch},
+		{`{}`, VisibilityPublic, utilities.CodeInvalidSearch},
+	}
+
+	for _, c := range cases {
+		sql, _, err := parseFilter(t, c.filter).Compile(c.visibility, nil)
+		if got := errorCode(err); got != c.code {
+			t.Errorf("%s: got %q (%v, %s), want %s", c.filter, got, err, sql, c.code)
+		}
+	}
+}
+
+func TestCompileUserFilterLimits(t *testing.T) {
+	condition := `{"field": "id", "op": "eq", "value": 1}`
+	nested := func(depth int) string {
+		filter := condition
+		for i := 1; i < depth; i++ {
+			filter = `{"not": ` + filter + `}`
+		}
+		return filter
+	}
+	conditions := func(n int) string {
+		return `{"or": [` + strings.TrimSuffix(strings.Repeat(condition+",", n), ",") + `]}`
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		valid  bool
+	}{
+		{"maximum depth", nested(maxFilterDepth), true},
+		{"too deep", nested(maxFilterDepth + 1), false},
+		{"maximum conditions", conditions(maxFilterConditions), true},
+		{"too many conditions", conditions(maxFilterConditions + 1), false},
+	}
+
+	for _, c := range cases {
+		_, _, err := parseFilter(t, c.filter).Compile(VisibilityPublic, nil)
+		if c.valid && err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else if !c.valid && errorCode(err) != utilities.CodeInvalidSearch {
+			t.Errorf("%s: got %v, want invalid_search", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"strconv"
+	"time"
+)
+
+var WebhookDeliveriesTableName string
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery is an event queued for one webhook
+type WebhookDelivery struct {
+	Id            int64      `json:"id"`
+	Webhook       string     `json:"webhook"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastStatus    int        `json:"last_status"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	Event         Event      `json:"event"`
+}
+
+const deliveryColumns = "d.id, d.webhook, d.status, d.attempts, d.next_attempt_at, d.last_status, d.last_error, d.created_at, d.delivered_at, e.id, e.type, e.time, e.data"
+
+func scanWebhookDelivery(row rowScanner) (delivery WebhookDelivery, err error) {
+	var deliveredAt sql.NullTime
+	var data string
+	err = row.Scan(&delivery.Id, &delivery.Webhook, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastStatus, &delivery.LastError, &delivery.CreatedAt, &deliveredAt,
+		&delivery.Event.Id, &delivery.Event.Type, &delivery.Event.Time, &data)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	delivery.Event.Data = json.RawMessage(data)
+	delivery.Event.Service = UserTableName
+	return
+}
+
+func deliveryNotFoundError(id string) *utilities.Error {
+	return utilities.NewError(utilities.ErrorNotFound, utilities.CodeDeliveryNotFound, fmt.Sprintf("Webhook delivery %s does not exist", id))
+}
+
+func queryWebhookDeliveries(ctx context.Context, operation, queryStr string, values ...interface{}) ([]WebhookDelivery, error) {
+	ctx, done := startTableQuery(ctx, WebhookDeliveriesTableName, operation, queryStr, values...)
+	rows, err := db.DB.QueryContext(ctx, queryStr, values...)
+	if err != nil {
+		done(err)
+		return nil, utilities.NewInternalError("Failed to query webhook deliveries", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			done(err)
+			return nil, utilities.NewInternalError("Failed to read webhook deliveries", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	err = rows.Err()
+	done(err)
+	if err != nil {
+		return nil, utilities.NewInternalError("Failed to read webhook deliveries", err)
+	}
+	return deliveries, nil
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due, oldest first, and postpones them by
+// lease so that other servers do not claim them too. A delivery whose server stops before recording the attempt
+// is retried once the lease expires.
+func ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	queryStr := fmt.Sprintf(`WITH d AS (
+           UPDATE %s SET next_attempt_at = now() + $2 * interval '1 second'
+           WHERE id IN (SELECT id FROM %s WHERE status = '%s' AND next_attempt_at <= now() ORDER BY next_attempt_at, id LIMIT $1 FOR UPDATE SKIP LOCKED)
+           RETURNING *
+           ) SELECT %s FROM d JOIN %s e ON e.id = d.event_id ORDER BY d.id;`,
+		WebhookDeliveriesTableName, WebhookDeliveriesTableName, DeliveryPending, deliveryColumns, EventsTableName)
+	return queryWebhookDeliveries(ctx, "claim_webhook_deliveries", queryStr, limit, lease.Seconds())
+}
+
+// WebhookAttempt is the outcome of sending a delivery
+type WebhookAttempt struct {
+	Status     string
+	HTTPStatus int
+	Error      string
+	RetryAt    time.Time
+}
+
+// RecordWebhookAttempt counts an attempt to send a delivery, and marks it delivered, dead, or pending until RetryAt
+func RecordWebhookAttempt(ctx context.Context, id int64, attempt WebhookAttempt) error {
+	queryStr := fmt.Sprintf(`UPDATE %s SET status = $2, attempts = attempts + 1, last_status = $3, last_error = $4,
+           next_attempt_at = CASE WHEN $2 = '%s' THEN $5 ELSE next_attempt_at END,
+           delivered_at = CASE WHEN $2 = '%s' THEN now() ELSE delivered_at END
+           WHERE id = $1;`, WebhookDeliveriesTableName, DeliveryPending, DeliveryDelivered)
+	ctx, done := startTableQuery(ctx, WebhookDeliveriesTableName, "record_webhook_attempt", queryStr, id, attempt.Status, attempt.HTTPStatus, attempt.Error, attempt.RetryAt)
+	_, err := db.DB.ExecContext(ctx, queryStr, id, attempt.Status, attempt.HTTPStatus, attempt.Error, attempt.RetryAt)
+	done(err)
+	if err != nil {
+		return utilities.NewInternalError("Failed to record webhook attempt", err)
+	}
+	return nil
+}
+
+// WebhookDeliveryQuery filters webhook deliveries. Empty fields match every delivery.
+type WebhookDeliveryQuery struct {
+	Status  string
+	Webhook string
+	Limit   int
+	Cursor  string
+}
+
+type WebhookDeliveryPage struct {
+	Deliveries []WebhookDelivery
+	NextCursor string
+}
+
+// ListWebhookDeliveries returns deliveries newest first, such as the dead deliveries that need attention.
+// The cursor is the id of the last delivery of the previous page.
+func ListWebhookDeliveries(ctx context.Context, query WebhookDeliveryQuery) (WebhookDeliveryPage, error) {
+	ctx, span := startOperation(ctx, "ListWebhookDeliveries")
+	page, err := listWebhookDeliveries(ctx, query)
+	span.Finish(err)
+	return page, err
+}
+
+func listWebhookDeliveries(ctx context.Context, query WebhookDeliveryQuery) (WebhookDeliveryPage, error) {
+	var conditions []string
+	var values []interface{}
+	if query.Status != "" {
+		values = append(values, query.Status)
+		conditions = append(conditions, fmt.Sprintf("d.status = $%d", len(values)))
+	}
+	if query.Webhook != "" {
+		values = append(values, query.Webhook)
+		conditions = append(conditions, fmt.Sprintf("d.webhook = $%d", len(values)))
+	}
+	if query.Cursor != "" {
+		before, err := strconv.ParseInt(query.Cursor, 10, 64)
+		if err != nil || before < 1 {
+			return WebhookDeliveryPage{}, utilities.NewValidationError("The listing parameters are invalid", utilities.FieldError{
+				Field:   "cursor",
+				Code:    utilities.FieldInvalid,
+				Message: "The cursor is invalid",
+			})
+		}
+		values = append(values, before)
+		conditions = append(conditions, fmt.Sprintf("d.id < $%d", len(values)))
+	}
+
+	// Fetch one extra delivery to find out whether there is a next page
+	values = append(values, query.Limit+1)
+	queryStr := fmt.Sprintf("SELECT %s FROM %s d JOIN %s e ON e.id = d.event_id%s ORDER BY d.id DESC LIMIT $%d;",
+		deliveryColumns, WebhookDeliveriesTableName, EventsTableName, whereClause(conditions), len(values))
+	deliveries, err := queryWebhookDeliveries(ctx, "list_webhook_deliveries", queryStr, values...)
+	if err != nil {
+		return WebhookDeliveryPage{}, err
+	}
+
+	page := WebhookDeliveryPage{Deliveries: deliveries}
+	if len(deliveries) > query.Limit {
+		page.Deliveries = deliveries[:query.Limit]
+		page.NextCursor = strconv.FormatInt(page.Deliveries[len(page.Deliveries)-1].Id, 10)
+	}
+	return page, nil
+}
+
+// RedeliverWebhook queues a delivery to be sent again now with a fresh set of attempts, such as a dead delivery
+// after its receiver has been fixed
+func RedeliverWebhook(ctx context.Context, id string) (WebhookDelivery, error) {
+	ctx, span := startOperation(ctx, "RedeliverWebhook", "webhook_delivery.id", id)
+	delivery, err := redeliverWebhook(ctx, id)
+	span.Finish(err)
+	return delivery, err
+}
+
+func redeliverWebhook(ctx context.Context, id string) (WebhookDelivery, error) {
+	deliveryId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return WebhookDelivery{}, deliveryNotFoundError(id)
+	}
+
+	queryStr := fmt.Sprintf(`WITH d AS (
+           UPDATE %s SET status = '%s', attempts = 0, next_attempt_at = now(), last_status = 0, last_error = '', delivered_at = NULL
+           WHERE id = $1 RETURNING *
+           ) SELECT %s FROM d JOIN %s e ON e.id = d.event_id;`,
+		WebhookDeliveriesTableName, DeliveryPending, deliveryColumns, EventsTableName)
+	deliveries, err := queryWebhookDeliveries(ctx, "redeliver_webhook", queryStr, deliveryId)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if len(deliveries) == 0 {
+		return WebhookDelivery{}, deliveryNotFoundError(id)
+	}
+
+	recordAudit(ctx, AuditWebhookRedelivered, fmt.Sprintf("webhook_delivery:%d", deliveryId), map[string]interface{}{"webhook": deliveries[0].Webhook})
+	return deliveries[0], nil
+}
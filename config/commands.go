@@ -0,0 +1,174 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/secrets"
+	"github.com/omar-ozgur/gram/utilities"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// RunCommand executes a command line subcommand such as `gram secrets rekey`
+func RunCommand(args []string) {
+	switch args[0] {
+	case "config":
+		runConfigCommand(args[1:])
+	case "secrets":
+		runSecretsCommand(args[1:])
+	case "db":
+		runDBCommand(args[1:])
+	case "openapi":
+		runOpenAPICommand()
+	case "audit":
+		runAuditCommand(args[1:])
+	default:
+		fmt.Printf("Error: Unknown command '%s'\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func runConfigCommand(args []string) {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print") {
+		fmt.Println("Usage: gram config validate|print")
+		os.Exit(2)
+	}
+
+	config, err := LoadConfig()
+	if err == nil && args[0] == "validate" {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Printf("Error: Invalid configuration\n%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if args[0] == "validate" {
+		path, _ := GetConfigPath()
+		fmt.Printf("The configuration in %s is valid.\n", path)
+		return
+	}
+
+	var b bytes.Buffer
+	if err := encodeTOML(&b, reflect.ValueOf(config).Elem(), "", true); err != nil {
+		fmt.Printf("Error: Could not print the configuration\n%s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Print(strings.TrimPrefix(b.String(), "\n"))
+}
+
+func runSecretsCommand(args []string) {
+	if len(args) == 0 || args[0] != "rekey" {
+		fmt.Println("Usage: gram secrets rekey")
+		os.Exit(2)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Printf("Error: Invalid configuration\n%s\n", err.Error())
+		os.Exit(1)
+	}
+	utilities.SetConfig(config)
+
+	oldKey := db.GetEncryptionKey()
+
+	newKey := os.Getenv("GRAM_NEW_ENCRYPTION_KEY")
+	if newKey == "" {
+		fmt.Println("Please enter a new encryption passphrase, or press enter to generate one.")
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Scan()
+		newKey = scanner.Text()
+		if newKey == "" {
+			newKey = secrets.GeneratePassphrase(24)
+		}
+	}
+
+	err = db.RekeyDBParams(oldKey, newKey)
+	if err != nil {
+		fmt.Printf("Error: Failed to rekey %s: %s\n", db.DBParamsPath, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Rekeyed %s. Please set the GRAM_ENCRYPTION_KEY environment variable to the following passphrase.\n", db.DBParamsPath)
+	fmt.Println(newKey)
+}
+
+func runDBCommand(args []string) {
+	if len(args) == 0 || (args[0] != "migrate" && args[0] != "status") {
+		fmt.Println("Usage: gram db migrate|status")
+		os.Exit(2)
+	}
+
+	utilities.SetConfig(MustLoadConfig())
+	db.OpenDB()
+
+	if args[0] == "migrate" {
+		err := db.Migrate()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("The database is up to date.")
+		return
+	}
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	pending := 0
+	for _, migration := range db.Migrations {
+		status := "applied"
+		if !applied[migration.Version] {
+			status = "pending"
+			pending++
+		}
+		fmt.Printf("%3d  %-8s %s\n", migration.Version, status, migration.Name)
+	}
+	if pending > 0 {
+		os.Exit(1)
+	}
+}
+
+// runOpenAPICommand prints the OpenAPI document, and fails if it does not describe every route
+func runOpenAPICommand() {
+	doc, err := BuildOpenAPI()
+	if err != nil {
+		fmt.Printf("Error: The OpenAPI document does not match the routes\n%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	JSON, _ := json.MarshalIndent(doc, "", "  ")
+	fmt.Println(string(JSON))
+}
+
+// runAuditCommand checks the audit log's hash chain, and prints its head hash to compare with later runs
+func runAuditCommand(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Println("Usage: gram audit verify")
+		os.Exit(2)
+	}
+
+	utilities.SetConfig(MustLoadConfig())
+	db.OpenDB()
+	models.Init()
+
+	result, err := models.VerifyAuditLog(context.Background())
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if result.BrokenAt != 0 {
+		fmt.Printf("Error: The audit log has been tampered with at event %d: %s\n", result.BrokenAt, result.Problem)
+		os.Exit(1)
+	}
+	fmt.Printf("The audit log is intact: %d events, head %s\n", result.Events, hex.EncodeToString(result.Head))
+}
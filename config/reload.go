@@ -0,0 +1,165 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/omar-ozgur/gram/utilities"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// restartSettings can only change when the server restarts, so reloads keep their live values
+var restartSettings = []string{
+	"Server",
+	"Database",
+	"TLS.CertFile",
+	"TLS.KeyFile",
+	"TLS.MinVersion",
+	"TLS.CipherSuites",
+	"TLS.ClientAuth",
+	"TLS.ClientCAFile",
+	"Log.Format",
+}
+
+// WatchConfig reloads the config on SIGHUP or when the config file changes, until ctx is cancelled
+func WatchConfig(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	path, _ := GetConfigPath()
+	modified := getModTime(path)
+	ticker := time.NewTicker(utilities.ConfigPollInterval)
+
+	go func() {
+		defer ticker.Stop()
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				utilities.Logger.Info("Received SIGHUP, reloading config")
+				modified = getModTime(path)
+				ReloadConfig()
+			case <-ticker.C:
+				if current := getModTime(path); !current.Equal(modified) {
+					utilities.Sugar.Infof("Config file %s changed, reloading config", path)
+					modified = current
+					ReloadConfig()
+				}
+			}
+		}
+	}()
+}
+
+// ReloadConfig loads and validates the config and swaps it in, keeping the old config if the new one is invalid
+func ReloadConfig() bool {
+	config, err := LoadConfig()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		utilities.Sugar.Errorf("Rejected config reload, keeping the current config: %s", err.Error())
+		return false
+	}
+
+	old := utilities.CurrentConfig()
+	for _, name := range restartSettings {
+		oldValue, _ := settingByName(reflect.ValueOf(old).Elem(), name)
+		newValue, path := settingByName(reflect.ValueOf(config).Elem(), name)
+		if !reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			utilities.Sugar.Warnf("Changes to %s require a restart and were not applied", path)
+			newValue.Set(oldValue)
+		}
+	}
+
+	changes := diffConfig(reflect.ValueOf(old).Elem(), reflect.ValueOf(config).Elem(), "", false)
+	if len(changes) == 0 {
+		utilities.Logger.Info("Reloaded config with no changes")
+		return true
+	}
+
+	utilities.SetConfig(config)
+	utilities.SetLogLevel(config.Log.Level)
+	for _, change := range changes {
+		utilities.Sugar.Infof("Config changed: %s", change)
+	}
+
+	return true
+}
+
+func getModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// settingByName resolves a dotted Go field path such as "TLS.CertFile" to its value and TOML path
+func settingByName(v reflect.Value, name string) (reflect.Value, string) {
+	path := ""
+	for _, part := range strings.Split(name, ".") {
+		field, _ := v.Type().FieldByName(part)
+		path = joinPath(path, tomlName(field))
+		v = v.FieldByName(part)
+	}
+	return v, path
+}
+
+// diffConfig describes every setting that differs between two configs, hiding secret values
+func diffConfig(old reflect.Value, new reflect.Value, path string, secret bool) []string {
+	var changes []string
+
+	switch old.Kind() {
+	case reflect.Struct:
+		t := old.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			changes = append(changes, diffConfig(old.Field(i), new.Field(i), joinPath(path, tomlName(field)), field.Tag.Get("secret") == "true")...)
+		}
+		return changes
+	case reflect.Map:
+		keys := make(map[string]bool)
+		for _, key := range old.MapKeys() {
+			keys[key.String()] = true
+		}
+		for _, key := range new.MapKeys() {
+			keys[key.String()] = true
+		}
+		var names []string
+		for key := range keys {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		for _, key := range names {
+			oldItem := old.MapIndex(reflect.ValueOf(key))
+			newItem := new.MapIndex(reflect.ValueOf(key))
+			switch {
+			case !oldItem.IsValid():
+				changes = append(changes, fmt.Sprintf("%s added", joinPath(path, key)))
+			case !newItem.IsValid():
+				changes = append(changes, fmt.Sprintf("%s removed", joinPath(path, key)))
+			default:
+				changes = append(changes, diffConfig(oldItem, newItem, joinPath(path, key), secret)...)
+			}
+		}
+		return changes
+	}
+
+	if reflect.DeepEqual(old.Interface(), new.Interface()) {
+		return nil
+	}
+	oldValue, oldErr := encodeTOMLValue(old)
+	newValue, newErr := encodeTOMLValue(new)
+	if secret || oldErr != nil || newErr != nil {
+		return []string{fmt.Sprintf("%s changed", path)}
+	}
+	return []string{fmt.Sprintf("%s changed from %s to %s", path, oldValue, newValue)}
+}
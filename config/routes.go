@@ -3,26 +3,230 @@ package config
 import (
 	"github.com/gorilla/mux"
 	"github.com/omar-ozgur/gram/app/controllers"
+	"github.com/omar-ozgur/gram/metrics"
 	"github.com/omar-ozgur/gram/middleware"
+	"github.com/omar-ozgur/gram/openapi"
+	"github.com/omar-ozgur/gram/utilities"
 	"github.com/urfave/negroni"
+	"net/http"
+	"strings"
 )
 
+// Route is an endpoint of the API. Every route must be described by an operation in controllers.Operations.
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.Handler
+	Auth    bool
+}
+
+// APIVersions are served under a prefix such as /v1, oldest first
+var APIVersions = []string{"v1"}
+
+// LegacyVersion is the version served at the unversioned paths that predate /v1
+const LegacyVersion = "v1"
+
+// Routes are served under every API version, and at their unversioned paths while legacy routes are enabled
+var Routes = []Route{
+	{"POST", "/signup", controllers.UsersCreate, false},
+	{"POST", "/login", controllers.UsersLogin, false},
+	{"GET", "/profile", controllers.UsersProfile, true},
+	{"GET", "/users", controllers.UsersIndex, false},
+	{"POST", "/users/search", controllers.UsersSearch, false},
+	{"GET", "/users/{id}", controllers.UsersShow, false},
+	{"PUT", "/users/{id}", controllers.UsersUpdate, true},
+	{"PATCH", "/users/{id}", controllers.UsersPatch, true},
+	{"DELETE", "/users/{id}", controllers.UsersDelete, true},
+	{"GET", "/events", controllers.EventsStream, false},
+	{"GET", "/auth/{provider}", controllers.FederationStart, false},
+	{"GET", "/auth/{provider}/callback", controllers.FederationCallback, false},
+	{"GET", "/identities", controllers.IdentitiesIndex, true},
+	{"POST", "/identities", controllers.IdentitiesCreate, true},
+	{"DELETE", "/identities/{provider}", controllers.IdentitiesDelete, true},
+}
+
+// Transitions serve a different handler for a route in some API versions, keyed by "METHOD /path" and then version.
+// To change a response shape, add the new handler under the new version here; older versions and the legacy routes
+// keep the route's original handler until they are removed. A nil handler removes the route from that version.
+var Transitions = map[string]map[string]http.Handler{}
+
+// UnversionedRoutes describe the API rather than being part of it, so they are only served at their own paths
+var UnversionedRoutes = []Route{
+	{"GET", "/openapi.json", controllers.OpenAPIShow, false},
+	{"GET", "/docs", controllers.DocsShow, false},
+	{"GET", "/healthz", controllers.HealthzShow, false},
+	{"GET", "/readyz", controllers.ReadyzShow, false},
+}
+
+// AdminRoutes are for operators rather than clients. They are served on server.admin_address when it is set,
+// and otherwise alongside the unversioned routes.
+var AdminRoutes = []Route{
+	{"GET", "/metrics", metrics.Handler, false},
+	{"GET", "/status", controllers.StatusShow, false},
+	{"GET", "/audit", controllers.AuditIndex, false},
+	{"GET", "/webhooks/deliveries", controllers.WebhookDeliveriesIndex, false},
+	{"POST", "/webhooks/deliveries/{id}/redeliver", controllers.WebhookDeliveriesRedeliver, false},
+}
+
+// SCIMRoutes let identity providers provision users and groups. They follow the SCIM 2.0 paths rather than the
+// API's versions, and are authenticated by the service's SCIM token rather than by user tokens.
+var SCIMRoutes = []Route{
+	{"GET", "/ServiceProviderConfig", controllers.SCIMServiceProviderConfigShow, false},
+	{"GET", "/ResourceTypes", controllers.SCIMResourceTypesIndex, false},
+	{"GET", "/ResourceTypes/{id}", controllers.SCIMResourceTypesIndex, false},
+	{"GET", "/Schemas", controllers.SCIMSchemasIndex, false},
+	{"GET", "/Schemas/{id}", controllers.SCIMSchemasIndex, false},
+	{"GET", "/Users", controllers.SCIMUsersIndex, false},
+	{"POST", "/Users", controllers.SCIMUsersCreate, false},
+	{"GET", "/Users/{id}", controllers.SCIMUsersShow, false},
+	{"PUT", "/Users/{id}", controllers.SCIMUsersUpdate, false},
+	{"PATCH", "/Users/{id}", controllers.SCIMUsersPatch, false},
+	{"DELETE", "/Users/{id}", controllers.SCIMUsersDelete, false},
+	{"GET", "/Groups", controllers.SCIMGroupsIndex, false},
+	{"POST", "/Groups", controllers.SCIMGroupsCreate, false},
+	{"GET", "/Groups/{id}", controllers.SCIMGroupsShow, false},
+	{"PUT", "/Groups/{id}", controllers.SCIMGroupsUpdate, false},
+	{"PATCH", "/Groups/{id}", controllers.SCIMGroupsPatch, false},
+	{"DELETE", "/Groups/{id}", controllers.SCIMGroupsDelete, false},
+}
+
+// servedRoute is a route as registered with the router
+type servedRoute struct {
+	Route
+	Prefix string
+	Legacy bool
+	Suffix string
+}
+
+// servedRoutes expands the route table into every versioned, legacy and unversioned route
+func servedRoutes() []servedRoute {
+	var served []servedRoute
+	latest := APIVersions[len(APIVersions)-1]
+
+	for _, version := range APIVersions {
+		for _, route := range Routes {
+			handler := versionHandler(route, version)
+			if handler == nil {
+				continue
+			}
+			suffix := ""
+			if version != latest {
+				suffix = strings.ToUpper(version)
+			}
+			route.Handler = middleware.APIVersion(version, authorize(route, handler))
+			served = append(served, servedRoute{route, "/" + version, false, suffix})
+		}
+	}
+
+	if utilities.CurrentConfig().API.LegacyRoutes {
+		for _, route := range Routes {
+			handler := versionHandler(route, LegacyVersion)
+			if handler == nil {
+				continue
+			}
+			route.Handler = middleware.LegacyRoute("/"+LegacyVersion, middleware.APIVersion(LegacyVersion, authorize(route, handler)))
+			served = append(served, servedRoute{route, "", true, "Legacy"})
+		}
+	}
+
+	unversioned := UnversionedRoutes
+	if utilities.CurrentConfig().Server.AdminAddress == "" {
+		unversioned = append(append([]Route{}, unversioned...), AdminRoutes...)
+	}
+	for _, route := range unversioned {
+		route.Handler = authorize(route, route.Handler)
+		served = append(served, servedRoute{route, "", false, ""})
+	}
+
+	for _, route := range SCIMRoutes {
+		route.Path = controllers.SCIMPrefix + route.Path
+		route.Handler = middleware.RequireSCIMToken(route.Handler)
+		served = append(served, servedRoute{route, "", false, ""})
+	}
+
+	return served
+}
+
+// authorize requires a bearer token for routes that need one, and rejects tokens of users who are no longer active
+func authorize(route Route, handler http.Handler) http.Handler {
+	handler = controllers.RequireActiveUser(handler)
+	if route.Auth {
+		return middleware.RequireToken(handler)
+	}
+	return handler
+}
+
+func versionHandler(route Route, version string) http.Handler {
+	if handlers, ok := Transitions[strings.ToUpper(route.Method)+" "+route.Path]; ok {
+		if handler, ok := handlers[version]; ok {
+			return handler
+		}
+	}
+	return route.Handler
+}
+
+var APIInfo = openapi.Info{
+	Title:       "Gram",
+	Version:     "1.0.0",
+	Description: "User accounts, authentication and search. Errors are returned as RFC 7807 problems with a stable code.",
+}
+
+// BuildOpenAPI describes the routes, and fails if any route or operation is missing the other
+func BuildOpenAPI() (*openapi.Document, error) {
+	var routes []openapi.Route
+	for _, route := range servedRoutes() {
+		routes = append(routes, openapi.Route{
+			Method:          route.Method,
+			Path:            route.Path,
+			Prefix:          route.Prefix,
+			Auth:            route.Auth,
+			Deprecated:      route.Legacy,
+			OperationSuffix: route.Suffix,
+		})
+	}
+
+	// Routes on the admin listener are not part of the API
+	operations := make(map[string]openapi.Operation)
+	for key, operation := range controllers.Operations {
+		operations[key] = operation
+	}
+	if utilities.CurrentConfig().Server.AdminAddress != "" {
+		for _, route := range AdminRoutes {
+			delete(operations, strings.ToUpper(route.Method)+" "+route.Path)
+		}
+	}
+
+	return openapi.Build(APIInfo, routes, operations, controllers.Components)
+}
+
 func InitRouter() (n *negroni.Negroni) {
-	authorizationHandler := middleware.JWTMiddleware.Handler
+	doc, err := BuildOpenAPI()
+	if err != nil {
+		panic("The OpenAPI document does not match the routes:\n" + err.Error())
+	}
+	controllers.OpenAPIDocument = doc
 
 	r := mux.NewRouter()
 
-	r.Handle("/signup", controllers.UsersCreate).Methods("POST")
-	r.Handle("/login", controllers.UsersLogin).Methods("POST")
-	r.Handle("/profile", authorizationHandler(controllers.UsersProfile)).Methods("Get")
-	r.Handle("/users", controllers.UsersIndex).Methods("GET")
-	r.Handle("/users/search", controllers.UsersSearch).Methods("POST")
-	r.Handle("/users/{id}", controllers.UsersShow).Methods("GET")
-	r.Handle("/users/{id}", authorizationHandler(controllers.UsersUpdate)).Methods("PUT")
-	r.Handle("/users/{id}", authorizationHandler(controllers.UsersDelete)).Methods("DELETE")
+	for _, route := range servedRoutes() {
+		r.Handle(route.Prefix+route.Path, route.Handler).Methods(route.Method)
+	}
 
-	n = negroni.New(negroni.HandlerFunc(middleware.CustomMiddleware), negroni.NewLogger())
+	n = negroni.New(negroni.HandlerFunc(middleware.RequestIDMiddleware), middleware.MetricsMiddleware(r), middleware.TracingMiddleware(r), middleware.LoggingMiddleware(r), negroni.HandlerFunc(middleware.RateLimitMiddleware), negroni.HandlerFunc(middleware.ClientCertMiddleware))
 	n.UseHandler(r)
 
 	return
 }
+
+// InitAdminRouter serves the admin routes on their own listener, or returns nil if server.admin_address is not set
+func InitAdminRouter() http.Handler {
+	if utilities.CurrentConfig().Server.AdminAddress == "" {
+		return nil
+	}
+
+	r := mux.NewRouter()
+	for _, route := range AdminRoutes {
+		r.Handle(route.Path, middleware.AdminListener(authorize(route, route.Handler))).Methods(route.Method)
+	}
+	return r
+}
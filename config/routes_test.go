@@ -0,0 +1,37 @@
+package config
+
+import (
+	"github.com/omar-ozgur/gram/utilities"
+	"testing"
+)
+
+func TestBuildOpenAPI(t *testing.T) {
+	defer utilities.SetConfig(utilities.CurrentConfig())
+
+	cases := []struct {
+		name         string
+		adminAddress string
+		legacy       bool
+	}{
+		{"admin routes on the main listener", "", true},
+		{"admin routes on the admin listener", "127.0.0.1:9090", true},
+		{"legacy routes disabled", "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := utilities.DefaultConfig()
+			config.Server.AdminAddress = c.adminAddress
+			config.API.LegacyRoutes = c.legacy
+			utilities.SetConfig(config)
+
+			doc, err := BuildOpenAPI()
+			if err != nil {
+				t.Fatalf("every served route must have an operation in controllers.Operations, and every operation a route:\n%s", err)
+			}
+			if doc == nil {
+				t.Fatal("BuildOpenAPI returned no document")
+			}
+		})
+	}
+}
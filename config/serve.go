@@ -0,0 +1,152 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/health"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func NewServer(handler http.Handler) *http.Server {
+	config := utilities.CurrentConfig().Server
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%s", config.Port),
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// NewAdminServer serves the admin routes on server.admin_address, or returns nil if it is not set
+func NewAdminServer() *http.Server {
+	handler := InitAdminRouter()
+	if handler == nil {
+		return nil
+	}
+
+	config := utilities.CurrentConfig().Server
+	return &http.Server{
+		Addr:              config.AdminAddress,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// Listen opens the configured TCP port or Unix socket, wrapped in TLS if a certificate is configured
+func Listen() (net.Listener, error) {
+	config := utilities.CurrentConfig()
+
+	var listener net.Listener
+	var err error
+	if config.Server.UnixSocket != "" {
+		err = removeStaleSocket(config.Server.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+		listener, err = net.Listen("unix", config.Server.UnixSocket)
+	} else {
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%s", config.Server.Port))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.TLS.Enabled() {
+		return listener, nil
+	}
+
+	tlsConfig, err := NewTLSConfig(config.TLS)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Serve runs the server, and the admin server if there is one, until SIGINT or SIGTERM,
+// then cancels background jobs, drains in-flight requests on both servers and closes the DB
+func Serve(server *http.Server, listener net.Listener, admin *http.Server, cancel context.CancelFunc) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	if admin != nil {
+		go func() {
+			errs <- admin.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		cancel()
+		return err
+	case sig := <-signals:
+		utilities.Sugar.Infof("Received %s, shutting down", sig)
+	}
+
+	// Fail readiness, and keep serving until load balancers have noticed
+	health.SetShuttingDown()
+	if delay := utilities.CurrentConfig().Server.ShutdownDelay; delay > 0 {
+		utilities.Sugar.Infof("Waiting %s for load balancers to stop sending requests", delay)
+		time.Sleep(delay)
+	}
+
+	// Stop background jobs
+	cancel()
+
+	// Drain in-flight requests
+	timeout := utilities.CurrentConfig().Server.ShutdownTimeout
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	var drained sync.WaitGroup
+	for _, s := range []*http.Server{server, admin} {
+		if s == nil {
+			continue
+		}
+		drained.Add(1)
+		go func(s *http.Server) {
+			defer drained.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				utilities.Sugar.Warnf("Requests were still in flight after %s, closing connections: %s", timeout, err.Error())
+				s.Close()
+			}
+		}(s)
+	}
+	drained.Wait()
+
+	// Export buffered spans
+	tracing.Shutdown(ctx)
+
+	// Close the DB pool
+	if db.DB != nil {
+		err := db.DB.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	utilities.Logger.Info("Server stopped")
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"github.com/omar-ozgur/gram/utilities"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsAdminRequests(t *testing.T) {
+	defer utilities.SetConfig(utilities.CurrentConfig())
+	utilities.SetConfig(utilities.DefaultConfig())
+
+	// Keep SIGTERM from stopping the test binary if it arrives before Serve handles it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAddress := adminListener.Addr().String()
+	adminListener.Close()
+
+	started, release := make(chan bool), make(chan bool)
+	finished := make(chan time.Time, 1)
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	admin := &http.Server{Addr: adminAddress, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		finished <- time.Now()
+	})}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(server, listener, admin, func() {})
+	}()
+
+	// Send a slow admin request, then shut down while it is in flight
+	go func() {
+		for {
+			if _, err := http.Get("http://" + adminAddress + "/status"); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the admin request was not received")
+	}
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned while an admin request was in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the admin request finished")
+	}
+	if len(finished) != 1 {
+		t.Error("the admin request did not finish")
+	}
+}
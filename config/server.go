@@ -2,24 +2,121 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"github.com/omar-ozgur/gram/utilities"
+	"io/ioutil"
 	"os"
+	"reflect"
 )
 
-func GetPort() string {
-	port := os.Getenv("GRAM_PORT")
+var ConfigPath string
 
-	// Set default port if there is nothing in the environment
-	if port == "" {
-		port = utilities.DefaultPort
-	}
+var flagValues = make(map[string]*string)
+
+// flagSettings maps command line flags onto the config settings they override
+var flagSettings = map[string][]string{
+	"port":    {"Server", "Port"},
+	"service": {"Server", "Service"},
+}
 
-	return port
+func GetConfigPath() (path string, explicit bool) {
+	if ConfigPath != "" {
+		return ConfigPath, true
+	}
+	if path := os.Getenv("GRAM_CONFIG"); path != "" {
+		return path, true
+	}
+	return utilities.DefaultConfigPath, false
 }
 
 func ParseArgs() {
-	flag.StringVar(&utilities.Port, "port", GetPort(), "Specifies the port for the server to run on. Ex: --port 3000")
-	flag.StringVar(&utilities.Service, "service", utilities.DefaultService, "Specifies the name of the service that the authentication server is being used for. Gram supports users for multiple services. Ex: --service MY_SERVICE")
+	flag.StringVar(&ConfigPath, "config", "", fmt.Sprintf("Specifies the path of the config file. Defaults to $GRAM_CONFIG or %s. Ex: --config /etc/gram.toml", utilities.DefaultConfigPath))
+	flagValues["port"] = flag.String("port", utilities.DefaultPort, "Specifies the port for the server to run on. Ex: --port 3000")
+	flagValues["service"] = flag.String("service", utilities.DefaultService, "Specifies the name of the service that the authentication server is being used for. Gram supports users for multiple services. Ex: --service MY_SERVICE")
 
 	flag.Parse()
 }
+
+// LoadConfig builds the effective config with the precedence flags > environment > config file > defaults
+func LoadConfig() (*utilities.Config, error) {
+	config := utilities.DefaultConfig()
+
+	// Apply the config file
+	path, explicit := GetConfigPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read config file: %s", err.Error())
+		}
+	} else {
+		table, err := parseTOML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		err = decodeTOML(table, reflect.ValueOf(config).Elem(), "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	// Apply environment variables
+	err = applyEnv(reflect.ValueOf(config).Elem(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply command line flags that were explicitly set
+	flag.Visit(func(f *flag.Flag) {
+		setting, ok := flagSettings[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		field := reflect.ValueOf(config).Elem().FieldByName(setting[0]).FieldByName(setting[1])
+		err = setString(field, *flagValues[f.Name], "--"+f.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// MustLoadConfig loads and validates the config, exiting with an error message on failure
+func MustLoadConfig() *utilities.Config {
+	config, err := LoadConfig()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Printf("Error: Invalid configuration\n%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	return config
+}
+
+func applyEnv(v reflect.Value, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := joinPath(path, tomlName(field))
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			if err := applyEnv(v.Field(i), name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		if value := os.Getenv(env); value != "" {
+			if err := setString(v.Field(i), value, env); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/omar-ozgur/gram/utilities"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileReloader caches a value loaded from files and reloads it when any of the files change
+type fileReloader struct {
+	paths    []string
+	load     func() (interface{}, error)
+	mutex    sync.Mutex
+	value    interface{}
+	modified []time.Time
+	checked  time.Time
+}
+
+func newFileReloader(load func() (interface{}, error), paths ...string) (*fileReloader, error) {
+	r := &fileReloader{paths: paths, load: load}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.value = value
+	r.modified = r.modTimes()
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *fileReloader) modTimes() []time.Time {
+	times := make([]time.Time, len(r.paths))
+	for i, path := range r.paths {
+		times[i] = getModTime(path)
+	}
+	return times
+}
+
+// get returns the cached value, checking the files for changes at most once per poll interval
+func (r *fileReloader) get() interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) < utilities.ConfigPollInterval {
+		return r.value
+	}
+	r.checked = time.Now()
+
+	modified := r.modTimes()
+	changed := false
+	for i := range modified {
+		if !modified[i].Equal(r.modified[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return r.value
+	}
+
+	value, err := r.load()
+	if err != nil {
+		// Files may be mid-rotation, so keep serving the old value and retry on the next check
+		utilities.Sugar.Errorf("Failed to reload %v, keeping the current version: %s", r.paths, err.Error())
+		return r.value
+	}
+
+	utilities.Sugar.Infof("Reloaded %v", r.paths)
+	r.value = value
+	r.modified = modified
+	return r.value
+}
+
+// NewTLSConfig builds the listener TLS config, reloading certificates when their files change
+func NewTLSConfig(config utilities.TLSConfig) (*tls.Config, error) {
+	certs, err := newFileReloader(func() (interface{}, error) {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		return &cert, err
+	}, config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: utilities.TLSVersions[config.MinVersion],
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get().(*tls.Certificate), nil
+		},
+	}
+
+	for _, name := range config.CipherSuites {
+		id, _ := utilities.TLSCipherSuite(name)
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	if config.ClientAuth == utilities.TLSClientAuthNone {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.ClientAuth == utilities.TLSClientAuthRequire {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	clientCAs, err := newFileReloader(func() (interface{}, error) {
+		return utilities.LoadCertPool(config.ClientCAFile)
+	}, config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig := tlsConfig.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.ClientCAs = clientCAs.get().(*x509.CertPool)
+		return clientConfig, nil
+	}
+
+	return tlsConfig, nil
+}
+
+// removeStaleSocket removes a socket left behind by a server that is no longer running. A socket that
+// accepts connections belongs to a running server, and is left for it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return &os.PathError{Op: "listen", Path: path, Err: os.ErrExist}
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return &os.PathError{Op: "listen", Path: path, Err: errors.New("another server is listening on the socket")}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return &os.PathError{Op: "listen", Path: path, Err: err}
+	}
+	return os.Remove(path)
+}
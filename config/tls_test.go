@@ -0,0 +1,55 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket whose server has stopped is removed
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if err := removeStaleSocket(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("the stale socket was not removed: %v", err)
+	}
+
+	// A socket that a server is listening on is left alone
+	live := filepath.Join(dir, "live.sock")
+	listener, err = net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := removeStaleSocket(live); err == nil {
+		t.Error("expected an error for a socket that a server is listening on")
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("the live socket was removed: %v", err)
+	}
+
+	// Other files are never removed
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(file); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+
+	if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("a missing socket: %v", err)
+	}
+}
@@ -0,0 +1,658 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The config file is a subset of TOML: tables, dotted keys, strings, integers, floats, booleans and arrays
+
+type tomlParser struct {
+	data   []byte
+	pos    int
+	line   int
+	tables map[string]bool
+}
+
+type defaulter interface {
+	SetDefaults()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{data: data, line: 1, tables: make(map[string]bool)}
+	root := make(map[string]interface{})
+	current := root
+
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			if p.peek() == '[' {
+				return nil, p.errorf("arrays of tables are not supported")
+			}
+			p.skipBlank(false)
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipBlank(false)
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ']' after table name")
+			}
+			p.pos++
+			name := strings.Join(keys, "\x00")
+			if p.tables[name] {
+				return nil, p.errorf("table '%s' is defined more than once", strings.Join(keys, "."))
+			}
+			p.tables[name] = true
+			current, err = p.table(root, keys)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.endLine(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		keys, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		if p.peek() != '=' {
+			return nil, p.errorf("expected '=' after key '%s'", strings.Join(keys, "."))
+		}
+		p.pos++
+		p.skipBlank(false)
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		table, err := p.table(current, keys[:len(keys)-1])
+		if err != nil {
+			return nil, err
+		}
+		key := keys[len(keys)-1]
+		if _, exists := table[key]; exists {
+			return nil, p.errorf("key '%s' is defined more than once", strings.Join(keys, "."))
+		}
+		table[key] = value
+
+		if err := p.endLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank skips spaces and comments, and newlines if requested
+func (p *tomlParser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endLine() error {
+	p.skipBlank(false)
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected '%c' at the end of the line", p.peek())
+	}
+	p.pos++
+	p.line++
+	return nil
+}
+
+func (p *tomlParser) table(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	table := root
+	for _, key := range keys {
+		next, exists := table[key]
+		if !exists {
+			next = make(map[string]interface{})
+			table[key] = next
+		}
+		nextTable, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, p.errorf("key '%s' is not a table", key)
+		}
+		table = nextTable
+	}
+	return table, nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		var key string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			key = string(p.data[start:p.pos])
+		default:
+			return nil, p.errorf("expected a key")
+		}
+		keys = append(keys, key)
+
+		p.skipBlank(false)
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+		p.skipBlank(false)
+	}
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseBasicString()
+	case c == '\'':
+		return p.parseLiteralString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return nil, p.errorf("inline tables are not supported")
+	case c == 't' || c == 'f':
+		start := p.pos
+		for !p.eof() && isBareKeyChar(p.peek()) {
+			p.pos++
+		}
+		switch word := string(p.data[start:p.pos]); word {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		default:
+			return nil, p.errorf("invalid value '%s'", word)
+		}
+	default:
+		start := p.pos
+		for !p.eof() && (isBareKeyChar(p.peek()) || strings.IndexByte("+.", p.peek()) >= 0) {
+			p.pos++
+		}
+		word := strings.Replace(string(p.data[start:p.pos]), "_", "", -1)
+		if word == "" {
+			return nil, p.errorf("expected a value")
+		}
+		value, err := parseNumber(word)
+		if err != nil {
+			return nil, p.errorf("%s", err.Error())
+		}
+		return value, nil
+	}
+}
+
+// parseNumber parses an integer or float. Decimal numbers cannot have leading zeros, and integers in other
+// bases must start with 0x, 0o or 0b.
+func parseNumber(word string) (interface{}, error) {
+	if len(word) > 2 && word[0] == '0' {
+		base := 0
+		switch word[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+		if base != 0 {
+			digits := word[2:]
+			if digits[0] == '+' || digits[0] == '-' {
+				return nil, fmt.Errorf("invalid value '%s'", word)
+			}
+			i, err := strconv.ParseInt(digits, base, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", word)
+			}
+			return i, nil
+		}
+	}
+
+	unsigned := strings.TrimLeft(word, "+-")
+	if len(unsigned) > 1 && unsigned[0] == '0' && unsigned[1] >= '0' && unsigned[1] <= '9' {
+		return nil, fmt.Errorf("invalid value '%s': numbers cannot have leading zeros, and octal integers start with 0o", word)
+	}
+
+	if i, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return i, nil
+	}
+	if unsigned != "inf" && unsigned != "nan" && strings.Trim(unsigned, "0123456789.eE+-") != "" {
+		return nil, fmt.Errorf("invalid value '%s'", word)
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value '%s'", word)
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var b bytes.Buffer
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.peek()
+			p.pos++
+			switch e {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				size := 4
+				if e == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.data) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(string(p.data[p.pos:p.pos+size]), 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				p.pos += size
+			default:
+				return "", p.errorf("invalid escape sequence '\\%c'", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return "", p.errorf("unterminated string")
+	}
+	s := string(p.data[start:p.pos])
+	p.pos++
+	return s, nil
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	values := []interface{}{}
+	for {
+		p.skipBlank(true)
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return values, nil
+		default:
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func tomlName(field reflect.StructField) string {
+	if name := field.Tag.Get("toml"); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// decodeTOML copies parsed values onto a struct, rejecting unknown keys
+func decodeTOML(table map[string]interface{}, v reflect.Value, path string) error {
+	t := v.Type()
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		fields[tomlName(t.Field(i))] = i
+	}
+
+	for key, raw := range table {
+		name := joinPath(path, key)
+		i, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown setting '%s'", name)
+		}
+		if err := setTOMLValue(v.Field(i), raw, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setTOMLValue(f reflect.Value, raw interface{}, name string) error {
+	if f.Type() == durationType {
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a duration such as \"24h\"", name)
+		}
+		return setString(f, s, name)
+	}
+
+	switch f.Kind() {
+	case reflect.Struct:
+		table, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a table", name)
+		}
+		return decodeTOML(table, f, name)
+	case reflect.Map:
+		table, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a table", name)
+		}
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(f.Type()))
+		}
+		for key, item := range table {
+			elem := reflect.New(f.Type().Elem())
+			if existing := f.MapIndex(reflect.ValueOf(key)); existing.IsValid() {
+				elem.Elem().Set(existing)
+			} else if d, ok := elem.Interface().(defaulter); ok {
+				d.SetDefaults()
+			}
+			if err := setTOMLValue(elem.Elem(), item, joinPath(name, key)); err != nil {
+				return err
+			}
+			f.SetMapIndex(reflect.ValueOf(key), elem.Elem())
+		}
+		return nil
+	case reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		slice := reflect.MakeSlice(f.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setTOMLValue(slice.Index(i), item, fmt.Sprintf("%s[%d]", name, i)); err != nil {
+				return err
+			}
+		}
+		f.Set(slice)
+		return nil
+	case reflect.String:
+		if s, ok := raw.(string); ok {
+			f.SetString(s)
+			return nil
+		}
+		return fmt.Errorf("%s must be a string", name)
+	case reflect.Bool:
+		if b, ok := raw.(bool); ok {
+			f.SetBool(b)
+			return nil
+		}
+		return fmt.Errorf("%s must be a boolean", name)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if i, ok := raw.(int64); ok {
+			f.SetInt(i)
+			return nil
+		}
+		return fmt.Errorf("%s must be an integer", name)
+	case reflect.Float64:
+		switch n := raw.(type) {
+		case float64:
+			f.SetFloat(n)
+			return nil
+		case int64:
+			f.SetFloat(float64(n))
+			return nil
+		}
+		return fmt.Errorf("%s must be a number", name)
+	}
+
+	return fmt.Errorf("%s has an unsupported type", name)
+}
+
+// setString parses a setting given as text, such as an environment variable or flag
+func setString(f reflect.Value, s string, name string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as \"24h\", got '%s'", name, s)
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got '%s'", name, s)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, got '%s'", name, s)
+		}
+		f.SetInt(i)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got '%s'", name, s)
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s has an unsupported type", name)
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s has an unsupported type", name)
+	}
+
+	return nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// encodeTOML writes a struct as TOML, replacing non-empty secret values if redact is set
+func encodeTOML(b *bytes.Buffer, v reflect.Value, path string, redact bool) error {
+	t := v.Type()
+
+	// Write scalar settings before any nested tables
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct || f.Kind() == reflect.Map {
+			continue
+		}
+		if redact && field.Tag.Get("secret") == "true" && !f.IsZero() {
+			fmt.Fprintf(b, "%s = %s\n", tomlName(field), strconv.Quote("<redacted>"))
+			continue
+		}
+		value, err := encodeTOMLValue(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", joinPath(path, tomlName(field)), err.Error())
+		}
+		fmt.Fprintf(b, "%s = %s\n", tomlName(field), value)
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		f := v.Field(i)
+		name := joinPath(path, tomlName(field))
+		switch f.Kind() {
+		case reflect.Struct:
+			fmt.Fprintf(b, "\n[%s]\n", name)
+			if err := encodeTOML(b, f, name, redact); err != nil {
+				return err
+			}
+		case reflect.Map:
+			keys := f.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			if f.Type().Elem().Kind() != reflect.Struct {
+				fmt.Fprintf(b, "\n[%s]\n", name)
+				for _, key := range keys {
+					value, err := encodeTOMLValue(f.MapIndex(key))
+					if err != nil {
+						return fmt.Errorf("%s: %s", joinPath(name, tomlKey(key.String())), err.Error())
+					}
+					if redact && field.Tag.Get("secret") == "true" {
+						value = strconv.Quote("<redacted>")
+					}
+					fmt.Fprintf(b, "%s = %s\n", tomlKey(key.String()), value)
+				}
+				continue
+			}
+			for _, key := range keys {
+				itemName := joinPath(name, tomlKey(key.String()))
+				fmt.Fprintf(b, "\n[%s]\n", itemName)
+				if err := encodeTOML(b, f.MapIndex(key), itemName, redact); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func tomlKey(key string) string {
+	for i := 0; i < len(key); i++ {
+		if !isBareKeyChar(key[i]) {
+			return strconv.Quote(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+func encodeTOMLValue(f reflect.Value) (string, error) {
+	if f.Type() == durationType {
+		return strconv.Quote(time.Duration(f.Int()).String()), nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		return strconv.Quote(f.String()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(f.Bool()), nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(f.Int(), 10), nil
+	case reflect.Float64:
+		return strconv.FormatFloat(f.Float(), 'g', -1, 64), nil
+	case reflect.Slice:
+		items := make([]string, f.Len())
+		for i := range items {
+			item, err := encodeTOMLValue(f.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+
+	return "", errors.New("unsupported config value type " + f.Type().String())
+}
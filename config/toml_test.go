@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLNumbers(t *testing.T) {
+	cases := []struct {
+		input string
+		want  interface{}
+	}{
+		{"0", int64(0)},
+		{"-0", int64(0)},
+		{"3000", int64(3000)},
+		{"+42", int64(42)},
+		{"-17", int64(-17)},
+		{"1_000", int64(1000)},
+		{"0x1f", int64(31)},
+		{"0o755", int64(493)},
+		{"0b101", int64(5)},
+		{"0.5", 0.5},
+		{"-1.5e3", -1500.0},
+		{"1e2", 100.0},
+	}
+
+	for _, c := range cases {
+		table, err := parseTOML([]byte("value = " + c.input + "\n"))
+		if err != nil {
+			t.Errorf("%s: %s", c.input, err)
+			continue
+		}
+		if got := table["value"]; got != c.want {
+			t.Errorf("%s: got %#v, want %#v", c.input, got, c.want)
+		}
+	}
+}
+
+func TestParseTOMLInvalidNumbers(t *testing.T) {
+	for _, input := range []string{"0755", "-0755", "00", "01.5", "0x", "0x-1", "-0x1f", "0o8", "0b2", "0x1p4", "Infinity", "12abc"} {
+		if _, err := parseTOML([]byte("value = " + input + "\n")); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func TestParseTOMLDuplicateTable(t *testing.T) {
+	_, err := parseTOML([]byte("[server]\nport = 3000\n\n[tokens]\n\n[server]\nservice = \"users\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "table 'server' is defined more than once") {
+		t.Errorf("expected a duplicate table error, got %v", err)
+	}
+
+	if _, err := parseTOML([]byte("[services.users]\n\n[services.admins]\n")); err != nil {
+		t.Errorf("sibling tables should be allowed, got %s", err)
+	}
+}
+
+func TestEncodeTOMLUnsupportedType(t *testing.T) {
+	var v struct {
+		Channel chan int `toml:"channel"`
+	}
+
+	var b bytes.Buffer
+	if err := encodeTOML(&b, reflect.ValueOf(&v).Elem(), "", false); err == nil {
+		t.Error("expected an error for an unsupported field type")
+	}
+}
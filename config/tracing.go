@@ -0,0 +1,27 @@
+package config
+
+import (
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"os"
+)
+
+// InitTracing starts exporting spans to the configured exporter, if any
+func InitTracing() {
+	config := utilities.CurrentConfig().Tracing
+
+	switch config.Exporter {
+	case utilities.TracingExporterStdout:
+		tracing.Init(&tracing.StdoutExporter{Out: os.Stdout}, config.SampleRatio)
+	case utilities.TracingExporterOTLP:
+		tracing.Init(&tracing.OTLPExporter{
+			Endpoint:    config.OTLPEndpoint,
+			ServiceName: config.ServiceName,
+			Headers:     config.OTLPHeaders,
+		}, config.SampleRatio)
+	default:
+		return
+	}
+
+	utilities.Sugar.Infof("Exporting traces to %s", config.Exporter)
+}
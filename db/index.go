@@ -2,77 +2,55 @@ package db
 
 import (
 	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	_ "github.com/lib/pq"
+	"github.com/omar-ozgur/gram/secrets"
 	"github.com/omar-ozgur/gram/utilities"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"reflect"
-	"time"
+	"strings"
 )
 
 type DBParams struct {
 	User     string
-	Password string
+	Password secrets.SealedSecret
 	Name     string
 	Host     string
 	SSLMode  string
 }
 
+const DBParamsPath = "config/dbParams.json"
+
 var DB *sql.DB
 var DBInfo string
-var GCM cipher.AEAD
-var Nonce []byte
-
-var src = rand.NewSource(time.Now().UnixNano())
-
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	letterIdxBits = 6
-	letterIdxMask = 1<<letterIdxBits - 1
-	letterIdxMax  = 63 / letterIdxBits
-)
 
-func RandStringBytesMaskImprSrc(n int) string {
-	b := make([]byte, n)
+func FindDBParam(param *string, alias string, defaultValue string) {
+	scanner := bufio.NewScanner(os.Stdin)
 
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
+	if *param != "" {
+		fmt.Printf("The currently saved DB %s is '%s'. Type a new %s, or press enter to keep it.\n", alias, *param, alias)
+	} else {
+		*param = defaultValue
+		fmt.Printf("The default DB %s is '%s'. Type a new %s, or press enter to keep it.\n", alias, *param, alias)
 	}
 
-	return string(b)
+	scanner.Scan()
+	input := scanner.Text()
+	if input != "" {
+		*param = input
+	}
 }
 
-func FindDBParam(param *string, alias string, defaultValue string, encrypt bool) {
+func FindDBPassword(param *secrets.SealedSecret, alias string, passphrase string) {
 	scanner := bufio.NewScanner(os.Stdin)
 
-	if !encrypt {
-		if *param != "" {
-			fmt.Printf("The currently saved DB %s is '%s'. Type a new %s, or press enter to keep it.\n", alias, *param, alias)
-		} else {
-			*param = defaultValue
-			fmt.Printf("The default DB %s is '%s'. Type a new %s, or press enter to keep it.\n", alias, *param, alias)
-		}
+	if !param.IsEmpty() {
+		fmt.Printf("Please enter a new %s, or press enter to keep your old one.\n", alias)
 	} else {
-		if *param != "" {
-			fmt.Printf("Please enter a new %s, or press enter to keep your old one.\n", alias)
-		} else {
-			fmt.Printf("Please enter a new %s.\n", alias)
-		}
+		fmt.Printf("Please enter a new %s.\n", alias)
 	}
 
 	complete := false
@@ -80,14 +58,11 @@ func FindDBParam(param *string, alias string, defaultValue string, encrypt bool)
 		scanner.Scan()
 		input := scanner.Text()
 		if input != "" {
-			if encrypt {
-				encryptedInput := GCM.Seal(nil, Nonce, []byte(input), nil)
-				*param = hex.EncodeToString(encryptedInput)
-			} else {
-				*param = input
-			}
+			sealed, err := secrets.Seal(passphrase, []byte(input))
+			utilities.CheckErr(err)
+			*param = sealed
 			complete = true
-		} else if encrypt && *param == "" {
+		} else if param.IsEmpty() {
 			fmt.Printf("The %s cannot be blank. Please try again.\n", alias)
 		} else {
 			complete = true
@@ -95,33 +70,46 @@ func FindDBParam(param *string, alias string, defaultValue string, encrypt bool)
 	}
 }
 
-func FindDBInfo(dbParams *DBParams) {
-	DBInfo = os.Getenv("GRAM_DB_INFO")
-	if DBInfo != "" {
-		return
-	}
-
-	key := os.Getenv("GRAM_ENCRYPTION_KEY")
+func GetEncryptionKey() string {
+	key := utilities.CurrentConfig().Database.EncryptionKey
 	if key == "" {
 		fmt.Println("Error: No database encryption key was found.")
-		newKey := RandStringBytesMaskImprSrc(16)
-		fmt.Println("Please set the GRAM_ENCRYPTION_KEY environment variable to the following 16-byte value, or generate your own.")
-		fmt.Println(string(newKey))
+		fmt.Println("Please set the GRAM_ENCRYPTION_KEY environment variable to the following passphrase, or choose your own.")
+		fmt.Println(secrets.GeneratePassphrase(24))
 		os.Exit(1)
 	}
 
-	c, err := aes.NewCipher([]byte(key))
-	utilities.CheckErr(err)
+	return key
+}
 
-	GCM, err = cipher.NewGCM(c)
-	utilities.CheckErr(err)
+func FindDBInfo(dbParams *DBParams) {
+	config := utilities.CurrentConfig().Database
+	DBInfo = config.Info
+	if DBInfo != "" {
+		return
+	}
 
-	Nonce = make([]byte, GCM.NonceSize())
+	key := GetEncryptionKey()
+
+	// Settings from the config take precedence over saved ones
+	for _, override := range []struct {
+		param *string
+		value string
+	}{
+		{&dbParams.User, config.User},
+		{&dbParams.Name, config.Name},
+		{&dbParams.Host, config.Host},
+		{&dbParams.SSLMode, config.SSLMode},
+	} {
+		if override.value != "" {
+			*override.param = override.value
+		}
+	}
 
 	count := 0
 	v := reflect.ValueOf(*dbParams)
 	for i := 0; i < v.NumField(); i++ {
-		if v.Field(i).Interface() != "" {
+		if !v.Field(i).IsZero() {
 			count++
 		}
 	}
@@ -131,57 +119,90 @@ func FindDBInfo(dbParams *DBParams) {
 	}
 
 	if count < v.NumField() {
-		FindDBParam(&dbParams.User, "username", utilities.DefaultDBUser, false)
-		FindDBParam(&dbParams.Password, "password", "", true)
-		FindDBParam(&dbParams.Name, "name", utilities.DefaultDBName, false)
-		FindDBParam(&dbParams.Host, "host", utilities.DefaultDBHost, false)
-		FindDBParam(&dbParams.SSLMode, "SSL mode", utilities.DefaultDBSSLMode, false)
+		FindDBParam(&dbParams.User, "username", utilities.DefaultDBUser)
+		FindDBPassword(&dbParams.Password, "password", key)
+		FindDBParam(&dbParams.Name, "name", utilities.DefaultDBName)
+		FindDBParam(&dbParams.Host, "host", utilities.DefaultDBHost)
+		FindDBParam(&dbParams.SSLMode, "SSL mode", utilities.DefaultDBSSLMode)
 	}
 
-	decodedHex, err := hex.DecodeString(dbParams.Password)
+	plainPassword, err := secrets.Open(key, dbParams.Password)
 	utilities.CheckErr(err)
 
-	plainPassword, err := GCM.Open(nil, Nonce, decodedHex, nil)
-	utilities.CheckErr(err)
+	// Migrate passwords stored in the legacy format
+	if dbParams.Password.IsLegacy() {
+		dbParams.Password, err = secrets.Seal(key, plainPassword)
+		utilities.CheckErr(err)
+		utilities.Logger.Info("Migrated the stored DB password to the current sealed secret format")
+	}
+
+	if !utilities.ValidDBSSLMode(dbParams.SSLMode) {
+		utilities.CheckErr(fmt.Errorf("the DB SSL mode must be one of %s, got '%s'", strings.Join(utilities.DBSSLModes, ", "), dbParams.SSLMode))
+	}
 
-	DBInfo = fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=disable",
-		dbParams.User, string(plainPassword), dbParams.Name, dbParams.Host)
+	DBInfo = fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=%s",
+		dbParams.User, string(plainPassword), dbParams.Name, dbParams.Host, dbParams.SSLMode)
 }
 
-func InitDB() {
-	var dbParams DBParams
+func ReadDBParams() (dbParams DBParams, err error) {
+	data, err := ioutil.ReadFile(DBParamsPath)
+	if err != nil {
+		return DBParams{}, err
+	}
 
-	data, err := ioutil.ReadFile("config/dbParams.json")
-	if err == nil {
-		json.Unmarshal(data, &dbParams)
+	err = json.Unmarshal(data, &dbParams)
+	return
+}
+
+func WriteDBParams(dbParams DBParams) error {
+	data, err := json.Marshal(dbParams)
+	if err != nil {
+		return err
 	}
 
-	FindDBInfo(&dbParams)
+	return ioutil.WriteFile(DBParamsPath, data, 0600)
+}
 
-	json, err := json.Marshal(dbParams)
-	utilities.CheckErr(err)
+// RekeyDBParams re-encrypts the stored DB password under a new passphrase
+func RekeyDBParams(oldKey string, newKey string) error {
+	dbParams, err := ReadDBParams()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", DBParamsPath, err.Error())
+	}
 
-	err = ioutil.WriteFile("config/dbParams.json", json, 0644)
-	utilities.CheckErr(err)
+	plainPassword, err := secrets.Open(oldKey, dbParams.Password)
+	if err != nil {
+		return err
+	}
 
-	DB, err = sql.Open("postgres", DBInfo)
+	dbParams.Password, err = secrets.Seal(newKey, plainPassword)
 	if err != nil {
-		panic(fmt.Sprintf("Error: An error occurred while opening the SQL database\n%v", err))
+		return err
 	}
 
-	service := utilities.Service
+	return WriteDBParams(dbParams)
+}
+
+func InitDB() {
+	OpenDB()
 
-	_, err = DB.Exec(fmt.Sprintf("SELECT * FROM %s", service))
+	err := Migrate()
 	if err != nil {
-		_, err = DB.Exec(fmt.Sprintf(`CREATE TABLE %s (
-           id SERIAL,
-           first_name text,
-           last_name text,
-           email text,
-           password bytea,
-           time_created timestamp DEFAULT now()
-           );`, service))
-		utilities.CheckErr(err)
+		panic(fmt.Sprintf("Error: The database could not be migrated\n%v", err))
 	}
+}
+
+// OpenDB finds the connection settings and opens the database pool without changing the schema
+func OpenDB() {
+	dbParams, _ := ReadDBParams()
+
+	FindDBInfo(&dbParams)
+
+	err := WriteDBParams(dbParams)
 	utilities.CheckErr(err)
+
+	DB, err = sql.Open("postgres", DBInfo)
+	if err != nil {
+		panic(fmt.Sprintf("Error: An error occurred while opening the SQL database\n%v", err))
+	}
 }
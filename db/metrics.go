@@ -0,0 +1,31 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/omar-ozgur/gram/metrics"
+)
+
+// poolStat reads a statistic of the connection pool when metrics are scraped, or 0 before the pool is opened
+func poolStat(stat func(sql.DBStats) float64) func() float64 {
+	return func() float64 {
+		if DB == nil {
+			return 0
+		}
+		return stat(DB.Stats())
+	}
+}
+
+func init() {
+	metrics.NewGaugeFunc("gram_db_pool_max_open_connections", "The maximum number of open connections to the database.",
+		poolStat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	metrics.NewGaugeFunc("gram_db_pool_open_connections", "The number of open connections to the database.",
+		poolStat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	metrics.NewGaugeFunc("gram_db_pool_in_use_connections", "The number of connections in use.",
+		poolStat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	metrics.NewGaugeFunc("gram_db_pool_idle_connections", "The number of idle connections.",
+		poolStat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	metrics.NewCounterFunc("gram_db_pool_wait_count_total", "The number of times a query waited for a connection.",
+		poolStat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	metrics.NewCounterFunc("gram_db_pool_wait_duration_seconds_total", "The total time queries waited for a connection.",
+		poolStat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+}
@@ -0,0 +1,375 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omar-ozgur/gram/utilities"
+	"strings"
+)
+
+// Migration is a change to a service's schema. Migrations are applied in order, each in its own transaction.
+// Early migrations use IF NOT EXISTS, because their changes were applied before migrations were recorded.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx, service string) error
+}
+
+var Migrations = []Migration{
+	{1, "create users table", func(tx *sql.Tx, service string) error {
+		return execAll(tx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+           id SERIAL,
+           first_name text,
+           last_name text,
+           email text,
+           password bytea,
+           time_created timestamp DEFAULT now()
+           );`, service))
+	}},
+	{2, "index sort columns", func(tx *sql.Tx, service string) error {
+		var statements []string
+		for _, column := range []string{"id", "first_name", "last_name", "time_created"} {
+			columns := column
+			if column != "id" {
+				columns = column + ", id"
+			}
+			statements = append(statements, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_idx ON %s (%s);", service, column, service, columns))
+		}
+		return execAll(tx, statements...)
+	}},
+	{3, "add updated_at and version", func(tx *sql.Tx, service string) error {
+		return execAll(tx, fmt.Sprintf(`ALTER TABLE %s
+           ADD COLUMN IF NOT EXISTS updated_at timestamp DEFAULT now(),
+           ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;`, service))
+	}},
+	{4, "add custom attributes", func(tx *sql.Tx, service string) error {
+		return execAll(tx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}';`, service))
+	}},
+	{5, "add username and phone identifiers", func(tx *sql.Tx, service string) error {
+		return execAll(tx,
+			fmt.Sprintf(`ALTER TABLE %s
+           ADD COLUMN IF NOT EXISTS username text,
+           ADD COLUMN IF NOT EXISTS username_skeleton text,
+           ADD COLUMN IF NOT EXISTS phone text;`, service),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_username_skeleton_key ON %s (username_skeleton);", service, service),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_phone_key ON %s (phone);", service, service))
+	}},
+	{6, "add primary key", func(tx *sql.Tx, service string) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = $1::regclass AND contype = 'p');`, service).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+
+		duplicates, err := findDuplicates(tx, fmt.Sprintf("SELECT 'id ' || id, array_agg(coalesce(email, 'no email') ORDER BY time_created) FROM %s GROUP BY id HAVING count(*) > 1 ORDER BY id;", service))
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			return duplicateError(service, "id", duplicates)
+		}
+
+		return execAll(tx, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s_pkey PRIMARY KEY (id);", service, service))
+	}},
+	{7, "add unique email index", func(tx *sql.Tx, service string) error {
+		duplicates, err := findDuplicates(tx, fmt.Sprintf("SELECT lower(email), array_agg('user ' || id ORDER BY id) FROM %s WHERE email <> '' GROUP BY lower(email) HAVING count(*) > 1 ORDER BY lower(email);", service))
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			return duplicateError(service, "lower(email)", duplicates)
+		}
+
+		// Blank emails are stored as NULL, which unique indexes ignore
+		return execAll(tx,
+			fmt.Sprintf("UPDATE %s SET email = NULL WHERE email = '';", service),
+			fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_email_key ON %s (lower(email));", service, service))
+	}},
+	{8, "create audit log", func(tx *sql.Tx, service string) error {
+		table := AuditTable(service)
+		return execAll(tx,
+			fmt.Sprintf(`CREATE TABLE %s (
+           id bigserial PRIMARY KEY,
+           time timestamptz NOT NULL,
+           actor text NOT NULL,
+           target text NOT NULL,
+           action text NOT NULL,
+           details text NOT NULL,
+           ip text NOT NULL,
+           user_agent text NOT NULL,
+           request_id text NOT NULL,
+           prev_hash bytea NOT NULL,
+           hash bytea NOT NULL UNIQUE
+           );`, table),
+			fmt.Sprintf("CREATE INDEX %s_time_idx ON %s (time);", table, table),
+			fmt.Sprintf("CREATE INDEX %s_actor_idx ON %s (actor, id);", table, table),
+			fmt.Sprintf("CREATE INDEX %s_target_idx ON %s (target, id);", table, table),
+
+			// The log is append-only, even for the server's own database user
+			fmt.Sprintf(`CREATE FUNCTION %s_append_only() RETURNS trigger AS $$
+           BEGIN
+             RAISE EXCEPTION 'the audit log is append-only';
+           END;
+           $$ LANGUAGE plpgsql;`, table),
+			fmt.Sprintf("CREATE TRIGGER %s_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE %s_append_only();", table, table, table))
+	}},
+	{9, "create events and webhook deliveries", func(tx *sql.Tx, service string) error {
+		events, deliveries := EventsTable(service), WebhookDeliveriesTable(service)
+		return execAll(tx,
+			fmt.Sprintf(`CREATE TABLE %s (
+           id bigserial PRIMARY KEY,
+           type text NOT NULL,
+           time timestamptz NOT NULL DEFAULT now(),
+           data text NOT NULL,
+           request_id text NOT NULL DEFAULT ''
+           );`, events),
+			fmt.Sprintf(`CREATE TABLE %s (
+           id bigserial PRIMARY KEY,
+           event_id bigint NOT NULL REFERENCES %s (id),
+           webhook text NOT NULL,
+           status text NOT NULL DEFAULT 'pending',
+           attempts integer NOT NULL DEFAULT 0,
+           next_attempt_at timestamptz NOT NULL DEFAULT now(),
+           last_status integer NOT NULL DEFAULT 0,
+           last_error text NOT NULL DEFAULT '',
+           created_at timestamptz NOT NULL DEFAULT now(),
+           delivered_at timestamptz,
+           UNIQUE (event_id, webhook)
+           );`, deliveries, events),
+			fmt.Sprintf("CREATE INDEX %s_due_idx ON %s (next_attempt_at, id) WHERE status = 'pending';", deliveries, deliveries),
+			fmt.Sprintf("CREATE INDEX %s_status_idx ON %s (status, id);", deliveries, deliveries))
+	}},
+	{10, "add groups and provisioning columns", func(tx *sql.Tx, service string) error {
+		groups, members := GroupsTable(service), GroupMembersTable(service)
+		return execAll(tx,
+			fmt.Sprintf(`ALTER TABLE %s
+           ADD COLUMN active boolean NOT NULL DEFAULT true,
+           ADD COLUMN external_id text NOT NULL DEFAULT '';`, service),
+			fmt.Sprintf(`CREATE TABLE %s (
+           id bigserial PRIMARY KEY,
+           display_name text NOT NULL,
+           external_id text NOT NULL DEFAULT '',
+           created_at timestamptz NOT NULL DEFAULT now(),
+           updated_at timestamptz NOT NULL DEFAULT now(),
+           version integer NOT NULL DEFAULT 1
+           );`, groups),
+			fmt.Sprintf("CREATE UNIQUE INDEX %s_display_name_key ON %s (lower(display_name));", groups, groups),
+			fmt.Sprintf(`CREATE TABLE %s (
+           group_id bigint NOT NULL REFERENCES %s (id) ON DELETE CASCADE,
+           user_id integer NOT NULL REFERENCES %s (id) ON DELETE CASCADE,
+           PRIMARY KEY (group_id, user_id)
+           );`, members, groups, service),
+			fmt.Sprintf("CREATE INDEX %s_user_idx ON %s (user_id);", members, members))
+	}},
+	{11, "create identities and login flows", func(tx *sql.Tx, service string) error {
+		identities, flows := IdentitiesTable(service), LoginFlowsTable(service)
+		return execAll(tx,
+			fmt.Sprintf(`CREATE TABLE %s (
+           provider text NOT NULL,
+           subject text NOT NULL,
+           user_id integer NOT NULL REFERENCES %s (id) ON DELETE CASCADE,
+           email text NOT NULL DEFAULT '',
+           created_at timestamptz NOT NULL DEFAULT now(),
+           PRIMARY KEY (provider, subject)
+           );`, identities, service),
+			fmt.Sprintf("CREATE UNIQUE INDEX %s_user_provider_key ON %s (user_id, provider);", identities, identities),
+			fmt.Sprintf(`CREATE TABLE %s (
+           token_hash bytea PRIMARY KEY,
+           kind text NOT NULL,
+           provider text NOT NULL,
+           data jsonb NOT NULL,
+           expires_at timestamptz NOT NULL
+           );`, flows),
+			fmt.Sprintf("CREATE INDEX %s_expires_at_idx ON %s (expires_at);", flows, flows))
+	}},
+}
+
+// AuditTable is the name of a service's audit log table
+func AuditTable(service string) string {
+	return service + "_audit_log"
+}
+
+// EventsTable is the name of a service's event log, which is also the outbox webhooks are delivered from
+func EventsTable(service string) string {
+	return service + "_events"
+}
+
+func WebhookDeliveriesTable(service string) string {
+	return service + "_webhook_deliveries"
+}
+
+// GroupsTable is the name of a service's groups, which identity providers manage with SCIM
+func GroupsTable(service string) string {
+	return service + "_groups"
+}
+
+func GroupMembersTable(service string) string {
+	return service + "_group_members"
+}
+
+// IdentitiesTable is the name of the table that links users to their accounts with upstream identity providers
+func IdentitiesTable(service string) string {
+	return service + "_identities"
+}
+
+// LoginFlowsTable is the name of the table of federated logins in progress, and of identities waiting to be linked
+func LoginFlowsTable(service string) string {
+	return service + "_login_flows"
+}
+
+// duplicate is a value that should be unique, and a description of each row that uses it
+type duplicate struct {
+	Value string
+	Rows  []string
+}
+
+func findDuplicates(tx *sql.Tx, query string) ([]duplicate, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		err = rows.Scan(&d.Value, pq.Array(&d.Rows))
+		if err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
+
+// duplicateError reports every value that prevents a unique constraint from being added
+func duplicateError(service, column string, duplicates []duplicate) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "cannot make %s.%s unique, because %d values are used by more than one user:\n", service, column, len(duplicates))
+	for _, d := range duplicates {
+		fmt.Fprintf(&b, "  %s: %s\n", d.Value, strings.Join(d.Rows, ", "))
+	}
+	b.WriteString("Merge, change or delete these users, then run the migrations again")
+	return fmt.Errorf("%s", b.String())
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrationsTable(service string) string {
+	return service + "_schema_migrations"
+}
+
+// AppliedMigrations returns the versions of the migrations applied to the current service
+func AppliedMigrations() (map[int]bool, error) {
+	service := utilities.CurrentConfig().Server.Service
+	applied := make(map[int]bool)
+
+	var exists bool
+	err := DB.QueryRow("SELECT to_regclass($1) IS NOT NULL;", migrationsTable(service)).Scan(&exists)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := DB.Query(fmt.Sprintf("SELECT version FROM %s;", migrationsTable(service)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// PendingMigrations returns the migrations that have not been applied to the current service
+func PendingMigrations() ([]Migration, error) {
+	applied, err := AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range Migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every pending migration to the current service.
+// An advisory lock stops several servers starting at once from applying the same migration.
+func Migrate() error {
+	service := utilities.CurrentConfig().Server.Service
+
+	_, err := DB.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+           version integer PRIMARY KEY,
+           name text NOT NULL,
+           applied_at timestamp NOT NULL DEFAULT now()
+           );`, migrationsTable(service)))
+	if err != nil {
+		return err
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		err = applyMigration(service, migration)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", migration.Version, migration.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func applyMigration(service string, migration Migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1));", migrationsTable(service))
+	if err != nil {
+		return err
+	}
+
+	// Another server may have applied the migration while this one waited for the lock
+	var applied bool
+	err = tx.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE version = $1);", migrationsTable(service)), migration.Version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	err = migration.Up(tx, service)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (version, name) VALUES ($1, $2);", migrationsTable(service)), migration.Version, migration.Name)
+	if err != nil {
+		return err
+	}
+
+	utilities.Sugar.Infof("Applied migration %d (%s)", migration.Version, migration.Name)
+	return tx.Commit()
+}
@@ -0,0 +1,24 @@
+package events
+
+// Event types published when a user changes
+const (
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+)
+
+// Event types published when a user logs in
+const (
+	SessionCreated = "session.created"
+)
+
+var All = []string{UserCreated, UserUpdated, UserDeleted, SessionCreated}
+
+func IsValid(eventType string) bool {
+	for _, name := range All {
+		if name == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omar-ozgur/gram/db"
+	"github.com/omar-ozgur/gram/utilities"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Build information, set at build time with
+// -ldflags "-X github.com/omar-ozgur/gram/health.Version=... -X github.com/omar-ozgur/gram/health.Commit=... -X github.com/omar-ozgur/gram/health.BuildTime=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Component statuses
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+// CheckTimeout bounds each readiness check, so a hung database cannot hang the probe
+const CheckTimeout = 2 * time.Second
+
+var started = time.Now()
+
+var shuttingDown int32
+
+// SetShuttingDown fails readiness so that load balancers stop sending new requests while in-flight requests drain
+func SetShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Check is one component that must be healthy for the server to be ready
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Checks are run in parallel by Ready, and reported in order
+var Checks = []Check{
+	{"server", checkServer},
+	{"database", checkDatabase},
+	{"migrations", checkMigrations},
+	{"signing_keys", checkSigningKeys},
+}
+
+func checkServer(ctx context.Context) error {
+	if ShuttingDown() {
+		return errors.New("Shutting down")
+	}
+	return nil
+}
+
+func checkDatabase(ctx context.Context) error {
+	if db.DB == nil {
+		return errors.New("Not connected")
+	}
+	return db.DB.PingContext(ctx)
+}
+
+func checkMigrations(ctx context.Context) error {
+	if db.DB == nil {
+		return errors.New("Not connected")
+	}
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		var versions []string
+		for _, migration := range pending {
+			versions = append(versions, fmt.Sprintf("%d (%s)", migration.Version, migration.Name))
+		}
+		return fmt.Errorf("Pending migrations: %s", strings.Join(versions, ", "))
+	}
+	return nil
+}
+
+func checkSigningKeys(ctx context.Context) error {
+	if utilities.CurrentConfig().Tokens.Secret == "" {
+		return errors.New("tokens.secret is not set")
+	}
+	return nil
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Message   string  `json:"message,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// Ready runs every check, and reports whether all of them passed
+func Ready(ctx context.Context) ([]Result, bool) {
+	results := make([]Result, len(Checks))
+	var wg sync.WaitGroup
+	for i, check := range Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Status != StatusPass {
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// run reports a check that has not finished within CheckTimeout as failed, leaving it to finish in the background
+func run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("Timed out after %s", CheckTimeout)
+	}
+
+	result := Result{Name: check.Name, Status: StatusPass, LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		result.Status = StatusFail
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// Failed returns the names of the checks that failed
+func Failed(results []Result) []string {
+	var names []string
+	for _, result := range results {
+		if result.Status != StatusPass {
+			names = append(names, result.Name)
+		}
+	}
+	return names
+}
+
+// Build describes the running binary
+func Build() map[string]interface{} {
+	return map[string]interface{}{
+		"version":    Version,
+		"commit":     Commit,
+		"build_time": BuildTime,
+		"go_version": runtime.Version(),
+	}
+}
+
+// Uptime is the time since the process started
+func Uptime() time.Duration {
+	return time.Since(started)
+}
+
+func StartedAt() time.Time {
+	return started
+}
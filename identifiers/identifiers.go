@@ -0,0 +1,153 @@
+package identifiers
+
+import (
+	"errors"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Login identifiers a service can enable
+const (
+	Email    = "email"
+	Username = "username"
+	Phone    = "phone"
+)
+
+var All = []string{Email, Username, Phone}
+
+const MinUsernameLength = 3
+const MaxUsernameLength = 32
+
+var phoneRegexp = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// scriptGroups are combinations of scripts that are commonly written together
+var scriptGroups = [][]string{
+	{"Han", "Hiragana", "Katakana"},
+	{"Han", "Hangul"},
+	{"Han", "Bopomofo"},
+}
+
+func IsValid(identifier string) bool {
+	for _, name := range All {
+		if name == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeUsername returns the canonical form of a username, or an error if it is not allowed.
+// Usernames are letters and ASCII digits from a single script, optionally separated by '.', '_' or '-'.
+// Usernames are normalized to NFKC, so that each username has one spelling: fullwidth forms are folded to ASCII
+// and combining marks are composed. Combining marks that have no precomposed form are rejected.
+func NormalizeUsername(username string) (string, error) {
+	normalized := norm.NFKC.String(strings.TrimSpace(username))
+
+	length := utf8.RuneCountInString(normalized)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return "", errors.New("must be between 3 and 32 characters long")
+	}
+
+	var previous rune
+	scripts := make(map[string]bool)
+	for i, r := range normalized {
+		switch {
+		case r >= '0' && r <= '9':
+		case r == '.' || r == '_' || r == '-':
+			if i == 0 || i == len(normalized)-1 || previous == '.' || previous == '_' || previous == '-' {
+				return "", errors.New("can only use '.', '_' and '-' between letters or digits")
+			}
+		case unicode.IsLetter(r):
+			scripts[scriptOf(r)] = true
+		case unicode.In(r, unicode.Mn, unicode.Me):
+			return "", errors.New("cannot contain combining marks")
+		case unicode.IsDigit(r):
+			return "", errors.New("can only use the digits 0-9")
+		default:
+			return "", errors.New("can only contain letters, digits, '.', '_' and '-'")
+		}
+		previous = r
+	}
+
+	if !singleScript(scripts) {
+		return "", errors.New("cannot mix letters from different scripts")
+	}
+
+	return normalized, nil
+}
+
+func scriptOf(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Common"
+}
+
+func singleScript(scripts map[string]bool) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+
+	for _, group := range scriptGroups {
+		allowed := make(map[string]bool)
+		for _, name := range group {
+			allowed[name] = true
+		}
+		inGroup := true
+		for name := range scripts {
+			if !allowed[name] {
+				inGroup = false
+				break
+			}
+		}
+		if inGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// confusables map characters that look alike to a common prototype, following Unicode TR 39
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'е': "e", 'һ': "h", 'і': "i", 'ј': "j", 'ӏ': "l", 'о': "o", 'р': "p", 'с': "c",
+	'у': "y", 'х': "x", 'ѕ': "s", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w",
+	// Greek
+	'α': "a", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o", 'ρ': "p", 'υ': "u", 'χ': "x",
+	// Latin and digits
+	'ı': "i", 'ȷ': "j", 'ɡ': "g", '0': "o", '1': "l",
+}
+
+// multiConfusables are sequences that look like a single letter
+var multiConfusables = strings.NewReplacer("rn", "m", "vv", "w")
+
+// Skeleton returns a form of a normalized username that is the same for usernames that look alike.
+// Two usernames with the same skeleton cannot both be registered.
+func Skeleton(username string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(norm.NFKC.String(username)) {
+		if prototype, ok := confusables[r]; ok {
+			b.WriteString(prototype)
+		} else if r == '.' || r == '_' || r == '-' {
+			b.WriteRune('_')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return multiConfusables.Replace(b.String())
+}
+
+// NormalizePhone returns a phone number in E.164 format, ignoring spaces, dashes, dots and parentheses
+func NormalizePhone(phone string) (string, error) {
+	normalized := phoneSeparators.Replace(strings.TrimSpace(phone))
+	if !phoneRegexp.MatchString(normalized) {
+		return "", errors.New("must be an E.164 phone number, such as +14155550123")
+	}
+	return normalized, nil
+}
@@ -0,0 +1,99 @@
+package identifiers
+
+import (
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	cases := []struct {
+		username string
+		want     string
+	}{
+		{"  jdoe  ", "jdoe"},
+		{"j.doe_1-x", "j.doe_1-x"},
+		{"ｊｄｏｅ", "jdoe"},
+		{"ｊ．ｄｏｅ１", "j.doe1"},
+		{"jose\u0301", "josé"},
+		{"josé", "josé"},
+		{"ﬁona", "fiona"},
+		{"Ａlice", "Alice"},
+		{"田中たろう", "田中たろう"},
+		{"김민준", "김민준"},
+		{"ｶﾀｶﾅ", "カタカナ"},
+	}
+
+	for _, c := range cases {
+		got, err := NormalizeUsername(c.username)
+		if err != nil {
+			t.Errorf("%q: %s", c.username, err)
+		} else if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.username, got, c.want)
+		}
+	}
+
+	// Spellings that are the same after normalization cannot register separately
+	composed, _ := NormalizeUsername("zoë")
+	decomposed, _ := NormalizeUsername("zoe\u0308")
+	if composed != decomposed || Skeleton(composed) != Skeleton(decomposed) {
+		t.Errorf("got %q and %q", composed, decomposed)
+	}
+}
+
+func TestNormalizeUsernameInvalid(t *testing.T) {
+	cases := []string{
+		"jd",
+		"abcdefghijklmnopqrstuvwxyzabcdefg",
+		"q\u0301q\u0301",
+		"j doe",
+		"jdoe!",
+		".jdoe",
+		"jdoe-",
+		"j..doe",
+		"j._doe",
+		"jdoe٣",
+		"pаypal",
+		"",
+	}
+
+	for _, username := range cases {
+		if got, err := NormalizeUsername(username); err == nil {
+			t.Errorf("%q: got %q, want an error", username, got)
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	cases := []struct {
+		a, b string
+		same bool
+	}{
+		{"alice", "Alice", true},
+		{"alice", "аlice", true},
+		{"paypal", "рауpаl", true},
+		{"modern", "rnodern", true},
+		{"wave", "vvave", true},
+		{"j.doe", "j_doe", true},
+		{"j.doe", "j-doe", true},
+		{"bob1", "bobl", true},
+		{"bob0", "bobo", true},
+		{"alice", "alicia", false},
+		{"josé", "jose", false},
+	}
+
+	for _, c := range cases {
+		if same := Skeleton(c.a) == Skeleton(c.b); same != c.same {
+			t.Errorf("%q and %q: got same skeleton %v, want %v", c.a, c.b, same, c.same)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	if got, err := NormalizePhone(" +1 (415) 555-0123 "); err != nil || got != "+14155550123" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	for _, phone := range []string{"4155550123", "+0155550123", "+1415555012345678", "+1415abc0123"} {
+		if _, err := NormalizePhone(phone); err == nil {
+			t.Errorf("%q: expected an error", phone)
+		}
+	}
+}
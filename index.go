@@ -1,25 +1,49 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"github.com/omar-ozgur/gram/app/models"
 	"github.com/omar-ozgur/gram/config"
 	"github.com/omar-ozgur/gram/db"
 	"github.com/omar-ozgur/gram/utilities"
-	"net/http"
+	"github.com/omar-ozgur/gram/webhooks"
 )
 
 func main() {
 	config.ParseArgs()
 
+	if flag.NArg() > 0 {
+		config.RunCommand(flag.Args())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	utilities.SetConfig(config.MustLoadConfig())
+	utilities.InitLogger()
+	config.WatchConfig(ctx)
+	config.InitTracing()
+
 	db.InitDB()
 
 	models.Init()
+	go webhooks.Run(ctx)
 
 	n := config.InitRouter()
 
-	utilities.Sugar.Infof("Started server on port %s\n", utilities.Port)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", utilities.Port), n)
+	listener, err := config.Listen()
+	if err != nil {
+		utilities.Logger.Fatal(err.Error())
+	}
+
+	server := config.NewServer(n)
+	admin := config.NewAdminServer()
+	utilities.Sugar.Infof("Started server on %s", listener.Addr())
+	if admin != nil {
+		utilities.Sugar.Infof("Started admin server on %s", admin.Addr)
+	}
+	err = config.Serve(server, listener, admin, cancel)
 	if err != nil {
 		utilities.Logger.Fatal(err.Error())
 	}
@@ -0,0 +1,165 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER identifier octets used by LDAP (RFC 4511 section 5.1). Only the low tag numbers that fit in one octet are used.
+const (
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+)
+
+// maxMessageSize limits the responses that are read, so that a misbehaving server cannot exhaust memory
+const maxMessageSize = 16 << 20
+
+var errMalformed = errors.New("ldap: malformed BER encoding")
+
+// element is a decoded BER element: its identifier octet and its contents
+type element struct {
+	tag     byte
+	content []byte
+}
+
+// encode returns the BER encoding of an element with the given identifier and contents
+func encode(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, content := range contents {
+		length += len(content)
+	}
+
+	out := []byte{tag}
+	if length < 0x80 {
+		out = append(out, byte(length))
+	} else {
+		var octets []byte
+		for n := length; n > 0; n >>= 8 {
+			octets = append([]byte{byte(n)}, octets...)
+		}
+		out = append(out, 0x80|byte(len(octets)))
+		out = append(out, octets...)
+	}
+	for _, content := range contents {
+		out = append(out, content...)
+	}
+	return out
+}
+
+func encodeString(tag byte, value string) []byte {
+	return encode(tag, []byte(value))
+}
+
+// encodeInt encodes an INTEGER or ENUMERATED in the fewest two's complement octets
+func encodeInt(tag byte, value int64) []byte {
+	octets := []byte{byte(value)}
+	for value > 127 || value < -128 {
+		value >>= 8
+		octets = append([]byte{byte(value)}, octets...)
+	}
+	return encode(tag, octets)
+}
+
+func encodeBool(value bool) []byte {
+	if value {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0x00})
+}
+
+// readElement reads one element from a stream
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return element{}, errMalformed
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first &^ 0x80)
+		if count == 0 || count > 4 {
+			return element{}, errMalformed
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, unexpectedEOF(err)
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return element{}, fmt.Errorf("ldap: a message of %d bytes is too large", length)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	return element{tag: tag, content: content}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// children decodes the elements in the contents of a constructed element
+func (e element) children() ([]element, error) {
+	var elements []element
+	data := e.content
+	for len(data) > 0 {
+		if len(data) < 2 || data[0]&0x1f == 0x1f {
+			return nil, errMalformed
+		}
+		tag, length, offset := data[0], int(data[1]), 2
+		if data[1]&0x80 != 0 {
+			count := int(data[1] &^ 0x80)
+			if count == 0 || count > 4 || len(data) < 2+count {
+				return nil, errMalformed
+			}
+			length = 0
+			for _, b := range data[2 : 2+count] {
+				length = length<<8 | int(b)
+			}
+			offset += count
+		}
+		if length < 0 || len(data)-offset < length {
+			return nil, errMalformed
+		}
+		elements = append(elements, element{tag: tag, content: data[offset : offset+length]})
+		data = data[offset+length:]
+	}
+	return elements, nil
+}
+
+// int decodes an INTEGER or ENUMERATED
+func (e element) int() (int64, error) {
+	if len(e.content) == 0 || len(e.content) > 8 {
+		return 0, errMalformed
+	}
+	value := int64(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		value = value<<8 | int64(b)
+	}
+	return value, nil
+}
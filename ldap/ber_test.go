@@ -0,0 +1,123 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodeLength(t *testing.T) {
+	cases := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x04, 0x00}},
+		{0x7f, []byte{0x04, 0x7f}},
+		{0x80, []byte{0x04, 0x81, 0x80}},
+		{0xff, []byte{0x04, 0x81, 0xff}},
+		{0x100, []byte{0x04, 0x82, 0x01, 0x00}},
+		{0x10000, []byte{0x04, 0x83, 0x01, 0x00, 0x00}},
+	}
+
+	for _, c := range cases {
+		got := encodeString(tagOctetString, strings.Repeat("a", c.length))
+		if !bytes.Equal(got[:len(c.want)], c.want) || len(got) != len(c.want)+c.length {
+			t.Errorf("length %d: got header % x, want % x", c.length, got[:len(c.want)], c.want)
+		}
+	}
+}
+
+func TestEncodeInt(t *testing.T) {
+	cases := []struct {
+		value int64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{256, []byte{0x01, 0x00}},
+		{-1, []byte{0xff}},
+		{-128, []byte{0x80}},
+		{-129, []byte{0xff, 0x7f}},
+		{1 << 31, []byte{0x00, 0x80, 0x00, 0x00, 0x00}},
+	}
+
+	for _, c := range cases {
+		got := encodeInt(tagInteger, c.value)
+		if want := encode(tagInteger, c.want); !bytes.Equal(got, want) {
+			t.Errorf("%d: got % x, want % x", c.value, got, want)
+		}
+
+		decoded, err := element{tag: tagInteger, content: got[2:]}.int()
+		if err != nil || decoded != c.value {
+			t.Errorf("%d: decoded %d, %v", c.value, decoded, err)
+		}
+	}
+}
+
+func TestReadElement(t *testing.T) {
+	message := encode(tagSequence, encodeInt(tagInteger, 7), encodeString(tagOctetString, strings.Repeat("x", 300)), encodeBool(true))
+	r := bufio.NewReader(bytes.NewReader(message))
+
+	e, err := readElement(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.tag != tagSequence {
+		t.Errorf("got tag 0x%02x", e.tag)
+	}
+	children, err := e.children()
+	if err != nil || len(children) != 3 {
+		t.Fatalf("got %d children, %v", len(children), err)
+	}
+	if id, _ := children[0].int(); id != 7 {
+		t.Errorf("got id %d", id)
+	}
+	if len(children[1].content) != 300 {
+		t.Errorf("got %d bytes of content", len(children[1].content))
+	}
+	if !bytes.Equal(children[2].content, []byte{0xff}) {
+		t.Errorf("got boolean % x", children[2].content)
+	}
+
+	if _, err := readElement(r); err != io.EOF {
+		t.Errorf("expected EOF after the message, got %v", err)
+	}
+}
+
+func TestReadElementMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated length":      {0x30},
+		"truncated long length": {0x30, 0x82, 0x01},
+		"truncated content":     {0x04, 0x05, 'a', 'b'},
+		"indefinite length":     {0x30, 0x80},
+		"five length octets":    {0x30, 0x85, 0, 0, 0, 0, 1},
+		"high tag number":       {0x1f, 0x01, 0x00},
+		"larger than the limit": {0x04, 0x84, 0x7f, 0xff, 0xff, 0xff},
+	}
+
+	for name, data := range cases {
+		if _, err := readElement(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestChildrenMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated header":    {0x04},
+		"length past the end": {0x04, 0x05, 'a'},
+		"truncated long form": {0x04, 0x82, 0x01},
+		"high tag number":     {0x1f, 0x00},
+		"zero length octets":  {0x04, 0x80},
+	}
+
+	for name, content := range cases {
+		if _, err := (element{tag: tagSequence, content: content}).children(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol operations (RFC 4511 section 4.2 to 4.12)
+const (
+	opBindRequest       = classApplication | constructed | 0
+	opBindResponse      = classApplication | constructed | 1
+	opUnbindRequest     = classApplication | 2
+	opSearchRequest     = classApplication | constructed | 3
+	opSearchEntry       = classApplication | constructed | 4
+	opSearchDone        = classApplication | constructed | 5
+	opSearchReference   = classApplication | constructed | 19
+	opExtendedRequest   = classApplication | constructed | 23
+	opExtendedResponse  = classApplication | constructed | 24
+	authSimple          = classContext | 0
+	extendedRequestName = classContext | 0
+)
+
+const protocolVersion = 3
+
+// startTLSOID names the StartTLS extended operation (RFC 4511 section 4.14)
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Result codes that callers act on
+const (
+	ResultSuccess            = 0
+	ResultSizeLimitExceeded  = 4
+	ResultInvalidCredentials = 49
+)
+
+// Search scopes
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+const neverDerefAliases = 0
+
+// ResultError is a result other than success returned by the server
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials reports whether an error is the server rejecting a bind's name or password
+func IsInvalidCredentials(err error) bool {
+	var result *ResultError
+	return errors.As(err, &result) && result.Code == ResultInvalidCredentials
+}
+
+// Config describes how to reach a directory server
+type Config struct {
+	// URL is an ldap:// or ldaps:// URL. The port defaults to 389 or 636.
+	URL string
+
+	// StartTLS upgrades an ldap:// connection to TLS before anything else is sent
+	StartTLS bool
+
+	// TLSConfig is used for ldaps:// and StartTLS. Its ServerName defaults to the URL's host.
+	TLSConfig *tls.Config
+
+	// Timeout limits connecting and each operation. Deadlines of the context also apply.
+	Timeout time.Duration
+}
+
+// Conn is a connection to a directory server. Operations are sent one at a time.
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	mutex     sync.Mutex
+	messageID int64
+}
+
+// Dial connects to a directory server, upgrading the connection with StartTLS if configured
+func Dial(ctx context.Context, config Config) (*Conn, error) {
+	parsed, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid URL: %w", err)
+	}
+	if parsed.Hostname() == "" {
+		return nil, errors.New("ldap: the URL has no host")
+	}
+
+	secure := false
+	port := parsed.Port()
+	switch strings.ToLower(parsed.Scheme) {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if config.StartTLS {
+			return nil, errors.New("ldap: StartTLS cannot be used with ldaps:// URLs")
+		}
+		secure = true
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL scheme '%s'", parsed.Scheme)
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = parsed.Hostname()
+	}
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(parsed.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: netConn, reader: bufio.NewReader(netConn), timeout: config.Timeout}
+	if secure {
+		if err := c.upgrade(ctx, tlsConfig); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	} else if config.StartTLS {
+		if err := c.startTLS(ctx, tlsConfig); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// upgrade performs a TLS handshake over the connection
+func (c *Conn) upgrade(ctx context.Context, config *tls.Config) error {
+	tlsConn := tls.Client(c.conn, config)
+	handshakeCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		return fmt.Errorf("ldap: TLS handshake failed: %w", err)
+	}
+	c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (c *Conn) startTLS(ctx context.Context, config *tls.Config) error {
+	responses, err := c.roundTrip(ctx, encode(opExtendedRequest, encodeString(extendedRequestName, startTLSOID)), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := resultOf(responses[len(responses)-1]); err != nil {
+		return fmt.Errorf("ldap: StartTLS was refused: %w", err)
+	}
+	return c.upgrade(ctx, config)
+}
+
+// Bind authenticates the connection as a distinguished name with a simple password. An empty password
+// is rejected before it is sent, because servers treat it as an unauthenticated bind that always succeeds.
+func (c *Conn) Bind(ctx context.Context, dn, password string) error {
+	if password == "" {
+		return &ResultError{Code: ResultInvalidCredentials, Message: "an empty password is not allowed"}
+	}
+
+	request := encode(opBindRequest,
+		encodeInt(tagInteger, protocolVersion),
+		encodeString(tagOctetString, dn),
+		encodeString(authSimple, password),
+	)
+	responses, err := c.roundTrip(ctx, request, opBindResponse)
+	if err != nil {
+		return err
+	}
+	return resultOf(responses[len(responses)-1])
+}
+
+// SearchRequest describes a search. Filter is in the string form of RFC 4515.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+	TimeLimit  int
+}
+
+// Entry is an entry returned by a search. Attributes are keyed by lower-case name.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// GetAttribute returns the first value of an attribute, or "" if the entry has none
+func (e *Entry) GetAttribute(name string) string {
+	values := e.Attributes[strings.ToLower(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Search returns the entries that match a request. Referrals are ignored. Reaching the size limit
+// is not an error, so that callers can tell that more entries matched than they asked for.
+func (c *Conn) Search(ctx context.Context, search SearchRequest) ([]*Entry, error) {
+	filter, err := CompileFilter(search.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := make([][]byte, len(search.Attributes))
+	for i, attribute := range search.Attributes {
+		attributes[i] = encodeString(tagOctetString, attribute)
+	}
+
+	request := encode(opSearchRequest,
+		encodeString(tagOctetString, search.BaseDN),
+		encodeInt(tagEnumerated, int64(search.Scope)),
+		encodeInt(tagEnumerated, neverDerefAliases),
+		encodeInt(tagInteger, int64(search.SizeLimit)),
+		encodeInt(tagInteger, int64(search.TimeLimit)),
+		encodeBool(false),
+		filter,
+		encode(tagSequence, attributes...),
+	)
+	responses, err := c.roundTrip(ctx, request, opSearchDone)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, response := range responses[:len(responses)-1] {
+		if response.tag != opSearchEntry {
+			continue
+		}
+		entry, err := parseEntry(response)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	err = resultOf(responses[len(responses)-1])
+	var result *ResultError
+	if errors.As(err, &result) && result.Code == ResultSizeLimitExceeded {
+		err = nil
+	}
+	return entries, err
+}
+
+func parseEntry(response element) (*Entry, error) {
+	fields, err := response.children()
+	if err != nil || len(fields) < 2 {
+		return nil, errMalformed
+	}
+	attributes, err := fields[1].children()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{DN: string(fields[0].content), Attributes: make(map[string][]string)}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil || len(parts) < 2 {
+			return nil, errMalformed
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// resultOf decodes the LDAPResult that ends an operation
+func resultOf(response element) error {
+	fields, err := response.children()
+	if err != nil || len(fields) < 3 {
+		return errMalformed
+	}
+	code, err := fields[0].int()
+	if err != nil {
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &ResultError{Code: int(code), Message: string(fields[2].content)}
+}
+
+// Close tells the server that the connection is no longer needed and closes it
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.messageID++
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.Write(encode(tagSequence, encodeInt(tagInteger, c.messageID), encode(opUnbindRequest)))
+	return c.conn.Close()
+}
+
+// roundTrip sends a request and reads the responses to it, up to and including the one tagged last
+func (c *Conn) roundTrip(ctx context.Context, request []byte, last byte) ([]element, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if c.timeout > 0 && (!ok || time.Until(deadline) > c.timeout) {
+		deadline, ok = time.Now().Add(c.timeout), true
+	}
+	if ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	// Interrupt blocked reads and writes if the context is cancelled
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	c.messageID++
+	id := c.messageID
+	if _, err := c.conn.Write(encode(tagSequence, encodeInt(tagInteger, id), request)); err != nil {
+		return nil, c.contextError(ctx, err)
+	}
+
+	var responses []element
+	for {
+		message, err := readElement(c.reader)
+		if err != nil {
+			return nil, c.contextError(ctx, err)
+		}
+		if message.tag != tagSequence {
+			return nil, errMalformed
+		}
+		fields, err := message.children()
+		if err != nil || len(fields) < 2 {
+			return nil, errMalformed
+		}
+		responseID, err := fields[0].int()
+		if err != nil {
+			return nil, err
+		}
+
+		// Message id 0 is an unsolicited notification, which servers send before disconnecting
+		if responseID == 0 {
+			if err := resultOf(fields[1]); err != nil {
+				return nil, fmt.Errorf("ldap: the server is disconnecting: %w", err)
+			}
+			return nil, errors.New("ldap: the server is disconnecting")
+		}
+		if responseID != id {
+			continue
+		}
+		responses = append(responses, fields[1])
+		if fields[1].tag == last {
+			return responses, nil
+		}
+		if fields[1].tag != opSearchEntry && fields[1].tag != opSearchReference {
+			return nil, fmt.Errorf("ldap: unexpected response 0x%02x", fields[1].tag)
+		}
+	}
+}
+
+func (c *Conn) contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/omar-ozgur/gram/ldap/ldaptest"
+	"testing"
+	"time"
+)
+
+var testEntries = []ldaptest.Entry{
+	{DN: "cn=service,dc=example,dc=com", Password: "service-password"},
+	{DN: "uid=jdoe,ou=people,dc=example,dc=com", Password: "jdoe-password", Attributes: map[string][]string{
+		"uid": {"jdoe"}, "givenName": {"Jane"}, "sn": {"Doe"}, "mail": {"jdoe@example.com"}, "objectClass": {"person"},
+	}},
+	{DN: "uid=jsmith,ou=people,dc=example,dc=com", Password: "jsmith-password", Attributes: map[string][]string{
+		"uid": {"jsmith"}, "givenName": {"John"}, "sn": {"Smith"}, "mail": {"jsmith@example.com"}, "objectClass": {"person"},
+	}},
+	{DN: "uid=jones,ou=people,dc=example,dc=com", Password: "jones-password", Attributes: map[string][]string{
+		"uid": {"jones"}, "sn": {"Jones"}, "objectClass": {"person"},
+	}},
+}
+
+func dialTest(t *testing.T, config Config) *Conn {
+	t.Helper()
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	conn, err := Dial(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSearchThenBind(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+	conn := dialTest(t, Config{URL: server.URL})
+	ctx := context.Background()
+
+	if err := conn.Bind(ctx, "cn=service,dc=example,dc=com", "service-password"); err != nil {
+		t.Fatalf("service bind: %s", err)
+	}
+	entries, err := conn.Search(ctx, SearchRequest{
+		BaseDN:     "ou=people,dc=example,dc=com",
+		Scope:      ScopeWholeSubtree,
+		Filter:     "(&(objectClass=person)(uid=" + EscapeFilter("jdoe") + "))",
+		Attributes: []string{"givenName", "sn", "mail"},
+		SizeLimit:  2,
+	})
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if len(entries) != 1 || entries[0].DN != "uid=jdoe,ou=people,dc=example,dc=com" {
+		t.Fatalf("got entries %+v", entries)
+	}
+	if got := entries[0].GetAttribute("GIVENNAME"); got != "Jane" {
+		t.Errorf("got givenName %q", got)
+	}
+	if got := entries[0].GetAttribute("uid"); got != "" {
+		t.Errorf("got uid %q, which was not requested", got)
+	}
+
+	if err := conn.Bind(ctx, entries[0].DN, "wrong-password"); !IsInvalidCredentials(err) {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if err := conn.Bind(ctx, entries[0].DN, "jdoe-password"); err != nil {
+		t.Errorf("user bind: %s", err)
+	}
+
+	searches := server.Searches()
+	if len(searches) != 1 || searches[0].SizeLimit != 2 || searches[0].Scope != ScopeWholeSubtree {
+		t.Errorf("got searches %+v", searches)
+	}
+}
+
+func TestSearchEscapedInput(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+	conn := dialTest(t, Config{URL: server.URL})
+
+	for _, login := range []string{"*", "j*", "*)(uid=*", "jdoe)(|(uid=*"} {
+		entries, err := conn.Search(context.Background(), SearchRequest{
+			BaseDN: "dc=example,dc=com",
+			Scope:  ScopeWholeSubtree,
+			Filter: "(uid=" + EscapeFilter(login) + ")",
+		})
+		if err != nil {
+			t.Errorf("%q: %s", login, err)
+		} else if len(entries) != 0 {
+			t.Errorf("%q matched %d entries", login, len(entries))
+		}
+	}
+}
+
+func TestSearchSizeLimit(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+	conn := dialTest(t, Config{URL: server.URL})
+
+	entries, err := conn.Search(context.Background(), SearchRequest{
+		BaseDN:    "dc=example,dc=com",
+		Scope:     ScopeWholeSubtree,
+		Filter:    "(uid=j*)",
+		SizeLimit: 2,
+	})
+	if err != nil {
+		t.Fatalf("reaching the size limit should not be an error, got %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(entries))
+	}
+}
+
+func TestBindEmptyPassword(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+	conn := dialTest(t, Config{URL: server.URL})
+
+	err := conn.Bind(context.Background(), "uid=jdoe,ou=people,dc=example,dc=com", "")
+	if !IsInvalidCredentials(err) {
+		t.Errorf("got %v, want invalid credentials", err)
+	}
+	if binds := server.Binds(); len(binds) != 0 {
+		t.Errorf("the empty password was sent to the server: %+v", binds)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	server := ldaptest.NewTLSServer(testEntries...)
+	server.RequireTLS = true
+	defer server.Close()
+
+	conn := dialTest(t, Config{URL: server.URL, StartTLS: true, TLSConfig: &tls.Config{RootCAs: server.CertPool()}})
+	if err := conn.Bind(context.Background(), "uid=jdoe,ou=people,dc=example,dc=com", "jdoe-password"); err != nil {
+		t.Fatal(err)
+	}
+	if binds := server.Binds(); len(binds) != 1 || !binds[0].TLS {
+		t.Errorf("the bind was not sent over TLS: %+v", binds)
+	}
+}
+
+func TestStartTLSUntrustedCertificate(t *testing.T) {
+	server := ldaptest.NewTLSServer(testEntries...)
+	defer server.Close()
+
+	_, err := Dial(context.Background(), Config{URL: server.URL, StartTLS: true, Timeout: 5 * time.Second})
+	if err == nil {
+		t.Fatal("expected the self-signed certificate to be rejected")
+	}
+	if binds := server.Binds(); len(binds) != 0 {
+		t.Errorf("got binds %+v", binds)
+	}
+}
+
+func TestStartTLSRefused(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+
+	_, err := Dial(context.Background(), Config{URL: server.URL, StartTLS: true, Timeout: 5 * time.Second})
+	if err == nil {
+		t.Fatal("expected an error from a server without StartTLS")
+	}
+}
+
+func TestDialInvalidURL(t *testing.T) {
+	for _, config := range []Config{
+		{URL: "http://localhost"},
+		{URL: "ldap://"},
+		{URL: "ldaps://localhost", StartTLS: true},
+	} {
+		if _, err := Dial(context.Background(), config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	server := ldaptest.NewServer(testEntries...)
+	defer server.Close()
+	conn := dialTest(t, Config{URL: server.URL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := conn.Bind(ctx, "uid=jdoe,ou=people,dc=example,dc=com", "jdoe-password"); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,207 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices (RFC 4511 section 4.5.1)
+const (
+	filterAnd            = classContext | constructed | 0
+	filterOr             = classContext | constructed | 1
+	filterNot            = classContext | constructed | 2
+	filterEqualityMatch  = classContext | constructed | 3
+	filterSubstrings     = classContext | constructed | 4
+	filterGreaterOrEqual = classContext | constructed | 5
+	filterLessOrEqual    = classContext | constructed | 6
+	filterPresent        = classContext | 7
+	filterApproxMatch    = classContext | constructed | 8
+
+	substringInitial = classContext | 0
+	substringAny     = classContext | 1
+	substringFinal   = classContext | 2
+)
+
+const maxFilterDepth = 16
+
+// EscapeFilter escapes a value for use in a filter, so that user input cannot change the filter's structure
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '*' || c == '(' || c == ')' || c == '\\' || c == 0 || c >= 0x80:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// CompileFilter checks a filter in the string form of RFC 4515, such as (&(objectClass=person)(uid=jdoe)),
+// and returns its BER encoding. Extensible matches are not supported.
+func CompileFilter(text string) ([]byte, error) {
+	p := &filterParser{text: text}
+	encoded, err := p.filter(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.text) {
+		return nil, p.errorf("unexpected '%s' after the filter", p.text[p.pos:])
+	}
+	return encoded, nil
+}
+
+type filterParser struct {
+	text string
+	pos  int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("ldap: invalid filter %q: %s", p.text, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) filter(depth int) ([]byte, error) {
+	if depth > maxFilterDepth {
+		return nil, p.errorf("it is nested more than %d levels deep", maxFilterDepth)
+	}
+	if p.pos >= len(p.text) || p.text[p.pos] != '(' {
+		return nil, p.errorf("expected '(' at position %d", p.pos)
+	}
+	p.pos++
+	if p.pos >= len(p.text) {
+		return nil, p.errorf("it is not terminated")
+	}
+
+	var encoded []byte
+	var err error
+	switch p.text[p.pos] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if p.text[p.pos] == '|' {
+			tag = filterOr
+		}
+		p.pos++
+		var operands [][]byte
+		for p.pos < len(p.text) && p.text[p.pos] == '(' {
+			operand, err := p.filter(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, operand)
+		}
+		if len(operands) == 0 {
+			return nil, p.errorf("'&' and '|' need at least one filter")
+		}
+		encoded = encode(tag, operands...)
+	case '!':
+		p.pos++
+		operand, err := p.filter(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		encoded = encode(filterNot, operand)
+	default:
+		encoded, err = p.item()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.pos >= len(p.text) || p.text[p.pos] != ')' {
+		return nil, p.errorf("expected ')' at position %d", p.pos)
+	}
+	p.pos++
+	return encoded, nil
+}
+
+// item parses an attribute comparison, up to the closing parenthesis
+func (p *filterParser) item() ([]byte, error) {
+	end := strings.IndexByte(p.text[p.pos:], ')')
+	if end < 0 {
+		return nil, p.errorf("it is not terminated")
+	}
+	item := p.text[p.pos : p.pos+end]
+	p.pos += end
+
+	equals := strings.IndexByte(item, '=')
+	if equals <= 0 {
+		return nil, p.errorf("'%s' is not a comparison", item)
+	}
+	attribute, value := item[:equals], item[equals+1:]
+
+	tag := byte(filterEqualityMatch)
+	switch attribute[len(attribute)-1] {
+	case '~':
+		tag = filterApproxMatch
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	case ':':
+		return nil, p.errorf("extensible matches are not supported")
+	}
+	if tag != filterEqualityMatch {
+		attribute = attribute[:len(attribute)-1]
+	}
+	if attribute == "" || strings.ContainsAny(attribute, "()*\\ ") {
+		return nil, p.errorf("'%s' is not a valid attribute", attribute)
+	}
+
+	if tag == filterEqualityMatch && value == "*" {
+		return encodeString(filterPresent, attribute), nil
+	}
+	if tag == filterEqualityMatch && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := p.unescape(part)
+			if err != nil {
+				return nil, err
+			}
+			partTag := byte(substringAny)
+			if i == 0 {
+				partTag = substringInitial
+			} else if i == len(parts)-1 {
+				partTag = substringFinal
+			}
+			substrings = append(substrings, encodeString(partTag, unescaped))
+		}
+		return encode(filterSubstrings, encodeString(tagOctetString, attribute), encode(tagSequence, substrings...)), nil
+	}
+
+	unescaped, err := p.unescape(value)
+	if err != nil {
+		return nil, err
+	}
+	return encode(tag, encodeString(tagOctetString, attribute), encodeString(tagOctetString, unescaped)), nil
+}
+
+// unescape decodes the \XX escapes of a value
+func (p *filterParser) unescape(value string) (string, error) {
+	if strings.ContainsAny(value, "()") {
+		return "", p.errorf("'(' and ')' in values must be escaped")
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", p.errorf("'\\' must be followed by two hex digits")
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", p.errorf("'\\' must be followed by two hex digits")
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
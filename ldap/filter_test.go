@@ -0,0 +1,121 @@
+package ldap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"jdoe", "jdoe"},
+		{"j.doe-1_2@example.com", "j.doe-1_2@example.com"},
+		{"*", `\2a`},
+		{"a*b", `a\2ab`},
+		{"(", `\28`},
+		{")", `\29`},
+		{"*)(uid=*", `\2a\29\28uid=\2a`},
+		{`\`, `\5c`},
+		{`\2a`, `\5c2a`},
+		{"a\x00b", `a\00b`},
+		{"é", `\c3\a9`},
+		{"名前", `\e5\90\8d\e5\89\8d`},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if got := EscapeFilter(c.value); got != c.want {
+			t.Errorf("EscapeFilter(%q) = %q, want %q", c.value, got, c.want)
+		}
+	}
+}
+
+// Escaped values must compile to an equality match of exactly the original value, whatever it contains
+func TestEscapeFilterRoundTrip(t *testing.T) {
+	for _, value := range []string{"*", "(", ")", `\`, "\x00", "é", "*)(|(uid=*", "a)(objectClass=*"} {
+		got, err := CompileFilter("(uid=" + EscapeFilter(value) + ")")
+		if err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		want := encode(filterEqualityMatch, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, value))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: got % x, want % x", value, got, want)
+		}
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	uid := encodeString(tagOctetString, "uid")
+	equality := func(attribute, value string) []byte {
+		return encode(filterEqualityMatch, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value))
+	}
+
+	cases := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=jdoe)", equality("uid", "jdoe")},
+		{"(uid=*)", encodeString(filterPresent, "uid")},
+		{"(uid>=m)", encode(filterGreaterOrEqual, uid, encodeString(tagOctetString, "m"))},
+		{"(uid<=m)", encode(filterLessOrEqual, uid, encodeString(tagOctetString, "m"))},
+		{"(uid~=jdoe)", encode(filterApproxMatch, uid, encodeString(tagOctetString, "jdoe"))},
+		{"(uid=j*)", encode(filterSubstrings, uid, encode(tagSequence, encodeString(substringInitial, "j")))},
+		{"(uid=*e)", encode(filterSubstrings, uid, encode(tagSequence, encodeString(substringFinal, "e")))},
+		{"(uid=j*d*e)", encode(filterSubstrings, uid, encode(tagSequence,
+			encodeString(substringInitial, "j"), encodeString(substringAny, "d"), encodeString(substringFinal, "e")))},
+		{`(uid=\2a*)`, encode(filterSubstrings, uid, encode(tagSequence, encodeString(substringInitial, "*")))},
+		{`(cn=caf\c3\a9)`, equality("cn", "café")},
+		{"(&(objectClass=person)(uid=jdoe))", encode(filterAnd, equality("objectClass", "person"), equality("uid", "jdoe"))},
+		{"(|(uid=a)(mail=a))", encode(filterOr, equality("uid", "a"), equality("mail", "a"))},
+		{"(!(uid=jdoe))", encode(filterNot, equality("uid", "jdoe"))},
+	}
+
+	for _, c := range cases {
+		got, err := CompileFilter(c.filter)
+		if err != nil {
+			t.Errorf("%s: %s", c.filter, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got % x, want % x", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestCompileFilterInvalid(t *testing.T) {
+	deep := ""
+	for i := 0; i <= maxFilterDepth+1; i++ {
+		deep += "(!"
+	}
+	deep += "(uid=a)"
+	for i := 0; i <= maxFilterDepth+1; i++ {
+		deep += ")"
+	}
+
+	for _, filter := range []string{
+		"",
+		"uid=jdoe",
+		"(uid=jdoe",
+		"(uid=jdoe))",
+		"(uid=jdoe)(uid=other)",
+		"(=jdoe)",
+		"(uid)",
+		"(&)",
+		"(!)",
+		"(uid:dn:=jdoe)",
+		"(u id=jdoe)",
+		"(u*d=jdoe)",
+		"(uid=a(b)",
+		`(uid=\)`,
+		`(uid=\2)`,
+		`(uid=\zz)`,
+		deep,
+	} {
+		if _, err := CompileFilter(filter); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package ldaptest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// BER identifiers of the requests, responses and filters that the server understands (RFC 4511)
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	opBindRequest      = 0x60
+	opBindResponse     = 0x61
+	opUnbindRequest    = 0x42
+	opSearchRequest    = 0x63
+	opSearchEntry      = 0x64
+	opSearchDone       = 0x65
+	opExtendedRequest  = 0x77
+	opExtendedResponse = 0x78
+	authSimple         = 0x80
+
+	filterAnd            = 0xa0
+	filterOr             = 0xa1
+	filterNot            = 0xa2
+	filterEqualityMatch  = 0xa3
+	filterSubstrings     = 0xa4
+	filterGreaterOrEqual = 0xa5
+	filterLessOrEqual    = 0xa6
+	filterPresent        = 0x87
+	filterApproxMatch    = 0xa8
+
+	substringInitial = 0x80
+	substringAny     = 0x81
+	substringFinal   = 0x82
+)
+
+var errMalformed = errors.New("ldaptest: malformed BER encoding")
+
+type element struct {
+	tag     byte
+	content []byte
+}
+
+func encode(tag byte, contents ...[]byte) []byte {
+	var content []byte
+	for _, c := range contents {
+		content = append(content, c...)
+	}
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+// parseLength decodes a definite length, returning it and the number of octets it took
+func parseLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errMalformed
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+	count := int(data[0] & 0x7f)
+	if count == 0 || count > 4 || len(data) < 1+count {
+		return 0, 0, errMalformed
+	}
+	length := 0
+	for _, b := range data[1 : 1+count] {
+		length = length<<8 | int(b)
+	}
+	return length, 1 + count, nil
+}
+
+func readElement(r *bufio.Reader) (element, error) {
+	header, err := r.Peek(2)
+	if err != nil {
+		return element{}, err
+	}
+	lengthOctets := 1
+	if header[1] >= 0x80 {
+		lengthOctets += int(header[1] & 0x7f)
+	}
+	header, err = r.Peek(1 + lengthOctets)
+	if err != nil {
+		return element{}, err
+	}
+	length, n, err := parseLength(header[1:])
+	if err != nil {
+		return element{}, err
+	}
+	r.Discard(1 + n)
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return element{}, err
+	}
+	return element{tag: header[0], content: content}, nil
+}
+
+func (e element) children() ([]element, error) {
+	var elements []element
+	data := e.content
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errMalformed
+		}
+		length, n, err := parseLength(data[1:])
+		if err != nil || len(data) < 1+n+length {
+			return nil, errMalformed
+		}
+		elements = append(elements, element{tag: data[0], content: data[1+n : 1+n+length]})
+		data = data[1+n+length:]
+	}
+	return elements, nil
+}
+
+func (e element) int() (int64, error) {
+	if len(e.content) == 0 || len(e.content) > 8 {
+		return 0, errMalformed
+	}
+	value := int64(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		value = value<<8 | int64(b)
+	}
+	return value, nil
+}
+
+// matches evaluates an encoded filter against an entry. Attribute names and values are compared without case.
+func matches(filter element, entry Entry) (bool, error) {
+	switch filter.tag {
+	case filterAnd, filterOr:
+		operands, err := filter.children()
+		if err != nil {
+			return false, err
+		}
+		for _, operand := range operands {
+			matched, err := matches(operand, entry)
+			if err != nil {
+				return false, err
+			}
+			if matched == (filter.tag == filterOr) {
+				return matched, nil
+			}
+		}
+		return filter.tag == filterAnd, nil
+	case filterNot:
+		operands, err := filter.children()
+		if err != nil || len(operands) != 1 {
+			return false, errMalformed
+		}
+		matched, err := matches(operands[0], entry)
+		return !matched, err
+	case filterPresent:
+		return len(attributeValues(entry, string(filter.content))) > 0, nil
+	case filterEqualityMatch, filterApproxMatch, filterGreaterOrEqual, filterLessOrEqual:
+		parts, err := filter.children()
+		if err != nil || len(parts) != 2 {
+			return false, errMalformed
+		}
+		want := strings.ToLower(string(parts[1].content))
+		for _, value := range attributeValues(entry, string(parts[0].content)) {
+			value = strings.ToLower(value)
+			if filter.tag == filterGreaterOrEqual && value >= want || filter.tag == filterLessOrEqual && value <= want || value == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case filterSubstrings:
+		parts, err := filter.children()
+		if err != nil || len(parts) != 2 {
+			return false, errMalformed
+		}
+		substrings, err := parts[1].children()
+		if err != nil {
+			return false, err
+		}
+		for _, value := range attributeValues(entry, string(parts[0].content)) {
+			if matchesSubstrings(strings.ToLower(value), substrings) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, errors.New("ldaptest: unsupported filter")
+}
+
+func matchesSubstrings(value string, substrings []element) bool {
+	for _, substring := range substrings {
+		part := strings.ToLower(string(substring.content))
+		switch substring.tag {
+		case substringInitial:
+			if !strings.HasPrefix(value, part) {
+				return false
+			}
+			value = value[len(part):]
+		case substringAny:
+			i := strings.Index(value, part)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(part):]
+		case substringFinal:
+			if !strings.HasSuffix(value, part) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
+
+func attributeValues(entry Entry, name string) []string {
+	for attribute, values := range entry.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
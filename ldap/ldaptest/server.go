@@ -0,0 +1,352 @@
+// Package ldaptest provides an in-process directory server for tests of LDAP clients.
+// It decodes requests independently of package ldap, so that tests exercise the client's encoding.
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result codes sent by the server
+const (
+	ResultSuccess            = 0
+	ResultProtocolError      = 2
+	ResultSizeLimitExceeded  = 4
+	ResultConfidentiality    = 13
+	ResultInvalidCredentials = 49
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Entry is a directory entry. Binding as its DN succeeds with Password, unless Password is empty.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Bind is a bind request received by the server
+type Bind struct {
+	DN       string
+	Password string
+	TLS      bool
+}
+
+// Search is a search request received by the server
+type Search struct {
+	BaseDN     string
+	Scope      int
+	SizeLimit  int
+	Attributes []string
+	TLS        bool
+}
+
+// Server answers simple binds, searches of its entries and, when it has a certificate, StartTLS.
+// As real directories do, it accepts a bind with a DN and an empty password as an unauthenticated bind.
+type Server struct {
+	// URL is the ldap:// URL of the server
+	URL string
+
+	// RequireTLS refuses binds and searches until the connection has been upgraded with StartTLS
+	RequireTLS bool
+
+	listener net.Listener
+	tls      *tls.Config
+	cert     *x509.Certificate
+	entries  []Entry
+
+	mutex    sync.Mutex
+	binds    []Bind
+	searches []Search
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on a loopback port. Close it when the test is done.
+func NewServer(entries ...Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: failed to listen: " + err.Error())
+	}
+	s := &Server{URL: "ldap://" + listener.Addr().String(), listener: listener, entries: entries, conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// NewTLSServer starts a server that supports StartTLS with a self-signed certificate for 127.0.0.1
+func NewTLSServer(entries ...Entry) *Server {
+	s := NewServer(entries...)
+	s.tls, s.cert = selfSignedConfig()
+	return s
+}
+
+// Certificate returns the server's self-signed certificate, or nil if it does not support StartTLS
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// CertPool returns a pool that trusts the server's certificate
+func (s *Server) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if s.cert != nil {
+		pool.AddCert(s.cert)
+	}
+	return pool
+}
+
+// Binds returns the bind requests received so far
+func (s *Server) Binds() []Bind {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Bind{}, s.binds...)
+}
+
+// Searches returns the search requests received so far
+func (s *Server) Searches() []Search {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Search{}, s.searches...)
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle answers the requests of a connection until it is closed or unbound
+func (s *Server) handle(raw net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, raw)
+		s.mutex.Unlock()
+		raw.Close()
+	}()
+
+	var conn net.Conn = raw
+	reader := bufio.NewReader(conn)
+	secure := false
+	for {
+		message, err := readElement(reader)
+		if err != nil || message.tag != tagSequence {
+			return
+		}
+		fields, err := message.children()
+		if err != nil || len(fields) < 2 {
+			return
+		}
+		id := fields[0].content
+		request := fields[1]
+		reply := func(responses ...[]byte) bool {
+			for _, response := range responses {
+				if _, err := conn.Write(encode(tagSequence, encode(tagInteger, id), response)); err != nil {
+					return false
+				}
+			}
+			return true
+		}
+
+		switch request.tag {
+		case opUnbindRequest:
+			return
+		case opExtendedRequest:
+			parts, _ := request.children()
+			if len(parts) == 0 || string(parts[0].content) != startTLSOID || s.tls == nil || secure {
+				reply(result(opExtendedResponse, ResultProtocolError, "unsupported extended operation"))
+				continue
+			}
+			if !reply(result(opExtendedResponse, ResultSuccess, "")) {
+				return
+			}
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case opBindRequest:
+			if !reply(s.bind(request, secure)) {
+				return
+			}
+		case opSearchRequest:
+			if !reply(s.search(request, secure)...) {
+				return
+			}
+		default:
+			reply(result(opExtendedResponse, ResultProtocolError, "unsupported operation"))
+			return
+		}
+	}
+}
+
+func (s *Server) bind(request element, secure bool) []byte {
+	parts, err := request.children()
+	if err != nil || len(parts) < 3 || parts[2].tag != authSimple {
+		return result(opBindResponse, ResultProtocolError, "only simple binds are supported")
+	}
+	bind := Bind{DN: string(parts[1].content), Password: string(parts[2].content), TLS: secure}
+	s.mutex.Lock()
+	s.binds = append(s.binds, bind)
+	s.mutex.Unlock()
+
+	if s.RequireTLS && !secure {
+		return result(opBindResponse, ResultConfidentiality, "StartTLS is required")
+	}
+	if bind.Password == "" {
+		return result(opBindResponse, ResultSuccess, "")
+	}
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, bind.DN) && entry.Password != "" && entry.Password == bind.Password {
+			return result(opBindResponse, ResultSuccess, "")
+		}
+	}
+	return result(opBindResponse, ResultInvalidCredentials, "invalid credentials")
+}
+
+func (s *Server) search(request element, secure bool) [][]byte {
+	parts, err := request.children()
+	if err != nil || len(parts) < 8 {
+		return [][]byte{result(opSearchDone, ResultProtocolError, "malformed search")}
+	}
+	scope, _ := parts[1].int()
+	sizeLimit, _ := parts[3].int()
+	search := Search{BaseDN: string(parts[0].content), Scope: int(scope), SizeLimit: int(sizeLimit), TLS: secure}
+	attributes, _ := parts[7].children()
+	for _, attribute := range attributes {
+		search.Attributes = append(search.Attributes, string(attribute.content))
+	}
+	s.mutex.Lock()
+	s.searches = append(s.searches, search)
+	s.mutex.Unlock()
+
+	if s.RequireTLS && !secure {
+		return [][]byte{result(opSearchDone, ResultConfidentiality, "StartTLS is required")}
+	}
+
+	var responses [][]byte
+	for _, entry := range s.entries {
+		if !inScope(entry.DN, search.BaseDN, search.Scope) {
+			continue
+		}
+		matched, err := matches(parts[6], entry)
+		if err != nil {
+			return [][]byte{result(opSearchDone, ResultProtocolError, err.Error())}
+		}
+		if !matched {
+			continue
+		}
+		if search.SizeLimit > 0 && len(responses) == search.SizeLimit {
+			return append(responses, result(opSearchDone, ResultSizeLimitExceeded, "size limit exceeded"))
+		}
+		responses = append(responses, encodeEntry(entry, search.Attributes))
+	}
+	return append(responses, result(opSearchDone, ResultSuccess, ""))
+}
+
+// inScope reports whether an entry is the base object, one of its children, or below it
+func inScope(dn, base string, scope int) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case 0:
+		return dn == base
+	case 1:
+		rdn := strings.TrimSuffix(dn, ","+base)
+		return rdn != dn && !strings.Contains(rdn, ",")
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+func encodeEntry(entry Entry, attributes []string) []byte {
+	var encoded [][]byte
+	for name, values := range entry.Attributes {
+		if len(attributes) > 0 && !containsFold(attributes, name) {
+			continue
+		}
+		var encodedValues [][]byte
+		for _, value := range values {
+			encodedValues = append(encodedValues, encode(tagOctetString, []byte(value)))
+		}
+		encoded = append(encoded, encode(tagSequence, encode(tagOctetString, []byte(name)), encode(tagSet, encodedValues...)))
+	}
+	return encode(opSearchEntry, encode(tagOctetString, []byte(entry.DN)), encode(tagSequence, encoded...))
+}
+
+func result(tag byte, code int, message string) []byte {
+	return encode(tag, encode(tagEnumerated, []byte{byte(code)}), encode(tagOctetString), encode(tagOctetString, []byte(message)))
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSignedConfig returns a TLS config with a new certificate for 127.0.0.1
+func selfSignedConfig() (*tls.Config, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("ldaptest: failed to generate key: " + err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic("ldaptest: failed to create certificate: " + err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, cert
+}
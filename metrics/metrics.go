@@ -0,0 +1,258 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request and query latencies, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is a metric and all of its labelled series
+type family interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	families = make(map[string]family)
+)
+
+func register(f family) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := families[f.name()]; ok {
+		panic(fmt.Sprintf("metrics: %s is registered twice", f.name()))
+	}
+	families[f.name()] = f
+}
+
+// labelKey joins label values into a map key; the separator cannot appear in valid UTF-8
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type desc struct {
+	Name   string
+	Help   string
+	Labels []string
+}
+
+func (d desc) name() string {
+	return d.Name
+}
+
+func (d desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.Name, kind)
+}
+
+func (d desc) checkLabels(values []string) {
+	if len(values) != len(d.Labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got %d values", d.Name, d.Labels, len(values)))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label names and values as {a="1",b="2"}, with extra appended after the family's labels
+func (d desc) labels(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range d.Labels {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a total that only increases, such as a number of requests
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	label  map[string][]string
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: make(map[string]float64), label: make(map[string][]string)}
+	if len(labels) == 0 {
+		// Counters without labels have a single series, which is reported from the start
+		c.label[""] = nil
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.checkLabels(labelValues)
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.label[key] = labelValues
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.label) {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, c.labels(c.label[key]), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations, such as latencies, in cumulative buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+	label   map[string][]string
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*histogramSeries), label: make(map[string][]string)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.label[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Since observes the seconds elapsed since start
+func (h *Histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.label) {
+		s, values := h.series[key], h.label[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels(values, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels(values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, h.labels(values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, h.labels(values), s.count)
+	}
+}
+
+// GaugeFunc reports a value read when metrics are scraped, such as the size of a pool
+type GaugeFunc struct {
+	desc
+	kind  string
+	value func() float64
+}
+
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{Name: name, Help: help}, kind: "gauge", value: value}
+	register(g)
+	return g
+}
+
+// NewCounterFunc reports a total kept elsewhere, such as the number of waits counted by a pool
+func NewCounterFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{Name: name, Help: help}, kind: "counter", value: value}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w, g.kind)
+	fmt.Fprintf(w, "%s %s\n", g.Name, formatFloat(g.value()))
+}
+
+// Write writes every registered metric in the Prometheus text format
+func Write(out io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sorted := make([]family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		sorted = append(sorted, families[name])
+	}
+	mu.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, f := range sorted {
+		f.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler serves the registered metrics to Prometheus
+var Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	Write(w)
+})
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+const adminListenerKey contextKey = "adminListener"
+
+// AdminListener marks requests received on server.admin_address. Config validation only allows loopback
+// addresses, which only operators on the server's host can reach.
+func AdminListener(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), adminListenerKey, true)))
+	})
+}
+
+// OnAdminListener reports whether a request was received on server.admin_address
+func OnAdminListener(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminListenerKey).(bool)
+	return admin
+}
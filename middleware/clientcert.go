@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+type contextKey string
+
+const clientIdentityKey contextKey = "clientIdentity"
+
+// ClientCertMiddleware maps a verified client certificate onto the identity configured for its subject
+func ClientCertMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		next(rw, r)
+		return
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	identities := utilities.CurrentConfig().TLS.ClientIdentities
+
+	// Match the full distinguished name first, then the common name
+	identity, ok := identities[subject.String()]
+	if !ok {
+		identity, ok = identities[subject.CommonName]
+	}
+	if ok {
+		utilities.AddLogFields(r.Context(), zap.String("client_identity", identity))
+		utilities.GetRequestSource(r.Context()).SetActor("client:" + identity)
+		utilities.Log(r.Context()).Debug("Authenticated client certificate", zap.String("subject", subject.String()))
+		r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey, identity))
+	}
+
+	next(rw, r)
+}
+
+// ClientIdentity returns the identity mapped from the request's client certificate, if any
+func ClientIdentity(r *http.Request) (string, bool) {
+	identity, ok := r.Context().Value(clientIdentityKey).(string)
+	return identity, ok
+}
@@ -1,16 +1,68 @@
 package middleware
 
 import (
+	"fmt"
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
-	"os"
+	"github.com/omar-ozgur/gram/metrics"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
 )
 
-var secretKey = []byte(os.Getenv("GRAM_TOKEN_SECRET"))
+var tokenVerificationsTotal = metrics.NewCounter("gram_token_verifications_total", "Bearer tokens checked by result.", "result")
 
 var JWTMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
 	ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
+		return []byte(utilities.CurrentConfig().Tokens.Secret), nil
 	},
 	SigningMethod: jwt.SigningMethodHS256,
+	ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) {
+		utilities.WriteProblem(w, r, utilities.NewError(utilities.ErrorUnauthorized, utilities.CodeUnauthorized, "A valid bearer token is required: "+err))
+	},
 })
+
+// RequireToken rejects requests without a valid bearer token, counting each check by result
+func RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		missing := r.Header.Get("Authorization") == ""
+		err := JWTMiddleware.CheckJWT(rw, r)
+		switch {
+		case missing:
+			tokenVerificationsTotal.Inc("missing")
+		case err != nil:
+			tokenVerificationsTotal.Inc("invalid")
+		default:
+			tokenVerificationsTotal.Inc("valid")
+		}
+
+		if err == nil {
+			if id, ok := tokenUserId(r); ok {
+				utilities.AddLogFields(r.Context(), zap.String("user_id", id))
+				utilities.GetRequestSource(r.Context()).SetActor("user:" + id)
+			}
+			next.ServeHTTP(rw, r)
+		}
+	})
+}
+
+// tokenUserId reads the user_id claim of a token that CheckJWT has verified
+func tokenUserId(r *http.Request) (string, bool) {
+	token, ok := r.Context().Value(JWTMiddleware.Options.UserProperty).(*jwt.Token)
+	if !ok {
+		return "", false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	switch id := claims["user_id"].(type) {
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprintf("%v", id), true
+	}
+}
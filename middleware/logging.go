@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"github.com/urfave/negroni"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// RequestIDHeader carries the id that ties a request to its log entries, both from callers and in responses
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDRegexp limits accepted ids to characters that are safe to log and echo back
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+const requestIDKey contextKey = "requestID"
+
+// RequestIDMiddleware propagates the caller's request id, or generates one, and returns it in the response.
+// It also records the request's source for the audit log.
+func RequestIDMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(RequestIDHeader)
+	if !requestIDRegexp.MatchString(id) {
+		id = newRequestID()
+	}
+	rw.Header().Set(RequestIDHeader, id)
+
+	ctx := context.WithValue(r.Context(), requestIDKey, id)
+	ctx = utilities.WithRequestSource(ctx, &utilities.RequestSource{IP: remoteIP(r), UserAgent: r.UserAgent(), RequestID: id})
+	next(rw, r.WithContext(ctx))
+}
+
+// remoteIP is the address of the connection. Forwarded headers are ignored, since any client can set them.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestID returns the id of a request, if it passed through RequestIDMiddleware
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// LoggingMiddleware logs one entry per request once it has been handled.
+// Entries logged with utilities.Log(r.Context()) while handling it share its request and trace ids.
+func LoggingMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		fields := []zapcore.Field{zap.String("request_id", RequestID(r))}
+		if span := tracing.FromContext(r.Context()); span != nil {
+			fields = append(fields, zap.String("trace_id", span.Context.TraceID.String()), zap.String("span_id", span.Context.SpanID.String()))
+		}
+		ctx := utilities.WithRequestLog(r.Context(), fields...)
+
+		next(rw, r.WithContext(ctx))
+
+		status := responseStatus(rw)
+		bytes := 0
+		if res, ok := rw.(negroni.ResponseWriter); ok {
+			bytes = res.Size()
+		}
+		entry := utilities.Log(ctx).With(
+			zap.String("method", r.Method),
+			zap.String("route", routeTemplate(router, r)),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", status),
+			zap.Float64("latency_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			zap.Int("bytes", bytes),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("user_agent", r.UserAgent()),
+		)
+		if status >= 500 {
+			entry.Error("request")
+		} else {
+			entry.Info("request")
+		}
+	}
+}
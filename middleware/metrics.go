@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/metrics"
+	"github.com/urfave/negroni"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var requestsTotal = metrics.NewCounter("gram_http_requests_total", "HTTP requests by method, route and status.", "method", "route", "status")
+
+var requestDuration = metrics.NewHistogram("gram_http_request_duration_seconds", "HTTP request latency by method, route and status.",
+	metrics.DefaultBuckets, "method", "route", "status")
+
+// MetricsMiddleware counts requests and their latency by the route template they match,
+// such as /v1/users/{id}, so that metrics do not grow with every user id
+func MetricsMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		route := routeTemplate(router, r)
+
+		next(rw, r)
+
+		status := strconv.Itoa(responseStatus(rw))
+		requestsTotal.Inc(r.Method, route, status)
+		requestDuration.Since(start, r.Method, route, status)
+	}
+}
+
+// routeTemplate returns the template of the route a request matches, or "unmatched"
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// responseStatus returns the status written to a negroni response writer, which is 200 if nothing was written
+func responseStatus(rw http.ResponseWriter) int {
+	if res, ok := rw.(negroni.ResponseWriter); ok && res.Status() != 0 {
+		return res.Status()
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/omar-ozgur/gram/utilities"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var rateLimitMutex sync.Mutex
+var rateLimitBuckets = make(map[string]*rateLimitBucket)
+var rateLimitSwept = time.Now()
+
+// RateLimitMiddleware limits each client address to a token bucket of requests
+func RateLimitMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	limits := utilities.CurrentConfig().RateLimit
+	if !limits.Enabled {
+		next(rw, r)
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	wait := takeRateLimitToken(client, limits, time.Now())
+	if wait > 0 {
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+		utilities.WriteProblem(rw, r, utilities.NewError(utilities.ErrorRateLimited, utilities.CodeRateLimited, "Too many requests"))
+		return
+	}
+
+	next(rw, r)
+}
+
+// takeRateLimitToken returns how long the client must wait, or zero if the request is allowed
+func takeRateLimitToken(client string, limits utilities.RateLimitConfig, now time.Time) time.Duration {
+	rate := float64(limits.RequestsPerMinute) / float64(time.Minute)
+	burst := float64(limits.Burst)
+
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	// Forget clients whose buckets have refilled
+	if now.Sub(rateLimitSwept) > time.Minute {
+		for key, bucket := range rateLimitBuckets {
+			if bucket.tokens+float64(now.Sub(bucket.updated))*rate >= burst {
+				delete(rateLimitBuckets, key)
+			}
+		}
+		rateLimitSwept = now
+	}
+
+	bucket, ok := rateLimitBuckets[client]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: burst, updated: now}
+		rateLimitBuckets[client] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+float64(now.Sub(bucket.updated))*rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / rate)
+	}
+	bucket.tokens--
+	return 0
+}
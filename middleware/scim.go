@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/omar-ozgur/gram/metrics"
+	"github.com/omar-ozgur/gram/scim"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+var scimVerificationsTotal = metrics.NewCounter("gram_scim_token_verifications_total", "SCIM bearer tokens checked by result.", "result")
+
+// RequireSCIMToken rejects requests without the service's SCIM token, with SCIM errors rather than problems
+// since identity providers expect them
+func RequireSCIMToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		config := utilities.CurrentConfig().Policy().SCIM
+		if !config.Enabled() {
+			scimVerificationsTotal.Inc("disabled")
+			scim.WriteError(rw, scim.NewError(http.StatusForbidden, "", "SCIM provisioning is not enabled for this service"))
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+			token = token[7:]
+		} else {
+			token = ""
+		}
+
+		// Compare digests so that the comparison takes the same time whatever the token's length
+		given, expected := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(config.Token))
+		if token == "" || subtle.ConstantTimeCompare(given[:], expected[:]) != 1 {
+			if token == "" {
+				scimVerificationsTotal.Inc("missing")
+			} else {
+				scimVerificationsTotal.Inc("invalid")
+			}
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			scim.WriteError(rw, scim.NewError(http.StatusUnauthorized, "", "The service's SCIM bearer token is required"))
+			return
+		}
+
+		scimVerificationsTotal.Inc("valid")
+		utilities.AddLogFields(r.Context(), zap.String("client_identity", "scim"))
+		utilities.GetRequestSource(r.Context()).SetActor("scim")
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/urfave/negroni"
+	"net/http"
+)
+
+// TracingMiddleware starts a server span for each request, continuing the caller's trace from its traceparent header
+func TracingMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := routeTemplate(router, r)
+		name := r.Method + " " + route
+		if route == "unmatched" {
+			name = r.Method
+		}
+
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, name, tracing.KindServer,
+			"http.request.method", r.Method,
+			"http.route", route,
+			"url.path", r.URL.Path,
+			"user_agent.original", r.UserAgent())
+
+		next(rw, r.WithContext(ctx))
+
+		status := responseStatus(rw)
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+		span.Finish(nil)
+	}
+}
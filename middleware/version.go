@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"time"
+)
+
+const apiVersionKey contextKey = "apiVersion"
+
+// APIVersion serves a handler as part of an API version, so the handler can tell which version it is serving
+func APIVersion(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), apiVersionKey, version)))
+	})
+}
+
+// RequestAPIVersion returns the API version of the route that matched the request, if it is versioned
+func RequestAPIVersion(r *http.Request) (string, bool) {
+	version, ok := r.Context().Value(apiVersionKey).(string)
+	return version, ok
+}
+
+// LegacyRoute marks the responses of an unversioned route as deprecated, following RFC 9745 and RFC 8594,
+// and links to the route under prefix that replaces it
+func LegacyRoute(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		config := utilities.CurrentConfig().API
+
+		if deprecation, err := time.Parse(utilities.DateFormat, config.LegacyDeprecation); err == nil {
+			rw.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecation.Unix()))
+		}
+		if sunset, err := time.Parse(utilities.DateFormat, config.LegacySunset); err == nil {
+			rw.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		rw.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, prefix, r.URL.EscapedPath()))
+
+		next.ServeHTTP(rw, r)
+	})
+}
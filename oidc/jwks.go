@@ -0,0 +1,211 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Leeway allows for clock differences when checking the times in ID tokens
+const Leeway = time.Minute
+
+// keySetRefreshInterval limits how often keys are fetched for tokens signed with an unknown key,
+// so that forged tokens cannot make every login fetch the provider's keys
+const keySetRefreshInterval = time.Minute
+
+// signingMethods are the asymmetric algorithms ID tokens may be signed with. HS256 and none are never accepted.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JSONWebKey is a public key from a provider's key set (RFC 7517)
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// PublicKey decodes an RSA or elliptic curve key
+func (k JSONWebKey) PublicKey() (interface{}, error) {
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("oidc: key %s has an invalid parameter", k.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("oidc: key %s has an invalid exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: key %s has unsupported curve '%s'", k.Kid, k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("oidc: key %s is not on its curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("oidc: key %s has unsupported type '%s'", k.Kid, k.Kty)
+}
+
+// KeySet caches the signing keys at a provider's JWKS URL. Keys are fetched again when a token
+// is signed with a key that is not in the cache, so that providers can rotate their keys.
+type KeySet struct {
+	URL    string
+	Client *http.Client
+
+	mutex     sync.Mutex
+	keys      []JSONWebKey
+	fetchedAt time.Time
+}
+
+// key returns the signing key with an id, or the only signing key if the token does not name one
+func (s *KeySet) key(ctx context.Context, kid string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if key, ok := s.find(kid); ok {
+		return key.PublicKey()
+	}
+	if time.Since(s.fetchedAt) < keySetRefreshInterval {
+		return nil, fmt.Errorf("oidc: no signing key has id '%s'", kid)
+	}
+
+	var document struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	s.fetchedAt = time.Now()
+	if err := getJSON(ctx, s.Client, s.URL, "", &document); err != nil {
+		return nil, err
+	}
+	s.keys = document.Keys
+
+	if key, ok := s.find(kid); ok {
+		return key.PublicKey()
+	}
+	return nil, fmt.Errorf("oidc: no signing key has id '%s'", kid)
+}
+
+func (s *KeySet) find(kid string) (JSONWebKey, bool) {
+	var signing []JSONWebKey
+	for _, key := range s.keys {
+		if key.Use == "" || key.Use == "sig" {
+			signing = append(signing, key)
+		}
+	}
+	for _, key := range signing {
+		if key.Kid == kid {
+			return key, true
+		}
+	}
+	if kid == "" && len(signing) == 1 {
+		return signing[0], true
+	}
+	return JSONWebKey{}, false
+}
+
+// VerifyIDToken checks an ID token's signature against the provider's keys, and its issuer, audience,
+// expiry and nonce (OpenID Connect Core 1.0 section 3.1.3.7), and returns its claims
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (Claims, error) {
+	p.keysOnce.Do(func() { p.keys = &KeySet{URL: p.JWKSURL, Client: p.client()} })
+
+	parser := jwt.Parser{ValidMethods: signingMethods, SkipClaimsValidation: true}
+	token, err := parser.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	})
+	if err != nil {
+		if validation, ok := err.(*jwt.ValidationError); ok && validation.Inner != nil {
+			err = validation.Inner
+		}
+		return nil, fmt.Errorf("oidc: the ID token is invalid: %w", err)
+	}
+	claims := Claims(token.Claims.(jwt.MapClaims))
+
+	if claims.String("iss") != p.Issuer {
+		return nil, fmt.Errorf("oidc: the ID token was issued by '%s', not '%s'", claims.String("iss"), p.Issuer)
+	}
+	if !claims.hasAudience(p.ClientID) {
+		return nil, errors.New("oidc: the ID token was not issued to this client")
+	}
+	if azp := claims.String("azp"); azp != "" && azp != p.ClientID {
+		return nil, errors.New("oidc: the ID token was issued to another party")
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("oidc: the ID token has no expiry")
+	}
+	if now.Add(-Leeway).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("oidc: the ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(Leeway).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("oidc: the ID token was issued in the future")
+	}
+
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("oidc: the ID token's nonce does not match the login's")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("oidc: the ID token has no subject")
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of strings, includes a client
+func (c Claims) hasAudience(clientID string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, value := range aud {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/omar-ozgur/gram/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idToken logs a user in at the mock provider and returns the ID token it issues for the nonce
+func idToken(t *testing.T, mock *oidctest.Provider, provider *Provider, nonce string) string {
+	t.Helper()
+	code, err := mock.Authorize(provider.AuthCodeURL("state", nonce, "verifier"), map[string]interface{}{"sub": "user-1", "email": "jdoe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.Exchange(context.Background(), code, "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.IDToken
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		sign   func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error)
+		nonce  string
+		valid  bool
+	}{
+		{name: "valid", valid: true},
+		{name: "wrong nonce", nonce: "another-nonce"},
+		{name: "missing nonce", claims: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "audience list", claims: func(c jwt.MapClaims) { c["aud"] = []string{"another-client", testClientID} }, valid: true},
+		{name: "audience list without client", claims: func(c jwt.MapClaims) { c["aud"] = []string{"another-client"} }},
+		{name: "no audience", claims: func(c jwt.MapClaims) { delete(c, "aud") }},
+		{name: "authorized party", claims: func(c jwt.MapClaims) { c["azp"] = testClientID }, valid: true},
+		{name: "another authorized party", claims: func(c jwt.MapClaims) { c["azp"] = "another-client" }},
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-5 * time.Minute).Unix() }},
+		{name: "expired within leeway", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-Leeway / 2).Unix() }, valid: true},
+		{name: "no expiry", claims: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "issued in the future", claims: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(5 * time.Minute).Unix() }},
+		{name: "no subject", claims: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{
+			name: "HS256 with the client secret",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testClientSecret))
+			},
+		},
+		{
+			// The classic algorithm confusion attack, which verifiers that trust the token's alg fall for
+			name: "HS256 with the public key",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				kid, key := mock.Key()
+				public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = kid
+				return token.SignedString(public)
+			},
+		},
+		{
+			name: "none",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				kid, _ := mock.Key()
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+				token.Header["kid"] = kid
+				return token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			},
+		},
+		{
+			name: "unknown kid",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+				token.Header["kid"] = "unknown"
+				return token.SignedString(otherKey)
+			},
+		},
+		{
+			name: "known kid signed by another key",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				kid, _ := mock.Key()
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+				token.Header["kid"] = kid
+				return token.SignedString(otherKey)
+			},
+		},
+		{
+			name: "no kid with a single key",
+			sign: func(mock *oidctest.Provider, claims jwt.MapClaims) (string, error) {
+				_, key := mock.Key()
+				return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+			},
+			valid: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mock, provider := newTestProvider(t)
+			mock.IDTokenClaims = c.claims
+			if c.sign != nil {
+				mock.SignIDToken = func(claims jwt.MapClaims) (string, error) { return c.sign(mock, claims) }
+			}
+			raw := idToken(t, mock, provider, "the-nonce")
+
+			nonce := "the-nonce"
+			if c.nonce != "" {
+				nonce = c.nonce
+			}
+			claims, err := provider.VerifyIDToken(context.Background(), raw, nonce)
+			if c.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claims.String("sub") != "user-1" || claims.String("email") != "jdoe@example.com" {
+					t.Errorf("got claims %v", claims)
+				}
+			} else if err == nil {
+				t.Errorf("expected the ID token to be rejected, got claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenTampered(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	raw := idToken(t, mock, provider, "the-nonce")
+
+	parts := strings.Split(raw, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), "user-1", "user-2", 1))
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+	if _, err := provider.VerifyIDToken(context.Background(), strings.Join(parts, "."), "the-nonce"); err == nil {
+		t.Error("expected a tampered ID token to be rejected")
+	}
+}
+
+func TestVerifyIDTokenUnknownKidRefreshLimit(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	mock.SignIDToken = func(claims jwt.MapClaims) (string, error) {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "unknown"
+		return token.SignedString(otherKey)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := provider.VerifyIDToken(context.Background(), idToken(t, mock, provider, "nonce"), "nonce"); err == nil {
+			t.Fatal("expected the ID token to be rejected")
+		}
+	}
+	if got := mock.JWKSRequests(); got != 1 {
+		t.Errorf("tokens with unknown keys fetched the key set %d times, want 1", got)
+	}
+}
+
+func TestVerifyIDTokenKeyRotation(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	if _, err := provider.VerifyIDToken(ctx, idToken(t, mock, provider, "nonce"), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with a new key are accepted once the key set may be refreshed
+	mock.RotateKey()
+	provider.keys.mutex.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-2 * keySetRefreshInterval)
+	provider.keys.mutex.Unlock()
+
+	if _, err := provider.VerifyIDToken(ctx, idToken(t, mock, provider, "nonce"), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mock.JWKSRequests(); got != 2 {
+		t.Errorf("got %d key set requests, want 2", got)
+	}
+}
+
+func TestJSONWebKeyPublicKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	valid := JSONWebKey{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X.Bytes()), Y: encode(ecKey.Y.Bytes())}
+	key, err := valid.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public, ok := key.(*ecdsa.PublicKey); !ok || public.X.Cmp(ecKey.X) != 0 {
+		t.Errorf("got key %v", key)
+	}
+
+	for name, k := range map[string]JSONWebKey{
+		"point not on the curve": {Kty: "EC", Crv: "P-256", X: encode(ecKey.X.Bytes()), Y: encode([]byte{1})},
+		"unsupported curve":      {Kty: "EC", Crv: "P-192", X: valid.X, Y: valid.Y},
+		"invalid base64":         {Kty: "RSA", N: "!!!", E: "AQAB"},
+		"empty modulus":          {Kty: "RSA", N: "", E: "AQAB"},
+		"huge exponent":          {Kty: "RSA", N: "AQAB", E: encode([]byte{1, 0, 0, 0, 0})},
+		"symmetric key":          {Kty: "oct"},
+	} {
+		if _, err := k.PublicKey(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseSize limits the provider responses that are read
+const maxResponseSize = 1 << 20
+
+// Metadata is the part of a provider's discovery document (OpenID Connect Discovery 1.0 section 3) that logins use
+type Metadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	UserinfoEndpoint              string   `json:"userinfo_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+// Discover fetches the discovery document of an issuer, and checks that it is the issuer's own.
+// A nil client is the default client with a 10 second timeout.
+func Discover(ctx context.Context, client *http.Client, issuer string) (Metadata, error) {
+	if client == nil {
+		client = defaultClient
+	}
+	var metadata Metadata
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, client, wellKnown, "", &metadata); err != nil {
+		return Metadata{}, err
+	}
+	if metadata.Issuer != issuer {
+		return Metadata{}, fmt.Errorf("oidc: the discovery document is for issuer '%s', not '%s'", metadata.Issuer, issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return Metadata{}, errors.New("oidc: the discovery document has no authorization, token or JWKS endpoint")
+	}
+	return metadata, nil
+}
+
+// Provider is an upstream identity provider that users are sent to with the authorization code flow. Providers
+// with an Issuer and JWKS URL are OpenID Connect providers, whose ID tokens are verified; others are plain
+// OAuth 2.0 providers, whose users are read from the userinfo endpoint.
+type Provider struct {
+	Issuer           string
+	AuthorizationURL string
+	TokenURL         string
+	UserinfoURL      string
+	JWKSURL          string
+
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// Client sends requests to the provider. It defaults to a client with a 10 second timeout.
+	Client *http.Client
+
+	keys     *KeySet
+	keysOnce sync.Once
+}
+
+// NewProvider returns a provider from its discovery metadata
+func NewProvider(metadata Metadata, clientID, clientSecret, redirectURL string, scopes []string, client *http.Client) *Provider {
+	return &Provider{
+		Issuer:           metadata.Issuer,
+		AuthorizationURL: metadata.AuthorizationEndpoint,
+		TokenURL:         metadata.TokenEndpoint,
+		UserinfoURL:      metadata.UserinfoEndpoint,
+		JWKSURL:          metadata.JWKSURI,
+		ClientID:         clientID,
+		ClientSecret:     clientSecret,
+		RedirectURL:      redirectURL,
+		Scopes:           scopes,
+		Client:           client,
+	}
+}
+
+// IsOIDC reports whether the provider issues ID tokens that can be verified
+func (p *Provider) IsOIDC() bool {
+	return p.Issuer != "" && p.JWKSURL != ""
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultClient
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// RandomString returns a URL-safe string of 32 random bytes, for states, nonces and PKCE code verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE code challenge of a code verifier (RFC 7636 section 4.2)
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL that users are redirected to, to log in with the provider.
+// The nonce is only sent to OpenID Connect providers.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"state":                 {state},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if len(p.Scopes) > 0 {
+		query.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	if p.IsOIDC() && nonce != "" {
+		query.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationURL, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationURL + separator + query.Encode()
+}
+
+// Token is a successful token response (RFC 6749 section 5.1)
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Error is an error response from the provider (RFC 6749 section 5.2), or an error
+// the provider redirected back with (section 4.1.2.1)
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return "oidc: " + e.Code
+	}
+	return fmt.Sprintf("oidc: %s: %s", e.Code, e.Description)
+}
+
+// Exchange redeems an authorization code for tokens, proving with the code verifier that it started the login.
+// The client authenticates with HTTP Basic authentication, which every provider must support.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientID},
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var providerError Error
+		if json.Unmarshal(body, &providerError) == nil && providerError.Code != "" {
+			return nil, &providerError
+		}
+		return nil, fmt.Errorf("oidc: the token endpoint returned status %d", res.StatusCode)
+	}
+	var token Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("oidc: the token response is invalid: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("oidc: the token response has no access token")
+	}
+	if p.IsOIDC() && token.IDToken == "" {
+		return nil, errors.New("oidc: the token response has no ID token")
+	}
+	return &token, nil
+}
+
+// Userinfo returns the claims of the user an access token was issued to
+func (p *Provider) Userinfo(ctx context.Context, accessToken string) (Claims, error) {
+	if p.UserinfoURL == "" {
+		return nil, errors.New("oidc: the provider has no userinfo endpoint")
+	}
+	claims := Claims{}
+	if err := getJSON(ctx, p.client(), p.UserinfoURL, accessToken, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// getJSON fetches and decodes a JSON document, with a bearer token if one is given
+func getJSON(ctx context.Context, client *http.Client, url, bearer string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned status %d", url, res.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(v); err != nil {
+		return fmt.Errorf("oidc: %s returned invalid JSON: %w", url, err)
+	}
+	return nil
+}
+
+// Claims are the claims of an ID token or userinfo response
+type Claims map[string]interface{}
+
+// String returns a claim that is a string, or "". Numeric claims, such as the ids some OAuth 2.0
+// providers return, are formatted as integers.
+func (c Claims) String(name string) string {
+	switch value := c[name].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%.0f", value)
+	}
+	return ""
+}
+
+// Bool returns a claim that is a boolean. Some providers send "true" and "false" as strings.
+func (c Claims) Bool(name string) bool {
+	switch value := c[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package oidc
+
+import (
+	"context"
+	"github.com/omar-ozgur/gram/oidc/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testClientID = "gram-client"
+const testClientSecret = "gram-secret"
+const testRedirectURL = "https://gram.example.com/v1/auth/mock/callback"
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+	mock := oidctest.NewProvider(testClientID, testClientSecret)
+	t.Cleanup(mock.Close)
+
+	metadata, err := Discover(context.Background(), nil, mock.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock, NewProvider(metadata, testClientID, testClientSecret, testRedirectURL, []string{"openid", "email"}, nil)
+}
+
+func TestDiscover(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	if !provider.IsOIDC() || provider.Issuer != mock.URL || provider.TokenURL != mock.URL+"/token" || provider.JWKSURL != mock.URL+"/jwks" {
+		t.Errorf("got provider %+v", provider)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer": "https://evil.example.com", "authorization_endpoint": "a", "token_endpoint": "t", "jwks_uri": "j"}`))
+	}))
+	defer server.Close()
+
+	if _, err := Discover(context.Background(), nil, server.URL); err == nil {
+		t.Error("expected an error for a document with another issuer")
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	_, provider := newTestProvider(t)
+
+	authURL, err := url.Parse(provider.AuthCodeURL("the-state", "the-nonce", "the-verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	for name, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"scope":                 "openid email",
+		"code_challenge":        CodeChallenge("the-verifier"),
+		"code_challenge_method": "S256",
+	} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if query.Get("code_verifier") != "" {
+		t.Error("the code verifier must not be sent to the authorization endpoint")
+	}
+
+	// Plain OAuth 2.0 providers do not get a nonce
+	oauth := &Provider{AuthorizationURL: "https://oauth.example.com/authorize?prompt=login", ClientID: testClientID}
+	authURL, _ = url.Parse(oauth.AuthCodeURL("the-state", "the-nonce", "the-verifier"))
+	if authURL.Query().Get("nonce") != "" || authURL.Query().Get("prompt") != "login" {
+		t.Errorf("got %s", authURL)
+	}
+}
+
+// RFC 7636 appendix B
+func TestCodeChallenge(t *testing.T) {
+	if got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	ctx := context.Background()
+	claims := map[string]interface{}{"sub": "user-1", "email": "jdoe@example.com"}
+
+	code, err := mock.Authorize(provider.AuthCodeURL("state", "nonce", "verifier"), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.Exchange(ctx, code, "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken == "" || token.IDToken == "" {
+		t.Errorf("got token %+v", token)
+	}
+
+	userinfo, err := provider.Userinfo(ctx, token.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userinfo.String("email") != "jdoe@example.com" {
+		t.Errorf("got userinfo %v", userinfo)
+	}
+
+	// Codes can only be redeemed once
+	if _, err := provider.Exchange(ctx, code, "verifier"); !isProviderError(err, "invalid_grant") {
+		t.Errorf("redeeming a code twice: got %v", err)
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	mock, provider := newTestProvider(t)
+
+	code, err := mock.Authorize(provider.AuthCodeURL("state", "nonce", "verifier"), map[string]interface{}{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(context.Background(), code, "another-verifier"); !isProviderError(err, "invalid_grant") {
+		t.Errorf("got %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeWrongClientSecret(t *testing.T) {
+	mock, provider := newTestProvider(t)
+	provider.ClientSecret = "wrong-secret"
+
+	code, err := mock.Authorize(provider.AuthCodeURL("state", "nonce", "verifier"), map[string]interface{}{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(context.Background(), code, "verifier"); !isProviderError(err, "invalid_client") {
+		t.Errorf("got %v, want invalid_client", err)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	claims := Claims{"id": float64(12345678901), "name": "Jane", "verified": true, "verified_string": "true", "unverified": "false"}
+	if got := claims.String("id"); got != "12345678901" {
+		t.Errorf("got id %s", got)
+	}
+	if got := claims.String("name"); got != "Jane" {
+		t.Errorf("got name %s", got)
+	}
+	if got := claims.String("missing"); got != "" {
+		t.Errorf("got missing %s", got)
+	}
+	if !claims.Bool("verified") || !claims.Bool("verified_string") || claims.Bool("unverified") || claims.Bool("missing") {
+		t.Error("got the wrong booleans")
+	}
+}
+
+func isProviderError(err error, code string) bool {
+	providerError, ok := err.(*Error)
+	return ok && providerError.Code == code
+}
@@ -0,0 +1,284 @@
+// Package oidctest provides a mock OpenID Connect provider for tests of logins with upstream providers.
+// It serves discovery, JWKS, token and userinfo endpoints, checks PKCE, and signs ID tokens with RSA keys
+// that can be rotated.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider is a mock provider. Its issuer is its URL.
+type Provider struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	// IDTokenClaims, if set, changes the claims of ID tokens before they are signed
+	IDTokenClaims func(claims jwt.MapClaims)
+
+	// SignIDToken, if set, signs ID tokens instead of the provider's current key
+	SignIDToken func(claims jwt.MapClaims) (string, error)
+
+	server *httptest.Server
+
+	mutex         sync.Mutex
+	keys          []signingKey
+	codes         map[string]authorization
+	userinfo      map[string]map[string]interface{}
+	tokenRequests int
+	jwksRequests  int
+}
+
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// authorization is a code issued to a user who logged in
+type authorization struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	claims        map[string]interface{}
+}
+
+// NewProvider starts a provider for a client. Close it when the test is done.
+func NewProvider(clientID, clientSecret string) *Provider {
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        make(map[string]authorization),
+		userinfo:     make(map[string]map[string]interface{}),
+	}
+	p.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "call Authorize instead", http.StatusNotImplemented)
+	})
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", p.userinfoEndpoint)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.server = httptest.NewServer(mux)
+	p.URL = p.server.URL
+	return p
+}
+
+// Close shuts the provider down
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// RotateKey adds a new signing key, which signs ID tokens from now on, and returns its id.
+// Earlier keys stay in the key set.
+func (p *Provider) RotateKey() string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidctest: failed to generate key: " + err.Error())
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	kid := fmt.Sprintf("key-%d", len(p.keys)+1)
+	p.keys = append(p.keys, signingKey{kid, key})
+	return kid
+}
+
+// Key returns the id and private key that ID tokens are signed with
+func (p *Provider) Key() (string, *rsa.PrivateKey) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	current := p.keys[len(p.keys)-1]
+	return current.kid, current.key
+}
+
+// TokenRequests returns the number of requests to the token endpoint
+func (p *Provider) TokenRequests() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.tokenRequests
+}
+
+// JWKSRequests returns the number of requests for the key set
+func (p *Provider) JWKSRequests() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.jwksRequests
+}
+
+// Authorize logs a user in at an authorization URL, as a browser would, and returns the code that the provider
+// redirects back with. The claims describe the user, and must include sub.
+func (p *Provider) Authorize(authURL string, claims map[string]interface{}) (string, error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	switch {
+	case !strings.HasPrefix(authURL, p.URL+"/authorize?"):
+		return "", fmt.Errorf("oidctest: %s is not the authorization endpoint", authURL)
+	case query.Get("response_type") != "code":
+		return "", errors.New("oidctest: response_type must be code")
+	case query.Get("client_id") != p.ClientID:
+		return "", errors.New("oidctest: unknown client_id")
+	case query.Get("redirect_uri") == "" || query.Get("state") == "":
+		return "", errors.New("oidctest: redirect_uri and state are required")
+	case query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		return "", errors.New("oidctest: an S256 code challenge is required")
+	}
+
+	code := randomString()
+	p.mutex.Lock()
+	p.codes[code] = authorization{
+		redirectURI:   query.Get("redirect_uri"),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		claims:        claims,
+	}
+	p.mutex.Unlock()
+	return code, nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                           p.URL,
+		"authorization_endpoint":           p.URL + "/authorize",
+		"token_endpoint":                   p.URL + "/token",
+		"userinfo_endpoint":                p.URL + "/userinfo",
+		"jwks_uri":                         p.URL + "/jwks",
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	p.jwksRequests++
+	var keys []map[string]string
+	for _, k := range p.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": k.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		})
+	}
+	p.mutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// token redeems a code once, checking the client's credentials, the redirect URI and the PKCE code verifier
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	p.tokenRequests++
+	p.mutex.Unlock()
+
+	if r.Method != "POST" || r.ParseForm() != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if !ok || id != p.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	p.mutex.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || code.redirectURI != r.PostForm.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(sum[:]) != code.codeChallenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{"iss": p.URL, "aud": p.ClientID, "iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix()}
+	if code.nonce != "" {
+		claims["nonce"] = code.nonce
+	}
+	for name, value := range code.claims {
+		claims[name] = value
+	}
+	if p.IDTokenClaims != nil {
+		p.IDTokenClaims(claims)
+	}
+
+	var idToken string
+	var err error
+	if p.SignIDToken != nil {
+		idToken, err = p.SignIDToken(claims)
+	} else {
+		kid, key := p.Key()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		idToken, err = token.SignedString(key)
+	}
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	accessToken := randomString()
+	p.mutex.Lock()
+	p.userinfo[accessToken] = code.claims
+	p.mutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+		"expires_in":   300,
+	})
+}
+
+func (p *Provider) userinfoEndpoint(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	claims, ok := p.userinfo[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	p.mutex.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, claims)
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("oidctest: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
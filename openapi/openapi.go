@@ -0,0 +1,239 @@
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const Version = "3.1.0"
+
+// Schema is a JSON Schema (draft 2020-12), as used by OpenAPI 3.1
+type Schema map[string]interface{}
+
+// Ref refers to a schema in the document's components
+func Ref(name string) Schema {
+	return Schema{"$ref": "#/components/schemas/" + name}
+}
+
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower-case HTTP methods to operations
+type PathItem map[string]*Operation
+
+type Components struct {
+	Schemas         map[string]Schema         `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+
+	// Errors lists the problem codes the operation can return by status code.
+	// Authentication, rate limiting and internal errors are added to every operation that can return them.
+	Errors map[int][]string `json:"-"`
+
+	// ErrorContent describes the errors of operations that do not return problems, such as the SCIM endpoints.
+	// Rate limiting errors are still problems, since they are returned before the operation's handler runs.
+	ErrorContent map[string]MediaType `json:"-"`
+}
+
+type Parameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Schema      Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string `json:"description,omitempty"`
+	Schema      Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+// Route is a registered route that the document must describe.
+// Routes served under a version prefix share the operation of their unprefixed path,
+// unless an operation is given for the prefixed path.
+type Route struct {
+	Method     string
+	Path       string
+	Prefix     string
+	Auth       bool
+	Deprecated bool
+
+	// OperationSuffix keeps operation ids unique when an operation is served at several paths
+	OperationSuffix string
+}
+
+// Key identifies the operation of a route, such as "GET /users/{id}"
+func (r Route) Key() string {
+	return strings.ToUpper(r.Method) + " " + r.Path
+}
+
+// PrefixedKey identifies an operation specific to the route's prefix, such as "GET /v2/users/{id}"
+func (r Route) PrefixedKey() string {
+	return strings.ToUpper(r.Method) + " " + r.Prefix + r.Path
+}
+
+// JSON returns content of the given media type described by a schema
+func JSON(mediaType string, schema Schema) map[string]MediaType {
+	return map[string]MediaType{mediaType: {Schema: schema}}
+}
+
+var pathParameterRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Build describes every route with its operation, adding path parameters, security and error responses.
+// It fails if a route has no operation or an operation has no route, so the document cannot drift from the router.
+func Build(info Info, routes []Route, operations map[string]Operation, components Components) (*Document, error) {
+	doc := &Document{OpenAPI: Version, Info: info, Paths: make(map[string]PathItem), Components: components}
+	if doc.Components.Schemas == nil {
+		doc.Components.Schemas = make(map[string]Schema)
+	}
+	doc.Components.SecuritySchemes = make(map[string]SecurityScheme)
+	for name, scheme := range components.SecuritySchemes {
+		doc.Components.SecuritySchemes[name] = scheme
+	}
+	doc.Components.Schemas["Problem"] = problemSchema
+	doc.Components.Schemas["FieldError"] = fieldErrorSchema
+
+	var missing []string
+	described := make(map[string]bool)
+	for _, route := range routes {
+		key := route.PrefixedKey()
+		operation, ok := operations[key]
+		if !ok {
+			key = route.Key()
+			operation, ok = operations[key]
+		}
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s has no OpenAPI operation", route.PrefixedKey()))
+			continue
+		}
+		described[key] = true
+
+		operation.OperationID += route.OperationSuffix
+		operation.Deprecated = operation.Deprecated || route.Deprecated
+
+		path := pathParameterRegexp.ReplaceAllString(route.Prefix+route.Path, "{$1}")
+		for _, match := range pathParameterRegexp.FindAllStringSubmatch(route.Path, -1) {
+			operation.Parameters = append([]Parameter{{Name: match[1], In: "path", Required: true, Schema: Schema{"type": "string"}}}, operation.Parameters...)
+		}
+
+		errs := map[int][]string{
+			http.StatusTooManyRequests:     {"rate_limited"},
+			http.StatusInternalServerError: {"internal_error"},
+		}
+		if route.Auth {
+			operation.Security = []map[string][]string{{"bearerAuth": {}}}
+			errs[http.StatusUnauthorized] = []string{"unauthorized"}
+			doc.Components.SecuritySchemes["bearerAuth"] = SecurityScheme{Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "A token returned by POST /login"}
+		}
+		for status, codes := range operation.Errors {
+			errs[status] = append(errs[status], codes...)
+		}
+
+		responses := make(map[string]Response)
+		for status, response := range operation.Responses {
+			responses[status] = response
+		}
+		for status, codes := range errs {
+			content := JSON("application/problem+json", Ref("Problem"))
+			if operation.ErrorContent != nil && status != http.StatusTooManyRequests {
+				content = operation.ErrorContent
+			}
+			responses[strconv.Itoa(status)] = Response{
+				Description: fmt.Sprintf("%s: %s", http.StatusText(status), strings.Join(codes, ", ")),
+				Content:     content,
+			}
+		}
+		operation.Responses = responses
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(PathItem)
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = &operation
+	}
+
+	for key := range operations {
+		if !described[key] {
+			missing = append(missing, fmt.Sprintf("the OpenAPI operation for %s has no route", key))
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return doc, errors.New(strings.Join(missing, "\n"))
+	}
+	return doc, nil
+}
+
+var problemSchema = Schema{
+	"type":        "object",
+	"description": "An RFC 7807 problem",
+	"required":    []string{"type", "title", "status", "code"},
+	"properties": map[string]interface{}{
+		"type":     Schema{"type": "string", "examples": []string{"urn:gram:problem:validation_failed"}},
+		"title":    Schema{"type": "string"},
+		"status":   Schema{"type": "integer"},
+		"detail":   Schema{"type": "string"},
+		"instance": Schema{"type": "string"},
+		"code":     Schema{"type": "string", "description": "A stable code that identifies the error"},
+		"errors":   Schema{"type": "array", "items": Ref("FieldError")},
+	},
+}
+
+var fieldErrorSchema = Schema{
+	"type":     "object",
+	"required": []string{"field", "code", "message"},
+	"properties": map[string]interface{}{
+		"field":   Schema{"type": "string"},
+		"code":    Schema{"type": "string", "enum": []string{"required", "invalid", "too_short", "taken", "unknown"}},
+		"message": Schema{"type": "string"},
+	},
+}
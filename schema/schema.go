@@ -0,0 +1,444 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supportedKeywords lists the JSON Schema keywords that are understood.
+// Schemas using other keywords are rejected rather than silently ignored.
+var supportedKeywords = map[string]bool{
+	"$schema": true, "$id": true, "title": true, "description": true, "default": true, "examples": true,
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "format": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+}
+
+var types = map[string]bool{"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true}
+
+// Schema is a JSON Schema (draft 2020-12) restricted to the supportedKeywords
+type Schema struct {
+	Types                []string
+	Enum                 []interface{}
+	Const                interface{}
+	HasConst             bool
+	Properties           map[string]*Schema
+	Required             []string
+	AdditionalProperties *Schema
+	Items                *Schema
+	MinItems             *int
+	MaxItems             *int
+	UniqueItems          bool
+	MinLength            *int
+	MaxLength            *int
+	Pattern              *regexp.Regexp
+	Format               string
+	Minimum              *float64
+	Maximum              *float64
+	ExclusiveMinimum     *float64
+	ExclusiveMaximum     *float64
+
+	// Boolean schemas accept everything (true) or nothing (false)
+	Reject bool
+}
+
+// ValidationError describes why the value at a path does not match a schema
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// Parse reads a JSON Schema document
+func Parse(data []byte) (*Schema, error) {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return compile(raw, "")
+}
+
+func compile(raw interface{}, path string) (*Schema, error) {
+	fail := func(format string, args ...interface{}) (*Schema, error) {
+		location := path
+		if location == "" {
+			location = "the root schema"
+		}
+		return nil, fmt.Errorf("%s: %s", location, fmt.Sprintf(format, args...))
+	}
+
+	if accept, ok := raw.(bool); ok {
+		return &Schema{Reject: !accept}, nil
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return fail("a schema must be an object or a boolean")
+	}
+
+	s := &Schema{}
+	for keyword, value := range object {
+		if !supportedKeywords[keyword] {
+			return fail("the '%s' keyword is not supported", keyword)
+		}
+
+		var err error
+		switch keyword {
+		case "type":
+			switch t := value.(type) {
+			case string:
+				s.Types = []string{t}
+			case []interface{}:
+				for _, item := range t {
+					name, _ := item.(string)
+					s.Types = append(s.Types, name)
+				}
+			}
+			if len(s.Types) == 0 {
+				return fail("type must be a type name or an array of type names")
+			}
+			for _, name := range s.Types {
+				if !types[name] {
+					return fail("unknown type '%s'", name)
+				}
+			}
+		case "enum":
+			items, ok := value.([]interface{})
+			if !ok {
+				return fail("enum must be an array")
+			}
+			s.Enum = items
+		case "const":
+			s.Const, s.HasConst = value, true
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return fail("properties must be an object")
+			}
+			s.Properties = make(map[string]*Schema)
+			for name, property := range properties {
+				s.Properties[name], err = compile(property, joinPath(path, name))
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			items, ok := value.([]interface{})
+			if !ok {
+				return fail("required must be an array of property names")
+			}
+			for _, item := range items {
+				name, ok := item.(string)
+				if !ok {
+					return fail("required must be an array of property names")
+				}
+				s.Required = append(s.Required, name)
+			}
+		case "additionalProperties":
+			s.AdditionalProperties, err = compile(value, joinPath(path, "additionalProperties"))
+		case "items":
+			s.Items, err = compile(value, joinPath(path, "items"))
+		case "uniqueItems":
+			s.UniqueItems, ok = value.(bool)
+			if !ok {
+				return fail("uniqueItems must be a boolean")
+			}
+		case "minItems", "maxItems", "minLength", "maxLength":
+			n, ok := value.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return fail("%s must be a non-negative integer", keyword)
+			}
+			limit := int(n)
+			switch keyword {
+			case "minItems":
+				s.MinItems = &limit
+			case "maxItems":
+				s.MaxItems = &limit
+			case "minLength":
+				s.MinLength = &limit
+			case "maxLength":
+				s.MaxLength = &limit
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+			n, ok := value.(float64)
+			if !ok {
+				return fail("%s must be a number", keyword)
+			}
+			switch keyword {
+			case "minimum":
+				s.Minimum = &n
+			case "maximum":
+				s.Maximum = &n
+			case "exclusiveMinimum":
+				s.ExclusiveMinimum = &n
+			case "exclusiveMaximum":
+				s.ExclusiveMaximum = &n
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fail("pattern must be a string")
+			}
+			s.Pattern, err = regexp.Compile(pattern)
+			if err != nil {
+				return fail("invalid pattern: %s", err.Error())
+			}
+		case "format":
+			s.Format, ok = value.(string)
+			if !ok {
+				return fail("format must be a string")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Type returns the schema's type if it allows exactly one type, ignoring null
+func (s *Schema) Type() string {
+	var found string
+	for _, name := range s.Types {
+		if name == "null" {
+			continue
+		}
+		if found != "" {
+			return ""
+		}
+		found = name
+	}
+	return found
+}
+
+// Validate checks a decoded JSON value against the schema, returning every problem found
+func (s *Schema) Validate(value interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate(value, "", &errs)
+	return errs
+}
+
+func (s *Schema) validate(value interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.Reject {
+		fail("is not allowed")
+		return
+	}
+
+	if len(s.Types) > 0 && !s.matchesType(value) {
+		fail("must be of type %s", strings.Join(s.Types, " or "))
+		return
+	}
+	if s.HasConst && !reflect.DeepEqual(value, s.Const) {
+		fail("must be %s", encode(s.Const))
+	}
+	if s.Enum != nil {
+		found := false
+		for _, item := range s.Enum {
+			if reflect.DeepEqual(value, item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			var options []string
+			for _, item := range s.Enum {
+				options = append(options, encode(item))
+			}
+			fail("must be one of %s", strings.Join(options, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			fail("must match the pattern %s", s.Pattern.String())
+		}
+		if s.Format != "" && !checkFormat(s.Format, v) {
+			fail("must be a valid %s", s.Format)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum {
+			fail("must be greater than %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			fail("must be less than %v", *s.ExclusiveMaximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must contain at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must contain at most %d items", *s.MaxItems)
+		}
+		if s.UniqueItems {
+		unique:
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						fail("must not contain duplicate items")
+						break unique
+					}
+				}
+			}
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, ValidationError{Path: joinPath(path, name), Message: "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				property.validate(v[name], joinPath(path, name), errs)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(v[name], joinPath(path, name), errs)
+			}
+		}
+	}
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	for _, name := range s.Types {
+		switch v := value.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFormat validates the formats attributes commonly use; other formats are annotations only
+func checkFormat(format, value string) bool {
+	switch format {
+	case "email":
+		address, err := mail.ParseAddress(value)
+		return err == nil && address.Address == value
+	case "uri":
+		u, err := url.Parse(value)
+		return err == nil && u.Scheme != ""
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	}
+	return true
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func encode(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+type cachedSchema struct {
+	modTime time.Time
+	schema  *Schema
+}
+
+var cacheMutex sync.Mutex
+var cache = make(map[string]cachedSchema)
+
+// Load reads and compiles the schema file at path, reusing the compiled schema until the file changes
+func Load(path string) (*Schema, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if cached, ok := cache[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.schema, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	cache[path] = cachedSchema{modTime: info.ModTime(), schema: s}
+	return s, nil
+}
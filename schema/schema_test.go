@@ -0,0 +1,171 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, document string) *Schema {
+	t.Helper()
+	s, err := Parse([]byte(document))
+	if err != nil {
+		t.Fatalf("%s: %s", document, err)
+	}
+	return s
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		`[]`,
+		`"object"`,
+		`{"type": "float"}`,
+		`{"type": []}`,
+		`{"type": 1}`,
+		`{"$ref": "#/definitions/name"}`,
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"properties": []}`,
+		`{"properties": {"name": {"type": "text"}}}`,
+		`{"required": ["a", 1]}`,
+		`{"minLength": -1}`,
+		`{"maxItems": 1.5}`,
+		`{"minimum": "1"}`,
+		`{"pattern": "("}`,
+		`{"uniqueItems": "yes"}`,
+		`{"format": 1}`,
+		`{"items": 1}`,
+	}
+
+	for _, document := range cases {
+		if _, err := Parse([]byte(document)); err == nil {
+			t.Errorf("%s: expected an error", document)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		schema string
+		value  string
+		errors []ValidationError
+	}{
+		{`true`, `{"a": 1}`, nil},
+		{`false`, `1`, []ValidationError{{"", "is not allowed"}}},
+		{`{"type": "string"}`, `"a"`, nil},
+		{`{"type": "string"}`, `1`, []ValidationError{{"", "must be of type string"}}},
+		{`{"type": ["string", "null"]}`, `null`, nil},
+		{`{"type": "integer"}`, `3.0`, nil},
+		{`{"type": "integer"}`, `3.5`, []ValidationError{{"", "must be of type integer"}}},
+		{`{"type": "number"}`, `3.5`, nil},
+		{`{"enum": ["a", 1]}`, `1`, nil},
+		{`{"enum": ["a", 1]}`, `"b"`, []ValidationError{{"", `must be one of "a", 1`}}},
+		{`{"const": {"a": [1]}}`, `{"a": [1]}`, nil},
+		{`{"const": true}`, `false`, []ValidationError{{"", "must be true"}}},
+		{`{"minLength": 2, "maxLength": 3}`, `"éé"`, nil},
+		{`{"minLength": 2}`, `"é"`, []ValidationError{{"", "must be at least 2 characters long"}}},
+		{`{"maxLength": 3}`, `"abcd"`, []ValidationError{{"", "must be at most 3 characters long"}}},
+		{`{"pattern": "^[a-z]+$"}`, `"abc1"`, []ValidationError{{"", "must match the pattern ^[a-z]+$"}}},
+		{`{"minimum": 1, "maximum": 2}`, `2`, nil},
+		{`{"minimum": 1}`, `0`, []ValidationError{{"", "must be at least 1"}}},
+		{`{"maximum": 1}`, `2`, []ValidationError{{"", "must be at most 1"}}},
+		{`{"exclusiveMinimum": 1}`, `1`, []ValidationError{{"", "must be greater than 1"}}},
+		{`{"exclusiveMaximum": 1}`, `1`, []ValidationError{{"", "must be less than 1"}}},
+		{`{"minItems": 1, "maxItems": 2}`, `[1]`, nil},
+		{`{"minItems": 1}`, `[]`, []ValidationError{{"", "must contain at least 1 items"}}},
+		{`{"maxItems": 1}`, `[1, 2]`, []ValidationError{{"", "must contain at most 1 items"}}},
+		{`{"uniqueItems": true}`, `[{"a": 1}, {"a": 2}]`, nil},
+		{`{"uniqueItems": true}`, `[{"a": 1}, {"a": 1}, 2, 2]`, []ValidationError{{"", "must not contain duplicate items"}}},
+		{`{"items": {"type": "string"}}`, `["a", 1, "b", true]`, []ValidationError{{"[1]", "must be of type string"}, {"[3]", "must be of type string"}}},
+		{`{"format": "email"}`, `"jdoe@example.com"`, nil},
+		{`{"format": "email"}`, `"Jane <jdoe@example.com>"`, []ValidationError{{"", "must be a valid email"}}},
+		{`{"format": "uri"}`, `"example.com"`, []ValidationError{{"", "must be a valid uri"}}},
+		{`{"format": "date-time"}`, `"2026-01-02T03:04:05Z"`, nil},
+		{`{"format": "date"}`, `"2026-02-30"`, []ValidationError{{"", "must be a valid date"}}},
+		{`{"format": "hostname"}`, `"not checked"`, nil},
+
+		// Objects report every problem, in a stable order, at the path of each property
+		{
+			`{"type": "object", "required": ["team", "level"], "additionalProperties": false, "properties": {
+				"team": {"type": "string"},
+				"level": {"type": "integer", "minimum": 1},
+				"manager": {"type": "object", "properties": {"email": {"format": "email"}}}
+			}}`,
+			`{"level": 0, "manager": {"email": "x"}, "zone": "eu", "alias": 1}`,
+			[]ValidationError{
+				{"team", "is required"},
+				{"alias", "is not allowed"},
+				{"level", "must be at least 1"},
+				{"manager.email", "must be a valid email"},
+				{"zone", "is not allowed"},
+			},
+		},
+		{`{"additionalProperties": {"type": "number"}}`, `{"a": 1, "b": "2"}`, []ValidationError{{"b", "must be of type number"}}},
+	}
+
+	for _, c := range cases {
+		var value interface{}
+		if err := json.Unmarshal([]byte(c.value), &value); err != nil {
+			t.Fatal(err)
+		}
+		if got := mustParse(t, c.schema).Validate(value); !reflect.DeepEqual(got, c.errors) {
+			t.Errorf("%s with %s: got %v, want %v", c.schema, c.value, got, c.errors)
+		}
+	}
+}
+
+func TestType(t *testing.T) {
+	cases := []struct {
+		schema string
+		want   string
+	}{
+		{`{"type": "integer"}`, "integer"},
+		{`{"type": ["string", "null"]}`, "string"},
+		{`{"type": ["string", "number"]}`, ""},
+		{`{}`, ""},
+	}
+
+	for _, c := range cases {
+		if got := mustParse(t, c.schema).Type(); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.schema, got, c.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type": "string"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	first, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := Load(path); again != first {
+		t.Error("an unchanged schema should be reused")
+	}
+
+	// The schema is compiled again when the file changes
+	if err := ioutil.WriteFile(path, []byte(`{"type": "integer"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := Load(path)
+	if err != nil || changed.Type() != "integer" {
+		t.Errorf("got %v, %v", changed, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"type": "text"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an invalid schema")
+	}
+}
@@ -0,0 +1,161 @@
+package scim
+
+// Attribute describes an attribute of a resource in a schema (RFC 7643 section 7)
+type Attribute struct {
+	Name           string      `json:"name"`
+	Type           string      `json:"type"`
+	MultiValued    bool        `json:"multiValued"`
+	Description    string      `json:"description"`
+	Required       bool        `json:"required"`
+	CaseExact      bool        `json:"caseExact"`
+	Mutability     string      `json:"mutability"`
+	Returned       string      `json:"returned"`
+	Uniqueness     string      `json:"uniqueness"`
+	ReferenceTypes []string    `json:"referenceTypes,omitempty"`
+	SubAttributes  []Attribute `json:"subAttributes,omitempty"`
+}
+
+func attribute(name, kind, description string) Attribute {
+	return Attribute{Name: name, Type: kind, Description: description, Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+}
+
+func (a Attribute) required() Attribute {
+	a.Required = true
+	return a
+}
+
+func (a Attribute) unique() Attribute {
+	a.Uniqueness = "server"
+	return a
+}
+
+func (a Attribute) multiValued() Attribute {
+	a.MultiValued = true
+	return a
+}
+
+func (a Attribute) readOnly() Attribute {
+	a.Mutability = "readOnly"
+	return a
+}
+
+func (a Attribute) immutable() Attribute {
+	a.Mutability = "immutable"
+	return a
+}
+
+func (a Attribute) writeOnly() Attribute {
+	a.Mutability, a.Returned = "writeOnly", "never"
+	return a
+}
+
+func (a Attribute) references(types ...string) Attribute {
+	a.ReferenceTypes = types
+	return a
+}
+
+func (a Attribute) with(subAttributes ...Attribute) Attribute {
+	a.SubAttributes = subAttributes
+	return a
+}
+
+// multiValuedValue describes the sub-attributes of emails and phone numbers
+func multiValuedValue(name, description string) Attribute {
+	return attribute(name, "complex", description).multiValued().with(
+		attribute("value", "string", "The value"),
+		attribute("type", "string", "A label, such as work"),
+		attribute("primary", "boolean", "Whether this is the primary value; Gram stores one value"),
+	)
+}
+
+// UserAttributes are the attributes of users that Gram stores
+var UserAttributes = []Attribute{
+	attribute("userName", "string", "A unique identifier for the user, stored as their email or username").required().unique(),
+	attribute("name", "complex", "The user's name").required().with(
+		attribute("givenName", "string", "The user's first name").required(),
+		attribute("familyName", "string", "The user's last name").required(),
+		attribute("formatted", "string", "The user's full name").readOnly(),
+	),
+	attribute("displayName", "string", "The user's full name").readOnly(),
+	multiValuedValue("emails", "The user's email address"),
+	multiValuedValue("phoneNumbers", "The user's phone number in E.164 format"),
+	attribute("active", "boolean", "Whether the user can log in"),
+	attribute("password", "string", "The user's password").writeOnly(),
+	attribute("groups", "complex", "The groups the user belongs to").multiValued().readOnly().with(
+		attribute("value", "string", "The id of the group").readOnly(),
+		attribute("$ref", "reference", "The URI of the group").readOnly().references("Group"),
+		attribute("display", "string", "The name of the group").readOnly(),
+	),
+}
+
+// GroupAttributes are the attributes of groups that Gram stores
+var GroupAttributes = []Attribute{
+	attribute("displayName", "string", "A unique name for the group").required().unique(),
+	attribute("members", "complex", "The users in the group").multiValued().with(
+		attribute("value", "string", "The id of the user").immutable(),
+		attribute("$ref", "reference", "The URI of the user").immutable().references("User"),
+		attribute("display", "string", "The name of the user").readOnly(),
+		attribute("type", "string", "The type of member; only User is supported").immutable(),
+	),
+}
+
+// Schemas describes the User and Group schemas. base is the URL of the SCIM endpoints, such as https://example.com/scim/v2.
+func Schemas(base string) []interface{} {
+	schema := func(id, name, description string, attributes []Attribute) interface{} {
+		return map[string]interface{}{
+			"schemas":     []string{SchemaSchema},
+			"id":          id,
+			"name":        name,
+			"description": description,
+			"attributes":  attributes,
+			"meta":        Meta{ResourceType: "Schema", Location: base + "/Schemas/" + id},
+		}
+	}
+	return []interface{}{
+		schema(UserSchema, "User", "User Account", UserAttributes),
+		schema(GroupSchema, "Group", "Group", GroupAttributes),
+	}
+}
+
+// ResourceTypes describes the User and Group resource types
+func ResourceTypes(base string) []interface{} {
+	resourceType := func(id, endpoint, schema string) interface{} {
+		return map[string]interface{}{
+			"schemas":     []string{ResourceTypeSchema},
+			"id":          id,
+			"name":        id,
+			"endpoint":    endpoint,
+			"description": id,
+			"schema":      schema,
+			"meta":        Meta{ResourceType: "ResourceType", Location: base + "/ResourceTypes/" + id},
+		}
+	}
+	return []interface{}{
+		resourceType("User", "/Users", UserSchema),
+		resourceType("Group", "/Groups", GroupSchema),
+	}
+}
+
+// ServiceProviderConfig describes the SCIM features Gram supports
+func ServiceProviderConfig(base string, maxResults int) interface{} {
+	supported := func(supported bool) map[string]interface{} {
+		return map[string]interface{}{"supported": supported}
+	}
+	return map[string]interface{}{
+		"schemas":          []string{ServiceProviderConfigSchema},
+		"documentationUri": "https://github.com/omar-ozgur/gram#scim-provisioning",
+		"patch":            supported(true),
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": maxResults},
+		"changePassword":   supported(true),
+		"sort":             supported(false),
+		"etag":             supported(true),
+		"authenticationSchemes": []interface{}{map[string]interface{}{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "The service's SCIM token in the Authorization header",
+			"primary":     true,
+		}},
+		"meta": Meta{ResourceType: "ServiceProviderConfig", Location: base + "/ServiceProviderConfig"},
+	}
+}
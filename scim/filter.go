@@ -0,0 +1,299 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxFilterLength limits the filters that are parsed
+const MaxFilterLength = 4096
+
+const maxFilterDepth = 10
+
+// Filter is a parsed filter expression (RFC 7644 section 3.4.2.2)
+type Filter struct {
+
+	// Op is "and", "or" or "not", or an attribute operator: eq, ne, co, sw, ew, gt, ge, lt, le or pr
+	Op string
+
+	// Left and Right are the operands of "and" and "or". Left is the operand of "not".
+	Left, Right *Filter
+
+	// Attr is the attribute path of an attribute operator, such as "userName" or "emails.value"
+	Attr string
+
+	// Value is the string, float64, bool or nil compared with the attribute, except by pr
+	Value interface{}
+}
+
+var comparisonOps = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func invalidFilter(format string, args ...interface{}) *Error {
+	return BadRequest(ErrInvalidFilter, "The filter is invalid: "+fmt.Sprintf(format, args...))
+}
+
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{tokenOpenBracket, "["})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{tokenCloseBracket, "]"})
+			i++
+		case c == '"':
+
+			// Strings are JSON strings, so find the closing quote that is not escaped
+			end := i + 1
+			for end < len(text) && text[end] != '"' {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return nil, invalidFilter("a string is not terminated")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(text[i:end+1]), &value); err != nil {
+				return nil, invalidFilter("the string %s is invalid", text[i:end+1])
+			}
+			tokens = append(tokens, token{tokenString, value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(text) && !strings.ContainsRune(" \t\n\r()[]\"", rune(text[end])) {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, text[i:end]})
+			i = end
+		}
+	}
+	return append(tokens, token{tokenEnd, ""}), nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// ParseFilter parses a filter such as `userName eq "bjensen" and not (emails co "@example.com")`.
+// Attributes in value paths such as emails[type eq "work"] are prefixed with their parent, as in emails.type.
+func ParseFilter(text string) (*Filter, error) {
+	if len(text) > MaxFilterLength {
+		return nil, invalidFilter("it is longer than %d characters", MaxFilterLength)
+	}
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, invalidFilter("unexpected '%s'", p.peek().text)
+	}
+	return filter, nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokenWord && strings.EqualFold(t.text, word)
+}
+
+func (p *filterParser) expect(kind tokenKind, text string) error {
+	if p.peek().kind != kind {
+		if p.peek().kind == tokenEnd {
+			return invalidFilter("expected '%s' at the end", text)
+		}
+		return invalidFilter("expected '%s' before '%s'", text, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *filterParser) parseOr() (*Filter, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterDepth {
+		return nil, invalidFilter("it is nested more than %d levels deep", maxFilterDepth)
+	}
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (*Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (*Filter, error) {
+	if p.keyword("not") {
+		p.next()
+		if err := p.expect(tokenOpen, "("); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return &Filter{Op: "not", Left: operand}, nil
+	}
+
+	if p.peek().kind == tokenOpen {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return filter, nil
+	}
+
+	attr := p.next()
+	if attr.kind != tokenWord {
+		if attr.kind == tokenEnd {
+			return nil, invalidFilter("expected an attribute at the end")
+		}
+		return nil, invalidFilter("expected an attribute before '%s'", attr.text)
+	}
+
+	// A value path filters the values of a multi-valued attribute
+	if p.peek().kind == tokenOpenBracket {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		filter.prefix(attr.text)
+		return filter, nil
+	}
+
+	op := p.next()
+	name := strings.ToLower(op.text)
+	if op.kind != tokenWord || (name != "pr" && !comparisonOps[name]) {
+		return nil, invalidFilter("expected an operator after '%s'", attr.text)
+	}
+	if name == "pr" {
+		return &Filter{Op: name, Attr: attr.text}, nil
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{Op: name, Attr: attr.text, Value: value}, nil
+}
+
+func (p *filterParser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenWord:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		if number, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return number, nil
+		}
+		return nil, invalidFilter("the value '%s' must be a string, number, boolean or null", t.text)
+	case tokenEnd:
+		return nil, invalidFilter("expected a value at the end")
+	}
+	return nil, invalidFilter("expected a value before '%s'", t.text)
+}
+
+// prefix qualifies the attributes of a value filter with their parent attribute
+func (filter *Filter) prefix(parent string) {
+	if filter.Attr != "" {
+		filter.Attr = parent + "." + filter.Attr
+	}
+	if filter.Left != nil {
+		filter.Left.prefix(parent)
+	}
+	if filter.Right != nil {
+		filter.Right.prefix(parent)
+	}
+}
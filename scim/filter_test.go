@@ -0,0 +1,83 @@
+package scim
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// format writes a filter in prefix form, such as (and (eq userName "bjensen") (pr title))
+func format(filter *Filter) string {
+	switch filter.Op {
+	case "and", "or":
+		return fmt.Sprintf("(%s %s %s)", filter.Op, format(filter.Left), format(filter.Right))
+	case "not":
+		return fmt.Sprintf("(not %s)", format(filter.Left))
+	case "pr":
+		return fmt.Sprintf("(pr %s)", filter.Attr)
+	}
+	return fmt.Sprintf("(%s %s %#v)", filter.Op, filter.Attr, filter.Value)
+}
+
+func TestParseFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		want   string
+	}{
+		{`userName eq "bjensen"`, `(eq userName "bjensen")`},
+		{`userName Eq "b\"jensené"`, `(eq userName "b\"jensené")`},
+		{`title pr`, `(pr title)`},
+		{`meta.lastModified gt "2011-05-13T04:42:34Z"`, `(gt meta.lastModified "2011-05-13T04:42:34Z")`},
+		{`active eq true and x ne null`, `(and (eq active true) (ne x <nil>))`},
+		{`age ge 21.5`, `(ge age 21.5)`},
+		{`a eq 1 or b eq 2 and c eq 3`, `(or (eq a 1) (and (eq b 2) (eq c 3)))`},
+		{`(a eq 1 or b eq 2) and c eq 3`, `(and (or (eq a 1) (eq b 2)) (eq c 3))`},
+		{`a eq 1 OR b eq 2 or c eq 3`, `(or (or (eq a 1) (eq b 2)) (eq c 3))`},
+		{`not (emails co "@example.com")`, `(not (co emails "@example.com"))`},
+		{`emails[type eq "work" and value ew "@example.com"]`, `(and (eq emails.type "work") (ew emails.value "@example.com"))`},
+		{`userType eq "Employee" and emails[primary eq true]`, `(and (eq userType "Employee") (eq emails.primary true))`},
+	}
+
+	for _, c := range cases {
+		filter, err := ParseFilter(c.filter)
+		if err != nil {
+			t.Errorf("%s: %s", c.filter, err)
+			continue
+		}
+		if got := format(filter); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	nested := strings.Repeat("not (", maxFilterDepth) + "a pr" + strings.Repeat(")", maxFilterDepth)
+	if _, err := ParseFilter(nested); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("a filter nested %d levels deep: got %v", maxFilterDepth+1, err)
+	}
+
+	cases := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName like "b"`,
+		`userName eq bjensen`,
+		`userName eq "bjensen`,
+		`userName eq "\x"`,
+		`userName eq "a" and`,
+		`userName eq "a" "b"`,
+		`(userName eq "a"`,
+		`userName eq "a")`,
+		`not userName eq "a"`,
+		`emails[type eq "work"`,
+		`"userName" eq "a"`,
+		strings.Repeat("a", MaxFilterLength+1),
+	}
+
+	for _, filter := range cases {
+		_, err := ParseFilter(filter)
+		if e, ok := err.(*Error); !ok || e.Status != 400 || e.ScimType != ErrInvalidFilter {
+			t.Errorf("%q: got %v, want an invalidFilter error", filter, err)
+		}
+	}
+}
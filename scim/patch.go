@@ -0,0 +1,109 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PatchRequest is the body of a PATCH request (RFC 7644 section 3.5.2)
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation adds, replaces or removes the value at a path. Without a path, the value is an object of
+// attributes to add or replace.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ParsePatchRequest reads a PATCH body. Operation names are lower-cased, since some identity providers capitalize them.
+func ParsePatchRequest(body []byte) (PatchRequest, error) {
+	var request PatchRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return request, BadRequest(ErrInvalidSyntax, "The request body must be a PatchOp message: "+err.Error())
+	}
+
+	hasSchema := false
+	for _, schema := range request.Schemas {
+		hasSchema = hasSchema || schema == PatchOpSchema
+	}
+	if !hasSchema {
+		return request, BadRequest(ErrInvalidSyntax, "The request body must have the schema "+PatchOpSchema)
+	}
+	if len(request.Operations) == 0 {
+		return request, BadRequest(ErrInvalidSyntax, "The request body must have at least one operation")
+	}
+
+	for i, operation := range request.Operations {
+		operation.Op = strings.ToLower(operation.Op)
+		switch operation.Op {
+		case "add", "replace":
+			if len(operation.Value) == 0 {
+				return request, BadRequest(ErrInvalidSyntax, fmt.Sprintf("Operation %d (%s) must have a value", i+1, operation.Op))
+			}
+		case "remove":
+			if operation.Path == "" {
+				return request, BadRequest(ErrNoTarget, fmt.Sprintf("Operation %d (remove) must have a path", i+1))
+			}
+		default:
+			return request, BadRequest(ErrInvalidSyntax, fmt.Sprintf("Operation %d has an unknown op '%s'. Valid ops are: add, replace, remove", i+1, operation.Op))
+		}
+		request.Operations[i] = operation
+	}
+	return request, nil
+}
+
+// Path is a parsed patch path, such as name.givenName or emails[type eq "work"].value
+type Path struct {
+
+	// Attr is the lower-case attribute, such as "name" or "emails"
+	Attr string
+
+	// Filter selects values of a multi-valued attribute. Its attributes are relative to Attr, as in type.
+	Filter *Filter
+
+	// Sub is the lower-case sub-attribute, such as "givenName" or "value", if any
+	Sub string
+}
+
+// ParsePath parses a patch path, which may be qualified with the URN of the resource's schema
+func ParsePath(text, schema string) (Path, error) {
+	invalid := BadRequest(ErrInvalidPath, fmt.Sprintf("The path '%s' is invalid", text))
+
+	rest := text
+	if strings.HasPrefix(strings.ToLower(rest), strings.ToLower(schema)+":") {
+		rest = rest[len(schema)+1:]
+	}
+
+	var path Path
+	if open := strings.Index(rest, "["); open >= 0 {
+		close := strings.LastIndex(rest, "]")
+		if close < open {
+			return path, invalid
+		}
+		filter, err := ParseFilter(rest[open+1 : close])
+		if err != nil {
+			return path, BadRequest(ErrInvalidPath, fmt.Sprintf("The path '%s' is invalid: %s", text, err.Error()))
+		}
+		path.Attr, path.Filter = rest[:open], filter
+		rest = rest[close+1:]
+		if rest != "" && !strings.HasPrefix(rest, ".") {
+			return path, invalid
+		}
+		path.Sub = strings.TrimPrefix(rest, ".")
+	} else if dot := strings.Index(rest, "."); dot >= 0 {
+		path.Attr, path.Sub = rest[:dot], rest[dot+1:]
+	} else {
+		path.Attr = rest
+	}
+
+	if path.Attr == "" || strings.ContainsAny(path.Attr+path.Sub, ".[] ") || (path.Sub == "" && strings.HasSuffix(rest, ".")) {
+		return path, invalid
+	}
+	path.Attr, path.Sub = strings.ToLower(path.Attr), strings.ToLower(path.Sub)
+	return path, nil
+}
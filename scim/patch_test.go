@@ -0,0 +1,96 @@
+package scim
+
+import (
+	"testing"
+)
+
+func TestParsePatchRequest(t *testing.T) {
+	request, err := ParsePatchRequest([]byte(`{
+		"schemas": ["` + PatchOpSchema + `"],
+		"Operations": [
+			{"op": "Replace", "path": "active", "value": false},
+			{"op": "add", "value": {"title": "Engineer"}},
+			{"op": "REMOVE", "path": "emails[type eq \"work\"]"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request.Operations) != 3 || request.Operations[0].Op != "replace" || request.Operations[2].Op != "remove" {
+		t.Errorf("got %+v", request.Operations)
+	}
+
+	cases := []struct {
+		body     string
+		scimType string
+	}{
+		{`[]`, ErrInvalidSyntax},
+		{`{"Operations": [{"op": "remove", "path": "title"}]}`, ErrInvalidSyntax},
+		{`{"schemas": ["` + PatchOpSchema + `"], "Operations": []}`, ErrInvalidSyntax},
+		{`{"schemas": ["` + PatchOpSchema + `"], "Operations": [{"op": "add", "path": "title"}]}`, ErrInvalidSyntax},
+		{`{"schemas": ["` + PatchOpSchema + `"], "Operations": [{"op": "move", "path": "title"}]}`, ErrInvalidSyntax},
+		{`{"schemas": ["` + PatchOpSchema + `"], "Operations": [{"op": "remove"}]}`, ErrNoTarget},
+	}
+
+	for _, c := range cases {
+		_, err := ParsePatchRequest([]byte(c.body))
+		if e, ok := err.(*Error); !ok || e.Status != 400 || e.ScimType != c.scimType {
+			t.Errorf("%s: got %v, want a %s error", c.body, err, c.scimType)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	cases := []struct {
+		path   string
+		attr   string
+		filter string
+		sub    string
+	}{
+		{`userName`, "username", "", ""},
+		{`name.givenName`, "name", "", "givenname"},
+		{UserSchema + `:name.familyName`, "name", "", "familyname"},
+		{`urn:ietf:params:scim:schemas:core:2.0:user:active`, "active", "", ""},
+		{`emails[type eq "work"]`, "emails", `(eq type "work")`, ""},
+		{`emails[type eq "work" and primary eq true].Value`, "emails", `(and (eq type "work") (eq primary true))`, "value"},
+		{`addresses[formatted co "]"].locality`, "addresses", `(co formatted "]")`, "locality"},
+	}
+
+	for _, c := range cases {
+		path, err := ParsePath(c.path, UserSchema)
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+		filter := ""
+		if path.Filter != nil {
+			filter = format(path.Filter)
+		}
+		if path.Attr != c.attr || filter != c.filter || path.Sub != c.sub {
+			t.Errorf("%s: got %q %s %q, want %q %s %q", c.path, path.Attr, filter, path.Sub, c.attr, c.filter, c.sub)
+		}
+	}
+}
+
+func TestParsePathInvalid(t *testing.T) {
+	cases := []string{
+		``,
+		`.givenName`,
+		`name.`,
+		`name.givenName.first`,
+		`name givenName`,
+		`emails]type eq "work"[`,
+		`[type eq "work"]`,
+		`emails[type eq]`,
+		`emails[type eq "work"]value`,
+		`emails[type eq "work"].`,
+		UserSchema + `:`,
+	}
+
+	for _, path := range cases {
+		_, err := ParsePath(path, UserSchema)
+		if e, ok := err.(*Error); !ok || e.Status != 400 || e.ScimType != ErrInvalidPath {
+			t.Errorf("%q: got %v, want an invalidPath error", path, err)
+		}
+	}
+}
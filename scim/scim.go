@@ -0,0 +1,151 @@
+// Package scim implements the message formats, filters and patch paths of SCIM 2.0 (RFC 7643 and RFC 7644),
+// which identity providers use to provision users and groups
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MediaType = "application/scim+json"
+
+// Schema URNs
+const (
+	UserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	ListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// Error types from RFC 7644 section 3.12
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrTooMany       = "tooMany"
+	ErrUniqueness    = "uniqueness"
+	ErrMutability    = "mutability"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidPath   = "invalidPath"
+	ErrNoTarget      = "noTarget"
+	ErrInvalidValue  = "invalidValue"
+	ErrInvalidVers   = "invalidVers"
+)
+
+// Error is a SCIM error response. ScimType is only set for 400 and 409 errors.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func NewError(status int, scimType, detail string) *Error {
+	return &Error{Status: status, ScimType: scimType, Detail: detail}
+}
+
+func BadRequest(scimType, detail string) *Error {
+	return NewError(http.StatusBadRequest, scimType, detail)
+}
+
+// WriteJSON writes a SCIM response
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", MediaType)
+	w.WriteHeader(status)
+	JSON, _ := json.Marshal(body)
+	w.Write(JSON)
+}
+
+// WriteError writes a SCIM error response
+func WriteError(w http.ResponseWriter, e *Error) {
+	body := map[string]interface{}{
+		"schemas": []string{ErrorSchema},
+		"status":  strconv.Itoa(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+	WriteJSON(w, e.Status, body)
+}
+
+// Meta describes a resource
+type Meta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+	Version      string     `json:"version,omitempty"`
+}
+
+// ListResponse is a page of resources, paged by a 1-based index
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+func NewListResponse(resources []interface{}, totalResults, startIndex int) ListResponse {
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	return ListResponse{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: totalResults,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// AttributeName normalizes an attribute path for comparison: attribute names are case-insensitive, and may be
+// qualified with the URN of the resource's schema
+func AttributeName(path, schema string) string {
+	path = strings.ToLower(path)
+	return strings.TrimPrefix(path, strings.ToLower(schema)+":")
+}
+
+// ParseIndex reads the startIndex and count parameters of a list request. Counts above maxCount are lowered to it.
+func ParseIndex(r *http.Request, defaultCount, maxCount int) (startIndex, count int, err error) {
+	query := r.URL.Query()
+
+	startIndex = 1
+	if value := query.Get("startIndex"); value != "" {
+		startIndex, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, BadRequest(ErrInvalidValue, "startIndex must be a number")
+		}
+
+		// Values below 1 are interpreted as 1
+		if startIndex < 1 {
+			startIndex = 1
+		}
+	}
+
+	count = defaultCount
+	if value := query.Get("count"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, BadRequest(ErrInvalidValue, "count must be a number")
+		}
+
+		// Negative values are interpreted as 0
+		if count < 0 {
+			count = 0
+		}
+	}
+	if count > maxCount {
+		count = maxCount
+	}
+	return startIndex, count, nil
+}
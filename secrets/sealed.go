@@ -0,0 +1,215 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const CurrentVersion = 1
+
+const KDFScrypt = "scrypt"
+
+const DefaultScryptN = 1 << 15
+const DefaultScryptR = 8
+const DefaultScryptP = 1
+
+// Limits on the scrypt parameters of secrets being opened, so that a corrupted or hostile file cannot make
+// Gram allocate unbounded memory or spin. The limits are well above the defaults.
+const MaxScryptN = 1 << 20
+const MaxScryptR = 32
+const MaxScryptP = 16
+const maxScryptMemory = 256 << 20
+
+const keyLength = 32
+const saltLength = 16
+
+// SealedSecret is a value encrypted with AES-GCM under a key derived from a passphrase
+type SealedSecret struct {
+	Version    int
+	KDF        string
+	N          int
+	R          int
+	P          int
+	Salt       string
+	Nonce      string
+	Ciphertext string
+}
+
+// UnmarshalJSON accepts both sealed secret objects and the legacy hex string format
+func (s *SealedSecret) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		*s = SealedSecret{Ciphertext: legacy}
+		return nil
+	}
+
+	type sealedSecret SealedSecret
+	return json.Unmarshal(data, (*sealedSecret)(s))
+}
+
+func (s SealedSecret) IsEmpty() bool {
+	return s.Ciphertext == ""
+}
+
+// IsLegacy reports whether the secret was written before sealed secrets were versioned
+func (s SealedSecret) IsLegacy() bool {
+	return s.Version == 0 && !s.IsEmpty()
+}
+
+func Seal(passphrase string, plaintext []byte) (SealedSecret, error) {
+	if passphrase == "" {
+		return SealedSecret{}, errors.New("the passphrase cannot be blank")
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return SealedSecret{}, err
+	}
+
+	sealed := SealedSecret{
+		Version: CurrentVersion,
+		KDF:     KDFScrypt,
+		N:       DefaultScryptN,
+		R:       DefaultScryptR,
+		P:       DefaultScryptP,
+		Salt:    hex.EncodeToString(salt),
+	}
+
+	gcm, err := sealed.newGCM(passphrase)
+	if err != nil {
+		return SealedSecret{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return SealedSecret{}, err
+	}
+
+	sealed.Nonce = hex.EncodeToString(nonce)
+	sealed.Ciphertext = hex.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil))
+
+	return sealed, nil
+}
+
+func Open(passphrase string, s SealedSecret) ([]byte, error) {
+	if s.IsEmpty() {
+		return nil, errors.New("the sealed secret is empty")
+	}
+	if s.IsLegacy() {
+		return openLegacy(passphrase, s)
+	}
+	if s.Version != CurrentVersion {
+		return nil, fmt.Errorf("unsupported sealed secret version %d", s.Version)
+	}
+
+	gcm, err := s.newGCM(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(s.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("the sealed secret nonce has an invalid length")
+	}
+
+	ciphertext, err := hex.DecodeString(s.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt the sealed secret; the passphrase may be incorrect")
+	}
+
+	return plaintext, nil
+}
+
+// GeneratePassphrase returns a random URL-safe passphrase built from n random bytes
+func GeneratePassphrase(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// checkParams rejects scrypt parameters outside the limits before any memory is allocated for them
+func (s SealedSecret) checkParams() error {
+	if s.N <= 1 || s.N&(s.N-1) != 0 || s.N > MaxScryptN {
+		return fmt.Errorf("the sealed secret's scrypt N must be a power of 2 between 2 and %d, got %d", MaxScryptN, s.N)
+	}
+	if s.R < 1 || s.R > MaxScryptR {
+		return fmt.Errorf("the sealed secret's scrypt r must be between 1 and %d, got %d", MaxScryptR, s.R)
+	}
+	if s.P < 1 || s.P > MaxScryptP {
+		return fmt.Errorf("the sealed secret's scrypt p must be between 1 and %d, got %d", MaxScryptP, s.P)
+	}
+	if 128*s.N*s.R > maxScryptMemory {
+		return fmt.Errorf("the sealed secret's scrypt parameters need more than %d MiB of memory", maxScryptMemory>>20)
+	}
+	return nil
+}
+
+func (s SealedSecret) newGCM(passphrase string) (cipher.AEAD, error) {
+	if s.KDF != KDFScrypt {
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", s.KDF)
+	}
+	if err := s.checkParams(); err != nil {
+		return nil, err
+	}
+
+	salt, err := hex.DecodeString(s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) < saltLength {
+		return nil, errors.New("the sealed secret salt is too short")
+	}
+
+	key, err := Scrypt([]byte(passphrase), salt, s.N, s.R, s.P, keyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+// openLegacy decrypts secrets sealed with the raw key and an all-zero nonce
+func openLegacy(key string, s SealedSecret) ([]byte, error) {
+	c, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := hex.DecodeString(s.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt the legacy secret; the key may be incorrect")
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,117 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	sealed, err := Seal("passphrase", []byte("db-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Version != CurrentVersion || sealed.KDF != KDFScrypt || sealed.IsLegacy() {
+		t.Errorf("got sealed secret %+v", sealed)
+	}
+
+	// Sealed secrets survive being saved to and read from dbParams.json
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read SealedSecret
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Open("passphrase", read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "db-password" {
+		t.Errorf("got %q", plaintext)
+	}
+
+	if _, err := Open("wrong-passphrase", read); err == nil {
+		t.Error("expected an error for the wrong passphrase")
+	}
+
+	// Each seal uses a new salt and nonce
+	again, err := Seal("passphrase", []byte("db-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Salt == sealed.Salt || again.Nonce == sealed.Nonce || again.Ciphertext == sealed.Ciphertext {
+		t.Error("sealing the same value twice gave the same salt, nonce or ciphertext")
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	sealed, err := Seal("passphrase", []byte("db-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := hex.DecodeString(sealed.Ciphertext)
+	ciphertext[0] ^= 1
+	sealed.Ciphertext = hex.EncodeToString(ciphertext)
+
+	if _, err := Open("passphrase", sealed); err == nil {
+		t.Error("expected an error for a tampered ciphertext")
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	block, _ := aes.NewCipher([]byte(key))
+	gcm, _ := cipher.NewGCM(block)
+	legacyHex := hex.EncodeToString(gcm.Seal(nil, make([]byte, gcm.NonceSize()), []byte("db-password"), nil))
+
+	var sealed SealedSecret
+	if err := json.Unmarshal([]byte(`"`+legacyHex+`"`), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.IsLegacy() {
+		t.Fatalf("a hex string should be read as a legacy secret, got %+v", sealed)
+	}
+	plaintext, err := Open(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "db-password" {
+		t.Errorf("got %q", plaintext)
+	}
+
+	if _, err := Open(strings.Repeat("x", 32), sealed); err == nil {
+		t.Error("expected an error for the wrong key")
+	}
+}
+
+func TestOpenRejectsExpensiveParameters(t *testing.T) {
+	valid, err := Seal("passphrase", []byte("db-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(s *SealedSecret){
+		"N not a power of 2": func(s *SealedSecret) { s.N = 1<<15 + 1 },
+		"N too large":        func(s *SealedSecret) { s.N = 1 << 30 },
+		"negative N":         func(s *SealedSecret) { s.N = -1 << 15 },
+		"r too large":        func(s *SealedSecret) { s.R = 1 << 20 },
+		"p too large":        func(s *SealedSecret) { s.P = 1 << 20 },
+		"zero p":             func(s *SealedSecret) { s.P = 0 },
+		"too much memory":    func(s *SealedSecret) { s.N, s.R = MaxScryptN, MaxScryptR },
+		"short salt":         func(s *SealedSecret) { s.Salt = "00" },
+		"unknown KDF":        func(s *SealedSecret) { s.KDF = "argon2id" },
+	}
+
+	for name, change := range cases {
+		sealed := valid
+		change(&sealed)
+		if _, err := Open("passphrase", sealed); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Status codes, numbered as in OTLP
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID.IsValid() && c.SpanID.IsValid()
+}
+
+// Span is a timed operation within a trace. A nil span is valid and records nothing.
+type Span struct {
+	Name       string
+	Kind       int
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Status     int
+	Message    string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span a context was started with, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// WithRemoteParent continues a trace started by another service, such as one propagated in a traceparent header
+func WithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, parent)
+}
+
+func parentOf(ctx context.Context) (SpanContext, bool) {
+	if span := FromContext(ctx); span != nil {
+		return span.Context, true
+	}
+	parent, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return parent, ok && parent.IsValid()
+}
+
+// Start begins a span as a child of the span in ctx, if any, or returns a nil span if tracing is disabled.
+// Spans of traces that are not sampled are not exported, but still propagate their trace.
+func Start(ctx context.Context, name string, kind int, attributes ...interface{}) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+	parent, hasParent := parentOf(ctx)
+
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]interface{})}
+	if hasParent {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Context.TraceState = parent.TraceState
+		span.Parent = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = t.sample(span.Context.TraceID)
+	}
+	rand.Read(span.Context.SpanID[:])
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[fmt.Sprint(attributes[i])] = attributes[i+1]
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Status, s.Message = StatusError, message
+	s.mu.Unlock()
+}
+
+// statusError is implemented by errors that map to an HTTP status, such as utilities.Error
+type statusError interface {
+	Status() int
+}
+
+// Finish ends the span and exports it if it is sampled.
+// Errors fail the span unless they are the client's fault, such as a validation error.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		var status statusError
+		if errors.As(err, &status) && status.Status() < 500 {
+			s.SetAttribute("error.status", status.Status())
+		} else {
+			s.SetError(err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if t := current(); t != nil && s.Context.Sampled {
+		t.export(s)
+	}
+}
+
+var traceparentRegexp = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// ParseTraceparent reads a W3C trace context traceparent header
+func ParseTraceparent(traceparent, tracestate string) (SpanContext, bool) {
+	match := traceparentRegexp.FindStringSubmatch(strings.TrimSpace(traceparent))
+	if match == nil || match[1] == "ff" || (match[1] == "00" && match[5] != "") {
+		return SpanContext{}, false
+	}
+
+	var c SpanContext
+	hex.Decode(c.TraceID[:], []byte(match[2]))
+	hex.Decode(c.SpanID[:], []byte(match[3]))
+	flags, _ := hex.DecodeString(match[4])
+	c.Sampled = flags[0]&1 == 1
+	c.TraceState = tracestate
+	return c, c.IsValid()
+}
+
+// Traceparent formats a span context as a W3C trace context traceparent header
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", c.TraceID, c.SpanID, flags)
+}
+
+// Extract continues the trace propagated by an incoming request, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	parent, ok := ParseTraceparent(header.Get("traceparent"), header.Get("tracestate"))
+	if !ok {
+		return ctx
+	}
+	return WithRemoteParent(ctx, parent)
+}
+
+// Inject propagates the trace in ctx to an outgoing request
+func Inject(ctx context.Context, header http.Header) {
+	parent, ok := parentOf(ctx)
+	if !ok {
+		return
+	}
+	header.Set("traceparent", parent.Traceparent())
+	if parent.TraceState != "" {
+		header.Set("tracestate", parent.TraceState)
+	}
+}
+
+// tracer batches finished spans for an exporter
+type tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+	spans       chan *Span
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+const batchSize = 512
+const batchInterval = 5 * time.Second
+
+var (
+	mu     sync.RWMutex
+	active *tracer
+)
+
+func current() *tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+// Init starts exporting sampled spans, replacing any previous exporter.
+// sampleRatio is the fraction of new traces that are recorded; traces continued from a caller follow its decision.
+func Init(exporter Exporter, sampleRatio float64) {
+	t := &tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		spans:       make(chan *Span, 4*batchSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+
+	mu.Lock()
+	previous := active
+	active = t
+	mu.Unlock()
+
+	if previous != nil {
+		previous.shutdown(context.Background())
+	}
+}
+
+// Shutdown exports buffered spans and stops tracing
+func Shutdown(ctx context.Context) {
+	mu.Lock()
+	t := active
+	active = nil
+	mu.Unlock()
+
+	if t != nil {
+		t.shutdown(ctx)
+	}
+}
+
+// sample keeps a trace if its id falls within the sample ratio, so every service sampling at the same ratio agrees
+func (t *tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>1) < t.sampleRatio*float64(uint64(1)<<63)
+}
+
+// export queues a span, dropping it if the exporter has fallen behind rather than slowing requests down
+func (t *tracer) export(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			if err := t.exporter.Export(batch); err != nil {
+				fmt.Printf("Failed to export %d spans: %s\n", len(batch), err.Error())
+			}
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			send()
+			return
+		}
+	}
+}
+
+func (t *tracer) shutdown(ctx context.Context) {
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,801 @@
+package utilities
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/omar-ozgur/gram/events"
+	"github.com/omar-ozgur/gram/identifiers"
+	"github.com/omar-ozgur/gram/ldap"
+	"github.com/omar-ozgur/gram/schema"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the effective configuration, layered from defaults, the config file, the environment and flags
+type Config struct {
+	Server    ServerConfig             `toml:"server"`
+	TLS       TLSConfig                `toml:"tls"`
+	Database  DatabaseConfig           `toml:"database"`
+	Tokens    TokenConfig              `toml:"tokens"`
+	Email     EmailConfig              `toml:"email"`
+	RateLimit RateLimitConfig          `toml:"rate_limit"`
+	API       APIConfig                `toml:"api"`
+	Tracing   TracingConfig            `toml:"tracing"`
+	Log       LogConfig                `toml:"log"`
+	Webhooks  WebhooksConfig           `toml:"webhooks"`
+	Services  map[string]ServicePolicy `toml:"services"`
+}
+
+type ServerConfig struct {
+	Port              string        `toml:"port" env:"GRAM_PORT"`
+	Service           string        `toml:"service" env:"GRAM_SERVICE"`
+	UnixSocket        string        `toml:"unix_socket" env:"GRAM_UNIX_SOCKET"`
+	AdminAddress      string        `toml:"admin_address" env:"GRAM_ADMIN_ADDRESS"`
+	ReadTimeout       time.Duration `toml:"read_timeout" env:"GRAM_READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `toml:"read_header_timeout" env:"GRAM_READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `toml:"write_timeout" env:"GRAM_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `toml:"idle_timeout" env:"GRAM_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `toml:"shutdown_timeout" env:"GRAM_SHUTDOWN_TIMEOUT"`
+	ShutdownDelay     time.Duration `toml:"shutdown_delay" env:"GRAM_SHUTDOWN_DELAY"`
+}
+
+// TLSConfig enables TLS when a certificate is set; the certificate files are reloaded when they change
+type TLSConfig struct {
+	CertFile         string            `toml:"cert_file" env:"GRAM_TLS_CERT_FILE"`
+	KeyFile          string            `toml:"key_file" env:"GRAM_TLS_KEY_FILE"`
+	MinVersion       string            `toml:"min_version" env:"GRAM_TLS_MIN_VERSION"`
+	CipherSuites     []string          `toml:"cipher_suites" env:"GRAM_TLS_CIPHER_SUITES"`
+	ClientAuth       string            `toml:"client_auth" env:"GRAM_TLS_CLIENT_AUTH"`
+	ClientCAFile     string            `toml:"client_ca_file" env:"GRAM_TLS_CLIENT_CA_FILE"`
+	ClientIdentities map[string]string `toml:"client_identities"`
+}
+
+// DatabaseConfig overrides the credentials saved in config/dbParams.json when set
+type DatabaseConfig struct {
+	Info          string `toml:"info" env:"GRAM_DB_INFO" secret:"true"`
+	User          string `toml:"user" env:"GRAM_DB_USER"`
+	Name          string `toml:"name" env:"GRAM_DB_NAME"`
+	Host          string `toml:"host" env:"GRAM_DB_HOST"`
+	SSLMode       string `toml:"ssl_mode" env:"GRAM_DB_SSL_MODE"`
+	EncryptionKey string `toml:"encryption_key" env:"GRAM_ENCRYPTION_KEY" secret:"true"`
+}
+
+// DBSSLModes are the libpq sslmodes supported by the Postgres driver
+var DBSSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// ValidDBSSLMode reports whether mode is one of DBSSLModes
+func ValidDBSSLMode(mode string) bool {
+	return containsString(DBSSLModes, mode)
+}
+
+type TokenConfig struct {
+	Secret   string        `toml:"secret" env:"GRAM_TOKEN_SECRET" secret:"true"`
+	Lifetime time.Duration `toml:"lifetime" env:"GRAM_TOKEN_LIFETIME"`
+}
+
+type EmailConfig struct {
+	Host     string `toml:"host" env:"GRAM_EMAIL_HOST"`
+	Port     int    `toml:"port" env:"GRAM_EMAIL_PORT"`
+	Username string `toml:"username" env:"GRAM_EMAIL_USERNAME"`
+	Password string `toml:"password" env:"GRAM_EMAIL_PASSWORD" secret:"true"`
+	From     string `toml:"from" env:"GRAM_EMAIL_FROM"`
+}
+
+type RateLimitConfig struct {
+	Enabled           bool `toml:"enabled" env:"GRAM_RATE_LIMIT_ENABLED"`
+	RequestsPerMinute int  `toml:"requests_per_minute" env:"GRAM_RATE_LIMIT_REQUESTS_PER_MINUTE"`
+	Burst             int  `toml:"burst" env:"GRAM_RATE_LIMIT_BURST"`
+}
+
+// APIConfig controls the unversioned routes that predate /v1. Changes take effect on restart.
+type APIConfig struct {
+	LegacyRoutes      bool   `toml:"legacy_routes" env:"GRAM_API_LEGACY_ROUTES"`
+	LegacyDeprecation string `toml:"legacy_deprecation" env:"GRAM_API_LEGACY_DEPRECATION"`
+	LegacySunset      string `toml:"legacy_sunset" env:"GRAM_API_LEGACY_SUNSET"`
+}
+
+// TracingConfig exports spans of requests, model operations and queries. Changes take effect on restart.
+type TracingConfig struct {
+	Exporter     string            `toml:"exporter" env:"GRAM_TRACING_EXPORTER"`
+	ServiceName  string            `toml:"service_name" env:"GRAM_TRACING_SERVICE_NAME"`
+	SampleRatio  float64           `toml:"sample_ratio" env:"GRAM_TRACING_SAMPLE_RATIO"`
+	OTLPEndpoint string            `toml:"otlp_endpoint" env:"GRAM_TRACING_OTLP_ENDPOINT"`
+	OTLPHeaders  map[string]string `toml:"otlp_headers" secret:"true"`
+}
+
+// LogConfig sets the log level, which can change on reload, and the format, which only changes on restart
+type LogConfig struct {
+	Level  string `toml:"level" env:"GRAM_LOG_LEVEL"`
+	Format string `toml:"format" env:"GRAM_LOG_FORMAT"`
+}
+
+// Tracing exporters
+const (
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+	TracingExporterOTLP   = "otlp"
+)
+
+// ServicePolicy holds the settings that may differ between the services Gram manages users for
+type ServicePolicy struct {
+	AllowSignup         bool          `toml:"allow_signup"`
+	MinPasswordLength   int           `toml:"min_password_length"`
+	TokenLifetime       time.Duration `toml:"token_lifetime"`
+	AdminUserIds        []int         `toml:"admin_user_ids"`
+	AdminIdentities     []string      `toml:"admin_identities"`
+	AttributeSchema     string        `toml:"attribute_schema"`
+	AttributeClaims     []string      `toml:"attribute_claims"`
+	LoginIdentifiers    []string      `toml:"login_identifiers"`
+	RequiredIdentifiers []string      `toml:"required_identifiers"`
+
+	Authentication string `toml:"authentication"`
+
+	Webhooks   map[string]WebhookConfig `toml:"webhooks"`
+	SCIM       SCIMConfig               `toml:"scim"`
+	LDAP       LDAPConfig               `toml:"ldap"`
+	Federation FederationConfig         `toml:"federation"`
+}
+
+// Authentication backends, which verify the credentials of logins
+const (
+	AuthenticationPassword = "password"
+	AuthenticationLDAP     = "ldap"
+)
+
+// LDAPConfig verifies logins by binding to a directory as the user, found by searching with a service account.
+// Users who log in for the first time are created from their directory entry when provision is enabled.
+type LDAPConfig struct {
+	URL           string         `toml:"url"`
+	StartTLS      bool           `toml:"start_tls"`
+	CAFile        string         `toml:"ca_file"`
+	AllowInsecure bool           `toml:"allow_insecure"`
+	BindDN        string         `toml:"bind_dn"`
+	BindPassword  string         `toml:"bind_password" secret:"true"`
+	BaseDN        string         `toml:"base_dn"`
+	UserFilter    string         `toml:"user_filter"`
+	Timeout       time.Duration  `toml:"timeout"`
+	Provision     bool           `toml:"provision"`
+	Attributes    LDAPAttributes `toml:"attributes"`
+}
+
+// LDAPAttributes names the directory attributes that user fields are read from. Username is optional.
+type LDAPAttributes struct {
+	FirstName string `toml:"first_name"`
+	LastName  string `toml:"last_name"`
+	Email     string `toml:"email"`
+	Username  string `toml:"username"`
+}
+
+// FederationConfig lets users log in with upstream identity providers, such as "Sign in with Google".
+// After logging in, users are sent back to one of return_urls with their Gram token.
+type FederationConfig struct {
+	ReturnURLs []string                  `toml:"return_urls"`
+	Providers  map[string]ProviderConfig `toml:"providers"`
+}
+
+// ProviderConfig is an upstream identity provider. OpenID Connect providers are configured by their issuer and
+// found by discovery; plain OAuth 2.0 providers are configured by their authorization, token and userinfo URLs.
+// redirect_url is Gram's callback URL for the provider, as registered with it.
+type ProviderConfig struct {
+	Issuer           string         `toml:"issuer"`
+	AuthorizationURL string         `toml:"authorization_url"`
+	TokenURL         string         `toml:"token_url"`
+	UserinfoURL      string         `toml:"userinfo_url"`
+	ClientID         string         `toml:"client_id"`
+	ClientSecret     string         `toml:"client_secret" secret:"true"`
+	RedirectURL      string         `toml:"redirect_url"`
+	Scopes           []string       `toml:"scopes"`
+	LinkByEmail      bool           `toml:"link_by_email"`
+	TrustEmail       bool           `toml:"trust_email"`
+	AllowSignup      bool           `toml:"allow_signup"`
+	Claims           ProviderClaims `toml:"claims"`
+}
+
+// ProviderClaims names the claims of ID tokens or userinfo responses that identities are read from.
+// Username is optional; name is split into first and last names when they are not given separately.
+type ProviderClaims struct {
+	Subject       string `toml:"subject"`
+	Email         string `toml:"email"`
+	EmailVerified string `toml:"email_verified"`
+	FirstName     string `toml:"first_name"`
+	LastName      string `toml:"last_name"`
+	Name          string `toml:"name"`
+	Username      string `toml:"username"`
+}
+
+func (p *ProviderConfig) SetDefaults() {
+	*p = ProviderConfig{
+		LinkByEmail: true,
+		AllowSignup: true,
+		Claims: ProviderClaims{
+			Subject:       "sub",
+			Email:         "email",
+			EmailVerified: "email_verified",
+			FirstName:     "given_name",
+			LastName:      "family_name",
+			Name:          "name",
+		},
+	}
+}
+
+// AllowsReturnURL reports whether users can be sent back to a URL after logging in with a provider
+func (c FederationConfig) AllowsReturnURL(returnURL string) bool {
+	return containsString(c.ReturnURLs, returnURL)
+}
+
+// IsOIDC reports whether the provider is an OpenID Connect provider, whose ID tokens are verified
+func (p ProviderConfig) IsOIDC() bool {
+	return p.Issuer != ""
+}
+
+// LDAPLoginPlaceholder is replaced in the user filter by the escaped login identifier
+const LDAPLoginPlaceholder = "{login}"
+
+// SCIMConfig lets an identity provider provision a service's users and groups with SCIM 2.0
+type SCIMConfig struct {
+	Token    string `toml:"token" secret:"true"`
+	UserName string `toml:"user_name"`
+}
+
+// MinSCIMTokenLength keeps SCIM tokens long enough that they cannot be guessed
+const MinSCIMTokenLength = 32
+
+// Enabled reports whether the SCIM endpoints accept requests for the service
+func (s SCIMConfig) Enabled() bool {
+	return s.Token != ""
+}
+
+// WebhookConfig subscribes a URL to a service's events
+type WebhookConfig struct {
+	URL    string   `toml:"url"`
+	Secret string   `toml:"secret" secret:"true"`
+	Events []string `toml:"events"`
+}
+
+// Subscribed reports whether the webhook receives events of the given type. A webhook without events receives every event.
+func (w WebhookConfig) Subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, name := range w.Events {
+		if name == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhooksConfig controls how every service's webhooks are delivered
+type WebhooksConfig struct {
+	Timeout        time.Duration `toml:"timeout" env:"GRAM_WEBHOOKS_TIMEOUT"`
+	MaxAttempts    int           `toml:"max_attempts" env:"GRAM_WEBHOOKS_MAX_ATTEMPTS"`
+	InitialBackoff time.Duration `toml:"initial_backoff" env:"GRAM_WEBHOOKS_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `toml:"max_backoff" env:"GRAM_WEBHOOKS_MAX_BACKOFF"`
+}
+
+// ValidationErrors lists every problem found in a configuration
+type ValidationErrors []string
+
+func (e ValidationErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var currentConfig atomic.Value
+
+func init() {
+	currentConfig.Store(DefaultConfig())
+}
+
+// CurrentConfig returns the live config, which may be swapped at any time by a reload
+func CurrentConfig() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+func SetConfig(config *Config) {
+	currentConfig.Store(config)
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              DefaultPort,
+			Service:           DefaultService,
+			ReadTimeout:       DefaultReadTimeout,
+			ReadHeaderTimeout: DefaultReadHeaderTimeout,
+			WriteTimeout:      DefaultWriteTimeout,
+			IdleTimeout:       DefaultIdleTimeout,
+			ShutdownTimeout:   DefaultShutdownTimeout,
+		},
+		TLS: TLSConfig{
+			MinVersion:       DefaultTLSMinVersion,
+			ClientAuth:       TLSClientAuthNone,
+			ClientIdentities: map[string]string{},
+		},
+		Tokens: TokenConfig{
+			Lifetime: DefaultTokenLifetime,
+		},
+		Email: EmailConfig{
+			Port: DefaultEmailPort,
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerMinute: DefaultRateLimitRequestsPerMinute,
+			Burst:             DefaultRateLimitBurst,
+		},
+		API: APIConfig{
+			LegacyRoutes:      true,
+			LegacyDeprecation: DefaultLegacyDeprecation,
+			LegacySunset:      DefaultLegacySunset,
+		},
+		Tracing: TracingConfig{
+			Exporter:     TracingExporterNone,
+			ServiceName:  DefaultTracingServiceName,
+			SampleRatio:  1,
+			OTLPEndpoint: DefaultOTLPEndpoint,
+			OTLPHeaders:  map[string]string{},
+		},
+		Log: LogConfig{
+			Level:  DefaultLogLevel,
+			Format: DefaultLogFormat,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:        DefaultWebhookTimeout,
+			MaxAttempts:    DefaultWebhookMaxAttempts,
+			InitialBackoff: DefaultWebhookInitialBackoff,
+			MaxBackoff:     DefaultWebhookMaxBackoff,
+		},
+		Services: map[string]ServicePolicy{},
+	}
+}
+
+func (p *ServicePolicy) SetDefaults() {
+	*p = ServicePolicy{
+		AllowSignup:         true,
+		LoginIdentifiers:    []string{identifiers.Email},
+		RequiredIdentifiers: []string{identifiers.Email},
+		Authentication:      AuthenticationPassword,
+		SCIM:                SCIMConfig{UserName: identifiers.Email},
+		LDAP: LDAPConfig{
+			UserFilter: DefaultLDAPUserFilter,
+			Timeout:    DefaultLDAPTimeout,
+			Provision:  true,
+			Attributes: LDAPAttributes{FirstName: "givenName", LastName: "sn", Email: "mail"},
+		},
+	}
+}
+
+// Policy returns the policy of the service this server was started for
+func (c *Config) Policy() ServicePolicy {
+	if policy, ok := c.Services[c.Server.Service]; ok {
+		return policy
+	}
+
+	var policy ServicePolicy
+	policy.SetDefaults()
+	return policy
+}
+
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// mapsIdentity reports whether some client certificate subject is mapped to the identity
+func (c *TLSConfig) mapsIdentity(identity string) bool {
+	for _, mapped := range c.ClientIdentities {
+		if mapped == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *TLSConfig) validate() []string {
+	var errs []string
+
+	if !c.Enabled() {
+		if c.KeyFile != "" {
+			errs = append(errs, "tls.cert_file must be set when tls.key_file is set")
+		}
+		return errs
+	}
+
+	if c.KeyFile == "" {
+		errs = append(errs, "tls.key_file must be set when tls.cert_file is set")
+	} else if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		errs = append(errs, fmt.Sprintf("tls.cert_file and tls.key_file could not be loaded: %s", err.Error()))
+	}
+
+	if _, ok := TLSVersions[c.MinVersion]; !ok {
+		errs = append(errs, fmt.Sprintf("tls.min_version must be one of 1.0, 1.1, 1.2 or 1.3, got '%s'", c.MinVersion))
+	}
+
+	for _, name := range c.CipherSuites {
+		if _, ok := TLSCipherSuite(name); !ok {
+			errs = append(errs, fmt.Sprintf("tls.cipher_suites contains unknown or insecure cipher suite '%s'", name))
+		}
+	}
+
+	switch c.ClientAuth {
+	case TLSClientAuthNone:
+	case TLSClientAuthOptional, TLSClientAuthRequire:
+		if c.ClientCAFile == "" {
+			errs = append(errs, "tls.client_ca_file must be set when client certificates are verified")
+		} else if _, err := LoadCertPool(c.ClientCAFile); err != nil {
+			errs = append(errs, fmt.Sprintf("tls.client_ca_file could not be loaded: %s", err.Error()))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tls.client_auth must be one of none, optional or require, got '%s'", c.ClientAuth))
+	}
+
+	return errs
+}
+
+func (c FederationConfig) validate(path string) []string {
+	var errs []string
+	for _, returnURL := range c.ReturnURLs {
+		if !secureURL(returnURL) {
+			errs = append(errs, fmt.Sprintf("%s.return_urls must be https URLs, or http URLs on localhost, got '%s'", path, returnURL))
+		} else if strings.Contains(returnURL, "#") {
+			errs = append(errs, fmt.Sprintf("%s.return_urls must not have fragments, which logins return their results in, got '%s'", path, returnURL))
+		}
+	}
+
+	for name, provider := range c.Providers {
+		providerPath := fmt.Sprintf("%s.providers.%s", path, name)
+		if !identifierRegexp.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("%s is not a valid provider name", providerPath))
+		}
+
+		if provider.IsOIDC() {
+			if !secureURL(provider.Issuer) {
+				errs = append(errs, fmt.Sprintf("%s.issuer must be an https URL, got '%s'", providerPath, provider.Issuer))
+			}
+			if len(provider.Scopes) > 0 && !containsString(provider.Scopes, "openid") {
+				errs = append(errs, fmt.Sprintf("%s.scopes must include openid", providerPath))
+			}
+		} else {
+			for _, endpoint := range []struct{ Name, URL string }{
+				{"authorization_url", provider.AuthorizationURL},
+				{"token_url", provider.TokenURL},
+				{"userinfo_url", provider.UserinfoURL},
+			} {
+				if !secureURL(endpoint.URL) {
+					errs = append(errs, fmt.Sprintf("%s.%s must be an https URL when issuer is not set, got '%s'", providerPath, endpoint.Name, endpoint.URL))
+				}
+			}
+		}
+
+		if provider.ClientID == "" || provider.ClientSecret == "" {
+			errs = append(errs, fmt.Sprintf("%s.client_id and client_secret must be set", providerPath))
+		}
+		if !secureURL(provider.RedirectURL) {
+			errs = append(errs, fmt.Sprintf("%s.redirect_url must be Gram's https callback URL for the provider, got '%s'", providerPath, provider.RedirectURL))
+		}
+		if provider.Claims.Subject == "" {
+			errs = append(errs, fmt.Sprintf("%s.claims.subject must be set", providerPath))
+		}
+	}
+	return errs
+}
+
+// secureURL reports whether a URL is https, or http on the local machine for development
+func secureURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	return u.Scheme == "http" && loopbackHost(u.Hostname())
+}
+
+// loopbackHost reports whether a host name or IP address only reaches this machine
+func loopbackHost(host string) bool {
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c LDAPConfig) validate(path string) []string {
+	var errs []string
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("%s.url must be an ldap or ldaps URL, got '%s'", path, c.URL))
+	} else if u.Scheme == "ldaps" && c.StartTLS {
+		errs = append(errs, fmt.Sprintf("%s.start_tls can only be used with ldap URLs", path))
+	} else if u.Scheme == "ldap" && !c.StartTLS && !c.AllowInsecure {
+		errs = append(errs, fmt.Sprintf("%s.url sends passwords unencrypted. Use an ldaps URL, set start_tls, or set allow_insecure", path))
+	}
+	if c.CAFile != "" {
+		if _, err := LoadCertPool(c.CAFile); err != nil {
+			errs = append(errs, fmt.Sprintf("%s.ca_file could not be loaded: %s", path, err.Error()))
+		}
+	}
+
+	if c.BindPassword != "" && c.BindDN == "" {
+		errs = append(errs, fmt.Sprintf("%s.bind_dn must be set when bind_password is set", path))
+	}
+	if c.BaseDN == "" {
+		errs = append(errs, fmt.Sprintf("%s.base_dn must be set", path))
+	}
+	if !strings.Contains(c.UserFilter, LDAPLoginPlaceholder) {
+		errs = append(errs, fmt.Sprintf("%s.user_filter must contain %s, got '%s'", path, LDAPLoginPlaceholder, c.UserFilter))
+	} else if _, err := ldap.CompileFilter(strings.Replace(c.UserFilter, LDAPLoginPlaceholder, "login", -1)); err != nil {
+		errs = append(errs, fmt.Sprintf("%s.user_filter is invalid: %s", path, err.Error()))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Sprintf("%s.timeout must be positive", path))
+	}
+
+	if c.Attributes.FirstName == "" || c.Attributes.LastName == "" || c.Attributes.Email == "" {
+		errs = append(errs, fmt.Sprintf("%s.attributes must name the first_name, last_name and email attributes", path))
+	}
+	return errs
+}
+
+func (p ServicePolicy) IsAdmin(userId string) bool {
+	for _, id := range p.AdminUserIds {
+		if strconv.Itoa(id) == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdminIdentity reports whether a client certificate identity, as mapped by tls.client_identities, is an admin
+func (p ServicePolicy) IsAdminIdentity(identity string) bool {
+	return containsString(p.AdminIdentities, identity)
+}
+
+// IdentifierEnabled reports whether users can log in with the given identifier
+func (p ServicePolicy) IdentifierEnabled(identifier string) bool {
+	for _, name := range p.LoginIdentifiers {
+		if name == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentifierRequired reports whether every user must have the given identifier
+func (p ServicePolicy) IdentifierRequired(identifier string) bool {
+	for _, name := range p.RequiredIdentifiers {
+		if name == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedClaims cannot be overridden by custom attributes
+var reservedClaims = map[string]bool{"user_id": true, "exp": true, "iat": true, "nbf": true, "iss": true, "sub": true, "aud": true, "jti": true}
+
+// Attributes returns the service's custom attribute schema, or nil if custom attributes are not enabled
+func (p ServicePolicy) Attributes() (*schema.Schema, error) {
+	if p.AttributeSchema == "" {
+		return nil, nil
+	}
+
+	s, err := schema.Load(p.AttributeSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type() != "object" || s.Properties == nil {
+		return nil, fmt.Errorf("%s: attribute schemas must have type \"object\" and properties", p.AttributeSchema)
+	}
+	return s, nil
+}
+
+// TokenLifetime returns the lifetime of tokens issued for the current service
+func (c *Config) TokenLifetime() time.Duration {
+	if lifetime := c.Policy().TokenLifetime; lifetime > 0 {
+		return lifetime
+	}
+	return c.Tokens.Lifetime
+}
+
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+
+	port, err := strconv.Atoi(c.Server.Port)
+	if err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Sprintf("server.port must be a number between 1 and 65535, got '%s'", c.Server.Port))
+	}
+	if !identifierRegexp.MatchString(c.Server.Service) {
+		errs = append(errs, fmt.Sprintf("server.service must contain only letters, digits and underscores, got '%s'", c.Server.Service))
+	}
+	for name, timeout := range map[string]time.Duration{
+		"read_timeout":        c.Server.ReadTimeout,
+		"read_header_timeout": c.Server.ReadHeaderTimeout,
+		"write_timeout":       c.Server.WriteTimeout,
+		"idle_timeout":        c.Server.IdleTimeout,
+		"shutdown_delay":      c.Server.ShutdownDelay,
+	} {
+		if timeout < 0 {
+			errs = append(errs, fmt.Sprintf("server.%s cannot be negative", name))
+		}
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, "server.shutdown_timeout must be positive")
+	}
+	if c.Server.AdminAddress != "" {
+		// Requests on the admin listener are not authenticated, so it must not be reachable from other hosts
+		if host, adminPort, err := net.SplitHostPort(c.Server.AdminAddress); err != nil || adminPort == c.Server.Port {
+			errs = append(errs, fmt.Sprintf("server.admin_address must be a host and port other than server.port, such as 127.0.0.1:9090, got '%s'", c.Server.AdminAddress))
+		} else if !loopbackHost(host) {
+			errs = append(errs, fmt.Sprintf("server.admin_address must be a loopback address, such as 127.0.0.1:9090, because its requests are not authenticated, got '%s'", c.Server.AdminAddress))
+		}
+	}
+
+	errs = append(errs, c.TLS.validate()...)
+
+	if c.Database.SSLMode != "" && !ValidDBSSLMode(c.Database.SSLMode) {
+		errs = append(errs, fmt.Sprintf("database.ssl_mode must be one of %s, got '%s'", strings.Join(DBSSLModes, ", "), c.Database.SSLMode))
+	}
+
+	if c.Tokens.Secret == "" {
+		errs = append(errs, "tokens.secret must be set (GRAM_TOKEN_SECRET)")
+	}
+	if c.Tokens.Lifetime <= 0 {
+		errs = append(errs, "tokens.lifetime must be positive")
+	}
+
+	if c.Email.Host != "" {
+		if c.Email.Port < 1 || c.Email.Port > 65535 {
+			errs = append(errs, fmt.Sprintf("email.port must be between 1 and 65535, got %d", c.Email.Port))
+		}
+		if c.Email.From == "" {
+			errs = append(errs, "email.from must be set when email.host is set")
+		}
+	}
+
+	if c.RateLimit.Enabled {
+		if c.RateLimit.RequestsPerMinute <= 0 {
+			errs = append(errs, "rate_limit.requests_per_minute must be positive when rate limiting is enabled")
+		}
+		if c.RateLimit.Burst <= 0 {
+			errs = append(errs, "rate_limit.burst must be positive when rate limiting is enabled")
+		}
+	}
+
+	deprecation, err := time.Parse(DateFormat, c.API.LegacyDeprecation)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("api.legacy_deprecation must be a date such as 2026-10-19, got '%s'", c.API.LegacyDeprecation))
+	}
+	sunset, err := time.Parse(DateFormat, c.API.LegacySunset)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("api.legacy_sunset must be a date such as 2027-04-30, got '%s'", c.API.LegacySunset))
+	} else if sunset.Before(deprecation) {
+		errs = append(errs, "api.legacy_sunset cannot be before api.legacy_deprecation")
+	}
+
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("tracing.otlp_endpoint must be an http or https URL, got '%s'", c.Tracing.OTLPEndpoint))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter must be one of none, stdout or otlp, got '%s'", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Sprintf("tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio))
+	}
+
+	if !ValidLogLevel(c.Log.Level) {
+		errs = append(errs, fmt.Sprintf("log.level must be one of debug, info, warn or error, got '%s'", c.Log.Level))
+	}
+	if c.Log.Format != LogFormatJSON && c.Log.Format != LogFormatConsole {
+		errs = append(errs, fmt.Sprintf("log.format must be json or console, got '%s'", c.Log.Format))
+	}
+
+	if c.Webhooks.Timeout <= 0 {
+		errs = append(errs, "webhooks.timeout must be positive")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, "webhooks.max_attempts must be at least 1")
+	}
+	if c.Webhooks.InitialBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.InitialBackoff {
+		errs = append(errs, "webhooks.initial_backoff must be positive, and no longer than webhooks.max_backoff")
+	}
+
+	for name, policy := range c.Services {
+		if !identifierRegexp.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("services.%s is not a valid service name", name))
+		}
+		if policy.MinPasswordLength < 0 {
+			errs = append(errs, fmt.Sprintf("services.%s.min_password_length cannot be negative", name))
+		}
+		if policy.TokenLifetime < 0 {
+			errs = append(errs, fmt.Sprintf("services.%s.token_lifetime cannot be negative", name))
+		}
+		for _, identity := range policy.AdminIdentities {
+			if !c.TLS.mapsIdentity(identity) {
+				errs = append(errs, fmt.Sprintf("services.%s.admin_identities includes '%s', which no certificate in tls.client_identities is mapped to", name, identity))
+			}
+		}
+
+		if len(policy.LoginIdentifiers) == 0 {
+			errs = append(errs, fmt.Sprintf("services.%s.login_identifiers must include at least one identifier", name))
+		}
+		for _, identifier := range policy.LoginIdentifiers {
+			if !identifiers.IsValid(identifier) {
+				errs = append(errs, fmt.Sprintf("services.%s.login_identifiers includes unknown identifier '%s'. Valid identifiers are: %s", name, identifier, strings.Join(identifiers.All, ", ")))
+			}
+		}
+		for _, identifier := range policy.RequiredIdentifiers {
+			if !policy.IdentifierEnabled(identifier) {
+				errs = append(errs, fmt.Sprintf("services.%s.required_identifiers includes '%s', which is not in login_identifiers", name, identifier))
+			}
+		}
+
+		attributes, err := policy.Attributes()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("services.%s.attribute_schema is invalid: %s", name, err.Error()))
+		} else if attributes == nil && len(policy.AttributeClaims) > 0 {
+			errs = append(errs, fmt.Sprintf("services.%s.attribute_claims requires attribute_schema to be set", name))
+		}
+		for _, claim := range policy.AttributeClaims {
+			if reservedClaims[claim] {
+				errs = append(errs, fmt.Sprintf("services.%s.attribute_claims cannot include the reserved claim '%s'", name, claim))
+			} else if attributes != nil && attributes.Properties[claim] == nil {
+				errs = append(errs, fmt.Sprintf("services.%s.attribute_claims includes '%s', which is not in the attribute schema", name, claim))
+			}
+		}
+
+		for webhookName, webhook := range policy.Webhooks {
+			path := fmt.Sprintf("services.%s.webhooks.%s", name, webhookName)
+			if !identifierRegexp.MatchString(webhookName) {
+				errs = append(errs, fmt.Sprintf("%s is not a valid webhook name", path))
+			}
+			if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Sprintf("%s.url must be an http or https URL, got '%s'", path, webhook.URL))
+			}
+			if webhook.Secret == "" {
+				errs = append(errs, fmt.Sprintf("%s.secret must be set, so receivers can verify signatures", path))
+			}
+			for _, eventType := range webhook.Events {
+				if !events.IsValid(eventType) {
+					errs = append(errs, fmt.Sprintf("%s.events includes unknown event '%s'. Valid events are: %s", path, eventType, strings.Join(events.All, ", ")))
+				}
+			}
+		}
+
+		if policy.SCIM.Enabled() && len(policy.SCIM.Token) < MinSCIMTokenLength {
+			errs = append(errs, fmt.Sprintf("services.%s.scim.token must be at least %d characters long", name, MinSCIMTokenLength))
+		}
+		if policy.SCIM.UserName != identifiers.Email && policy.SCIM.UserName != identifiers.Username {
+			errs = append(errs, fmt.Sprintf("services.%s.scim.user_name must be email or username, got '%s'", name, policy.SCIM.UserName))
+		}
+
+		errs = append(errs, policy.Federation.validate(fmt.Sprintf("services.%s.federation", name))...)
+
+		switch policy.Authentication {
+		case AuthenticationPassword:
+		case AuthenticationLDAP:
+			errs = append(errs, policy.LDAP.validate(fmt.Sprintf("services.%s.ldap", name))...)
+		default:
+			errs = append(errs, fmt.Sprintf("services.%s.authentication must be password or ldap, got '%s'", name, policy.Authentication))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package utilities
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAdminAddress(t *testing.T) {
+	cases := []struct {
+		address string
+		valid   bool
+	}{
+		{"", true},
+		{"127.0.0.1:9090", true},
+		{"localhost:9090", true},
+		{"[::1]:9090", true},
+		{"0.0.0.0:9090", false},
+		{":9090", false},
+		{"10.0.0.5:9090", false},
+		{"gram.example.com:9090", false},
+		{"127.0.0.1:" + DefaultPort, false},
+		{"127.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		config := DefaultConfig()
+		config.Tokens.Secret = "secret"
+		config.Server.AdminAddress = c.address
+
+		err := config.Validate()
+		if c.valid && err != nil {
+			t.Errorf("%q: %s", c.address, err)
+		} else if !c.valid && (err == nil || !strings.Contains(err.Error(), "server.admin_address")) {
+			t.Errorf("%q: got %v, want an admin_address error", c.address, err)
+		}
+	}
+}
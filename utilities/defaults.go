@@ -1,9 +1,54 @@
 package utilities
 
+import (
+	"time"
+)
+
 const DefaultPort = "3000"
 
+const DefaultReadTimeout = 15 * time.Second
+const DefaultReadHeaderTimeout = 5 * time.Second
+const DefaultWriteTimeout = 30 * time.Second
+const DefaultIdleTimeout = 2 * time.Minute
+const DefaultShutdownTimeout = 30 * time.Second
+
 const DefaultDBUser = "root"
 const DefaultDBName = "gram"
 const DefaultDBHost = "localhost"
 const DefaultDBSSLMode = "disable"
 const DefaultService = "users"
+
+const DefaultTLSMinVersion = "1.2"
+
+const DefaultPageLimit = 50
+const MaxPageLimit = 200
+
+const DefaultConfigPath = "config/gram.toml"
+const ConfigPollInterval = 5 * time.Second
+
+const DefaultTokenLifetime = 24 * time.Hour
+
+const DefaultEmailPort = 587
+
+const DefaultRateLimitRequestsPerMinute = 60
+const DefaultRateLimitBurst = 10
+
+// DateFormat is the format of dates in the config file
+const DateFormat = "2006-01-02"
+
+const DefaultLegacyDeprecation = "2026-10-19"
+const DefaultLegacySunset = "2027-04-30"
+
+const DefaultTracingServiceName = "gram"
+const DefaultOTLPEndpoint = "http://localhost:4318"
+
+const DefaultLogLevel = "info"
+const DefaultLogFormat = LogFormatJSON
+
+const DefaultWebhookTimeout = 10 * time.Second
+const DefaultWebhookMaxAttempts = 10
+const DefaultWebhookInitialBackoff = 10 * time.Second
+const DefaultWebhookMaxBackoff = time.Hour
+
+const DefaultLDAPUserFilter = "(uid={login})"
+const DefaultLDAPTimeout = 10 * time.Second
@@ -1,7 +1,160 @@
 package utilities
 
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+)
+
 func CheckErr(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
+
+// ErrorKind classifies domain errors by how they are reported to clients
+type ErrorKind int
+
+const (
+	ErrorInternal ErrorKind = iota
+	ErrorValidation
+	ErrorUnauthorized
+	ErrorForbidden
+	ErrorNotFound
+	ErrorConflict
+	ErrorRateLimited
+	ErrorPreconditionFailed
+	ErrorUnsupportedMediaType
+	ErrorUnavailable
+)
+
+var errorStatuses = map[ErrorKind]int{
+	ErrorInternal:     http.StatusInternalServerError,
+	ErrorValidation:   http.StatusBadRequest,
+	ErrorUnauthorized: http.StatusUnauthorized,
+	ErrorForbidden:    http.StatusForbidden,
+	ErrorNotFound:     http.StatusNotFound,
+	ErrorConflict:     http.StatusConflict,
+	ErrorRateLimited:  http.StatusTooManyRequests,
+
+	ErrorPreconditionFailed:   http.StatusPreconditionFailed,
+	ErrorUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	ErrorUnavailable:          http.StatusServiceUnavailable,
+}
+
+// Error codes are part of the API and must not change once released
+const (
+	CodeInternal             = "internal_error"
+	CodeInvalidRequest       = "invalid_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeInvalidSearch        = "invalid_search"
+	CodeUnauthorized         = "unauthorized"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeForbidden            = "forbidden"
+	CodeSignupDisabled       = "signup_disabled"
+	CodeUserNotFound         = "user_not_found"
+	CodeUserConflict         = "user_conflict"
+	CodeUpdateConflict       = "update_conflict"
+	CodeRateLimited          = "rate_limited"
+	CodePatchFailed          = "patch_failed"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeUnsupportedMedia     = "unsupported_media_type"
+	CodeNotReady             = "not_ready"
+	CodeDeliveryNotFound     = "delivery_not_found"
+	CodeGroupNotFound        = "group_not_found"
+	CodeGroupConflict        = "group_conflict"
+	CodeDirectoryUnavailable = "directory_unavailable"
+	CodeProviderNotFound     = "provider_not_found"
+	CodeProviderUnavailable  = "provider_unavailable"
+	CodeFederationFailed     = "federation_failed"
+	CodeInvalidLoginState    = "invalid_login_state"
+	CodeInvalidLinkToken     = "invalid_link_token"
+	CodeIdentityNotFound     = "identity_not_found"
+	CodeIdentityConflict     = "identity_conflict"
+)
+
+// Field error codes describe why a single field was rejected
+const (
+	FieldRequired = "required"
+	FieldInvalid  = "invalid"
+	FieldTooShort = "too_short"
+	FieldTaken    = "taken"
+	FieldUnknown  = "unknown"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is a domain error with a stable machine-readable code
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	Fields  []FieldError
+	Cause   error
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Cause.Error())
+	}
+	return e.Message
+}
+
+func (e *Error) Status() int {
+	return errorStatuses[e.Kind]
+}
+
+func NewError(kind ErrorKind, code string, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+func NewValidationError(message string, fields ...FieldError) *Error {
+	return &Error{Kind: ErrorValidation, Code: CodeValidationFailed, Message: message, Fields: fields}
+}
+
+// NewInternalError wraps an unexpected error; the cause is logged but never shown to clients
+func NewInternalError(message string, cause error) *Error {
+	return &Error{Kind: ErrorInternal, Code: CodeInternal, Message: message, Cause: cause}
+}
+
+// AsError converts any error to a domain error, treating unknown errors as internal
+func AsError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return NewInternalError("An unexpected error occurred", err)
+}
+
+// WriteProblem writes an error as an RFC 7807 application/problem+json response
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error) {
+	e := AsError(err)
+	status := e.Status()
+
+	detail := e.Message
+	if e.Kind == ErrorInternal {
+		Log(r.Context()).Error("Request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(e))
+		detail = "An unexpected error occurred"
+	}
+
+	problem := map[string]interface{}{
+		"type":     "urn:gram:problem:" + e.Code,
+		"title":    http.StatusText(status),
+		"status":   status,
+		"detail":   detail,
+		"instance": r.URL.Path,
+		"code":     e.Code,
+	}
+	if len(e.Fields) > 0 {
+		problem["errors"] = e.Fields
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	JSON, _ := json.Marshal(problem)
+	w.Write(JSON)
+}
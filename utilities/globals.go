@@ -1,4 +0,0 @@
-package utilities
-
-var Port string
-var Service string
@@ -2,19 +2,23 @@ package utilities
 
 import (
 	"github.com/dgrijalva/jwt-go"
-	"os"
 )
 
-var secretKey = []byte(os.Getenv("GRAM_TOKEN_SECRET"))
-
+// GetClaims returns the claims of a valid token, or nil if the token is missing or invalid
 func GetClaims(tokenString string) map[string]interface{} {
 	if tokenString == "" {
 		return nil
 	}
 
-	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(CurrentConfig().Tokens.Secret), nil
 	})
+	if err != nil || !token.Valid {
+		return nil
+	}
 
 	claims := token.Claims.(jwt.MapClaims)
 	return claims
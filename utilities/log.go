@@ -1,8 +1,186 @@
 package utilities
 
 import (
+	"context"
+	"fmt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"regexp"
+	"strings"
+	"sync"
 )
 
-var Logger, _ = zap.NewDevelopment()
+// Log formats
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
+var logLevel = zap.NewAtomicLevel()
+
+var Logger = newLogger(DefaultLogFormat)
 var Sugar = Logger.Sugar()
+
+func newLogger(format string) *zap.Logger {
+	config := zap.NewProductionConfig()
+	config.Level = logLevel
+	config.Sampling = nil
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.MessageKey = "message"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	if format == LogFormatConsole {
+		config.Encoding = "console"
+		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	}
+
+	logger, err := config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return redactingCore{core}
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create logger: %s", err.Error()))
+	}
+	return logger
+}
+
+// InitLogger applies the configured log format and level. The format only changes on restart.
+func InitLogger() {
+	config := CurrentConfig().Log
+	Logger = newLogger(config.Format)
+	Sugar = Logger.Sugar()
+	SetLogLevel(config.Level)
+}
+
+// SetLogLevel changes the level of every logger, including request loggers that were already created
+func SetLogLevel(level string) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err == nil {
+		logLevel.SetLevel(l)
+	}
+}
+
+// ValidLogLevel reports whether level is one of debug, info, warn or error
+func ValidLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
+
+// Redacted replaces secrets in logs
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of field names whose values are never logged
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "hash", "authorization", "cookie", "api_key"}
+
+// sensitivePatterns match secrets that appear inside other text, such as a bcrypt hash or a JWT in an error message
+var sensitivePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\$2[abxy]?\$[0-9]{2}\$[./A-Za-z0-9]{53}`),
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	regexp.MustCompile(`(?i)(bearer|basic) [A-Za-z0-9._~+/=-]+`),
+}
+
+// IsSensitiveKey reports whether a field with the given name holds a secret
+func IsSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactString replaces hashes and tokens within text
+func RedactString(text string) string {
+	for _, pattern := range sensitivePatterns {
+		text = pattern.ReplaceAllString(text, Redacted)
+	}
+	return text
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case IsSensitiveKey(field.Key):
+			field = zap.String(field.Key, Redacted)
+		case field.Type == zapcore.StringType:
+			field.String = RedactString(field.String)
+		case field.Type == zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field = zap.String(field.Key, RedactString(err.Error()))
+			}
+		}
+		redacted[i] = field
+	}
+	return redacted
+}
+
+// redactingCore removes secrets from every log entry, so that a careless log line cannot leak them
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = RedactString(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+// requestLog collects fields that describe a request, such as the authenticated user, as it is handled
+type requestLog struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+	keys   []string
+	fields map[string]zapcore.Field
+}
+
+type requestLogKey struct{}
+
+// WithRequestLog starts collecting log fields for a request; entries logged with Log(ctx) include them
+func WithRequestLog(ctx context.Context, fields ...zapcore.Field) context.Context {
+	log := &requestLog{logger: Logger.With(fields...), fields: make(map[string]zapcore.Field)}
+	return context.WithValue(ctx, requestLogKey{}, log)
+}
+
+// AddLogFields adds fields to the request's log entries, replacing earlier fields with the same key
+func AddLogFields(ctx context.Context, fields ...zapcore.Field) {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for _, field := range fields {
+		if _, exists := log.fields[field.Key]; !exists {
+			log.keys = append(log.keys, field.Key)
+		}
+		log.fields[field.Key] = field
+	}
+}
+
+// Log returns a logger for ctx, which includes the fields of its request, if any
+func Log(ctx context.Context) *zap.Logger {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return Logger
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	fields := make([]zapcore.Field, 0, len(log.keys))
+	for _, key := range log.keys {
+		fields = append(fields, log.fields[key])
+	}
+	return log.logger.With(fields...)
+}
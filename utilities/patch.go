@@ -0,0 +1,304 @@
+package utilities
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const MergePatchType = "application/merge-patch+json"
+const JSONPatchType = "application/json-patch+json"
+
+// PatchOperation is a single RFC 6902 JSON patch operation
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MergePatch applies an RFC 7396 JSON merge patch to a decoded JSON document.
+// The target is not modified.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	result := make(map[string]interface{})
+	if targetObject, ok := target.(map[string]interface{}); ok {
+		for key, value := range targetObject {
+			result[key] = value
+		}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = MergePatch(result[key], value)
+		}
+	}
+
+	return result
+}
+
+// JSONPatch applies RFC 6902 JSON patch operations to a decoded JSON document.
+// Either every operation is applied or none are, and the target is not modified.
+func JSONPatch(target interface{}, operations []PatchOperation) (interface{}, error) {
+	document, err := copyJSON(target)
+	if err != nil {
+		return nil, NewInternalError("Failed to copy the patch target", err)
+	}
+
+	for i, operation := range operations {
+		document, err = applyPatchOperation(document, operation)
+		if err != nil {
+			e := AsError(err)
+			e.Message = fmt.Sprintf("Operation %d (%s %s) failed: %s", i, operation.Op, operation.Path, e.Message)
+			return nil, e
+		}
+	}
+
+	return document, nil
+}
+
+func patchFailed(message string, args ...interface{}) *Error {
+	return NewError(ErrorConflict, CodePatchFailed, fmt.Sprintf(message, args...))
+}
+
+func invalidPatch(message string, args ...interface{}) *Error {
+	return NewError(ErrorValidation, CodeInvalidRequest, fmt.Sprintf(message, args...))
+}
+
+func applyPatchOperation(document interface{}, operation PatchOperation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (interface{}, error) {
+		if operation.Value == nil {
+			return nil, invalidPatch("the value is missing")
+		}
+		var v interface{}
+		if err := json.Unmarshal(operation.Value, &v); err != nil {
+			return nil, invalidPatch("the value is not valid JSON")
+		}
+		return v, nil
+	}
+
+	switch operation.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return addAt(document, path, v)
+	case "remove":
+		document, err = removeAt(document, path)
+		return document, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return v, nil
+		}
+		document, err = removeAt(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return addAt(document, path, v)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" && isPointerPrefix(from, path) && len(from) < len(path) {
+			return nil, invalidPatch("a value cannot be moved into one of its children")
+		}
+		v, err := getAt(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			document, err = removeAt(document, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			v, err = copyJSON(v)
+			if err != nil {
+				return nil, NewInternalError("Failed to copy the patch value", err)
+			}
+		}
+		return addAt(document, path, v)
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		current, err := getAt(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, v) {
+			return nil, patchFailed("the value does not match")
+		}
+		return document, nil
+	}
+
+	return nil, invalidPatch("unknown operation '%s'. Valid operations are: add, remove, replace, move, copy, test", operation.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalidPatch("'%s' is not a valid JSON pointer", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array reference token; "-" refers to the end of the array when appending
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, invalidPatch("'%s' is not a valid array index", token)
+	}
+	if index > length || (!appending && index == length) {
+		return 0, patchFailed("array index %d is out of range", index)
+	}
+	return index, nil
+}
+
+func getAt(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, patchFailed("'%s' does not exist", token)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			document = container[index]
+		default:
+			return nil, patchFailed("'%s' does not exist", token)
+		}
+	}
+	return document, nil
+}
+
+// updateAt replaces the parent of the last token with the result of update
+func updateAt(document interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(document, path[0])
+	}
+
+	child, err := getAt(document, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = updateAt(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		container[path[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(path[0], len(container), false)
+		container[index] = child
+	}
+	return document, nil
+}
+
+func addAt(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateAt(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, patchFailed("the parent of '%s' is not an object or array", token)
+	})
+}
+
+func removeAt(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, invalidPatch("the whole document cannot be removed")
+	}
+
+	return updateAt(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, patchFailed("'%s' does not exist", token)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, patchFailed("'%s' does not exist", token)
+	})
+}
+
+func copyJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
@@ -0,0 +1,48 @@
+package utilities
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestSource describes who made a request and from where, so that models can record it in the audit log
+type RequestSource struct {
+	IP        string
+	UserAgent string
+	RequestID string
+
+	mu    sync.Mutex
+	actor string
+}
+
+type requestSourceKey struct{}
+
+// WithRequestSource attaches a request's source to ctx. The actor is set once the request is authenticated.
+func WithRequestSource(ctx context.Context, source *RequestSource) context.Context {
+	return context.WithValue(ctx, requestSourceKey{}, source)
+}
+
+// GetRequestSource returns the source of the request ctx belongs to, or an empty source outside of requests
+func GetRequestSource(ctx context.Context) *RequestSource {
+	if source, ok := ctx.Value(requestSourceKey{}).(*RequestSource); ok {
+		return source
+	}
+	return &RequestSource{}
+}
+
+// SetActor records who made the request, such as "user:5" or "client:billing"
+func (s *RequestSource) SetActor(actor string) {
+	s.mu.Lock()
+	s.actor = actor
+	s.mu.Unlock()
+}
+
+// Actor is who made the request, or "anonymous" if it was not authenticated
+func (s *RequestSource) Actor() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.actor == "" {
+		return "anonymous"
+	}
+	return s.actor
+}
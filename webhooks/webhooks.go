@@ -0,0 +1,196 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/metrics"
+	"github.com/omar-ozgur/gram/tracing"
+	"github.com/omar-ozgur/gram/utilities"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-Gram-Event"
+	DeliveryHeader  = "X-Gram-Delivery"
+	SignatureHeader = "X-Gram-Signature"
+)
+
+// PollInterval is how often the outbox is checked for deliveries that are due
+const PollInterval = time.Second
+
+// batchSize is the most deliveries claimed, and sent in parallel, at a time
+const batchSize = 16
+
+var deliveriesTotal = metrics.NewCounter("gram_webhook_deliveries_total", "Webhook delivery attempts by result.", "webhook", "result")
+
+var deliveryDuration = metrics.NewHistogram("gram_webhook_delivery_duration_seconds", "Latency of webhook requests.",
+	metrics.DefaultBuckets, "webhook")
+
+// client does not follow redirects, so a receiver cannot send deliveries on to another address
+var client = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Sign returns the signature header for a delivery body: the time it was sent, and the hex HMAC-SHA256 of
+// "<time>.<body>" keyed with the webhook's secret. Receivers should reject signatures that are too old.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Backoff is the delay before retrying a delivery that has failed the given number of times.
+// It doubles with each attempt up to webhooks.max_backoff, and is jittered so that retries are spread out.
+func Backoff(config utilities.WebhooksConfig, attempts int) time.Duration {
+	delay := config.InitialBackoff
+	for i := 1; i < attempts && delay < config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxBackoff {
+		delay = config.MaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Run delivers due events from the outbox until ctx is cancelled
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep sending while a full batch suggests more deliveries are due
+			for deliverDue(ctx) == batchSize && ctx.Err() == nil {
+			}
+		}
+	}
+}
+
+// deliverDue sends a batch of due deliveries and returns how many there were
+func deliverDue(ctx context.Context) int {
+	config := utilities.CurrentConfig().Webhooks
+	deliveries, err := models.ClaimWebhookDeliveries(ctx, batchSize, 2*config.Timeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			utilities.Log(ctx).Error("Failed to claim webhook deliveries", zap.Error(err))
+		}
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery models.WebhookDelivery) {
+			defer wg.Done()
+			deliver(ctx, config, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+func deliver(ctx context.Context, config utilities.WebhooksConfig, delivery models.WebhookDelivery) {
+	attempt := models.WebhookAttempt{Status: models.DeliveryDelivered}
+
+	webhook, ok := utilities.CurrentConfig().Policy().Webhooks[delivery.Webhook]
+	if ok {
+		attempt.HTTPStatus, attempt.Error = send(ctx, config, webhook, delivery)
+	} else {
+		attempt.Error = "The webhook is no longer configured"
+	}
+
+	// Deliveries interrupted by shutdown are retried when their lease expires
+	if ctx.Err() != nil {
+		return
+	}
+
+	result := "delivered"
+	if attempt.Error != "" {
+		if ok && delivery.Attempts+1 < config.MaxAttempts {
+			result, attempt.Status = "retry", models.DeliveryPending
+			attempt.RetryAt = time.Now().Add(Backoff(config, delivery.Attempts+1))
+		} else {
+			result, attempt.Status = "dead", models.DeliveryDead
+		}
+		utilities.Log(ctx).Warn("Webhook delivery failed",
+			zap.String("webhook", delivery.Webhook),
+			zap.Int64("delivery_id", delivery.Id),
+			zap.Int("attempts", delivery.Attempts+1),
+			zap.String("status", attempt.Status),
+			zap.String("error", attempt.Error))
+	}
+	deliveriesTotal.Inc(delivery.Webhook, result)
+
+	err := models.RecordWebhookAttempt(ctx, delivery.Id, attempt)
+	if err != nil {
+		utilities.Log(ctx).Error("Failed to record webhook attempt", zap.Int64("delivery_id", delivery.Id), zap.Error(err))
+	}
+}
+
+// send posts the signed event, and returns the response status and an error message if it was not a 2xx response
+func send(ctx context.Context, config utilities.WebhooksConfig, webhook utilities.WebhookConfig, delivery models.WebhookDelivery) (int, string) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "webhook "+delivery.Webhook, tracing.KindClient,
+		"http.request.method", "POST",
+		"url.full", webhook.URL,
+		"gram.webhook", delivery.Webhook,
+		"gram.event.type", delivery.Event.Type)
+	defer deliveryDuration.Since(time.Now(), delivery.Webhook)
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		span.Finish(err)
+		return 0, err.Error()
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gram-Webhooks")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, time.Now(), body))
+	tracing.Inject(ctx, req.Header)
+
+	res, err := client.Do(req)
+	if err != nil {
+		span.Finish(err)
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message := fmt.Sprintf("The receiver responded with %s", res.Status)
+		span.SetError(message)
+		span.Finish(nil)
+		return res.StatusCode, message
+	}
+	span.Finish(nil)
+	return res.StatusCode, ""
+}
@@ -0,0 +1,87 @@
+package webhooks
+
+import (
+	"context"
+	"github.com/omar-ozgur/gram/app/models"
+	"github.com/omar-ozgur/gram/utilities"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		body string
+		want string
+	}{
+		{`{"type":"user.created"}`, "t=1700000000,v1=2309b3241c934edd598182cd8af8663e23a4ed93bae9e076fbd3e8df8202253b"},
+		{``, "t=1700000000,v1=5967f3c560522fa40cf2876ebc3c3a08551dd6959aaade3b413460591895bdcc"},
+	}
+
+	for _, c := range cases {
+		if got := Sign("whsec_test", timestamp, []byte(c.body)); got != c.want {
+			t.Errorf("%q: got %s, want %s", c.body, got, c.want)
+		}
+	}
+
+	if Sign("whsec_test", timestamp.Add(time.Second), nil) == cases[1].want {
+		t.Error("the signature should cover the timestamp")
+	}
+	if Sign("other", timestamp, nil) == cases[1].want {
+		t.Error("the signature should depend on the secret")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config := utilities.WebhooksConfig{InitialBackoff: 10 * time.Second, MaxBackoff: time.Minute}
+
+	cases := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{10, time.Minute},
+		{1000, time.Minute},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if got := Backoff(config, c.attempts); got < c.delay/2 || got > c.delay {
+				t.Fatalf("attempt %d: got %s, want between %s and %s", c.attempts, got, c.delay/2, c.delay)
+			}
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	var signature, event string
+	status := http.StatusNoContent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature, event = r.Header.Get(SignatureHeader), r.Header.Get(EventHeader)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	config := utilities.WebhooksConfig{Timeout: 5 * time.Second}
+	webhook := utilities.WebhookConfig{URL: receiver.URL, Secret: "whsec_test"}
+	delivery := models.WebhookDelivery{Id: 1, Webhook: "audit", Event: models.Event{Type: "user.created"}}
+
+	if got, message := send(context.Background(), config, webhook, delivery); got != http.StatusNoContent || message != "" {
+		t.Errorf("got %d %q, want 204", got, message)
+	}
+	if event != "user.created" || !strings.HasPrefix(signature, "t=") || !strings.Contains(signature, ",v1=") {
+		t.Errorf("got event %q and signature %q", event, signature)
+	}
+
+	status = http.StatusFound
+	if got, message := send(context.Background(), config, webhook, delivery); got != http.StatusFound || message == "" {
+		t.Errorf("got %d %q, want a failed 302", got, message)
+	}
+}